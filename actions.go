@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ActionsPath is the endpoint of ActionDispatcher, $action('todos.toggle', data) posts to
+// ActionsPath + "/todos.toggle"
+const ActionsPath = "/_jalpine/actions"
+
+type actionNameKey struct{}
+
+// ActionDispatcher serves actions registered by name from a single endpoint, an alternative to
+// a router entry per action. Middleware added with Use wraps all actions, e.g. an auth check
+// or a rate limit keyed by ActionFromContext. Mount it on the router with
+// router.PathPrefix(ActionsPath + "/").Handler(actions).Methods("POST"); RouteTable lists the
+// actions as routes of their own.
+type ActionDispatcher struct {
+	t          *JTemplate
+	mu         sync.RWMutex
+	handlers   map[string]http.Handler
+	middleware []func(http.Handler) http.Handler
+}
+
+// NewActionDispatcher creates a dispatcher answering unknown actions with errors of t
+func NewActionDispatcher(t *JTemplate) *ActionDispatcher {
+	return &ActionDispatcher{t: t, handlers: make(map[string]http.Handler)}
+}
+
+// Register adds the action, handlers are the same as for routes: they decode the JSON body
+// and answer with JSON. Registering a name again replaces the handler.
+func (d *ActionDispatcher) Register(name string, handler http.HandlerFunc) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.handlers[name] = handler
+}
+
+// Use adds middleware applied to every action, the first added is the outermost
+func (d *ActionDispatcher) Use(middleware ...func(http.Handler) http.Handler) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.middleware = append(d.middleware, middleware...)
+}
+
+// Names returns the registered actions in alphabetical order
+func (d *ActionDispatcher) Names() []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	names := make([]string, 0, len(d.handlers))
+	for name := range d.handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// handler returns the unwrapped handler of the action, for RouteTable
+func (d *ActionDispatcher) handler(name string) http.Handler {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.handlers[name]
+}
+
+// ActionFromContext returns the name of the action being served by an ActionDispatcher
+func ActionFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(actionNameKey{}).(string)
+	return name
+}
+
+func (d *ActionDispatcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, name, _ := strings.Cut(r.URL.Path, ActionsPath+"/")
+	d.mu.RLock()
+	handler, ok := d.handlers[name]
+	middleware := d.middleware
+	d.mu.RUnlock()
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		d.t.Error(w, "Unknown action "+name)
+		return
+	}
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), actionNameKey{}, name)))
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+// FileArchive is an append-only gzip file of JSON lines holding records moved out of buntdb,
+// which keeps the hot database small while old records stay retrievable with Get and Scan.
+// Every Flush ends a gzip member, readers see the members as one stream. Archiving a record
+// whose key already has the same value in the archive does nothing, so a batch can be
+// archived again after a failure without duplicates.
+type FileArchive struct {
+	path string
+
+	mu      sync.Mutex
+	file    *os.File
+	gz      *gzip.Writer
+	index   map[string]string // Key => hash of the latest flushed value, loaded on first Archive
+	pending map[string]string // Hashes of records written since the last Flush
+}
+
+// ArchivedRecord is a line of a FileArchive
+type ArchivedRecord struct {
+	Key        string    `json:"key"`
+	Value      string    `json:"value"`
+	ArchivedAt time.Time `json:"archivedAt"`
+}
+
+// OpenFileArchive opens or creates the archive file
+func OpenFileArchive(path string) (*FileArchive, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileArchive{path: path, file: file}, nil
+}
+
+// Archive appends a record, it is durable after Flush
+func (a *FileArchive) Archive(key, value string) error {
+	line, err := json.Marshal(ArchivedRecord{Key: key, Value: value, ArchivedAt: time.Now()})
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.index == nil {
+		if err := a.loadIndex(); err != nil {
+			return err
+		}
+	}
+	hash := archiveHash(value)
+	if pending, ok := a.pending[key]; ok && pending == hash || !ok && a.index[key] == hash {
+		return nil
+	}
+	if a.gz == nil {
+		a.gz = gzip.NewWriter(a.file)
+	}
+	if _, err = a.gz.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	a.pending[key] = hash
+	return nil
+}
+
+// loadIndex reads the hashes of the archived values
+func (a *FileArchive) loadIndex() error {
+	index := make(map[string]string)
+	err := a.Scan("", func(record ArchivedRecord) bool {
+		index[record.Key] = archiveHash(record.Value)
+		return true
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	a.index, a.pending = index, make(map[string]string)
+	return nil
+}
+
+func archiveHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return string(sum[:16])
+}
+
+// Flush finishes the current gzip member and syncs the file
+func (a *FileArchive) Flush() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.gz == nil {
+		return nil
+	}
+	err := a.gz.Close()
+	a.gz = nil
+	if err == nil {
+		err = a.file.Sync()
+	}
+	// Records of a failed flush are written again by the next attempt
+	if err == nil {
+		maps.Copy(a.index, a.pending)
+	}
+	clear(a.pending)
+	return err
+}
+
+// Close flushes and closes the file
+func (a *FileArchive) Close() error {
+	err := a.Flush()
+	if closeErr := a.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Get returns the latest archived value of the key
+func (a *FileArchive) Get(key string) (value string, found bool, err error) {
+	err = a.Scan(key, func(record ArchivedRecord) bool {
+		if record.Key == key {
+			value, found = record.Value, true
+		}
+		return true
+	})
+	return value, found, err
+}
+
+// Scan calls fn for flushed records with keys starting with prefix, oldest first, until fn returns false
+func (a *FileArchive) Scan(prefix string, fn func(record ArchivedRecord) bool) error {
+	file, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if errors.Is(err, io.EOF) {
+		return nil // Nothing archived yet
+	}
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		var record ArchivedRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return err
+		}
+		if strings.HasPrefix(record.Key, prefix) && !fn(record) {
+			return nil
+		}
+	}
+	// An unfinished member at the end is being written right now
+	if err := scanner.Err(); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+	return nil
+}
+
+// ArchiveKeys moves records from the database to the archive on demand
+func ArchiveKeys(db *buntdb.DB, archiver Archiver, keys ...string) error {
+	values := make(map[string]string)
+	err := db.View(func(tx *buntdb.Tx) error {
+		for _, key := range keys {
+			value, err := tx.Get(key)
+			if err == buntdb.ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			values[key] = value
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	_, err = archiveAndDelete(db, archiver, values)
+	return err
+}
+
+// archiveAndDelete archives the records and makes them durable before deleting them in one
+// transaction, a crash in between leaves them in both places. Records changed since they
+// were read stay in the database. Returns the deleted keys.
+func archiveAndDelete(db *buntdb.DB, archiver Archiver, values map[string]string) ([]string, error) {
+	keys := slices.Sorted(maps.Keys(values))
+	for _, key := range keys {
+		if err := archiver.Archive(key, values[key]); err != nil {
+			return nil, errors.Join(fmt.Errorf("archive %s: %w", key, err), flushArchiver(archiver))
+		}
+	}
+	if err := flushArchiver(archiver); err != nil {
+		return nil, err
+	}
+	return deleteUnchanged(db, values)
+}
+
+// deleteUnchanged deletes the records that still have the values and returns their keys
+func deleteUnchanged(db *buntdb.DB, values map[string]string) ([]string, error) {
+	var deleted []string
+	err := db.Update(func(tx *buntdb.Tx) error {
+		deleted = deleted[:0]
+		for _, key := range slices.Sorted(maps.Keys(values)) {
+			value := values[key]
+			current, err := tx.Get(key)
+			if err == buntdb.ErrNotFound || err == nil && current != value {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Delete(key); err != nil {
+				return err
+			}
+			deleted = append(deleted, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+// flushArchiver makes archived records durable if the archiver buffers them
+func flushArchiver(archiver Archiver) error {
+	if f, ok := archiver.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"maps"
+	"net/http"
+	"strings"
+)
+
+// userTopicPrefix starts the internal topics of users, "_user:<tab>:<user>" when publishing
+// and "_user:<user>" in subscriptions, see userTopic
+const userTopicPrefix = "_user:"
+
+// WithUsers identifies the user of each connection, e.g. AuthSegment("session"), so
+// PublishUser and JTemplate.BroadcastJSON reach all tabs of the user. Connections of
+// identified users are accepted without x-subscribe topics then, helpers.js keeps one open for
+// the user updates when the template has WithBroadcastHub.
+func WithUsers(identify func(r *http.Request) string) HubOption {
+	return func(h *Hub) { h.identify = identify }
+}
+
+// userTopic is the topic the connections of the user are subscribed to. Only a hash goes
+// into it, identities may be tokens and topics travel through the broker.
+func userTopic(user string) string {
+	return userTopicPrefix + userHash(user)
+}
+
+func userHash(user string) string {
+	sum := sha256.Sum256([]byte(user))
+	return hex.EncodeToString(sum[:8])
+}
+
+// splitUserTopic turns a published user topic into the subscribed one and the tab to skip
+func splitUserTopic(topic string) (string, string) {
+	rest, ok := strings.CutPrefix(topic, userTopicPrefix)
+	if !ok {
+		return topic, ""
+	}
+	tab, user, ok := strings.Cut(rest, ":")
+	if !ok {
+		return topic, ""
+	}
+	return userTopicPrefix + user, tab
+}
+
+// PublishUser sends data in "component::key" form to all connections of the user, as
+// returned by the WithUsers function, on this instance and on others sharing the broker
+func (h *Hub) PublishUser(user string, data map[string]interface{}) error {
+	return h.publishUser(user, "", data)
+}
+
+// publishUser skips the connection of the tab, which has the data already
+func (h *Hub) publishUser(user, tab string, data map[string]interface{}) error {
+	if user == "" {
+		return nil
+	}
+	message, err := h.jsonOptions.encode(data, 1)
+	if err != nil {
+		return err
+	}
+	return h.broker.Publish(userTopicPrefix+tab+":"+userHash(user), message)
+}
+
+// WithBroadcastHub sends the data of BroadcastJSON through the hub, which needs WithUsers
+func WithBroadcastHub(hub *Hub) TemplateOption {
+	return func(t *JTemplate) {
+		t.broadcastHub = hub
+	}
+}
+
+// BroadcastJSON answers like JSON and sends the same data to the other tabs of the user, so
+// they don't show stale state until their next request. The tab that made the request is
+// skipped. Send only data every tab should show, clearing an input would clear it everywhere.
+func (t *JTemplate) BroadcastJSON(w http.ResponseWriter, r *http.Request, data map[string]interface{}) error {
+	// JSON adds keys meant for this request only
+	shared := maps.Clone(data)
+	if err := t.JSON(w, data); err != nil || t.broadcastHub == nil || t.broadcastHub.identify == nil {
+		return err
+	}
+	if shared == nil {
+		shared = make(map[string]interface{})
+	}
+	shared["main::availVersion"] = t.currentVersion()
+	if t.dataVersions != nil {
+		shared["main::dataVersions"] = t.dataVersions.snapshot()
+	}
+	return t.broadcastHub.publishUser(t.broadcastHub.identify(r), r.Header.Get("X-JAlpine-Tab"), shared)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Broker carries published messages to every replica of the app, so a change made on one
+// instance reaches browsers connected to the others. Realtime features publish through it
+// and deliver to their own connections from the subscription only.
+type Broker interface {
+	Publish(topic string, message []byte) error
+	// Subscribe calls handler for messages of all topics until unsubscribe is called
+	Subscribe(handler func(topic string, message []byte)) (unsubscribe func())
+}
+
+// MemoryBroker delivers messages within the process, it is enough for a single instance
+type MemoryBroker struct {
+	mu       sync.RWMutex
+	handlers map[int]func(topic string, message []byte)
+	nextID   int
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{handlers: make(map[int]func(string, []byte))}
+}
+
+func (b *MemoryBroker) Publish(topic string, message []byte) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, handler := range b.handlers {
+		handler(topic, message)
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Subscribe(handler func(topic string, message []byte)) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.nextID
+	b.nextID++
+	b.handlers[id] = handler
+	return func() {
+		b.mu.Lock()
+		delete(b.handlers, id)
+		b.mu.Unlock()
+	}
+}
+
+// Network brokers use a single channel, so the topic travels in the payload: "topic\nmessage"
+func encodeBrokerMessage(topic string, message []byte) []byte {
+	return append([]byte(topic+"\n"), message...)
+}
+
+func decodeBrokerMessage(payload []byte) (topic string, message []byte, ok bool) {
+	idx := bytes.IndexByte(payload, '\n')
+	if idx == -1 {
+		return "", nil, false
+	}
+	return string(payload[:idx]), payload[idx+1:], true
+}
+
+// BrokerFromURL creates a broker by address like "redis://host:6379/channel" or
+// "nats://host:4222/subject". An empty address gives a MemoryBroker.
+func BrokerFromURL(address string) (Broker, error) {
+	if address == "" {
+		return NewMemoryBroker(), nil
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	channel := strings.TrimPrefix(u.Path, "/")
+	if channel == "" {
+		channel = "jalpine"
+	}
+	switch u.Scheme {
+	case "redis":
+		return NewRedisBroker(u.Host, channel), nil
+	case "nats":
+		return NewNATSBroker(u.Host, channel), nil
+	}
+	return nil, fmt.Errorf("unsupported broker scheme %q", u.Scheme)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NATSBroker distributes messages through a NATS subject using the core text protocol.
+// Authentication and TLS are not supported.
+type NATSBroker struct {
+	addr    string
+	subject string
+
+	mu   sync.Mutex // Guards the publishing connection
+	conn net.Conn
+}
+
+// NewNATSBroker creates a broker for the NATS server at addr (host:port) using one subject for all topics
+func NewNATSBroker(addr, subject string) *NATSBroker {
+	return &NATSBroker{addr: addr, subject: subject}
+}
+
+func (b *NATSBroker) Publish(topic string, message []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == nil {
+		conn, reader, err := dialNATS(b.addr)
+		if err != nil {
+			return err
+		}
+		b.conn = conn
+		// The server pings idle connections and drops the ones not answering
+		go b.keepalive(conn, reader)
+	}
+
+	payload := encodeBrokerMessage(topic, message)
+	b.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := fmt.Fprintf(b.conn, "PUB %s %d\r\n%s\r\n", b.subject, len(payload), payload)
+	if err != nil {
+		b.conn.Close()
+		b.conn = nil
+	}
+	return err
+}
+
+// keepalive answers pings on the publishing connection until it breaks
+func (b *NATSBroker) keepalive(conn net.Conn, reader *bufio.Reader) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err == nil && strings.HasPrefix(line, "PING") {
+			b.mu.Lock()
+			conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			_, err = io.WriteString(conn, "PONG\r\n")
+			b.mu.Unlock()
+		}
+		if err != nil {
+			b.mu.Lock()
+			if b.conn == conn {
+				b.conn = nil
+			}
+			b.mu.Unlock()
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (b *NATSBroker) Subscribe(handler func(topic string, message []byte)) func() {
+	stop := make(chan struct{})
+	var mu sync.Mutex
+	var conn net.Conn
+
+	go func() {
+		for {
+			c, reader, err := dialNATS(b.addr)
+			if err == nil {
+				mu.Lock()
+				select {
+				case <-stop:
+					mu.Unlock()
+					c.Close()
+					return
+				default:
+				}
+				conn = c
+				mu.Unlock()
+				err = b.receive(c, reader, handler)
+				c.Close()
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Second):
+				log.Printf("NATS broker subscription lost, reconnecting: %v", err)
+			}
+		}
+	}()
+
+	return func() {
+		mu.Lock()
+		close(stop)
+		if conn != nil {
+			conn.Close()
+		}
+		mu.Unlock()
+	}
+}
+
+// receive subscribes on the connection and passes messages to handler until an error
+func (b *NATSBroker) receive(conn net.Conn, reader *bufio.Reader, handler func(string, []byte)) error {
+	if _, err := fmt.Fprintf(conn, "SUB %s 1\r\n", b.subject); err != nil {
+		return err
+	}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "PING":
+			if _, err := io.WriteString(conn, "PONG\r\n"); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New("nats: " + line)
+		case strings.HasPrefix(line, "MSG "):
+			// MSG <subject> <sid> [reply-to] <#bytes>
+			fields := strings.Fields(line)
+			n, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil {
+				return err
+			}
+			payload := make([]byte, n+2)
+			if _, err := io.ReadFull(reader, payload); err != nil {
+				return err
+			}
+			if topic, message, ok := decodeBrokerMessage(payload[:n]); ok {
+				handler(topic, message)
+			}
+		}
+	}
+}
+
+// dialNATS connects and completes the handshake: the server sends INFO, the client answers CONNECT
+func dialNATS(addr string) (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	info, err := reader.ReadString('\n')
+	if err == nil && !strings.HasPrefix(info, "INFO") {
+		err = fmt.Errorf("nats: unexpected greeting %q", info)
+	}
+	if err == nil {
+		_, err = io.WriteString(conn, `CONNECT {"verbose":false,"pedantic":false}`+"\r\n")
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, reader, nil
+}
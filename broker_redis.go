@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RedisBroker distributes messages through Redis Pub/Sub. It speaks the plain RESP protocol
+// and does not authenticate, so put Redis on a private network or use a local proxy.
+type RedisBroker struct {
+	addr    string
+	channel string
+
+	mu     sync.Mutex // Guards the publishing connection
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// NewRedisBroker creates a broker for the Redis at addr (host:port) using one channel for all topics
+func NewRedisBroker(addr, channel string) *RedisBroker {
+	return &RedisBroker{addr: addr, channel: channel}
+}
+
+func (b *RedisBroker) Publish(topic string, message []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == nil {
+		conn, err := net.DialTimeout("tcp", b.addr, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		b.conn, b.reader = conn, bufio.NewReader(conn)
+	}
+
+	b.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	err := writeRESPCommand(b.conn, "PUBLISH", b.channel, string(encodeBrokerMessage(topic, message)))
+	if err == nil {
+		_, err = readRESP(b.reader)
+	}
+	if err != nil {
+		// Reconnect on the next call
+		b.conn.Close()
+		b.conn, b.reader = nil, nil
+	}
+	return err
+}
+
+func (b *RedisBroker) Subscribe(handler func(topic string, message []byte)) func() {
+	stop := make(chan struct{})
+	var mu sync.Mutex
+	var conn net.Conn
+
+	go func() {
+		for {
+			c, err := net.DialTimeout("tcp", b.addr, 5*time.Second)
+			if err == nil {
+				mu.Lock()
+				select {
+				case <-stop:
+					mu.Unlock()
+					c.Close()
+					return
+				default:
+				}
+				conn = c
+				mu.Unlock()
+				err = b.receive(c, handler)
+				c.Close()
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Second):
+				log.Printf("Redis broker subscription lost, reconnecting: %v", err)
+			}
+		}
+	}()
+
+	return func() {
+		mu.Lock()
+		close(stop)
+		if conn != nil {
+			conn.Close()
+		}
+		mu.Unlock()
+	}
+}
+
+// receive subscribes on the connection and passes messages to handler until an error
+func (b *RedisBroker) receive(conn net.Conn, handler func(string, []byte)) error {
+	if err := writeRESPCommand(conn, "SUBSCRIBE", b.channel); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	for {
+		reply, err := readRESP(reader)
+		if err != nil {
+			return err
+		}
+		// Messages come as ["message", channel, payload], subscription confirmations are skipped
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 3 || parts[0] != "message" {
+			continue
+		}
+		payload, _ := parts[2].(string)
+		if topic, message, ok := decodeBrokerMessage([]byte(payload)); ok {
+			handler(topic, message)
+		}
+	}
+}
+
+func writeRESPCommand(w io.Writer, args ...string) error {
+	buf := fmt.Appendf(nil, "*%d\r\n", len(args))
+	for _, arg := range args {
+		buf = fmt.Appendf(buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// readRESP reads one reply: strings and integers as strings, arrays as []interface{}
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 {
+		return nil, errors.New("redis: malformed reply")
+	}
+	kind, value := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+', ':':
+		return value, nil
+	case '-':
+		return nil, errors.New("redis: " + value)
+	case '$':
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRESP(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// BundleLibName is the name of the bundle in the libs map returned by BundleLibs
+const BundleLibName = "bundle"
+
+// sourceMappingURLRe matches source map comments, which point nowhere once files are joined
+var sourceMappingURLRe = regexp.MustCompile(`(?m)^//# sourceMappingURL=.*$`)
+
+// BundleLibs joins the deferred JS libraries of libsMap into one "bundle@hash.js" in staticDir
+// and returns libsMap with the bundle in their place, so the page makes one request. The files
+// follow the injection order of the entries, see EnsureLibsEntry.Order. Libraries loaded
+// otherwise (the Tailwind browser build, modules) and stylesheets keep their own tags.
+func BundleLibs(staticDir string, libsMap map[string]string, entries ...EnsureLibsEntry) (map[string]string, error) {
+	byName := make(map[string]EnsureLibsEntry, len(entries))
+	for _, entry := range entries {
+		byName[entry.Name] = entry
+	}
+
+	var bundle bytes.Buffer
+	bundled := maps.Clone(libsMap)
+	for _, name := range libOrder(libsMap, byName) {
+		file := libsMap[name]
+		entry, ok := byName[name]
+		if !ok && strings.ToLower(name) == "tailwindcss" {
+			continue
+		}
+		if entry.loadAttrs() != " defer" || !strings.EqualFold(filepath.Ext(file), ".js") {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(staticDir, file))
+		if err != nil {
+			return nil, fmt.Errorf("failed to bundle %s: %v", name, err)
+		}
+		fmt.Fprintf(&bundle, "/* %s */\n", file)
+		bundle.Write(sourceMappingURLRe.ReplaceAll(content, nil))
+		// Files without a trailing semicolon must not run into the next one
+		bundle.WriteString("\n;\n")
+		delete(bundled, name)
+	}
+	if bundle.Len() == 0 {
+		return libsMap, nil
+	}
+
+	sum := sha256.Sum256(bundle.Bytes())
+	file := BundleLibName + "@" + hex.EncodeToString(sum[:6]) + ".js"
+	path := filepath.Join(staticDir, file)
+	if _, err := os.Stat(path); err != nil {
+		if err := os.WriteFile(path+".tmp", bundle.Bytes(), 0644); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return nil, err
+		}
+	}
+	if LibDownloads.Precompress {
+		if err := precompressFile(path); err != nil {
+			log.Printf("Failed to precompress %s: %v", file, err)
+		}
+	}
+	removeLibVersions(staticDir, BundleLibName, ".js", file)
+	bundled[BundleLibName] = file
+	return bundled, nil
+}
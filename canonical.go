@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CanonicalJSON serializes v into a stable form: object keys are sorted at every level
+// (including keys produced by custom MarshalJSON implementations) and numbers are printed
+// in the shortest form, so equal data always gives byte-identical output.
+// It is used for component data in Execute/JSON and for everything that hashes or diffs it,
+// see JSONOptions to customize it.
+func CanonicalJSON(v interface{}) ([]byte, error) {
+	return (*JSONOptions)(nil).encode(v, 0)
+}
+
+// writeCanonical writes a value produced by json.Decoder with UseNumber
+func writeCanonical(buf *bytes.Buffer, v interface{}) error {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeCanonicalString(buf, k)
+			buf.WriteByte(':')
+			if err := writeCanonical(buf, val[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, item := range val {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeCanonical(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case json.Number:
+		num, err := canonicalNumber(val)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(num)
+	case string:
+		writeCanonicalString(buf, val)
+	case bool:
+		buf.WriteString(strconv.FormatBool(val))
+	case nil:
+		buf.WriteString("null")
+	default:
+		return fmt.Errorf("unexpected JSON value of type %T", v)
+	}
+	return nil
+}
+
+// writeCanonicalString uses the standard escaping, including HTML-safe escaping of <, > and &,
+// because component data is embedded into a <script> block
+func writeCanonicalString(buf *bytes.Buffer, s string) {
+	encoded, _ := json.Marshal(s)
+	buf.Write(encoded)
+}
+
+// canonicalNumber formats integers as is and floats in the shortest ES6-like form,
+// so "1.0", "1e0" and "1" all become "1"
+func canonicalNumber(n json.Number) (string, error) {
+	// Integer literals are kept untouched to not lose precision of large values
+	if !strings.ContainsAny(string(n), ".eE") {
+		return string(n), nil
+	}
+	f, err := strconv.ParseFloat(string(n), 64)
+	if err != nil {
+		return "", err
+	}
+	if f == math.Trunc(f) && math.Abs(f) < 1e21 {
+		return strconv.FormatFloat(f, 'f', -1, 64), nil
+	}
+	// encoding/json already produces the ES6 number format for float64
+	encoded, err := json.Marshal(f)
+	return string(encoded), err
+}
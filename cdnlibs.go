@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html"
+)
+
+// CDNLib is where the page loads a library from instead of /static
+type CDNLib struct {
+	URL       string
+	Integrity string // Subresource integrity, e.g. "sha256-...", checked by the browser if set
+}
+
+// CDNLibs returns the exact URLs of the locked libraries with their hashes as integrity.
+// Libraries from npm tarballs have no single-file URL and stay local.
+func CDNLibs(lock LibsLock) map[string]CDNLib {
+	libs := make(map[string]CDNLib)
+	for name, locked := range lock.Libs {
+		if locked.Path != "" || locked.URL == "" {
+			continue
+		}
+		lib := CDNLib{URL: locked.URL}
+		if sum, err := hex.DecodeString(locked.SHA256); err == nil {
+			lib.Integrity = "sha256-" + base64.StdEncoding.EncodeToString(sum)
+		}
+		libs[name] = lib
+	}
+	return libs
+}
+
+// WithCDNLibs makes pages load the libraries from the CDN by name, e.g. WithCDNLibs(CDNLibs(lock)).
+// If a CDN copy fails to load, the local one from /static is inserted instead and helpers.js
+// reports it to ClientLogPath. Local copies of plugins may run after Alpine has started, so the
+// fallback is mostly useful for short CDN outages, not as the primary source.
+func WithCDNLibs(libs map[string]CDNLib) TemplateOption {
+	return func(t *JTemplate) {
+		t.cdnLibs = libs
+	}
+}
+
+// assetFallbackScript defines the onerror handler of CDN tags. It must be inline in <head>,
+// helpers.js is only at the end of the body. Failures are queued for helpers.js to report.
+const assetFallbackScript = `<script>window._jalpineAssetFailures=[];function jalpineAssetFallback(el){` +
+	`el.onerror=null;var local=el.getAttribute('data-jalpine-local'),copy=document.createElement(el.tagName);` +
+	`if(el.tagName==='LINK'){copy.rel='stylesheet';copy.href=local}else{copy.src=local;copy.async=false}` +
+	`el.after(copy);window._jalpineAssetFailures.push({source:el.src||el.href,local:local})}</script>`
+
+// cdnTag returns a tag loading the library from the CDN with the local URL as fallback.
+// Integrity checks need CORS, so crossOrigin defaults to "anonymous" with an integrity.
+func cdnTag(lib CDNLib, local string, js bool, attrs, crossOrigin string) string {
+	integrity := ""
+	if lib.Integrity != "" {
+		if crossOrigin == "" {
+			crossOrigin = "anonymous"
+		}
+		integrity = fmt.Sprintf(` integrity="%s"`, html.EscapeString(lib.Integrity))
+	}
+	integrity += crossOriginAttr(crossOrigin)
+	fallback := fmt.Sprintf(` data-jalpine-local="%s" onerror="jalpineAssetFallback(this)"`, html.EscapeString(local))
+	if js {
+		return fmt.Sprintf(`<script src="%s"%s%s%s></script>`, html.EscapeString(lib.URL), integrity, fallback, attrs)
+	}
+	return fmt.Sprintf(`<link rel="stylesheet" href="%s"%s%s>`, html.EscapeString(lib.URL), integrity, fallback)
+}
+
+// crossOriginAttr returns the crossorigin attribute, empty if value is
+func crossOriginAttr(value string) string {
+	if value == "" {
+		return ""
+	}
+	return fmt.Sprintf(` crossorigin="%s"`, html.EscapeString(value))
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/gorilla/mux"
+)
+
+// ClientAPIPath serves the generated API in development, see ClientAPIHandler
+const ClientAPIPath = "/_jalpine/api.js"
+
+// ClientScriptFromSource renders the actions found by ClientAPIFromSource as a script for the
+// $api magic of helpers.js, so components call this.$api.createTodo({ newTodo }) instead of
+// writing methods and URLs. Functions are named after their handlers (handleCreateTodo is
+// createTodo), actions of an ActionDispatcher after the action (todos.toggle is todosToggle),
+// the rest after method and path. Request and response types in the JSDoc refer to the
+// declarations of "go run . types". Upload routes are left out, they don't take JSON, and so
+// are routes wrapped in JTemplate.Deprecated.
+func ClientScriptFromSource(dir string, router *mux.Router) (string, error) {
+	_, actions, err := ClientAPIFromSource(dir, router)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	b.WriteString("// Generated from the Go sources by \"go run . client\", do not edit\n")
+	b.WriteString("window.jalpineAPI = Object.assign(window.jalpineAPI || {}, {\n")
+	taken := make(map[string]bool)
+	for _, action := range actions {
+		// Uploads are sent as FormData with $post, deprecated routes have replacements
+		if action.Upload || action.Old {
+			continue
+		}
+		name := clientFuncName(action)
+		if taken[name] {
+			name = camelJoin(strings.ToLower(action.Method) + "/" + action.Path)
+		}
+		taken[name] = true
+
+		route := strconv.Quote(action.Method + " " + action.Path)
+		fmt.Fprintf(&b, "    /**\n     * %s %s\n", action.Method, action.Path)
+		if action.Request != "" {
+			fmt.Fprintf(&b, "     * @param {%s} data\n", action.Request)
+		}
+		fmt.Fprintf(&b, "     * @returns {Promise<JAlpineActions[%s][\"response\"]>}\n     */\n", route)
+		query := ""
+		if action.Query {
+			query = ", query: true"
+		}
+		fmt.Fprintf(&b, "    %s: { method: %s, url: %s%s },\n", name, strconv.Quote(action.Method), strconv.Quote(action.Path), query)
+	}
+	b.WriteString("});\n")
+	return b.String(), nil
+}
+
+// clientFuncName names the function of an action in the generated script
+func clientFuncName(action ClientAction) string {
+	if name, ok := strings.CutPrefix(action.Path, ActionsPath+"/"); ok {
+		return camelJoin(name)
+	}
+	if isIdentifier(action.Handler) {
+		// handleCreateTodo and MarkdownHandler become createTodo and markdown
+		name := strings.TrimSuffix(strings.TrimPrefix(action.Handler, "handle"), "Handler")
+		return strings.ToLower(name[:1]) + name[1:]
+	}
+	return camelJoin(strings.ToLower(action.Method) + "/" + action.Path)
+}
+
+// camelJoin turns "todos.clear-completed" or "post//todos/import" into "todosClearCompleted"
+// and "postTodosImport"
+func camelJoin(s string) string {
+	var b strings.Builder
+	upper := false
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = b.Len() > 0
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func isIdentifier(name string) bool {
+	if name == "" || name == "handle" || name == "Handler" {
+		return false
+	}
+	for i, r := range name {
+		if !unicode.IsLetter(r) && r != '_' && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// ClientAPIHandler serves the script of ClientScriptFromSource generated from the sources in
+// dir on every request, for development. Production builds have no sources, see ClientAPIFile.
+func ClientAPIHandler(dir string, router *mux.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		script, err := ClientScriptFromSource(dir, router)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write([]byte(script))
+	}
+}
+
+// ClientAPIFile serves the script from file, e.g. static/api.js written by "go run . client"
+// for builds without sources. Without the file the script is generated once from the sources
+// in dir.
+func ClientAPIFile(file, dir string, router *mux.Router) http.HandlerFunc {
+	var once sync.Once
+	var script string
+	var err error
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, statErr := os.Stat(file); statErr == nil {
+			http.ServeFile(w, r, file)
+			return
+		}
+		once.Do(func() {
+			script, err = ClientScriptFromSource(dir, router)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write([]byte(script))
+	}
+}
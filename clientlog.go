@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ClientLogPath is where helpers.js sends client-side errors
+const ClientLogPath = "/_jalpine/log"
+
+// ClientError is a problem reported by helpers.js: an uncaught error or data that could not
+// be applied because the target component is not on the page
+type ClientError struct {
+	Message   string `json:"message"`
+	Source    string `json:"source,omitempty"`
+	Line      int    `json:"line,omitempty"`
+	Column    int    `json:"column,omitempty"`
+	Stack     string `json:"stack,omitempty"`
+	Component string `json:"component,omitempty"`
+	Key       string `json:"key,omitempty"`
+	Version   string `json:"version,omitempty"` // Template version of the page
+	URL       string `json:"url,omitempty"`
+
+	// Filled by the server
+	UserAgent string    `json:"userAgent,omitempty"`
+	Stale     bool      `json:"stale,omitempty"` // Page was rendered from an outdated template
+	Time      time.Time `json:"time"`
+}
+
+// ErrorReporter receives client-side errors, e.g. to store them or forward to a monitoring service
+type ErrorReporter interface {
+	ReportClientError(r *http.Request, e ClientError)
+}
+
+// LogErrorReporter writes client errors to the standard logger, used by default
+type LogErrorReporter struct{}
+
+func (LogErrorReporter) ReportClientError(r *http.Request, e ClientError) {
+	log.Printf("Client error: %s (component=%q key=%q source=%s:%d:%d version=%s stale=%t url=%s)",
+		e.Message, e.Component, e.Key, e.Source, e.Line, e.Column, e.Version, e.Stale, e.URL)
+}
+
+// WithErrorReporter replaces the default LogErrorReporter
+func WithErrorReporter(reporter ErrorReporter) TemplateOption {
+	return func(t *JTemplate) {
+		t.errorReporter = reporter
+	}
+}
+
+// ClientLogHandler accepts reports sent by helpers.js, should be registered at ClientLogPath
+func (t *JTemplate) ClientLogHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var report ClientError
+		r.Body = http.MaxBytesReader(w, r.Body, 16*1024)
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+			http.Error(w, "Invalid report", http.StatusBadRequest)
+			return
+		}
+
+		t.Update()
+		report.UserAgent = r.UserAgent()
+		report.Stale = report.Version != "" && report.Version != t.currentVersion()
+		report.Time = t.clock.Now()
+
+		reporter := t.errorReporter
+		if reporter == nil {
+			reporter = LogErrorReporter{}
+		}
+		reporter.ReportClientError(r, report)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
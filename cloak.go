@@ -0,0 +1,51 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Standard Alpine rule hiding elements until they are initialized
+const cloakStyle = `<style>[x-cloak]{display:none !important}</style>`
+
+// WithAutoCloak stamps x-cloak onto every component root element (x-data) during compilation,
+// so raw markup is not shown before Alpine starts. The [x-cloak] style is always injected.
+// Cloaked components hide server-rendered content too, so it makes little sense with WithSSR.
+func WithAutoCloak(enabled bool) TemplateOption {
+	return func(t *JTemplate) {
+		t.autoCloak = enabled
+	}
+}
+
+var (
+	startTagRe   = regexp.MustCompile(`<([a-zA-Z][\w-]*)(\s(?:[^>"']|"[^"]*"|'[^']*')*)?>`)
+	xDataAttrRe  = regexp.MustCompile(`\sx-data(?:[\s=/]|$)`)
+	xCloakAttrRe = regexp.MustCompile(`\sx-cloak(?:[\s=/]|$)`)
+)
+
+// injectCloakStyle adds the [x-cloak] style to the head unless the template defines it itself
+func injectCloakStyle(html string) string {
+	if strings.Contains(html, "[x-cloak]") {
+		return html
+	}
+	if strings.Contains(html, "</head>") {
+		return strings.Replace(html, "</head>", cloakStyle+"\n</head>", 1)
+	}
+	// The style must precede the content it hides, but not a doctype
+	if idx := strings.Index(html, "<body"); idx != -1 {
+		return html[:idx] + cloakStyle + "\n" + html[idx:]
+	}
+	return cloakStyle + "\n" + html
+}
+
+// stampCloak adds x-cloak to start tags with x-data, except scripts
+func stampCloak(html string) string {
+	return startTagRe.ReplaceAllStringFunc(html, func(tag string) string {
+		m := startTagRe.FindStringSubmatch(tag)
+		attrs := m[2]
+		if strings.EqualFold(m[1], "script") || !xDataAttrRe.MatchString(attrs) || xCloakAttrRe.MatchString(attrs) {
+			return tag
+		}
+		return "<" + m[1] + " x-cloak" + attrs + ">"
+	})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// WithComponentsDir sets the directory scanned for component fragments, by default it is
+// "components" next to the main file. An empty dir disables auto-discovery.
+func WithComponentsDir(dir string) TemplateOption {
+	return func(t *JTemplate) {
+		t.componentsDir = dir
+	}
+}
+
+// loadComponents compiles every .html file of the components directory (including subdirectories).
+// Components are keyed by path relative to the directory, like "todoList.html" or "forms/login.html",
+// and can be rendered with ExecuteFragment even if the page doesn't include them.
+// Directories are added to deps, so adding a new component file triggers recompilation.
+func (t *JTemplate) loadComponents() (map[string]string, error) {
+	components := make(map[string]string)
+	if t.componentsDir == "" {
+		return components, nil
+	}
+	if _, err := os.Stat(t.componentsDir); os.IsNotExist(err) {
+		return components, nil
+	}
+
+	err := filepath.WalkDir(t.componentsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			t.deps[path] = struct{}{}
+			return nil
+		}
+		if filepath.Ext(path) != ".html" {
+			return nil
+		}
+
+		content, err := t.loadTemplate(path)
+		if err != nil {
+			return err
+		}
+		if t.preprocess != nil {
+			if content, err = t.preprocess.execute(content); err != nil {
+				return err
+			}
+		}
+		name, _ := filepath.Rel(t.componentsDir, path)
+		components[filepath.ToSlash(name)] = content
+		return nil
+	})
+	return components, err
+}
+
+// resolveInclude returns the path of an included file: relative to the including file,
+// or in the components directory if there is no such file
+func (t *JTemplate) resolveInclude(currentDir, fileName string) string {
+	includePath := filepath.Join(currentDir, fileName)
+	if t.componentsDir == "" {
+		return includePath
+	}
+	if _, err := os.Stat(includePath); os.IsNotExist(err) {
+		componentPath := filepath.Join(t.componentsDir, fileName)
+		if _, err := os.Stat(componentPath); err == nil {
+			return componentPath
+		}
+	}
+	return includePath
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Compressor creates a writer that compresses into w for a particular Content-Encoding
+type Compressor func(w io.Writer) io.WriteCloser
+
+var (
+	compressors = map[string]Compressor{
+		"gzip": func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+	}
+	// Encodings in order of preference
+	compressionPreference = []string{"gzip"}
+)
+
+// RegisterCompressor adds support for another Content-Encoding (e.g. "br" backed by a brotli library).
+// Registered encodings are preferred over gzip when the client accepts them.
+// Should be called during setup, before serving requests.
+func RegisterCompressor(encoding string, c Compressor) {
+	if _, exists := compressors[encoding]; !exists {
+		compressionPreference = append([]string{encoding}, compressionPreference...)
+	}
+	compressors[encoding] = c
+}
+
+// negotiateEncoding picks the most preferred registered encoding allowed by Accept-Encoding
+func negotiateEncoding(r *http.Request) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, _ = strconv.ParseFloat(value, 64)
+		}
+		accepted[strings.ToLower(name)] = q > 0
+	}
+	for _, encoding := range compressionPreference {
+		if accepted[encoding] {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// Compress is a middleware that transparently compresses responses (e.g. of JSON) according
+// to Accept-Encoding. Responses that already have Content-Encoding set, like pages rendered
+// by ExecuteHTTP, are passed through untouched.
+func Compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := negotiateEncoding(r)
+		if encoding == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter decides whether to compress on the first write, when headers are known
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	compressor  io.WriteCloser
+	wroteHeader bool
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+
+	h := cw.Header()
+	addVary(h, "Accept-Encoding")
+	bodyless := status == http.StatusNoContent || status == http.StatusNotModified || status < 200
+	// Event streams must reach the client message by message
+	streaming := strings.HasPrefix(h.Get("Content-Type"), "text/event-stream")
+	if h.Get("Content-Encoding") == "" && !bodyless && !streaming {
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+		// The tag of the identity content can't stand for the encoded bytes, only weakly
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		cw.compressor = compressors[cw.encoding](cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.compressor != nil {
+		return cw.compressor.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *compressWriter) Flush() {
+	if f, ok := cw.compressor.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *compressWriter) Close() error {
+	if cw.compressor != nil {
+		return cw.compressor.Close()
+	}
+	return nil
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// gzipPage caches the deflated static part of the page preceding the component data.
+// Per request only the data and the rest of the page are compressed, continuing the same
+// deflate stream with the cached part as a preset dictionary.
+type gzipPage struct {
+	mu        sync.Mutex
+	version   string
+	deflated  []byte // Prefix compressed and sync-flushed, so more blocks may follow
+	dict      []byte // Last 32KB of prefix, the window the decompressor has at the joint
+	prefixCRC uint32
+	prefixLen int
+}
+
+// renderEncoded renders the page compressed with the given Content-Encoding, "" means no compression
+func (t *JTemplate) renderEncoded(compDataJSON []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case "":
+		return t.render(compDataJSON), nil
+	case "gzip":
+		if !t.ssr {
+			return t.renderGzip(compDataJSON)
+		}
+		// With SSR the prefix depends on data and can't be cached
+		fallthrough
+	default:
+		var buf bytes.Buffer
+		cw := compressors[encoding](&buf)
+		if _, err := cw.Write(t.render(compDataJSON)); err != nil {
+			return nil, err
+		}
+		if err := cw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+}
+
+// renderGzip renders the page as a single gzip member built from the cached compressed prefix
+func (t *JTemplate) renderGzip(compDataJSON []byte) ([]byte, error) {
+	compiled, version := t.current()
+	prefix, suffix := t.pageParts(compiled)
+
+	cache := &t.gzipCache
+	cache.mu.Lock()
+	if cache.version != version || cache.deflated == nil {
+		var buf bytes.Buffer
+		fw, _ := flate.NewWriter(&buf, flate.BestCompression)
+		io.WriteString(fw, prefix)
+		fw.Flush()
+
+		dict := prefix
+		if len(dict) > 32*1024 {
+			dict = dict[len(dict)-32*1024:]
+		}
+		cache.version = version
+		cache.deflated = buf.Bytes()
+		cache.dict = []byte(dict)
+		cache.prefixCRC = crc32.ChecksumIEEE([]byte(prefix))
+		cache.prefixLen = len(prefix)
+	}
+	deflated, dict, crc, size := cache.deflated, cache.dict, cache.prefixCRC, cache.prefixLen
+	cache.mu.Unlock()
+
+	var out bytes.Buffer
+	// Minimal gzip header: deflate, no flags, no mtime, unknown OS
+	out.Write([]byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 255})
+	out.Write(deflated)
+
+	fw, err := flate.NewWriterDict(&out, flate.DefaultCompression, dict)
+	if err != nil {
+		return nil, err
+	}
+	fw.Write(compDataJSON)
+	io.WriteString(fw, suffix)
+	if err := fw.Close(); err != nil {
+		return nil, err
+	}
+
+	crc = crc32.Update(crc, crc32.IEEETable, compDataJSON)
+	crc = crc32.Update(crc, crc32.IEEETable, []byte(suffix))
+	size += len(compDataJSON) + len(suffix)
+	out.Write(binary.LittleEndian.AppendUint32(nil, crc))
+	out.Write(binary.LittleEndian.AppendUint32(nil, uint32(size)))
+
+	return out.Bytes(), nil
+}
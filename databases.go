@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+// Database declares one buntdb file of the app, see OpenDatabases. High churn data like
+// sessions or rate limits gets its own file, so expiring keys don't bloat the domain data and
+// each file gets the sync, shrink and backup policy it needs.
+type Database struct {
+	Name   string
+	Path   string                      // The file, ":memory:" keeps the data in memory only
+	Config func(config *buntdb.Config) // Adjusts buntdb's defaults, e.g. SyncPolicy or AutoShrinkPercentage
+
+	ShrinkEvery time.Duration // Also shrinks the file on this interval, e.g. for TTL-heavy data; 0 leaves it to buntdb
+	BackupDir   string        // Where snapshots are written, empty disables backups
+	BackupEvery time.Duration // How often Schedule writes a snapshot, daily by default
+	BackupKeep  int           // Newest snapshots kept, 7 by default
+}
+
+// Databases are the opened files of the app by name
+type Databases struct {
+	specs map[string]Database
+	dbs   map[string]*buntdb.DB
+}
+
+// OpenDatabases opens all files with their configs. If one fails, the opened ones are closed.
+func OpenDatabases(specs ...Database) (*Databases, error) {
+	d := &Databases{specs: make(map[string]Database), dbs: make(map[string]*buntdb.DB)}
+	for _, spec := range specs {
+		if spec.Name == "" || spec.Path == "" {
+			return nil, errors.Join(fmt.Errorf("database name and path are required"), d.Close())
+		}
+		if _, ok := d.specs[spec.Name]; ok {
+			return nil, errors.Join(fmt.Errorf("database %s is declared twice", spec.Name), d.Close())
+		}
+		if spec.BackupEvery <= 0 {
+			spec.BackupEvery = 24 * time.Hour
+		}
+		if spec.BackupKeep <= 0 {
+			spec.BackupKeep = 7
+		}
+		db, err := openDatabase(spec)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("failed to open database %s: %v", spec.Name, err), d.Close())
+		}
+		d.specs[spec.Name] = spec
+		d.dbs[spec.Name] = db
+	}
+	return d, nil
+}
+
+func openDatabase(spec Database) (*buntdb.DB, error) {
+	db, err := buntdb.Open(spec.Path)
+	if err != nil {
+		return nil, err
+	}
+	if spec.Config != nil {
+		var config buntdb.Config
+		if err = db.ReadConfig(&config); err == nil {
+			spec.Config(&config)
+			err = db.SetConfig(config)
+		}
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// Get returns the database of the name, it panics for undeclared names like a typo would deserve
+func (d *Databases) Get(name string) *buntdb.DB {
+	db, ok := d.dbs[name]
+	if !ok {
+		panic(fmt.Sprintf("database %s is not declared", name))
+	}
+	return db
+}
+
+// Names returns the declared names, sorted
+func (d *Databases) Names() []string {
+	names := make([]string, 0, len(d.dbs))
+	for name := range d.dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Backup writes a snapshot of the database into its BackupDir as "name-<time>.db" and removes
+// snapshots over BackupKeep. Returns the path of the snapshot.
+func (d *Databases) Backup(name string) (string, error) {
+	spec := d.specs[name]
+	if spec.BackupDir == "" {
+		return "", fmt.Errorf("database %s has no backup dir", name)
+	}
+	if err := os.MkdirAll(spec.BackupDir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(spec.BackupDir, name+"-"+time.Now().UTC().Format("20060102-150405")+".db")
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return "", err
+	}
+	err = d.Get(name).Save(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return "", err
+	}
+
+	// The timestamps sort the snapshots by age
+	old, _ := filepath.Glob(filepath.Join(spec.BackupDir, name+"-*.db"))
+	sort.Strings(old)
+	for len(old) > spec.BackupKeep {
+		os.Remove(old[0])
+		old = old[1:]
+	}
+	return path, nil
+}
+
+// Schedule shrinks and backs up every database on its own intervals until stop is called
+func (d *Databases) Schedule() (stop func()) {
+	done := make(chan struct{})
+	for _, name := range d.Names() {
+		spec := d.specs[name]
+		if spec.ShrinkEvery > 0 {
+			go d.every(done, spec.ShrinkEvery, func() {
+				if err := d.Get(name).Shrink(); err != nil && err != buntdb.ErrShrinkInProcess {
+					log.Printf("Failed to shrink database %s: %v", name, err)
+				}
+			})
+		}
+		if spec.BackupDir != "" {
+			go d.every(done, spec.BackupEvery, func() {
+				if _, err := d.Backup(name); err != nil {
+					log.Printf("Failed to back up database %s: %v", name, err)
+				}
+			})
+		}
+	}
+	return func() { close(done) }
+}
+
+func (d *Databases) every(done chan struct{}, interval time.Duration, fn func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			fn()
+		}
+	}
+}
+
+// Register adds a health check for every database to the startup and closes them all on
+// Shutdown. Register it before other shutdown hooks, so it runs after those using the data.
+func (d *Databases) Register(startup *Startup) {
+	for _, name := range d.Names() {
+		db := d.dbs[name]
+		startup.Check("database "+name, func() error {
+			return db.View(func(tx *buntdb.Tx) error { return nil })
+		})
+	}
+	startup.OnShutdown(func(ctx context.Context) error { return d.Close() })
+}
+
+// Close closes all databases, ones closed already are skipped
+func (d *Databases) Close() error {
+	var errs []error
+	for name, db := range d.dbs {
+		if err := db.Close(); err != nil && err != buntdb.ErrDatabaseClosed {
+			errs = append(errs, fmt.Errorf("database %s: %v", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
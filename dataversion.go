@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+// DataVersions counts writes by component or key prefix, e.g. "todoApp". Pages and JSON
+// answers carry the versions as "main::dataVersions", so helpers.js notices that a list changed
+// even when the template did not, see WithDataVersions. Versions live in memory and start over
+// with a new epoch on restart, replicas have their own.
+type DataVersions struct {
+	mu     sync.Mutex
+	epoch  string
+	counts map[string]uint64
+}
+
+// NewDataVersions creates an empty set of versions
+func NewDataVersions() *DataVersions {
+	return &DataVersions{
+		epoch:  strconv.FormatInt(time.Now().UnixNano(), 36),
+		counts: make(map[string]uint64),
+	}
+}
+
+// DataChange is the version of a prefix before and after a write, see ListPatch.Versioned
+type DataChange struct {
+	Base    string
+	Version string
+}
+
+// Bump marks the data of the prefix as changed
+func (v *DataVersions) Bump(prefix string) DataChange {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.counts[prefix]++
+	return DataChange{
+		Base:    v.epoch + "." + strconv.FormatUint(v.counts[prefix]-1, 10),
+		Version: v.epoch + "." + strconv.FormatUint(v.counts[prefix], 10),
+	}
+}
+
+// Update runs db.Update and bumps the prefix if the transaction succeeds
+func (v *DataVersions) Update(db *buntdb.DB, prefix string, fn func(tx *buntdb.Tx) error) error {
+	_, err := v.UpdateChange(db, prefix, fn)
+	return err
+}
+
+// UpdateChange is Update returning the versions around the write, for patches of the data
+func (v *DataVersions) UpdateChange(db *buntdb.DB, prefix string, fn func(tx *buntdb.Tx) error) (DataChange, error) {
+	if err := db.Update(fn); err != nil {
+		return DataChange{}, err
+	}
+	return v.Bump(prefix), nil
+}
+
+// Get returns the version of the prefix, opaque to clients
+func (v *DataVersions) Get(prefix string) string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.epoch + "." + strconv.FormatUint(v.counts[prefix], 10)
+}
+
+// snapshot returns versions of all prefixes written so far
+func (v *DataVersions) snapshot() map[string]string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	versions := make(map[string]string, len(v.counts))
+	for prefix, count := range v.counts {
+		versions[prefix] = v.epoch + "." + strconv.FormatUint(count, 10)
+	}
+	return versions
+}
+
+// WithDataVersions sends the versions with pages and JSON answers. When a version differs from
+// the one the page knows and the answer has no data for that component, helpers.js dispatches
+// "jalpine:stale-data" on window with {prefixes: [...]}, e.g. @jalpine:stale-data.window="reload()".
+func WithDataVersions(versions *DataVersions) TemplateOption {
+	return func(t *JTemplate) {
+		t.dataVersions = versions
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// DebugPath shows the internals of the template, see DebugHandler
+const DebugPath = "/_jalpine/debug"
+
+// WriteDebug writes the current version, the include tree with modification times,
+// all dependencies, registered libraries, components and the fully compiled template
+func (t *JTemplate) WriteDebug(w io.Writer) error {
+	profile := t.Profile()
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	fmt.Fprintf(w, "VERSION %s\nMAIN %s\nCOMPONENTS DIR %s\n\n", t.version, t.mainFile, t.componentsDir)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "INCLUDE TREE\tMODIFIED\tSIZE\t\n")
+	for _, p := range profile {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t\n", strings.Repeat("  ", p.Depth)+p.File, fileModTime(p.File), p.Size)
+	}
+	tw.Flush()
+
+	// Deps also contain component files and watched directories
+	deps := make([]string, 0, len(t.deps))
+	for file := range t.deps {
+		deps = append(deps, file)
+	}
+	sort.Strings(deps)
+	fmt.Fprintf(tw, "\nDEPENDENCY\tMODIFIED\t\n")
+	for _, file := range deps {
+		fmt.Fprintf(tw, "%s\t%s\t\n", file, fileModTime(file))
+	}
+	tw.Flush()
+
+	libs := make([]string, 0, len(t.libsMap))
+	for name := range t.libsMap {
+		libs = append(libs, name)
+	}
+	sort.Strings(libs)
+	fmt.Fprintf(tw, "\nLIBRARY\tFILE\t\n")
+	for _, name := range libs {
+		fmt.Fprintf(tw, "%s\t%s\t\n", name, t.libsMap[name])
+	}
+	tw.Flush()
+
+	components := make([]string, 0, len(t.components))
+	for name := range t.components {
+		components = append(components, name)
+	}
+	sort.Strings(components)
+	fmt.Fprintf(w, "\nCOMPONENTS\n")
+	for _, name := range components {
+		fmt.Fprintf(w, "%s (%d bytes)\n", name, len(t.components[name]))
+	}
+
+	_, err := fmt.Fprintf(w, "\nCOMPILED TEMPLATE (%d bytes)\n%s\n", len(t.compiled), t.compiled)
+	return err
+}
+
+func fileModTime(file string) string {
+	info, err := os.Stat(file)
+	if err != nil {
+		return "missing"
+	}
+	return info.ModTime().Format(time.DateTime)
+}
+
+// DebugHandler serves WriteDebug as plain text, only in dev mode since it exposes the sources
+func (t *JTemplate) DebugHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !t.dev {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		t.WriteDebug(w)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// WithDevMode enables development behavior, e.g. deprecation warnings sent to the client
+func WithDevMode(dev bool) TemplateOption {
+	return func(t *JTemplate) {
+		t.dev = dev
+	}
+}
+
+// DeprecateKey marks a data key (like "todoApp::newTodo") as deprecated. When a handler still sends it,
+// the message is added to "main::deprecations" in dev mode and logged once in production.
+// Should be called during setup, before serving requests.
+func (t *JTemplate) DeprecateKey(key, message string) {
+	if t.deprecatedKeys == nil {
+		t.deprecatedKeys = make(map[string]string)
+	}
+	t.deprecatedKeys[key] = message
+}
+
+// Deprecated wraps the handler of a deprecated action. Responses sent by the handler via JSON
+// get the message in "main::deprecations" in dev mode, in production it is logged once.
+func (t *JTemplate) Deprecated(message string, next http.HandlerFunc) http.HandlerFunc {
+	return wrapRoute(func(w http.ResponseWriter, r *http.Request) {
+		if !t.dev {
+			t.logDeprecation(r.Method + " " + r.URL.Path + ": " + message)
+			next(w, r)
+			return
+		}
+		next(&deprecationWriter{ResponseWriter: w, messages: []string{message}}, r)
+	}, next, "deprecated")
+}
+
+// deprecationWriter carries deprecation messages of the current action to JSON
+type deprecationWriter struct {
+	http.ResponseWriter
+	messages []string
+}
+
+func (w *deprecationWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// deprecations returns messages for deprecated keys present in data, sorted for stable output.
+// In production mode they are only logged and nil is returned.
+func (t *JTemplate) deprecations(data map[string]interface{}) []string {
+	var messages []string
+	for key, message := range t.deprecatedKeys {
+		if _, ok := data[key]; ok {
+			messages = append(messages, key+": "+message)
+		}
+	}
+	sort.Strings(messages)
+	if t.dev {
+		return messages
+	}
+	for _, message := range messages {
+		t.logDeprecation(message)
+	}
+	return nil
+}
+
+// loggedDeprecations keeps messages already written to the log to avoid flooding it
+var loggedDeprecations sync.Map
+
+func (t *JTemplate) logDeprecation(message string) {
+	if _, logged := loggedDeprecations.LoadOrStore(message, struct{}{}); !logged {
+		log.Printf("Deprecated: %s", message)
+	}
+}
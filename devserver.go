@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// runDev implements "jalpine dev": builds and runs the app in dev mode, rebuilding and
+// restarting it when Go sources change. Templates are reloaded by the app itself. The build
+// id is passed in JALPINE_BUILD and hashed into the template version, so opened pages notice
+// the restart like any other template change.
+func runDev(args []string) {
+	flags := flag.NewFlagSet("dev", flag.ExitOnError)
+	interval := flags.Duration("interval", 500*time.Millisecond, "how often to check Go sources")
+	flags.Parse(args)
+
+	binary := filepath.Join(os.TempDir(), fmt.Sprintf("jalpine-dev-%d", os.Getpid()))
+	defer os.Remove(binary)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	var app *devProcess
+	stamp := ""
+	for {
+		if current := goSourcesStamp("."); current != stamp {
+			stamp = current
+			log.Printf("Building...")
+			if output, err := exec.Command("go", "build", "-o", binary, ".").CombinedOutput(); err != nil {
+				log.Printf("Build failed, the previous version keeps running:\n%s", output)
+			} else {
+				app.stop()
+				app = startDevProcess(binary, stamp, flags.Args())
+			}
+		}
+		select {
+		case <-signals:
+			app.stop()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type devProcess struct {
+	cmd    *exec.Cmd
+	exited chan struct{}
+}
+
+func startDevProcess(binary, buildID string, args []string) *devProcess {
+	cmd := exec.Command(binary, args...)
+	cmd.Env = append(os.Environ(), "JALPINE_DEV=1", "JALPINE_BUILD="+buildID)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		log.Printf("Failed to start the app: %v", err)
+		return nil
+	}
+	p := &devProcess{cmd: cmd, exited: make(chan struct{})}
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			log.Printf("App exited: %v", err)
+		}
+		close(p.exited)
+	}()
+	return p
+}
+
+// stop interrupts the app and waits for it to release the port, killing it if it hangs
+func (p *devProcess) stop() {
+	if p == nil {
+		return
+	}
+	p.cmd.Process.Signal(os.Interrupt)
+	select {
+	case <-p.exited:
+	case <-time.After(5 * time.Second):
+		p.cmd.Process.Kill()
+		<-p.exited
+	}
+}
+
+// goSourcesStamp returns a hash of names, modification times and sizes of Go files and module files
+func goSourcesStamp(dir string) string {
+	var entries []string
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if path != dir && (strings.HasPrefix(d.Name(), ".") || d.Name() == "static") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ".go") && path != "go.mod" && path != "go.sum" {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			entries = append(entries, fmt.Sprintf("%s:%d:%d", path, info.ModTime().UnixNano(), info.Size()))
+		}
+		return nil
+	})
+	sort.Strings(entries)
+	sum := sha256.Sum256([]byte(strings.Join(entries, ";")))
+	return hex.EncodeToString(sum[:])[:16]
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DownloadConfig controls how EnsureStaticLibs talks to the CDN
+type DownloadConfig struct {
+	// Client sends the requests, e.g. with a proxy or custom TLS. nil is http.DefaultClient,
+	// which already takes the proxy from HTTPS_PROXY and HTTP_PROXY.
+	Client     *http.Client
+	Timeout    time.Duration // Of a single request including the body, 0 is no limit
+	Retries    int           // Attempts after the first failed one
+	Backoff    time.Duration // Delay before the first retry, doubled after each one
+	MaxBackoff time.Duration // 0 is no limit
+	// Mirrors replace URL prefixes of requests, e.g. "https://unpkg.com/" with an npm proxy of an
+	// internal registry. Entries and libs.lock.json keep the original URLs, so the same lockfile
+	// works with and without mirrors. The longest matching prefix wins.
+	Mirrors map[string]string
+	// Fallback has copies of libraries named like in the static dir ("alpinejs@3.14.8.js"),
+	// usually embedded into the binary. They are used when a library can't be downloaded,
+	// so the first start works without internet access.
+	Fallback fs.FS
+	// SourceMaps also downloads the source maps of libraries as "file.map", meant for
+	// development together with SourceMapHeaders. Failures are only logged.
+	SourceMaps bool
+	// Precompress writes a ".gz" variant of every library (and one per RegisterCompressor
+	// encoding, e.g. ".br"), served by StaticFiles
+	Precompress bool
+	// Minify is the path of an esbuild binary (see EnsureEsbuild) that minifies libraries
+	// downloaded as readable sources into "name@version.min.js", which pages then load. The
+	// original stays next to it for debugging.
+	Minify string
+}
+
+// LibDownloads is used by EnsureStaticLibs, change it before the call
+var LibDownloads = DownloadConfig{
+	Timeout:    30 * time.Second,
+	Retries:    3,
+	Backoff:    500 * time.Millisecond,
+	MaxBackoff: 10 * time.Second,
+}
+
+func (c DownloadConfig) client() *http.Client {
+	if c.Client != nil {
+		return c.Client
+	}
+	return http.DefaultClient
+}
+
+// mirror rewrites url according to Mirrors
+func (c DownloadConfig) mirror(url string) string {
+	best := ""
+	for prefix := range c.Mirrors {
+		if strings.HasPrefix(url, prefix) && len(prefix) > len(best) {
+			best = prefix
+		}
+	}
+	if best == "" {
+		return url
+	}
+	return c.Mirrors[best] + strings.TrimPrefix(url, best)
+}
+
+// ParseMirrors reads mirrors in "https://unpkg.com/=https://npm.example.com/unpkg/,..." form
+func ParseMirrors(spec string) (map[string]string, error) {
+	mirrors := make(map[string]string)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(entry, "=")
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid mirror %q, expected from=to", entry)
+		}
+		mirrors[from] = to
+	}
+	return mirrors, nil
+}
+
+// permanentError stops retries, e.g. the CDN answered 404
+type permanentError struct{ error }
+
+func (e permanentError) Unwrap() error { return e.error }
+
+// retry calls fn until it succeeds, fails permanently or the retries are exhausted.
+// Each attempt gets its own timeout.
+func (c DownloadConfig) retry(what string, fn func(ctx context.Context) error) error {
+	delay := c.Backoff
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		if c.Timeout > 0 {
+			ctx, cancel = context.WithTimeout(context.Background(), c.Timeout)
+		}
+		err := fn(ctx)
+		cancel()
+
+		if errors.As(err, new(permanentError)) {
+			return err
+		}
+		if err == nil || attempt >= c.Retries {
+			return err
+		}
+		log.Printf("%s failed: %v, retrying in %s", what, err, delay)
+		time.Sleep(delay)
+		delay *= 2
+		if c.MaxBackoff > 0 && delay > c.MaxBackoff {
+			delay = c.MaxBackoff
+		}
+	}
+}
+
+// checkStatus treats server errors and rate limiting as transient
+func checkStatus(resp *http.Response, expected ...int) error {
+	for _, code := range expected {
+		if resp.StatusCode == code {
+			return nil
+		}
+	}
+	err := fmt.Errorf("unexpected status: %s", resp.Status)
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		return err
+	}
+	return permanentError{err}
+}
+
+// downloadFile downloads the content from the specified URL and saves it to dest. The body is
+// written to a temporary file and only renamed to dest after checkDownload accepted it.
+func downloadFile(url, dest string, headers http.Header) error {
+	// Ensure the destination directory exists.
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	url = LibDownloads.mirror(url)
+	return LibDownloads.retry("Download of "+url, func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return permanentError{err}
+		}
+		setHeaders(req, headers)
+		resp, err := LibDownloads.client().Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if err := checkStatus(resp, http.StatusOK); err != nil {
+			return fmt.Errorf("failed to download file: %s (%w)", url, err)
+		}
+		tmp := dest + ".tmp"
+		out, err := os.Create(tmp)
+		if err != nil {
+			return permanentError{err}
+		}
+		defer os.Remove(tmp)
+		progress := &downloadProgress{name: filepath.Base(dest), total: resp.ContentLength, started: time.Now()}
+		progress.lastReport = progress.started
+		head := &headBuffer{}
+		_, err = io.Copy(io.MultiWriter(out, head), io.TeeReader(resp.Body, progress))
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		if err := checkDownload(dest, resp.Header.Get("Content-Type"), head.buf, progress.done, resp.ContentLength); err != nil {
+			return fmt.Errorf("%s: %w", url, err)
+		}
+		if err := os.Rename(tmp, dest); err != nil {
+			return permanentError{err}
+		}
+		fmt.Printf("Downloaded %s (%d KB in %s)\n", progress.name, progress.done/1024, time.Since(progress.started).Round(time.Millisecond))
+		return nil
+	})
+}
+
+// headBuffer keeps the first bytes written to it for checkDownload
+type headBuffer struct {
+	buf []byte
+}
+
+func (h *headBuffer) Write(p []byte) (int, error) {
+	if n := min(len(p), 512-len(h.buf)); n > 0 {
+		h.buf = append(h.buf, p[:n]...)
+	}
+	return len(p), nil
+}
+
+// checkDownload rejects bodies that can't be the file: empty or truncated ones (retried), and
+// HTML pages, e.g. of a captive portal or a proxy, where a script, stylesheet or source map is
+// expected (not retried).
+func checkDownload(dest, contentType string, head []byte, size, expected int64) error {
+	if size == 0 {
+		return errors.New("empty body")
+	}
+	if expected >= 0 && size != expected {
+		return fmt.Errorf("truncated body, %d of %d bytes", size, expected)
+	}
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	if mediaType == "text/html" {
+		return permanentError{fmt.Errorf("got an HTML page instead of %s", filepath.Base(dest))}
+	}
+	switch strings.ToLower(filepath.Ext(dest)) {
+	case ".js", ".css", ".map":
+		// None of them starts with a tag, error pages do
+		text := bytes.TrimLeft(bytes.TrimPrefix(head, []byte("\xef\xbb\xbf")), " \t\r\n")
+		if bytes.HasPrefix(text, []byte("<")) {
+			return permanentError{fmt.Errorf("got markup instead of %s", filepath.Base(dest))}
+		}
+	}
+	return nil
+}
+
+// headNoRedirect returns the redirect location of url, "" if there is none
+func headNoRedirect(url string, headers http.Header) (string, error) {
+	client := *LibDownloads.client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	url = LibDownloads.mirror(url)
+	var location string
+	err := LibDownloads.retry("HEAD "+url, func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+		if err != nil {
+			return permanentError{err}
+		}
+		setHeaders(req, headers)
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return fmt.Errorf("unexpected status: %s", resp.Status)
+		}
+		location = resp.Header.Get("Location")
+		return nil
+	})
+	return location, err
+}
+
+func setHeaders(req *http.Request, headers http.Header) {
+	for key, values := range headers {
+		req.Header[http.CanonicalHeaderKey(key)] = values
+	}
+}
+
+// downloadProgress prints the state of a long download once a second
+type downloadProgress struct {
+	name       string
+	total      int64 // -1 if unknown
+	done       int64
+	started    time.Time
+	lastReport time.Time
+}
+
+func (p *downloadProgress) Write(b []byte) (int, error) {
+	p.done += int64(len(b))
+	if now := time.Now(); now.Sub(p.lastReport) >= time.Second {
+		p.lastReport = now
+		if p.total > 0 {
+			fmt.Printf("Downloading %s: %d%% of %d KB\n", p.name, p.done*100/p.total, p.total/1024)
+		} else {
+			fmt.Printf("Downloading %s: %d KB\n", p.name, p.done/1024)
+		}
+	}
+	return len(b), nil
+}
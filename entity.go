@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+// Revision is embedded into entities changed with UpdateEntity. Rev counts the writes, pages
+// send back the revision they show, so a write based on stale data is rejected instead of
+// silently overwriting the change of another tab or user.
+type Revision struct {
+	Rev       int64     `json:"rev"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func (r *Revision) revision() *Revision {
+	return r
+}
+
+// ConflictError is returned by UpdateEntity for a write based on an outdated revision
+type ConflictError struct {
+	Key      string
+	Expected int64       // Revision the write was based on
+	Rev      int64       // Revision in the database
+	Current  interface{} // The entity as stored
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s is at revision %d, the write was based on %d", e.Key, e.Rev, e.Expected)
+}
+
+// UpdateEntity loads the JSON entity at key, applies fn and stores it with the next revision.
+// If the stored revision is not the expected one, usually sent by the page, nothing is
+// written and the error is a *ConflictError, see JTemplate.Conflict. Entities stored before
+// they had a revision are at 0.
+func UpdateEntity[T any, P interface {
+	*T
+	revision() *Revision
+}](tx *buntdb.Tx, clock Clock, key string, expected int64, fn func(entity P) error) (P, error) {
+	val, err := tx.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	entity := P(new(T))
+	if err := json.Unmarshal([]byte(val), entity); err != nil {
+		return nil, err
+	}
+	rev := entity.revision()
+	if rev.Rev != expected {
+		return nil, &ConflictError{Key: key, Expected: expected, Rev: rev.Rev, Current: entity}
+	}
+	if err := fn(entity); err != nil {
+		return nil, err
+	}
+	rev.Rev++
+	rev.UpdatedAt = clock.Now()
+	encoded, err := json.Marshal(entity)
+	if err != nil {
+		return nil, err
+	}
+	_, _, err = tx.Set(key, string(encoded), nil)
+	return entity, err
+}
+
+// Conflict answers a write rejected by UpdateEntity with 409. The message goes to the error
+// key of the component and the details to "component::conflict" ({key, rev, current}), which
+// helpers.js also dispatches as "jalpine:conflict". data is sent along, e.g. a patch showing
+// the stored entity.
+func (t *JTemplate) Conflict(w http.ResponseWriter, component string, conflict *ConflictError, data map[string]interface{}) error {
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	data[component+"::"+t.errorKey()] = "This was changed in the meantime, please check and try again"
+	data[component+"::conflict"] = map[string]interface{}{
+		"key":     conflict.Key,
+		"rev":     conflict.Rev,
+		"current": conflict.Current,
+	}
+	return t.jsonStatus(w, http.StatusConflict, data)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/go-playground/validator"
+)
+
+// Enum is a named closed set of string values shared between Go and Alpine. Registered enums
+// are validated with the `enum` tag (validate:"enum=TodoFilter") and sent to every page as
+// "main::enums" ({"TodoFilter": ["all", "active", "completed"]}), so select controls and
+// server validation use the same list.
+type Enum[T ~string] struct {
+	name   string
+	values []T
+}
+
+var enumRegistry = struct {
+	sync.RWMutex
+	values map[string][]string
+}{values: make(map[string][]string)}
+
+// NewEnum declares an enum and registers it by name, redeclaring a name replaces the values
+func NewEnum[T ~string](name string, values ...T) *Enum[T] {
+	strs := make([]string, len(values))
+	for i, v := range values {
+		strs[i] = string(v)
+	}
+	enumRegistry.Lock()
+	enumRegistry.values[name] = strs
+	enumRegistry.Unlock()
+	return &Enum[T]{name: name, values: values}
+}
+
+func (e *Enum[T]) Name() string {
+	return e.name
+}
+
+// Values returns allowed values in declaration order
+func (e *Enum[T]) Values() []T {
+	return slices.Clone(e.values)
+}
+
+func (e *Enum[T]) Valid(value T) bool {
+	return slices.Contains(e.values, value)
+}
+
+// Parse converts a string into a value of the enum or returns an error listing allowed values
+func (e *Enum[T]) Parse(s string) (T, error) {
+	if !e.Valid(T(s)) {
+		return "", fmt.Errorf("%s must be one of %v, got %q", e.name, e.values, s)
+	}
+	return T(s), nil
+}
+
+// MarshalJSON encodes the enum as the array of its values
+func (e *Enum[T]) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.values)
+}
+
+// registeredEnums returns values of all enums by name, nil if there are none
+func registeredEnums() map[string][]string {
+	enumRegistry.RLock()
+	defer enumRegistry.RUnlock()
+	if len(enumRegistry.values) == 0 {
+		return nil
+	}
+	enums := make(map[string][]string, len(enumRegistry.values))
+	for name, values := range enumRegistry.values {
+		enums[name] = values
+	}
+	return enums
+}
+
+// validateEnum implements the `enum=Name` validation tag, values of unknown enums are invalid
+func validateEnum(fl validator.FieldLevel) bool {
+	enumRegistry.RLock()
+	defer enumRegistry.RUnlock()
+	values, ok := enumRegistry.values[fl.Param()]
+	if !ok {
+		return false
+	}
+	return slices.Contains(values, fl.Field().String())
+}
+
+func init() {
+	validate.RegisterValidation("enum", validateEnum)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"maps"
+	"net/http"
+	"strings"
+)
+
+// ExecuteHTTP renders the page like Execute, but also sets an ETag built from the template
+// version and the hash of component data, and answers 304 Not Modified if the client
+// already has the same page (If-None-Match).
+func (t *JTemplate) ExecuteHTTP(w http.ResponseWriter, r *http.Request, data map[string]interface{}) error {
+	t.Update()
+	// Features of the client are part of the data and so of the tag
+	if t.hasClientGeo(w) {
+		data = maps.Clone(data)
+		if data == nil {
+			data = make(map[string]interface{})
+		}
+		t.addClientGeo(w, data)
+	}
+
+	compDataJSON, err := t.componentDataJSON(data)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(compDataJSON)
+	encoding := negotiateEncoding(r)
+	segment := cacheSegment(w)
+	etag := `"` + t.currentVersion() + "-" + hex.EncodeToString(sum[:8])
+	if segment != "" {
+		// Same data of different users must not validate each other's pages
+		etag += "-" + segment
+	}
+	if encoding != "" {
+		// Representations with different encodings must have different tags
+		etag += "-" + encoding
+	}
+	etag += `"`
+
+	// Force revalidation on every load, so updated data is never served from the browser cache
+	w.Header().Set("ETag", etag)
+	if segment != "" {
+		w.Header().Set("Cache-Control", "private, no-cache")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	addVary(w.Header(), "Accept-Encoding")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		// The cached page loads its data script again
+		t.externalData(compDataJSON)
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	body, err := t.cachedRender(compDataJSON, encoding, segment)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+	_, err = w.Write(body)
+	return err
+}
+
+// etagMatches checks the If-None-Match header value, which may be "*" or a list of (weak) tags
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Paths of helpers.js and of component data scripts, see WithExternalScripts
+const (
+	HelpersPath  = "/_jalpine/helpers.js"
+	PageDataPath = "/_jalpine/data/"
+)
+
+// ExternalScripts moves the integration code out of the page, so a Content-Security-Policy can
+// allow scripts by origin instead of per-page hashes, and browsers cache helpers.js across pages
+type ExternalScripts struct {
+	Data    bool          // Load component data from PageDataPath too, instead of a JSON block in the page. Ignored with SSR.
+	DataTTL time.Duration // How long data scripts stay available after the page is rendered, a minute by default
+}
+
+// WithExternalScripts links helpers.js as HelpersPath?v=hash instead of inlining it. Helper
+// options and component data become <script type="application/json"> blocks, which are not
+// executed. Register HelpersHandler and, for ExternalScripts.Data, PageDataHandler of any
+// template created with the option, they share the data.
+func WithExternalScripts(opts ExternalScripts) TemplateOption {
+	if opts.DataTTL <= 0 {
+		opts.DataTTL = time.Minute
+	}
+	store := &pageDataStore{entries: make(map[string]pageDataEntry)}
+	return func(t *JTemplate) {
+		t.external = &opts
+		t.pageData = store
+	}
+}
+
+// helpersVersion identifies the embedded helpers.js in its URL
+var helpersVersion = func() string {
+	sum := sha256.Sum256([]byte(helperJS))
+	return hex.EncodeToString(sum[:6])
+}()
+
+// HelpersHandler serves helpers.js, cached for good since its URL changes with the content
+func (t *JTemplate) HelpersHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+		if r.URL.Query().Get("v") == helpersVersion {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		w.Write([]byte(helperJS))
+	}
+}
+
+// PageDataHandler serves data scripts of rendered pages by the hash of the data. Hashes can't be
+// guessed without knowing the data, so the URL is as private as the page it is linked from.
+func (t *JTemplate) PageDataHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hash := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, PageDataPath), ".js")
+		var body []byte
+		if t.pageData != nil {
+			body = t.pageData.get(hash, t.clock.Now())
+		}
+		if body == nil {
+			http.Error(w, "Page data expired", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+		w.Header().Set("Cache-Control", "private, max-age=3600, immutable")
+		w.Write([]byte("window._componentData = "))
+		w.Write(body)
+		w.Write([]byte(";\n"))
+	}
+}
+
+// dataExternal reports whether component data is served by PageDataHandler
+func (t *JTemplate) dataExternal() bool {
+	return t.external != nil && t.external.Data && !t.ssr
+}
+
+// externalData stores the data for PageDataHandler and returns what goes into the page in its
+// place, the hash. Called for every rendered page and by ExecuteHTTP for pages revalidated
+// with 304, so data of pages in render caches and browser caches stays available.
+func (t *JTemplate) externalData(compDataJSON []byte) []byte {
+	if !t.dataExternal() {
+		return compDataJSON
+	}
+	sum := sha256.Sum256(compDataJSON)
+	hash := hex.EncodeToString(sum[:])
+	t.pageData.put(hash, compDataJSON, t.clock.Now(), t.external.DataTTL)
+	return []byte(hash)
+}
+
+// pageParts splits the page around the component data, which is the only part that depends
+// on the request (unless SSR is enabled). The integration block with data and js helpers goes
+// before the closing </body> tag, or at the end if there is none.
+func (t *JTemplate) pageParts(compiled string) (prefix, suffix string) {
+	if t.external == nil {
+		return pageParts(compiled, t.helperJSON)
+	}
+	before, after := compiled, ""
+	if idx := strings.Index(compiled, "</body>"); idx != -1 {
+		before, after = compiled[:idx], compiled[idx+len("</body>"):]
+	}
+
+	prefix = before + "\n"
+	if t.helperJSON != "" {
+		prefix += `<script type="application/json" id="jalpine-options">` + t.helperJSON + "</script>\n"
+	}
+	if t.dataExternal() {
+		prefix += `<script src="` + t.helperOptions.BasePath + PageDataPath
+		suffix = `.js"></script>` + "\n"
+	} else {
+		prefix += `<script type="application/json" id="jalpine-data">`
+		suffix = "</script>\n"
+	}
+	suffix += `<script src="` + t.helperOptions.BasePath + HelpersPath + "?v=" + helpersVersion + `"></script>` + "\n</body>" + after
+	return prefix, suffix
+}
+
+// maxPageData caps the stored data scripts, the ones closest to expiring make room for new pages
+const maxPageData = 10000
+
+type pageDataEntry struct {
+	body    []byte
+	expires time.Time
+}
+
+// pageDataStore keeps data of rendered pages until their scripts are loaded
+type pageDataStore struct {
+	mu      sync.Mutex
+	entries map[string]pageDataEntry
+	pruned  time.Time
+}
+
+func (s *pageDataStore) put(hash string, body []byte, now time.Time, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Expired entries are dropped at most once per second, not on every page
+	_, exists := s.entries[hash]
+	if now.Sub(s.pruned) > time.Second || !exists && len(s.entries) >= maxPageData {
+		s.pruned = now
+		for key, entry := range s.entries {
+			if now.After(entry.expires) {
+				delete(s.entries, key)
+			}
+		}
+	}
+	if !exists && len(s.entries) >= maxPageData {
+		s.evictOldest()
+	}
+	s.entries[hash] = pageDataEntry{body: body, expires: now.Add(ttl)}
+}
+
+func (s *pageDataStore) evictOldest() {
+	var oldest string
+	var expires time.Time
+	for key, entry := range s.entries {
+		if oldest == "" || entry.expires.Before(expires) {
+			oldest, expires = key, entry.expires
+		}
+	}
+	delete(s.entries, oldest)
+}
+
+func (s *pageDataStore) get(hash string, now time.Time) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[hash]
+	if !ok || now.After(entry.expires) {
+		return nil
+	}
+	return entry.body
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+)
+
+// fallbackLib takes the library from LibDownloads.Fallback when it can't be downloaded.
+// Locked libraries must match the hash of the lockfile, others are locked as found.
+func fallbackLib(staticDir string, plugin EnsureLibsEntry, lock LibsLock, cause error) (LockedLib, error) {
+	fallback := LibDownloads.Fallback
+	if fallback == nil {
+		return LockedLib{}, cause
+	}
+
+	pattern := plugin.Name + "@*" + plugin.ext()
+	if plugin.Version != "" {
+		pattern = plugin.Name + "@" + plugin.Version + plugin.ext()
+	}
+	locked, isLocked := lock.Libs[plugin.Name]
+	if isLocked && (plugin.Version == "" || plugin.Version == locked.Version) {
+		pattern = locked.File
+	} else {
+		isLocked = false
+	}
+	matches, err := fs.Glob(fallback, path.Clean(pattern))
+	if err != nil || len(matches) == 0 {
+		return LockedLib{}, cause
+	}
+	// Names differ in the version only, take the newest
+	file := slices.MaxFunc(matches, func(a, b string) int {
+		return compareVersions(libFileVersion(plugin.Name, a), libFileVersion(plugin.Name, b))
+	})
+
+	data, err := fs.ReadFile(fallback, file)
+	if err != nil {
+		return LockedLib{}, errors.Join(cause, err)
+	}
+	dest := filepath.Join(staticDir, file)
+	if err := os.WriteFile(dest, data, 0644); err != nil {
+		return LockedLib{}, errors.Join(cause, err)
+	}
+	log.Printf("Using the embedded copy of %s: %v", file, cause)
+
+	if !isLocked {
+		return lockLib(staticDir, plugin, file)
+	}
+	sum, err := fileSHA256(dest)
+	if err != nil {
+		return LockedLib{}, err
+	}
+	if sum != locked.SHA256 {
+		os.Remove(dest)
+		return LockedLib{}, fmt.Errorf("embedded %s does not match the hash in %s: %w", file, LockFileName, cause)
+	}
+	return locked, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// ExecuteFragment renders only the HTML of one included file (found by its BEGIN/END markers)
+// or of a component from the components directory instead of the whole page,
+// for progressive-enhancement or HTMX-style flows.
+// As with includes, ".html" is added to name without extension.
+// Data uses the same "component::key" convention as JSON and is applied to the components
+// by a small script right after the fragment is inserted into the page.
+func (t *JTemplate) ExecuteFragment(w io.Writer, name string, data map[string]interface{}) error {
+	t.Update()
+
+	fragment, err := t.fragment(name)
+	if err != nil {
+		return err
+	}
+
+	if len(data) > 0 {
+		namespaced := make(map[string]interface{}, len(data))
+		for k, v := range data {
+			if !strings.Contains(k, "::") {
+				k = "main::" + k
+			}
+			namespaced[k] = v
+		}
+		dataJSON, err := t.jsonOptions.encode(namespaced, 1)
+		if err != nil {
+			return err
+		}
+		// Give Alpine a chance to initialize components of the inserted fragment first
+		fragment += fmt.Sprintf("\n<script>setTimeout(() => applyComponentData(%s));</script>", dataJSON)
+	}
+
+	_, err = io.WriteString(w, fragment)
+	return err
+}
+
+// fragment returns the compiled content of the included file without the markers
+func (t *JTemplate) fragment(name string) (string, error) {
+	if filepath.Ext(name) == "" {
+		name += ".html"
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if fragment, ok := t.fragments[name]; ok {
+		return fragment, nil
+	}
+	if component, ok := t.components[name]; ok {
+		return component, nil
+	}
+	return "", fmt.Errorf("fragment %s not found in %s", name, t.mainFile)
+}
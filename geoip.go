@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// GeoInfo is the location of a client, empty fields are unknown
+type GeoInfo struct {
+	Country  string `json:"country,omitempty"`  // ISO 3166-1 code, e.g. "DE"
+	Region   string `json:"region,omitempty"`   // ISO 3166-2 subdivision code without the country, e.g. "BY"
+	City     string `json:"city,omitempty"`     // English name
+	TimeZone string `json:"timeZone,omitempty"` // IANA name, e.g. "Europe/Berlin"
+}
+
+// GeoResolver finds the location of an address, *MMDB is the usual one
+type GeoResolver interface {
+	LookupIP(ip net.IP) (interface{}, error)
+}
+
+// GeoOption configures GeoMiddleware
+type GeoOption func(*geoMiddleware)
+
+// WithTrustedProxy takes the client address from the last X-Forwarded-For entry. Only use it
+// behind a proxy that sets the header, otherwise clients can pick any location.
+func WithTrustedProxy() GeoOption {
+	return func(g *geoMiddleware) {
+		g.trustProxy = true
+	}
+}
+
+// WithClientGeo sends the location to the page as "main::geo" in Execute and JSON responses
+func WithClientGeo() GeoOption {
+	return func(g *geoMiddleware) {
+		g.exposeToClient = true
+	}
+}
+
+type geoMiddleware struct {
+	resolver       GeoResolver
+	trustProxy     bool
+	exposeToClient bool
+}
+
+type geoContextKey struct{}
+
+// GeoMiddleware looks up the client location and attaches it to the request context, where
+// handlers get it with GeoFromContext for analytics, rate limits or locale defaults
+func GeoMiddleware(resolver GeoResolver, opts ...GeoOption) func(http.Handler) http.Handler {
+	g := &geoMiddleware{resolver: resolver}
+	for _, opt := range opts {
+		opt(g)
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			geo, ok := g.lookup(r)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), geoContextKey{}, geo))
+			next.ServeHTTP(&geoWriter{ResponseWriter: w, geo: geo, expose: g.exposeToClient}, r)
+		})
+	}
+}
+
+// GeoFromContext returns the location found by GeoMiddleware
+func GeoFromContext(ctx context.Context) (GeoInfo, bool) {
+	geo, ok := ctx.Value(geoContextKey{}).(GeoInfo)
+	return geo, ok
+}
+
+func (g *geoMiddleware) lookup(r *http.Request) (GeoInfo, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if forwarded := r.Header.Get("X-Forwarded-For"); g.trustProxy && forwarded != "" {
+		entries := strings.Split(forwarded, ",")
+		host = strings.TrimSpace(entries[len(entries)-1])
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() {
+		return GeoInfo{}, false
+	}
+	record, err := g.resolver.LookupIP(ip)
+	if err != nil {
+		log.Printf("GeoIP lookup of %s failed: %v", ip, err)
+		return GeoInfo{}, false
+	}
+	geo := geoFromRecord(record)
+	return geo, geo != GeoInfo{}
+}
+
+// geoFromRecord reads the fields of GeoLite2/GeoIP2 Country and City databases
+func geoFromRecord(record interface{}) GeoInfo {
+	get := func(v interface{}, path ...interface{}) string {
+		for _, step := range path {
+			switch key := step.(type) {
+			case string:
+				m, _ := v.(map[string]interface{})
+				v = m[key]
+			case int:
+				a, _ := v.([]interface{})
+				if key >= len(a) {
+					return ""
+				}
+				v = a[key]
+			}
+		}
+		s, _ := v.(string)
+		return s
+	}
+	return GeoInfo{
+		Country:  firstNonEmpty(get(record, "country", "iso_code"), get(record, "registered_country", "iso_code")),
+		Region:   get(record, "subdivisions", 0, "iso_code"),
+		City:     get(record, "city", "names", "en"),
+		TimeZone: get(record, "location", "time_zone"),
+	}
+}
+
+// geoWriter carries the location of the client to Execute and JSON
+type geoWriter struct {
+	http.ResponseWriter
+	geo    GeoInfo
+	expose bool // See WithClientGeo
+}
+
+func (w *geoWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// findGeoWriter finds a geoWriter among the wrappers of w
+func findGeoWriter(w io.Writer) *geoWriter {
+	for {
+		switch cur := w.(type) {
+		case *geoWriter:
+			return cur
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = cur.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+// hasClientGeo tells whether addClientGeo would add anything for w
+func (t *JTemplate) hasClientGeo(w io.Writer) bool {
+	return t.regionGates != nil || findGeoWriter(w) != nil
+}
+
+// addClientGeo adds "main::geo" and "main::features" of the client behind w to data
+func (t *JTemplate) addClientGeo(w io.Writer, data map[string]interface{}) {
+	var geo GeoInfo
+	gw := findGeoWriter(w)
+	if gw != nil {
+		geo = gw.geo
+		if gw.expose {
+			data["main::geo"] = geo
+		}
+	}
+	if t.regionGates != nil {
+		data["main::features"] = t.regionGates.Evaluate(geo, gw != nil)
+	}
+}
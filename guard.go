@@ -0,0 +1,58 @@
+package main
+
+import (
+	"slices"
+	"sync"
+)
+
+// ActionGuard is client-side behavior required before a request to an action is sent
+type ActionGuard struct {
+	Confirm string `json:"confirm,omitempty"` // Message of a confirmation dialog
+}
+
+// navigationGuards are sent to pages as "main::guards" and enforced by helpers.js
+type navigationGuards struct {
+	mu      sync.RWMutex
+	actions map[string]ActionGuard // "METHOD /path" => guard
+	unsaved map[string][]string    // Component => keys checked for unsaved changes
+}
+
+// GuardAction makes helpers.js apply the guard to every request to the action, e.g. ask for
+// confirmation before a destructive request, without each component repeating it.
+// The path must match the URL used by the client exactly, query strings are ignored.
+func (t *JTemplate) GuardAction(method, path string, guard ActionGuard) {
+	t.guards.mu.Lock()
+	defer t.guards.mu.Unlock()
+	if t.guards.actions == nil {
+		t.guards.actions = make(map[string]ActionGuard)
+	}
+	t.guards.actions[method+" "+path] = guard
+}
+
+// GuardUnsaved makes helpers.js warn before leaving the page while any of the component keys
+// differ from the value last received from the server, e.g. a half-typed form
+func (t *JTemplate) GuardUnsaved(component string, keys ...string) {
+	t.guards.mu.Lock()
+	defer t.guards.mu.Unlock()
+	if t.guards.unsaved == nil {
+		t.guards.unsaved = make(map[string][]string)
+	}
+	for _, key := range keys {
+		if !slices.Contains(t.guards.unsaved[component], key) {
+			t.guards.unsaved[component] = append(t.guards.unsaved[component], key)
+		}
+	}
+}
+
+// guardsData returns the guards in the form expected by helpers.js, nil if there are none
+func (t *JTemplate) guardsData() map[string]interface{} {
+	t.guards.mu.RLock()
+	defer t.guards.mu.RUnlock()
+	if len(t.guards.actions) == 0 && len(t.guards.unsaved) == 0 {
+		return nil
+	}
+	return map[string]interface{}{
+		"actions": t.guards.actions,
+		"unsaved": t.guards.unsaved,
+	}
+}
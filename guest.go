@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+// GuestCookie holds the id of an anonymous visitor, see GuestID
+const GuestCookie = "jalpine_guest"
+
+var guestIDRe = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// GuestID returns the guest session of the visitor, issuing a new cookie on the first visit.
+// Guests keep their data under GuestOwner keys until ClaimGuest moves it to an account.
+func GuestID(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(GuestCookie); err == nil && guestIDRe.MatchString(cookie.Value) {
+		return cookie.Value
+	}
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	id := hex.EncodeToString(buf)
+	http.SetCookie(w, &http.Cookie{
+		Name:     GuestCookie,
+		Value:    id,
+		Path:     "/",
+		Expires:  time.Now().AddDate(1, 0, 0),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	// Later reads in the same request see the new id
+	r.AddCookie(&http.Cookie{Name: GuestCookie, Value: id})
+	return id
+}
+
+// ForgetGuest removes the guest cookie, e.g. after ClaimGuest
+func ForgetGuest(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: GuestCookie, Value: "", Path: "/", MaxAge: -1})
+}
+
+// GuestOwner and UserOwner are key prefixes of records owned by a guest or a user account,
+// records are stored as OwnerKey(owner, "todo:42")
+func GuestOwner(guestID string) string { return "guest:" + guestID }
+func UserOwner(userID string) string   { return "user:" + userID }
+
+// OwnerKey returns the database key of the owner's record
+func OwnerKey(owner, key string) string {
+	return owner + ":" + key
+}
+
+// ClaimGuest re-keys all records of the guest to the user in a single transaction, so either
+// all of them move or none. Records the user already has with the same key are an error.
+// Returns the number of moved records.
+func ClaimGuest(db *buntdb.DB, guestID, userID string) (int, error) {
+	if !guestIDRe.MatchString(guestID) {
+		return 0, fmt.Errorf("invalid guest id")
+	}
+	if userID == "" || strings.ContainsAny(userID, "*?") {
+		return 0, fmt.Errorf("invalid user id %q", userID)
+	}
+	from, to := OwnerKey(GuestOwner(guestID), ""), OwnerKey(UserOwner(userID), "")
+
+	moved := 0
+	err := db.Update(func(tx *buntdb.Tx) error {
+		records := make(map[string]string)
+		err := tx.AscendKeys(from+"*", func(key, value string) bool {
+			records[key] = value
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		for key, value := range records {
+			target := to + strings.TrimPrefix(key, from)
+			if _, err := tx.Get(target); err == nil {
+				return fmt.Errorf("%s already exists", target)
+			}
+			// Keep the expiration of records that have one
+			var opts *buntdb.SetOptions
+			if ttl, err := tx.TTL(key); err == nil && ttl > 0 {
+				opts = &buntdb.SetOptions{Expires: true, TTL: ttl}
+			}
+			if _, _, err := tx.Set(target, value, opts); err != nil {
+				return err
+			}
+			if _, err := tx.Delete(key); err != nil {
+				return err
+			}
+			moved++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return moved, nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Probe endpoints for orchestrators like Kubernetes (httpGet probes).
+// They are served by Startup from the very first moment, while the app is still initializing.
+// There is no gRPC health service, it would pull in the whole grpc module for a single endpoint.
+const (
+	LivenessPath  = "/_jalpine/live"    // The process is up
+	ReadinessPath = "/_jalpine/ready"   // Initialization finished, traffic may be routed
+	StartupPath   = "/_jalpine/startup" // Progress of initialization steps, 200 once all are done
+	HealthPath    = "/_jalpine/health"  // Checks added with Startup.Check, 503 if any of them fails
+)
+
+// Startup tracks initialization steps (downloads of static libs, template compilation,
+// migrations, ...) and serves probes until the app handler is ready
+type Startup struct {
+	mu      sync.RWMutex
+	steps   []*StartupStep
+	started time.Time
+	handler http.Handler
+	checks  []startupCheck
+
+	startupHooks  []startupHook
+	shutdownHooks []func(ctx context.Context) error
+}
+
+type startupHook struct {
+	name string
+	fn   func() error
+}
+
+type startupCheck struct {
+	name string
+	fn   func() error
+}
+
+// StartupStep is the state of a single initialization step
+type StartupStep struct {
+	Name     string        `json:"name"`
+	Status   string        `json:"status"` // pending, running, done or failed
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"durationNs,omitempty"`
+}
+
+// NewStartup declares initialization steps in the order they run
+func NewStartup(steps ...string) *Startup {
+	s := &Startup{started: time.Now()}
+	for _, name := range steps {
+		s.steps = append(s.steps, &StartupStep{Name: name, Status: "pending"})
+	}
+	return s
+}
+
+// Run executes fn as the named step recording its status
+func (s *Startup) Run(name string, fn func() error) error {
+	step := s.step(name)
+	s.mu.Lock()
+	step.Status = "running"
+	s.mu.Unlock()
+
+	begin := time.Now()
+	err := fn()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	step.Duration = time.Since(begin)
+	step.Status = "done"
+	if err != nil {
+		step.Status = "failed"
+		step.Error = err.Error()
+	}
+	return err
+}
+
+// step finds a declared step or adds an undeclared one
+func (s *Startup) step(name string) *StartupStep {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, step := range s.steps {
+		if step.Name == name {
+			return step
+		}
+	}
+	step := &StartupStep{Name: name, Status: "pending"}
+	s.steps = append(s.steps, step)
+	return step
+}
+
+// Check adds a runtime check of the running app to HealthPath, e.g. LibGuard.Err. Failing
+// checks don't affect readiness: the app still serves, but something needs attention.
+func (s *Startup) Check(name string, fn func() error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checks = append(s.checks, startupCheck{name, fn})
+}
+
+// OnStartup registers fn to run as a step of the name when Ready is called, before the app takes
+// traffic, e.g. to warm caches
+func (s *Startup) OnStartup(name string, fn func() error) {
+	s.step(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.startupHooks = append(s.startupHooks, startupHook{name, fn})
+}
+
+// OnShutdown registers fn to run by Shutdown, e.g. to flush buffers. Hooks run in reverse order
+// of registration, like defers.
+func (s *Startup) OnShutdown(fn func(ctx context.Context) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shutdownHooks = append(s.shutdownHooks, fn)
+}
+
+// Ready runs the startup hooks and switches all non-probe requests to the app handler, then
+// tells systemd the service is ready (see SDNotify). If a hook fails the app stays unready and
+// the error is returned.
+func (s *Startup) Ready(handler http.Handler) error {
+	s.mu.RLock()
+	hooks := s.startupHooks
+	s.mu.RUnlock()
+	for _, hook := range hooks {
+		if err := s.Run(hook.name, hook.fn); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	s.handler = handler
+	s.mu.Unlock()
+	if err := SDNotify("READY=1"); err != nil {
+		log.Printf("Failed to notify systemd: %v", err)
+	}
+	return nil
+}
+
+// Shutdown runs all shutdown hooks, after the server stopped taking requests
+func (s *Startup) Shutdown(ctx context.Context) error {
+	SDNotify("STOPPING=1")
+	s.mu.RLock()
+	hooks := s.shutdownHooks
+	s.mu.RUnlock()
+	var errs []error
+	for i := len(hooks) - 1; i >= 0; i-- {
+		errs = append(errs, hooks[i](ctx))
+	}
+	return errors.Join(errs...)
+}
+
+// ServeHTTP answers probes and passes other requests to the app handler, or 503 until it is ready
+func (s *Startup) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	handler := s.handler
+	s.mu.RUnlock()
+
+	switch r.URL.Path {
+	case LivenessPath:
+		w.Write([]byte("ok"))
+	case ReadinessPath:
+		if handler == nil {
+			http.Error(w, "starting", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	case StartupPath:
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		status := http.StatusOK
+		if handler == nil {
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		writeJSON(w, map[string]interface{}{
+			"ready":  handler != nil,
+			"uptime": time.Since(s.started).String(),
+			"steps":  s.steps,
+		})
+	case HealthPath:
+		s.mu.RLock()
+		checks := s.checks
+		s.mu.RUnlock()
+		status := http.StatusOK
+		results := make(map[string]string, len(checks))
+		for _, check := range checks {
+			results[check.name] = "ok"
+			if err := check.fn(); err != nil {
+				results[check.name] = err.Error()
+				status = http.StatusServiceUnavailable
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		writeJSON(w, results)
+	default:
+		if handler == nil {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Service is starting", http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+)
+
+// VersionPath reports the current template version to pages polling for updates, see HelperOptions.PollSeconds
+const VersionPath = "/_jalpine/version"
+
+// What helpers.js does when a response reports a newer availVersion than the page was rendered with
+const (
+	NewVersionNone       = "none"        // Nothing, the page shows its own notice based on availVersion (default)
+	NewVersionBanner     = "banner"      // Show a built-in banner with ReloadPrompt and a reload button
+	NewVersionConfirm    = "confirm"     // Ask with ReloadPrompt and reload if the user agrees
+	NewVersionReload     = "reload"      // Reload the page right away
+	NewVersionReloadIdle = "reload-idle" // Show the banner and reload once the user is idle for IdleSeconds
+)
+
+// HelperOptions tune the embedded helpers.js without editing it, see WithHelperOptions.
+// Zero values keep the default behavior.
+type HelperOptions struct {
+	OnNewVersion string `json:"onNewVersion,omitempty"` // One of NewVersion* constants
+	ReloadPrompt string `json:"reloadPrompt,omitempty"` // Message of the banner and NewVersionConfirm
+	IdleSeconds  int    `json:"idleSeconds,omitempty"`  // Without input before NewVersionReloadIdle reloads, 60 by default
+	PollSeconds  int    `json:"pollSeconds,omitempty"`  // Check VersionPath periodically, pages without requests never learn otherwise
+
+	BasePath    string            `json:"basePath,omitempty"`    // Prefix of URLs starting with "/" passed to $get, $post...
+	Headers     map[string]string `json:"headers,omitempty"`     // Extra headers of every request
+	Credentials string            `json:"credentials,omitempty"` // fetch credentials mode, e.g. "include"
+
+	ErrorKey       string `json:"errorKey,omitempty"`       // Component key receiving failed request messages, "error" by default
+	SwallowErrors  bool   `json:"swallowErrors,omitempty"`  // Failed requests resolve to null instead of rejecting
+	NoErrorReports bool   `json:"noErrorReports,omitempty"` // Don't send client-side errors to ClientLogPath
+
+	Transport   string `json:"transport,omitempty"`   // Of x-subscribe updates: "sse", "poll", "ws" (actions too) or "auto" (default), trying events first
+	LiveReload  bool   `json:"liveReload,omitempty"`  // Reload on template changes, always on in dev mode, see LiveReloadHandler
+	UserUpdates bool   `json:"userUpdates,omitempty"` // Stay connected for BroadcastJSON without topics, set by WithBroadcastHub
+}
+
+// WithHelperOptions serializes the options into the integration script of every page
+func WithHelperOptions(options HelperOptions) TemplateOption {
+	return func(t *JTemplate) {
+		t.helperOptions = options
+	}
+}
+
+// encode serializes the options for pageParts, empty if helpers.js defaults are enough
+func (o HelperOptions) encode(dev bool) string {
+	o.LiveReload = o.LiveReload || dev
+	encoded, err := json.Marshal(o)
+	if err != nil {
+		panic(err)
+	}
+	if string(encoded) == "{}" {
+		return ""
+	}
+	return string(encoded)
+}
+
+// VersionHandler answers polls of helpers.js with the current availVersion and data versions,
+// should be registered at VersionPath. Pages restored from the back/forward cache ask it what
+// changed too. The answer is revalidated by an ETag, so unchanged versions cost a 304.
+func (t *JTemplate) VersionHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t.Update()
+		etag := `"` + t.currentVersion()
+		if t.dataVersions != nil {
+			versions, _ := CanonicalJSON(t.dataVersions.snapshot())
+			sum := sha256.Sum256(versions)
+			etag += "-" + hex.EncodeToString(sum[:8])
+		}
+		etag += `"`
+		w.Header().Set("Cache-Control", "private, no-cache")
+		w.Header().Set("ETag", etag)
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		t.JSON(w, map[string]interface{}{})
+	}
+}
@@ -1,3 +1,79 @@
+// Pages with external helpers carry options and data in JSON blocks, see WithExternalScripts
+(function () {
+    const options = document.getElementById('jalpine-options');
+    if (options) window._jalpineOptions = JSON.parse(options.textContent);
+    const data = document.getElementById('jalpine-data');
+    if (data) window._componentData = JSON.parse(data.textContent);
+})();
+
+// Version of the client-server protocol, sent with every request.
+// The server forces a reload of pages speaking a different version.
+const jalpineProtocol = 1;
+
+// Behavior configured from Go, see HelperOptions
+const jalpineOptions = Object.assign({
+    onNewVersion: 'none',
+    reloadPrompt: 'A new version of this page is available. Reload now?',
+    idleSeconds: 60,
+    pollSeconds: 0,
+    basePath: '',
+    headers: {},
+    credentials: 'same-origin',
+    errorKey: 'error',
+    transport: 'auto',
+}, window._jalpineOptions);
+
+// Endpoint receiving client-side errors, see ClientLogHandler
+const jalpineLogURL = jalpineOptions.basePath + '/_jalpine/log';
+
+// Endpoint streaming updates for x-subscribe topics, see Hub.ServeSSE
+const jalpineEventsURL = jalpineOptions.basePath + '/_jalpine/events';
+
+// Long polling alternative to the event stream, see Hub.ServePoll
+const jalpinePollURL = jalpineOptions.basePath + '/_jalpine/poll';
+
+// WebSocket carrying x-subscribe updates and actions, see Hub.ServeWS
+const jalpineWSURL = jalpineOptions.basePath + '/_jalpine/ws';
+
+// Endpoint of named actions, see ActionDispatcher. Relative to basePath like URLs of $post.
+const jalpineActionsURL = '/_jalpine/actions';
+
+// Endpoint reporting the current version, see JTemplate.VersionHandler
+const jalpineVersionURL = jalpineOptions.basePath + '/_jalpine/version';
+
+// Version of the template this page was rendered from
+const jalpinePageVersion = ((window._componentData || {}).main || {}).currentVersion;
+
+// One-time tokens for sensitive actions by name, empty until fetched, see JTemplate.RequireNonce
+const jalpineNonces = Object.assign({}, ((window._componentData || {}).main || {}).nonces);
+
+// Endpoint issuing tokens for jalpineNonces, see JTemplate.NonceHandler
+const jalpineNonceURL = jalpineOptions.basePath + '/_jalpine/nonce';
+
+// Confirmations of actions and keys checked for unsaved changes, see JTemplate.GuardAction
+const jalpineGuards = Object.assign({ actions: {}, unsaved: {} }, ((window._componentData || {}).main || {}).guards);
+
+
+// Components split across several <script x-data> blocks are registered together on init
+const jalpineParts = {};
+function jalpineExtend(name, part) {
+    (jalpineParts[name] = jalpineParts[name] || []).push(part);
+}
+
+document.addEventListener('alpine:init', () => {
+    Object.entries(jalpineParts).forEach(([name, parts]) => {
+        Alpine.data(name, (...args) => parts.reduce((data, part) => {
+            // Descriptors keep getters working, unlike Object.assign
+            const descriptors = Object.getOwnPropertyDescriptors(part(...args));
+            Object.keys(descriptors).filter(key => key in data).forEach(key => {
+                console.warn(`Component ${name} defines ${key} in several scripts, the last one wins`);
+            });
+            return Object.defineProperties(data, descriptors);
+        }, {}));
+    });
+});
+
+
 // When Alpine components have been initialized, merge our data
 document.addEventListener('alpine:initialized', () => {
     document.querySelectorAll('[x-data]').forEach(el => {
@@ -5,81 +81,759 @@ document.addEventListener('alpine:initialized', () => {
         const compData = window._componentData[componentName];
         if (!compData) return;
         Object.assign(Alpine.$data(el), compData);
+        markSaved(componentName, compData);
         delete window._componentData[componentName];
+        warnDeprecations(compData.deprecations);
     });
 
     // Check for any leftover component data and output error if present
     if (Object.keys(window._componentData).length > 0) {
         console.error("Unused _componentData found:", window._componentData);
+        Object.entries(window._componentData).forEach(([component, data]) => {
+            reportClientError({ message: 'Unused component data', component, key: Object.keys(data).join(',') });
+        });
+    }
+});
+
+
+// Send client-side problems to the server, limited per page to avoid floods
+let jalpineReportsLeft = 20;
+function reportClientError(report) {
+    if (jalpineOptions.noErrorReports || jalpineReportsLeft-- <= 0) return;
+    fetch(jalpineLogURL, {
+        method: 'POST',
+        keepalive: true,
+        headers: {
+            'Content-Type': 'application/json',
+            'X-JAlpine-Protocol': jalpineProtocol,
+        },
+        body: JSON.stringify(Object.assign({ version: jalpinePageVersion, url: window.location.href }, report)),
+    }).catch(() => {});
+}
+
+window.addEventListener('error', event => {
+    reportClientError({
+        message: event.message,
+        source: event.filename,
+        line: event.lineno,
+        column: event.colno,
+        stack: event.error && event.error.stack,
+    });
+});
+
+window.addEventListener('unhandledrejection', event => {
+    const reason = event.reason || {};
+    reportClientError({ message: String(reason.message || reason), stack: reason.stack });
+});
+
+// CDN libraries replaced by their local copies, queued by jalpineAssetFallback in <head>.
+// Deferred libraries fail after this script runs, so later failures are reported directly.
+function reportAssetFallback(failure) {
+    console.warn('Failed to load', failure.source, 'using', failure.local);
+    reportClientError({ message: 'CDN asset failed to load, using the local copy', source: failure.source, key: failure.local });
+}
+if (window._jalpineAssetFailures) {
+    window._jalpineAssetFailures.forEach(reportAssetFallback);
+    window._jalpineAssetFailures = { push: reportAssetFallback };
+}
+
+
+// Deprecation messages are only sent by the server in dev mode
+function warnDeprecations(deprecations) {
+    (deprecations || []).forEach(message => console.warn('Deprecated:', message));
+}
+
+
+// React to a newer version of the page according to jalpineOptions.onNewVersion, only once
+let jalpineVersionHandled = false;
+function checkAvailVersion(version) {
+    if (!version || version === jalpinePageVersion || jalpineVersionHandled) return;
+    jalpineVersionHandled = true;
+    switch (jalpineOptions.onNewVersion) {
+        case 'reload':
+            window.location.reload();
+            break;
+        case 'confirm':
+            if (window.confirm(jalpineOptions.reloadPrompt)) window.location.reload();
+            break;
+        case 'banner':
+            showVersionBanner();
+            break;
+        case 'reload-idle':
+            showVersionBanner();
+            reloadWhenIdle();
+            break;
+    }
+}
+
+function showVersionBanner() {
+    const banner = document.createElement('div');
+    banner.setAttribute('role', 'alert');
+    banner.style.cssText = 'position:fixed;left:50%;bottom:1rem;transform:translateX(-50%);z-index:2147483647;' +
+        'display:flex;gap:1rem;align-items:center;padding:.75rem 1rem;border-radius:.5rem;' +
+        'background:#fefce8;border:1px solid #facc15;color:#854d0e;font:14px sans-serif;box-shadow:0 2px 8px rgba(0,0,0,.15)';
+    banner.textContent = jalpineOptions.reloadPrompt;
+    const button = document.createElement('button');
+    button.textContent = 'Reload';
+    button.style.cssText = 'padding:.25rem .75rem;border:0;border-radius:.25rem;background:#eab308;color:#fff;font-weight:bold;cursor:pointer';
+    button.addEventListener('click', () => window.location.reload());
+    banner.appendChild(button);
+    document.body.appendChild(banner);
+}
+
+// Time of the last user input, pages are reloaded automatically only when nobody is using them
+let jalpineLastActivity = Date.now();
+['pointerdown', 'pointermove', 'keydown', 'scroll', 'touchstart'].forEach(type => {
+    window.addEventListener(type, () => { jalpineLastActivity = Date.now(); }, { passive: true, capture: true });
+});
+
+function reloadWhenIdle() {
+    setInterval(() => {
+        if (Date.now() - jalpineLastActivity >= jalpineOptions.idleSeconds * 1000 && !hasUnsavedChanges()) {
+            window.location.reload();
+        }
+    }, 1000);
+}
+
+// Dev mode: reload as soon as a template changes, see TemplateSet.LiveReloadHandler
+if (jalpineOptions.liveReload && jalpinePageVersion) {
+    const source = new EventSource(jalpineOptions.basePath + '/_jalpine/reload?version=' + encodeURIComponent(jalpinePageVersion));
+    source.addEventListener('reload', () => {
+        source.close();
+        window.location.reload();
+    });
+}
+
+// Pages that make no requests learn about new versions by polling
+if (jalpineOptions.pollSeconds > 0) {
+    setInterval(() => {
+        if (jalpineVersionHandled) return;
+        fetch(jalpineVersionURL, { credentials: jalpineOptions.credentials, headers: { 'X-JAlpine-Protocol': jalpineProtocol } })
+            .then(response => response.json())
+            .then(applyComponentData)
+            .catch(() => {});
+    }, jalpineOptions.pollSeconds * 1000);
+}
+
+
+// Versions of component data the page has, see WithDataVersions
+let jalpineDataVersions = ((window._componentData || {}).main || {}).dataVersions || {};
+
+// Tell components that the server has newer data than they show. Answers carrying data of
+// the component, e.g. to the action that made the change, refresh it already.
+function checkDataVersions(data) {
+    const versions = data['main::dataVersions'];
+    if (!versions) return;
+    const stale = Object.keys(versions).filter(prefix => versions[prefix] !== jalpineDataVersions[prefix]
+        && !Object.keys(data).some(key => key.startsWith(prefix + '::')));
+    jalpineDataVersions = versions;
+    if (stale.length > 0) {
+        window.dispatchEvent(new CustomEvent('jalpine:stale-data', { detail: { prefixes: stale } }));
     }
+}
+
+// Opens an event stream of component data, EventSource reconnects by itself until the server
+// sends "done"
+function jalpineStream(url) {
+    const source = new EventSource(url.startsWith('/') ? jalpineOptions.basePath + url : url,
+        { withCredentials: jalpineOptions.credentials === 'include' });
+    source.onmessage = event => applyComponentData(JSON.parse(event.data));
+    source.addEventListener('done', () => source.close());
+    return () => source.close();
+}
+
+// Loaders of x-loader by component, run by jalpineRunLoader once Alpine started
+const jalpineLoaders = {};
+let jalpineRunLoader = () => {};
+
+window.addEventListener('jalpine:stale-data', event => {
+    event.detail.prefixes.forEach(prefix => (jalpineLoaders[prefix] || []).forEach(jalpineRunLoader));
+});
+
+// A page restored from the back/forward cache shows the data it had when the user left. The
+// version check reports newer data through jalpine:stale-data; without data versions on the
+// server all loaders run. "jalpine:restored" lets pages do more.
+window.addEventListener('pageshow', event => {
+    if (!event.persisted) return;
+    window.dispatchEvent(new CustomEvent('jalpine:restored'));
+    fetch(jalpineVersionURL, { cache: 'no-cache', credentials: jalpineOptions.credentials, headers: { 'X-JAlpine-Protocol': jalpineProtocol } })
+        .then(response => response.json())
+        .then(data => {
+            applyComponentData(data);
+            if (!data['main::dataVersions']) {
+                Object.values(jalpineLoaders).flat().forEach(jalpineRunLoader);
+            }
+        })
+        .catch(() => {});
+});
+
+// Data versions of the lists by "component::field", versioned patches apply to the one they
+// were made from. Lists of the page are at the versions it was rendered with.
+const jalpineListVersions = {};
+const jalpinePageDataVersions = Object.assign({}, jalpineDataVersions);
+
+// Compares "epoch.count" versions of DataVersions, true if a includes b
+function versionIncludes(a, b) {
+    const [epochA, countA] = [a.slice(0, a.lastIndexOf('.')), Number(a.slice(a.lastIndexOf('.') + 1))];
+    const [epochB, countB] = [b.slice(0, b.lastIndexOf('.')), Number(b.slice(b.lastIndexOf('.') + 1))];
+    return epochA === epochB && countA >= countB;
+}
+
+// Sets a key of a component, patching its list in place for a ListPatch of the server.
+// versions are the data versions sent along, "main::dataVersions".
+function assignData(el, scope, field, value, versions) {
+    const root = el.closest('[x-data]');
+    const component = root ? root.getAttribute('x-data') : 'main';
+    const listKey = component + '::' + field;
+    if (!(value && typeof value === 'object' && value.$patch === 'list')) {
+        scope[field] = value;
+        if (versions && versions[component]) {
+            jalpineListVersions[listKey] = versions[component];
+        }
+        return;
+    }
+    const runLoaders = () => (jalpineLoaders[component] || []).forEach(jalpineRunLoader);
+    if (!Array.isArray(scope[field])) {
+        // Nothing to patch yet, the loaders of the component fetch the whole list
+        runLoaders();
+        return;
+    }
+    if (value.version) {
+        const known = jalpineListVersions[listKey] || jalpinePageDataVersions[component];
+        if (known && versionIncludes(known, value.version)) {
+            // Already applied, e.g. the broadcast of a change this page made
+            return;
+        }
+        if (known && known !== value.base) {
+            // A patch in between got lost, the whole list is fetched instead
+            runLoaders();
+            return;
+        }
+        jalpineListVersions[listKey] = value.version;
+    }
+    const list = scope[field];
+    const key = value.key;
+    const indexOf = id => list.findIndex(item => item && item[key] === id);
+    (value.ops || []).forEach(op => {
+        (op.remove || []).forEach(id => {
+            const index = indexOf(id);
+            if (index >= 0) list.splice(index, 1);
+        });
+        (op.update || []).forEach(item => {
+            const index = indexOf(item[key]);
+            index >= 0 ? list.splice(index, 1, item) : list.push(item);
+        });
+        // The page that made the change gets both the answer and the broadcast
+        (op.append || []).forEach(item => {
+            if (indexOf(item[key]) < 0) list.push(item);
+        });
+    });
+}
+
+// Update components by namespaced keys like "todoApp::todos"
+function applyComponentData(data) {
+    checkAvailVersion(data['main::availVersion']);
+    checkDataVersions(data);
+    const applied = new Set();
+    document.querySelectorAll('[x-data]').forEach(element => {
+        const compName = element.getAttribute('x-data');
+        const scope = Alpine.$data(element);
+        Object.entries(data).forEach(([key, value]) => {
+            if (key.includes('::')) {
+                const [targetComp, field] = key.split('::');
+                if (targetComp === compName) {
+                    assignData(element, scope, field, value, data['main::dataVersions']);
+                    markSaved(compName, { [field]: scope[field] });
+                    applied.add(key);
+                }
+            }
+        });
+    });
+
+    // Data for components that are not on the page is lost, let the server know
+    Object.keys(data).forEach(key => {
+        if (key.includes('::') && !applied.has(key)) {
+            const [component, field] = key.split('::');
+            reportClientError({ message: 'No component for data', component, key: field });
+        }
+    });
+}
+
+
+// Values of guarded keys as last received from the server, by component
+const jalpineSaved = {};
+
+function markSaved(component, data) {
+    (jalpineGuards.unsaved[component] || []).forEach(key => {
+        if (key in data) {
+            (jalpineSaved[component] = jalpineSaved[component] || {})[key] = JSON.stringify(data[key]);
+        }
+    });
+}
+
+// Checks whether guarded keys changed since the server sent them
+function hasUnsavedChanges() {
+    return [...document.querySelectorAll('[x-data]')].some(el => {
+        const component = el.getAttribute('x-data');
+        const saved = jalpineSaved[component] || {};
+        const scope = Alpine.$data(el);
+        return (jalpineGuards.unsaved[component] || []).some(key => key in saved && JSON.stringify(scope[key]) !== saved[key]);
+    });
+}
+
+// Warn before leaving the page with unsaved changes
+window.addEventListener('beforeunload', event => {
+    if (hasUnsavedChanges()) {
+        event.preventDefault();
+        event.returnValue = '';
+    }
+});
+
+
+// Identifies this tab to the server, so BroadcastJSON skips the tab that made the change
+const jalpineTab = Math.random().toString(36).slice(2);
+
+// Topics of all mounted x-subscribe elements, counted to support duplicates
+const jalpineTopics = new Map();
+let jalpineEvents = null;
+let jalpinePoll = null;
+let jalpineResubscribeTimer = null;
+
+// Once the event stream failed to connect, the page (and the tab session) long polls and tries
+// the stream again after a backoff, from a minute doubling up to half an hour
+const jalpinePollingUntil = parseInt(sessionStorage.getItem('jalpinePollingUntil')) || 0;
+let jalpineUsePolling = jalpineOptions.transport === 'poll' ||
+    (jalpineOptions.transport === 'auto' && Date.now() < jalpinePollingUntil);
+if (jalpineUsePolling && jalpineOptions.transport === 'auto') {
+    setTimeout(retryEventStream, jalpinePollingUntil - Date.now());
+}
+
+function retryEventStream() {
+    jalpineUsePolling = false;
+    resubscribe();
+}
+
+// pollForAWhile switches to long polling until the next try of the event stream
+function pollForAWhile() {
+    const backoff = Math.min(Math.max(2 * (parseInt(sessionStorage.getItem('jalpinePollingBackoff')) || 0), 60000), 1800000);
+    sessionStorage.setItem('jalpinePollingBackoff', backoff);
+    sessionStorage.setItem('jalpinePollingUntil', Date.now() + backoff);
+    jalpineUsePolling = true;
+    setTimeout(retryEventStream, backoff);
+}
+
+// Reconnect the event stream with the current set of topics, batched to one reconnect per tick
+function resubscribe() {
+    clearTimeout(jalpineResubscribeTimer);
+    jalpineResubscribeTimer = setTimeout(() => {
+        if (jalpineEvents) {
+            jalpineEvents.close();
+            jalpineEvents = null;
+        }
+        if (jalpinePoll) {
+            jalpinePoll.stop();
+            jalpinePoll = null;
+        }
+        const topics = [...jalpineTopics.keys()].sort();
+        if (jalpineOptions.transport === 'ws') {
+            jalpineSocket.subscribe(topics);
+            return;
+        }
+        // With user updates the connection stays open without topics, see WithBroadcastHub
+        if (topics.length === 0 && !jalpineOptions.userUpdates) return;
+        if (jalpineUsePolling) {
+            jalpinePoll = startPolling(topics);
+            return;
+        }
+
+        const events = new EventSource(jalpineEventsURL + '?topics=' + encodeURIComponent(topics.join(',')) + '&tab=' + jalpineTab);
+        jalpineEvents = events;
+        events.onmessage = event => applyComponentData(JSON.parse(event.data));
+        if (jalpineOptions.transport !== 'auto') return;
+        // Proxies buffering the stream never deliver the first event
+        let connected = false;
+        const fallback = () => {
+            if (connected || jalpineEvents !== events || jalpineUsePolling) return;
+            console.warn('Event stream is not getting through, switching to long polling for a while');
+            pollForAWhile();
+            resubscribe();
+        };
+        const timer = setTimeout(fallback, 5000);
+        events.addEventListener('connected', () => {
+            connected = true;
+            clearTimeout(timer);
+            sessionStorage.removeItem('jalpinePollingBackoff');
+        });
+        events.onerror = fallback;
+    });
+}
+
+// WebSocket to the Hub: the server pushes updates of subscribed topics, the page sends
+// subscriptions and actions, answered with results matched by id
+const jalpineSocket = {
+    ws: null,
+    open: false,
+    topics: new Set(), // Subscribed on the server
+    pending: new Map(), // Actions waiting for their result by id
+    nextId: 1,
+    failures: 0,
+
+    connect() {
+        if (this.ws) return;
+        const url = new URL(jalpineWSURL, window.location.href);
+        url.protocol = url.protocol === 'https:' ? 'wss:' : 'ws:';
+        url.searchParams.set('tab', jalpineTab);
+        const ws = new WebSocket(url);
+        this.ws = ws;
+        ws.onopen = () => {
+            this.open = true;
+            this.failures = 0;
+            this.topics = new Set();
+            this.subscribe([...jalpineTopics.keys()]);
+        };
+        ws.onmessage = event => {
+            const message = JSON.parse(event.data);
+            if (message.type === 'data') {
+                applyComponentData(message.data);
+            } else if (message.type === 'result' && this.pending.has(message.id)) {
+                this.pending.get(message.id).resolve(message);
+                this.pending.delete(message.id);
+            }
+        };
+        ws.onclose = () => {
+            this.ws = null;
+            this.open = false;
+            // Whether lost actions ran is unknown, they fail like a dropped fetch
+            this.pending.forEach(request => request.reject(new TypeError('Connection lost')));
+            this.pending.clear();
+            // Only subscriptions reconnect, actions open the socket again when needed
+            if (jalpineTopics.size > 0 || jalpineOptions.userUpdates) {
+                this.failures++;
+                setTimeout(() => this.connect(), Math.min(30000, 1000 * 2 ** this.failures));
+            }
+        };
+    },
+
+    // Brings the subscriptions of the server in line with the topics
+    subscribe(topics) {
+        if (!this.open) {
+            if (topics.length > 0 || jalpineOptions.userUpdates) this.connect();
+            return;
+        }
+        const wanted = new Set(topics);
+        const added = topics.filter(topic => !this.topics.has(topic));
+        const removed = [...this.topics].filter(topic => !wanted.has(topic));
+        if (added.length) this.ws.send(JSON.stringify({ type: 'subscribe', topics: added }));
+        if (removed.length) this.ws.send(JSON.stringify({ type: 'unsubscribe', topics: removed }));
+        this.topics = wanted;
+    },
+
+    // Sends an action and resolves to a Response, like fetch
+    request(url, options) {
+        return new Promise((resolve, reject) => {
+            const id = this.nextId++;
+            this.pending.set(id, {
+                resolve: result => {
+                    const empty = result.status === 204 || result.status === 304;
+                    resolve(new Response(empty ? null : result.body, { status: result.status, headers: result.headers }));
+                },
+                reject,
+            });
+            this.ws.send(JSON.stringify({
+                type: 'action', id, method: options.method, url, headers: options.headers, body: options.body || '',
+            }));
+        });
+    },
+};
+
+// Sends requests of helpers over the WebSocket when it's the transport and connected, over
+// fetch otherwise. Uploads and other origins always use fetch.
+function jalpineFetch(url, options) {
+    if (jalpineOptions.transport === 'ws' && url.startsWith('/') && !(options.body instanceof FormData)) {
+        if (jalpineSocket.open) return jalpineSocket.request(url, options);
+        jalpineSocket.connect();
+    }
+    return fetch(url.startsWith('/') ? jalpineOptions.basePath + url : url, options);
+}
+
+// Pages without x-subscribe elements still connect for user updates
+if (jalpineOptions.userUpdates) resubscribe();
+
+// Long polls the topics until stopped, applying messages the same way as the event stream
+function startPolling(topics) {
+    const controller = new AbortController();
+    const poll = { stopped: false, stop() { this.stopped = true; controller.abort(); } };
+    (async () => {
+        let session = '';
+        let failures = 0;
+        while (!poll.stopped) {
+            try {
+                const url = jalpinePollURL + '?topics=' + encodeURIComponent(topics.join(',')) + '&tab=' + jalpineTab +
+                    '&session=' + encodeURIComponent(session);
+                const response = await fetch(url, { signal: controller.signal, credentials: jalpineOptions.credentials });
+                if (!response.ok) throw new Error('Polling failed: ' + response.status);
+                const result = await response.json();
+                session = result.session;
+                result.messages.forEach(applyComponentData);
+                failures = 0;
+            } catch (error) {
+                if (poll.stopped) return;
+                failures++;
+                await new Promise(resolve => setTimeout(resolve, Math.min(30000, 1000 * 2 ** failures)));
+            }
+        }
+    })();
+    return poll;
+}
+
+// List items rendered on the server (WithSSR) are replaced by Alpine's own x-for clones.
+// Both happen synchronously during Alpine start, so nothing flickers.
+document.addEventListener('alpine:init', () => {
+    document.querySelectorAll('[data-jalpine-ssr]').forEach(el => el.remove());
+});
+
+// x-subscribe="todoApp todo:42" receives server broadcasts for the listed topics while the element exists
+document.addEventListener('alpine:init', () => {
+    Alpine.directive('subscribe', (el, { expression }, { cleanup }) => {
+        const topics = expression.split(/[\s,]+/).filter(Boolean);
+        topics.forEach(topic => jalpineTopics.set(topic, (jalpineTopics.get(topic) || 0) + 1));
+        resubscribe();
+        cleanup(() => {
+            topics.forEach(topic => {
+                const count = jalpineTopics.get(topic) - 1;
+                count > 0 ? jalpineTopics.set(topic, count) : jalpineTopics.delete(topic);
+            });
+            resubscribe();
+        });
+    });
 });
 
 
 // Define AJAX helper functions for Alpine
 document.addEventListener('alpine:init', () => {
-    Alpine.magic('get', (el) => async(url) => {
-        return makeRequest(el, 'GET', url);
+    Alpine.magic('get', (el) => async(url, opts) => {
+        return makeRequest(el, 'GET', url, null, opts);
+    });
+    Alpine.magic('post', (el) => async(url, data, opts) => {
+        return makeRequest(el, 'POST', url, data, opts);
+    });
+    Alpine.magic('delete', (el) => async(url, data, opts) => {
+        return makeRequest(el, 'DELETE', url, data, opts);
     });
-    Alpine.magic('post', (el) => async(url, data) => {
-        return makeRequest(el, 'POST', url, data);
+    Alpine.magic('put', (el) => async(url, data, opts) => {
+        return makeRequest(el, 'PUT', url, data, opts);
     });
-    Alpine.magic('delete', (el) => async(url, data) => {
-        return makeRequest(el, 'DELETE', url, data);
+    Alpine.magic('patch', (el) => async(url, data, opts) => {
+        return makeRequest(el, 'PATCH', url, data, opts);
     });
-    Alpine.magic('put', (el) => async(url, data) => {
-        return makeRequest(el, 'PUT', url, data);
+    // Calls a function of the API generated from the routes, see ClientScriptFromSource:
+    // $api.createTodo({ newTodo }) or $api.getTodos({ filter: 'active' })
+    Alpine.magic('api', (el) => new Proxy({}, {
+        get: (_, name) => async(data, opts) => {
+            const endpoint = (window.jalpineAPI || {})[name];
+            if (!endpoint) {
+                throw new Error('Unknown API function ' + String(name) + ', is the generated script included?');
+            }
+            let url = endpoint.url;
+            if (endpoint.query && data) {
+                url += '?' + new URLSearchParams(data);
+                data = null;
+            }
+            // Actions of an ActionDispatcher send their nonce like with $action
+            const action = url.startsWith(jalpineActionsURL + '/') ? url.slice(jalpineActionsURL.length + 1) : '';
+            const defaults = { action: action in jalpineNonces ? action : undefined };
+            return makeRequest(el, endpoint.method, url, data, Object.assign(defaults, opts));
+        },
+    }));
+    // Calls an action of an ActionDispatcher by name, e.g. $action('todos.toggle', { id }).
+    // Actions with a nonce issued to the page send it without the {action} option.
+    Alpine.magic('action', (el) => async(name, data, opts) => {
+        const defaults = { action: name in jalpineNonces ? name : undefined };
+        return makeRequest(el, 'POST', jalpineActionsURL + '/' + name, data, Object.assign(defaults, opts));
+    });
+    // x-stream="/jobs/42/progress" applies data pushed by the server (JTemplate.Stream) while the
+    // element exists, $stream(url) does the same from code and returns a function closing it
+    Alpine.directive('stream', (el, { expression }, { cleanup }) => {
+        cleanup(jalpineStream(expression.trim()));
+    });
+    // Downloads go through fetch, so busy exports queue and errors land in the component
+    Alpine.magic('download', (el) => async(url, opts) => {
+        return makeRequest(el, 'GET', url, null, Object.assign({ download: true }, opts));
+    });
+    Alpine.magic('stream', () => url => jalpineStream(url));
+
+    // x-loader="/todos" on a component refetches its data from the URL when the server has newer
+    // data for it (jalpine:stale-data), e.g. after the page was restored from the back/forward cache
+    Alpine.directive('loader', (el, { expression }, { cleanup }) => {
+        const root = el.closest('[x-data]');
+        const component = root ? root.getAttribute('x-data') : 'main';
+        const loader = { el, url: expression.trim() };
+        (jalpineLoaders[component] = jalpineLoaders[component] || []).push(loader);
+        cleanup(() => {
+            jalpineLoaders[component] = jalpineLoaders[component].filter(item => item !== loader);
+        });
     });
-    Alpine.magic('patch', (el) => async(url, data) => {
-        return makeRequest(el, 'PATCH', url, data);
+    jalpineRunLoader = loader => makeRequest(loader.el, 'GET', loader.url).catch(() => {});
+
+    // Opens a variant of the current page (TemplateSet.Handle), e.g. $openVariant('print')
+    Alpine.magic('openVariant', () => (variant) => {
+        const url = new URL(window.location.href);
+        url.searchParams.set('variant', variant);
+        return window.open(url.toString(), '_blank');
     });
 
+    // The server sends nonces in "action=token" form, see JTemplate.RequireNonce
+    function storeNonce(response) {
+        const nonce = response.headers.get('X-JAlpine-Nonce');
+        if (nonce) {
+            const [action, token] = nonce.split('=');
+            jalpineNonces[action] = token;
+        }
+    }
+
+    // Pages only know the names of protected actions, tokens are fetched when needed
+    async function fetchNonce(action) {
+        const response = await fetch(jalpineNonceURL + '?action=' + encodeURIComponent(action), {
+            cache: 'no-store',
+            credentials: jalpineOptions.credentials,
+            headers: jalpineOptions.headers,
+        });
+        storeNonce(response);
+    }
+
     // Helper function for making AJAX requests
-    async function makeRequest(el, method, url, data = null) {
+    // opts.confirm - message of a confirmation dialog, the request is not sent if it is declined
+    // opts.action - name of the action protected by a one-time nonce
+    // opts.queue - ticket of a request waiting for a busy action, see ConcurrencyLimiter
+    // waitForTurn asks with bodyless probes until the queued ticket may run, see ConcurrencyLimiter
+    async function waitForTurn(el, method, url, headers, ticket) {
+        for (;;) {
+            const response = await jalpineFetch(url, {
+                method,
+                credentials: jalpineOptions.credentials,
+                headers: Object.assign({}, headers, { 'X-JAlpine-Queue': ticket, 'X-JAlpine-Queue-Probe': '1' }),
+            });
+            ticket = response.headers.get('X-JAlpine-Queue') || '';
+            if (response.status !== 503 || !ticket) {
+                return ticket;
+            }
+            const responseData = await response.json();
+            Alpine.$data(el)[jalpineOptions.errorKey] = responseData[jalpineOptions.errorKey];
+            el.dispatchEvent(new CustomEvent('jalpine:queued', { bubbles: true, detail: responseData['main::queue'] }));
+            await new Promise(resolve => setTimeout(resolve, (parseInt(response.headers.get('Retry-After')) || 1) * 1000));
+        }
+    }
+
+    // saveDownload hands a file answer to the browser, named after Content-Disposition
+    async function saveDownload(response, fallbackName) {
+        const disposition = response.headers.get('Content-Disposition') || '';
+        const match = disposition.match(/filename="?([^";]+)"?/);
+        const link = document.createElement('a');
+        link.href = URL.createObjectURL(await response.blob());
+        link.download = match ? match[1] : (typeof fallbackName === 'string' ? fallbackName : '');
+        document.body.appendChild(link);
+        link.click();
+        link.remove();
+        setTimeout(() => URL.revokeObjectURL(link.href), 1000);
+    }
+
+    async function makeRequest(el, method, url, data = null, opts = {}) {
+        const guard = jalpineGuards.actions[method + ' ' + url.split('?')[0]] || {};
+        opts = Object.assign({ confirm: guard.confirm }, opts);
+        if (opts.confirm && !window.confirm(opts.confirm)) {
+            return null;
+        }
         try {
             const options = {
                 method,
-                headers: {
+                credentials: jalpineOptions.credentials,
+                headers: Object.assign({}, jalpineOptions.headers, {
                     'Content-Type': 'application/json',
-                }
+                    'X-JAlpine-Protocol': jalpineProtocol,
+                    'X-JAlpine-Tab': jalpineTab,
+                }),
             };
 
-            if (data) {
+            // Uploads are sent as multipart, the browser sets the boundary
+            if (data instanceof FormData) {
+                delete options.headers['Content-Type'];
+                options.body = data;
+            } else if (data) {
                 options.body = JSON.stringify(data);
             }
+            if (opts.action) {
+                if (!jalpineNonces[opts.action]) {
+                    await fetchNonce(opts.action);
+                }
+                options.headers['X-JAlpine-Nonce'] = jalpineNonces[opts.action] || '';
+                // A token is used once, the answer of an accepted request brings the next one
+                jalpineNonces[opts.action] = '';
+            }
+            if (opts.queue) {
+                options.headers['X-JAlpine-Queue'] = opts.queue;
+            }
 
-            const response = await fetch(url, options);
+            const response = await jalpineFetch(url, options);
+            if (response.headers.get('X-JAlpine-Reload')) {
+                window.location.reload();
+            }
+            storeNonce(response);
+            if (opts.download && response.ok) {
+                await saveDownload(response, opts.download);
+                return null;
+            }
             const responseData = await response.json();
 
+            // Busy actions queue the request, show the position and ask again until it's our turn
+            const ticket = response.headers.get('X-JAlpine-Queue');
+            if (response.status === 503 && ticket) {
+                const scope = Alpine.$data(el);
+                scope[jalpineOptions.errorKey] = responseData[jalpineOptions.errorKey];
+                el.dispatchEvent(new CustomEvent('jalpine:queued', { bubbles: true, detail: responseData['main::queue'] }));
+                await new Promise(resolve => setTimeout(resolve, (parseInt(response.headers.get('Retry-After')) || 1) * 1000));
+                // Bodies, e.g. uploaded files, are sent again only once it's our turn
+                const turn = data ? await waitForTurn(el, method, url, options.headers, ticket) : ticket;
+                const result = await makeRequest(el, method, url, data, Object.assign({}, opts, { confirm: false, queue: turn }));
+                if (scope[jalpineOptions.errorKey] === responseData[jalpineOptions.errorKey]) {
+                    scope[jalpineOptions.errorKey] = '';
+                }
+                return result;
+            }
+
+            warnDeprecations(responseData['main::deprecations']);
             if (response.ok) {
                 // Update the current Alpine component
                 const currentScope = Alpine.$data(el);
                 Object.entries(responseData).forEach(([key, value]) => {
                     if (!key.includes('::')) {
-                        currentScope[key] = value;
+                        assignData(el, currentScope, key, value, responseData['main::dataVersions']);
                     }
                 });
 
                 // For namespaced data, update corresponding components
-                document.querySelectorAll('[x-data]').forEach(element => {
-                    const compName = element.getAttribute('x-data');
-                    const scope = Alpine.$data(element);
-                    Object.entries(responseData).forEach(([key, value]) => {
-                        if (key.includes('::')) {
-                            const [targetComp, field] = key.split('::');
-                            if (targetComp === compName) {
-                                scope[field] = value;
-                            }
-                        }
-                    });
-                });
+                applyComponentData(responseData);
                 return responseData;
             } else {
-                throw new Error(responseData.error || 'Request failed');
+                // Errors of failed requests belong to the calling component, see JTemplate.ErrorFor
+                const key = jalpineOptions.errorKey;
+                const root = el.closest('[x-data]');
+                const component = root ? root.getAttribute('x-data') : 'main';
+                // A write based on stale data, see JTemplate.Conflict. The component gets the
+                // details and whatever the server sent along, e.g. the stored entity.
+                const conflictKey = Object.keys(responseData).find(key => key.endsWith('::conflict'));
+                if (response.status === 409 && conflictKey) {
+                    applyComponentData(responseData);
+                    el.dispatchEvent(new CustomEvent('jalpine:conflict', { bubbles: true, detail: responseData[conflictKey] }));
+                }
+                throw new Error(responseData[key] || responseData[component + '::' + key] || responseData['main::' + key] || 'Request failed');
             }
         } catch (error) {
             console.error('API request failed:', error);
             const scope = Alpine.$data(el);
-            scope.error = error.message;
+            scope[jalpineOptions.errorKey] = error.message;
+            if (jalpineOptions.swallowErrors) {
+                return null;
+            }
             throw error;
         }
     }
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ImportField is a target field the columns of an uploaded file are mapped to
+type ImportField struct {
+	Name     string `json:"name"`
+	Label    string `json:"label"`
+	Required bool   `json:"required,omitempty"`
+}
+
+// ImportPreview is sent to the mapping UI as "component::importPreview" after an upload
+type ImportPreview struct {
+	ID      string            `json:"id"`
+	Columns []string          `json:"columns"`
+	Sample  [][]string        `json:"sample"`
+	Rows    int               `json:"rows"`
+	Fields  []ImportField     `json:"fields"`
+	Mapping map[string]string `json:"mapping"` // Field => column, guessed from the headers
+}
+
+// ImportJob is the progress of a confirmed import, sent as "component::importJob"
+type ImportJob struct {
+	ID       string   `json:"id"`
+	Total    int      `json:"total"`
+	Done     int      `json:"done"`
+	Failed   int      `json:"failed"`
+	Errors   []string `json:"errors,omitempty"` // The first errors with row numbers
+	Finished bool     `json:"finished"`
+
+	finishedAt time.Time
+}
+
+// Importer implements a two-phase CSV import: Preview parses an upload and returns its columns
+// and sample rows, the page lets the user map columns to fields, Confirm runs the import in
+// the background and Status (or the Hub) reports the progress. Progress goes only to the
+// uploader: Status needs the job id, the Hub topic is ImportTopic of the job.
+type Importer struct {
+	Component  string // Receives importPreview and importJob keys
+	Fields     []ImportField
+	Row        func(record map[string]string) error // Imports one row keyed by field name
+	SampleRows int                                  // Rows in the preview, 5 by default
+	MaxSize    int64                                // Of the upload, 10 MB by default
+	TTL        time.Duration                        // Of unconfirmed uploads and finished jobs, 1 hour by default
+	Hub        *Hub                                 // Optional, receives progress updates
+	MaxPending int64                                // Bytes of all unconfirmed uploads, 50 MB by default
+	Clock      Clock                                // Ages uploads and jobs, the system clock by default
+
+	// Optional, creates the row function of each job instead of Row, e.g. with an index of
+	// the existing records
+	Begin func() (func(record map[string]string) error, error)
+
+	mu      sync.Mutex
+	uploads map[string]*importUpload
+	jobs    map[string]*ImportJob
+}
+
+type importUpload struct {
+	columns []string
+	rows    [][]string
+	size    int64
+	created time.Time
+}
+
+const maxImportErrors = 20
+
+// NewImporter creates an importer for the component with the default limits. row may be nil
+// when Begin is set.
+func NewImporter(component string, row func(record map[string]string) error, fields ...ImportField) *Importer {
+	return &Importer{
+		Component:  component,
+		Fields:     fields,
+		Row:        row,
+		SampleRows: 5,
+		MaxSize:    10 << 20,
+		TTL:        time.Hour,
+		MaxPending: 50 << 20,
+		Clock:      SystemClock{},
+		uploads:    make(map[string]*importUpload),
+		jobs:       make(map[string]*ImportJob),
+	}
+}
+
+// Preview accepts a multipart upload with the CSV in the "file" field
+func (im *Importer) Preview(t *JTemplate) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, im.MaxSize)
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			t.Error(w, "No file uploaded: "+err.Error())
+			return
+		}
+		defer file.Close()
+		columns, rows, err := parseImportCSV(file)
+		if err != nil {
+			t.Error(w, "Invalid CSV: "+err.Error())
+			return
+		}
+
+		id := newImportID()
+		im.mu.Lock()
+		im.sweep()
+		pending := header.Size
+		for _, upload := range im.uploads {
+			pending += upload.size
+		}
+		if pending > im.MaxPending {
+			im.mu.Unlock()
+			t.Error(w, "Too many imports are waiting for confirmation, try again later")
+			return
+		}
+		im.uploads[id] = &importUpload{columns: columns, rows: rows, size: header.Size, created: im.Clock.Now()}
+		im.mu.Unlock()
+
+		t.JSON(w, map[string]interface{}{
+			im.Component + "::importPreview": ImportPreview{
+				ID:      id,
+				Columns: columns,
+				Sample:  rows[:min(len(rows), im.SampleRows)],
+				Rows:    len(rows),
+				Fields:  im.Fields,
+				Mapping: guessImportMapping(im.Fields, columns),
+			},
+		})
+	}
+}
+
+// Confirm starts the import of an upload with the mapping chosen by the user
+func (im *Importer) Confirm(t *JTemplate) http.HandlerFunc {
+	type confirmRequest struct {
+		ID      string            `json:"id" validate:"required"`
+		Mapping map[string]string `json:"mapping" validate:"required"` // Field => column
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, ok := DecodeAndValidate[confirmRequest](t, w, r)
+		if !ok {
+			return
+		}
+
+		im.mu.Lock()
+		upload := im.uploads[req.ID]
+		im.mu.Unlock()
+		if upload == nil {
+			t.Error(w, "The upload has expired, please upload the file again")
+			return
+		}
+
+		indexes := make(map[string]int)
+		for _, field := range im.Fields {
+			column, mapped := req.Mapping[field.Name]
+			idx := slices.Index(upload.columns, column)
+			if mapped && column != "" && idx == -1 {
+				t.Error(w, fmt.Sprintf("Unknown column %q for %s", column, field.Label))
+				return
+			}
+			if idx == -1 {
+				if field.Required {
+					t.Error(w, fmt.Sprintf("%s must be mapped to a column", field.Label))
+					return
+				}
+				continue
+			}
+			indexes[field.Name] = idx
+		}
+
+		job := &ImportJob{ID: req.ID, Total: len(upload.rows)}
+		im.mu.Lock()
+		if im.uploads[req.ID] == nil {
+			// Confirmed twice concurrently
+			im.mu.Unlock()
+			t.Error(w, "The import has already started")
+			return
+		}
+		delete(im.uploads, req.ID)
+		im.jobs[job.ID] = job
+		snapshot := *job
+		im.mu.Unlock()
+		go im.run(job, upload.rows, indexes)
+
+		t.JSON(w, map[string]interface{}{
+			im.Component + "::importPreview": nil,
+			im.Component + "::importJob":     snapshot,
+		})
+	}
+}
+
+// Status reports the progress of the job given by the "id" query parameter
+func (im *Importer) Status(t *JTemplate) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, ok := im.Job(r.URL.Query().Get("id"))
+		if !ok {
+			t.Error(w, "Unknown import")
+			return
+		}
+		t.JSON(w, map[string]interface{}{im.Component + "::importJob": job})
+	}
+}
+
+// Job returns a snapshot of the import job
+func (im *Importer) Job(id string) (ImportJob, bool) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	job, ok := im.jobs[id]
+	if !ok {
+		return ImportJob{}, false
+	}
+	snapshot := *job
+	snapshot.Errors = append([]string(nil), job.Errors...)
+	return snapshot, true
+}
+
+// run imports rows one by one, publishing the progress every 100 rows and at the end
+func (im *Importer) run(job *ImportJob, rows [][]string, indexes map[string]int) {
+	importRow := im.Row
+	if im.Begin != nil {
+		var err error
+		if importRow, err = im.Begin(); err != nil {
+			im.mu.Lock()
+			job.Done, job.Failed = job.Total, job.Total
+			job.Errors = []string{err.Error()}
+			job.Finished = true
+			job.finishedAt = im.Clock.Now()
+			im.mu.Unlock()
+			im.publish(job.ID)
+			return
+		}
+	}
+	for i, row := range rows {
+		record := make(map[string]string, len(indexes))
+		for field, idx := range indexes {
+			if idx < len(row) {
+				record[field] = strings.TrimSpace(row[idx])
+			}
+		}
+		err := importRow(record)
+
+		im.mu.Lock()
+		job.Done++
+		if err != nil {
+			job.Failed++
+			if len(job.Errors) < maxImportErrors {
+				// Row 1 is the header
+				job.Errors = append(job.Errors, fmt.Sprintf("row %d: %v", i+2, err))
+			}
+		}
+		if job.Done == job.Total {
+			job.Finished = true
+			job.finishedAt = im.Clock.Now()
+		}
+		progress := job.Done%100 == 0 && !job.Finished
+		im.mu.Unlock()
+
+		if progress {
+			im.publish(job.ID)
+		}
+	}
+	if len(rows) == 0 {
+		im.mu.Lock()
+		job.Finished = true
+		job.finishedAt = im.Clock.Now()
+		im.mu.Unlock()
+	}
+	im.publish(job.ID)
+}
+
+// ImportTopic is the Hub topic of a job, only known to the uploader as the id is random
+func ImportTopic(component, id string) string {
+	return component + ":import:" + id
+}
+
+func (im *Importer) publish(id string) {
+	if im.Hub == nil {
+		return
+	}
+	if job, ok := im.Job(id); ok {
+		im.Hub.Publish(ImportTopic(im.Component, id), map[string]interface{}{im.Component + "::importJob": job})
+	}
+}
+
+// sweep drops expired uploads and finished jobs. Must be called with im.mu held.
+func (im *Importer) sweep() {
+	deadline := im.Clock.Now().Add(-im.TTL)
+	for id, upload := range im.uploads {
+		if upload.created.Before(deadline) {
+			delete(im.uploads, id)
+		}
+	}
+	for id, job := range im.jobs {
+		if job.Finished && job.finishedAt.Before(deadline) {
+			delete(im.jobs, id)
+		}
+	}
+}
+
+// parseImportCSV reads the header and the rows, detecting ";" and tab separated files
+func parseImportCSV(r io.Reader) (columns []string, rows [][]string, err error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	reader.Comma = detectImportComma(data)
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil, fmt.Errorf("the file is empty")
+	}
+	for i := range records[0] {
+		records[0][i] = strings.TrimSpace(records[0][i])
+	}
+	return records[0], records[1:], nil
+}
+
+// importSniffRows are parsed with each separator to detect the one of a file
+const importSniffRows = 10
+
+// detectImportComma parses the first rows with ",", ";" and tab, and picks the separator that
+// splits them into the same number of columns, the most columns if several do. Quoted fields
+// may contain the other separators.
+func detectImportComma(data []byte) rune {
+	best, bestColumns := ',', 1
+	for _, sep := range []rune{',', ';', '\t'} {
+		reader := csv.NewReader(bytes.NewReader(data))
+		reader.FieldsPerRecord = -1
+		reader.LazyQuotes = true
+		reader.Comma = sep
+		columns := 0
+		for i := 0; i < importSniffRows; i++ {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil || (columns != 0 && len(record) != columns) {
+				columns = 0
+				break
+			}
+			columns = len(record)
+		}
+		if columns > bestColumns {
+			best, bestColumns = sep, columns
+		}
+	}
+	return best
+}
+
+// guessImportMapping maps fields to columns with the same name or label, ignoring case
+func guessImportMapping(fields []ImportField, columns []string) map[string]string {
+	mapping := make(map[string]string)
+	for _, field := range fields {
+		for _, column := range columns {
+			if strings.EqualFold(column, field.Name) || strings.EqualFold(column, field.Label) {
+				mapping[field.Name] = column
+				break
+			}
+		}
+	}
+	return mapping
+}
+
+func newImportID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,148 @@
+// Package jalpinetest helps to snapshot-test compiled JAlpine templates against golden files.
+//
+// A typical test in the app package:
+//
+//	func TestIndexSnapshot(t *testing.T) {
+//		dir := jalpinetest.Dir(t, map[string]string{"index.html": "...", "components/card.html": "..."})
+//		tmpl, err := NewJTemplate(filepath.Join(dir, "index.html"), map[string]string{"alpinejs": "alpinejs@3.js"})
+//		if err != nil {
+//			t.Fatal(err)
+//		}
+//		jalpinetest.Snapshot(t, "index", tmpl, nil)
+//	}
+//
+// Golden files live in testdata/<name>.golden, run "go test -jalpine.update" to rewrite them.
+package jalpinetest
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("jalpine.update", false, "rewrite golden files of jalpinetest snapshots")
+
+// Renderer is implemented by JTemplate
+type Renderer interface {
+	ExecuteToString(data map[string]interface{}) (string, error)
+}
+
+// Dir writes files (slash separated relative name => content) into a temporary directory
+// removed after the test and returns its path
+func Dir(t testing.TB, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// DirFS copies a file system, e.g. embedded templates or fstest.MapFS, into a temporary directory
+func DirFS(t testing.TB, fsys fs.FS) string {
+	t.Helper()
+	files := make(map[string]string)
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		content, err := fs.ReadFile(fsys, path)
+		files[path] = string(content)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Dir(t, files)
+}
+
+var (
+	versionRe   = regexp.MustCompile(`"(currentVersion|availVersion)":"[0-9a-f]{16}"`)
+	sourceURLRe = regexp.MustCompile(`(//# sourceURL=)\S*?([^/\\\s]+)\n`)
+)
+
+// Normalize removes parts of the output that change without a change of the template:
+// versions become "VERSION" and sourceURL comments keep only the file name
+func Normalize(output string) string {
+	output = versionRe.ReplaceAllString(output, `"$1":"VERSION"`)
+	return sourceURLRe.ReplaceAllString(output, "$1$2\n")
+}
+
+// Snapshot renders the template with data and compares the normalized output with testdata/<name>.golden
+func Snapshot(t testing.TB, name string, r Renderer, data map[string]interface{}) {
+	t.Helper()
+	output, err := r.ExecuteToString(data)
+	if err != nil {
+		t.Fatalf("render %s: %v", name, err)
+	}
+	Golden(t, name, Normalize(output))
+}
+
+// Golden compares got with testdata/<name>.golden, or rewrites the file with -jalpine.update
+func Golden(t testing.TB, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.MkdirAll("testdata", 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run go test -jalpine.update to create it)", err)
+	}
+	if diff := Diff(string(want), got); diff != "" {
+		t.Errorf("%s differs from the golden file (-want +got):\n%s", name, diff)
+	}
+}
+
+// Diff returns the differing lines of two texts around the first mismatch, or "" if they are equal
+func Diff(want, got string) string {
+	if want == got {
+		return ""
+	}
+	wantLines, gotLines := strings.Split(want, "\n"), strings.Split(got, "\n")
+	first := 0
+	for first < len(wantLines) && first < len(gotLines) && wantLines[first] == gotLines[first] {
+		first++
+	}
+	// Skip the common tail to show only the changed block
+	lastWant, lastGot := len(wantLines), len(gotLines)
+	for lastWant > first && lastGot > first && wantLines[lastWant-1] == gotLines[lastGot-1] {
+		lastWant--
+		lastGot--
+	}
+
+	const context = 3
+	var b strings.Builder
+	fmt.Fprintf(&b, "@@ line %d @@\n", first+1)
+	for _, line := range wantLines[max(first-context, 0):first] {
+		fmt.Fprintf(&b, "  %s\n", line)
+	}
+	for _, line := range wantLines[first:lastWant] {
+		fmt.Fprintf(&b, "- %s\n", line)
+	}
+	for _, line := range gotLines[first:lastGot] {
+		fmt.Fprintf(&b, "+ %s\n", line)
+	}
+	for _, line := range gotLines[lastGot:min(lastGot+context, len(gotLines))] {
+		fmt.Fprintf(&b, "  %s\n", line)
+	}
+	return b.String()
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"time"
+	"unicode"
+)
+
+// TimeFormat is the representation of time values in component data
+type TimeFormat int
+
+const (
+	TimeRFC3339    TimeFormat = iota // "2006-01-02T15:04:05Z07:00" strings, as encoding/json does
+	TimeUnixMillis                   // Milliseconds since epoch, ready for new Date(ms)
+)
+
+// JSONOptions customizes serialization of component data. The output is still canonical
+// (sorted keys, shortest numbers), see CanonicalJSON.
+type JSONOptions struct {
+	// Marshal replaces encoding/json, e.g. jsoniter.ConfigCompatibleWithStandardLibrary.Marshal
+	Marshal func(v interface{}) ([]byte, error)
+	// TimeFormat converts strings in the format of time.Time (RFC 3339 with optional
+	// nanoseconds), so plain strings looking exactly like timestamps are converted too
+	TimeFormat TimeFormat
+	// OmitZero drops null, false, 0, "", [] and {} members of objects inside values.
+	// Component keys themselves are always kept, since sending "" is how inputs are cleared.
+	OmitZero bool
+	// EmptySlices sends nil slices as [] instead of null, so client code can always iterate.
+	// []byte stays null, it is a base64 string otherwise.
+	EmptySlices bool
+	// FieldNames renames keys of objects inside values, e.g. LowerCamelCase for structs without
+	// json tags. Keys of maps are renamed too, component keys are not.
+	FieldNames func(name string) string
+}
+
+// DefaultJSONOptions apply to templates and hubs created without WithJSONOptions or
+// WithHubJSONOptions, and to JSON answers of framework endpoints, so the whole app sends one
+// format. Set it during setup, before creating them.
+var DefaultJSONOptions *JSONOptions
+
+var (
+	jsonMarshalerType = reflect.TypeFor[json.Marshaler]()
+	textMarshalerType = reflect.TypeFor[encoding.TextMarshaler]()
+)
+
+// WithJSONOptions applies the options to component data in Execute, JSON, Error and ExecuteFragment
+func WithJSONOptions(opts JSONOptions) TemplateOption {
+	return func(t *JTemplate) {
+		t.jsonOptions = &opts
+	}
+}
+
+// WithHubJSONOptions applies the options to published messages, pass the same as to the templates
+func WithHubJSONOptions(opts JSONOptions) HubOption {
+	return func(h *Hub) {
+		h.jsonOptions = &opts
+	}
+}
+
+// encode serializes v in canonical form applying the options, nil options give CanonicalJSON.
+// Keys of objects nested less than keepDepth levels deep are never omitted.
+func (o *JSONOptions) encode(v interface{}, keepDepth int) ([]byte, error) {
+	marshal := json.Marshal
+	if o != nil && o.Marshal != nil {
+		marshal = o.Marshal
+	}
+	if o != nil && o.EmptySlices && v != nil {
+		v = emptySlices(reflect.ValueOf(v)).Interface()
+	}
+	raw, err := marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var generic interface{}
+	if err := dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+	if o != nil {
+		generic = o.transform(generic, 0, keepDepth)
+	}
+
+	var buf bytes.Buffer
+	if err := writeCanonical(&buf, generic); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// transform applies time format, zero omission and field names to a decoded value at the
+// given depth
+func (o *JSONOptions) transform(v interface{}, depth, keepDepth int) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			item = o.transform(item, depth+1, keepDepth)
+			if depth >= keepDepth {
+				if o.OmitZero && isZeroJSON(item) {
+					continue
+				}
+				if o.FieldNames != nil {
+					k = o.FieldNames(k)
+				}
+			}
+			out[k] = item
+		}
+		return out
+	case []interface{}:
+		for i, item := range val {
+			val[i] = o.transform(item, depth+1, keepDepth)
+		}
+	case string:
+		if o.TimeFormat == TimeUnixMillis {
+			if t, err := time.Parse(time.RFC3339Nano, val); err == nil {
+				return json.Number(strconv.FormatInt(t.UnixMilli(), 10))
+			}
+		}
+	}
+	return v
+}
+
+func isZeroJSON(v interface{}) bool {
+	switch val := v.(type) {
+	case nil:
+		return true
+	case bool:
+		return !val
+	case string:
+		return val == ""
+	case json.Number:
+		f, err := val.Float64()
+		return err == nil && f == 0
+	case []interface{}:
+		return len(val) == 0
+	case map[string]interface{}:
+		return len(val) == 0
+	}
+	return false
+}
+
+// emptySlices returns a copy of v with nil slices replaced by empty ones. Types with their own
+// marshaling are left as they are.
+func emptySlices(v reflect.Value) reflect.Value {
+	if !v.IsValid() {
+		return v
+	}
+	t := v.Type()
+	if t.Implements(jsonMarshalerType) || t.Implements(textMarshalerType) ||
+		reflect.PointerTo(t).Implements(jsonMarshalerType) || reflect.PointerTo(t).Implements(textMarshalerType) {
+		return v
+	}
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		return emptySlices(v.Elem())
+	case reflect.Pointer:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.New(t.Elem())
+		out.Elem().Set(emptySlices(v.Elem()))
+		return out
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return v
+		}
+		out := reflect.MakeSlice(t, v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			out.Index(i).Set(emptySlices(v.Index(i)))
+		}
+		return out
+	case reflect.Array:
+		out := reflect.New(t).Elem()
+		for i := 0; i < v.Len(); i++ {
+			out.Index(i).Set(emptySlices(v.Index(i)))
+		}
+		return out
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeMapWithSize(t, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			out.SetMapIndex(iter.Key(), emptySlices(iter.Value()))
+		}
+		return out
+	case reflect.Struct:
+		out := reflect.New(t).Elem()
+		out.Set(v)
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).IsExported() {
+				out.Field(i).Set(emptySlices(v.Field(i)))
+			}
+		}
+		return out
+	}
+	return v
+}
+
+// LowerCamelCase turns Go field names into JavaScript ones: "CreatedAt" into "createdAt",
+// "ID" into "id" and "URLPath" into "urlPath". For JSONOptions.FieldNames.
+func LowerCamelCase(name string) string {
+	runes := []rune(name)
+	upper := 0
+	for upper < len(runes) && unicode.IsUpper(runes[upper]) {
+		upper++
+	}
+	// The last capital of a run starts the next word, unless the run is the whole name
+	if upper > 1 && upper < len(runes) {
+		upper--
+	}
+	for i := 0; i < upper; i++ {
+		runes[i] = unicode.ToLower(runes[i])
+	}
+	return string(runes)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+// KVBrowserPath serves the database browser, see KVBrowser
+const KVBrowserPath = "/_jalpine/kv"
+
+//go:embed kvbrowser.html
+var kvBrowserHTML string
+
+// KVBrowser is a small admin page for the database: prefixes of keys, records with their
+// values, editing and deleting single records and exporting a selection as JSON.
+// Every request must pass Authorize, e.g. BasicAuth; changes also need the
+// X-JAlpine-Protocol header, which cross-site forms can't send.
+type KVBrowser struct {
+	DB        *buntdb.DB
+	Authorize func(w http.ResponseWriter, r *http.Request) bool // Answers the request itself on false
+	OnChange  func(key string)                                  // Called after a record is saved or deleted, optional
+
+	types map[string]func(value []byte) error // Validation by key prefix, see KVType
+}
+
+// NewKVBrowser creates a browser of db
+func NewKVBrowser(db *buntdb.DB, authorize func(w http.ResponseWriter, r *http.Request) bool) *KVBrowser {
+	return &KVBrowser{DB: db, Authorize: authorize, types: make(map[string]func([]byte) error)}
+}
+
+// KVType makes edits of records with the key prefix, e.g. "todo:", decode into T without
+// unknown fields and pass its validate tags before they are saved
+func KVType[T any](b *KVBrowser, prefix string) {
+	b.types[prefix] = func(value []byte) error {
+		var record T
+		dec := json.NewDecoder(bytes.NewReader(value))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&record); err != nil {
+			return err
+		}
+		return validate.Struct(record)
+	}
+}
+
+// BasicAuth accepts requests with the user and password, asking the browser for them otherwise
+func BasicAuth(user, password string) func(w http.ResponseWriter, r *http.Request) bool {
+	return func(w http.ResponseWriter, r *http.Request) bool {
+		u, p, ok := r.BasicAuth()
+		if ok && subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1 {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="jalpine", charset="UTF-8"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+}
+
+// KVRecord is a record as shown by the browser
+type KVRecord struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	TTL   int64  `json:"ttl,omitempty"` // Seconds until the record expires, 0 if it doesn't
+	Type  bool   `json:"typed"`         // Edits are validated, see KVType
+}
+
+// kvPageSize limits records per listing
+const kvPageSize = 100
+
+// ServeHTTP answers:
+//
+//	GET                      the page
+//	GET ?prefixes            {"prefix": count} for the part of keys up to the first ':'
+//	GET ?prefix=p&after=k    up to 100 records with keys starting with p, after k
+//	GET ?key=k               the record
+//	PUT ?key=k               replaces the value with the body, keeping its TTL
+//	DELETE ?key=k            deletes the record
+//	POST ?export             {"key": value} of the keys in the body, e.g. ["todo:1"]
+func (b *KVBrowser) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if b.Authorize == nil || !b.Authorize(w, r) {
+		if b.Authorize == nil {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		}
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	query := r.URL.Query()
+	if r.Method != "GET" && r.Header.Get("X-JAlpine-Protocol") == "" {
+		http.Error(w, "Missing X-JAlpine-Protocol", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && query.Has("prefixes"):
+		b.servePrefixes(w)
+	case r.Method == "GET" && query.Has("prefix"):
+		b.serveList(w, query.Get("prefix"), query.Get("after"))
+	case r.Method == "GET" && query.Has("key"):
+		record, err := b.record(query.Get("key"))
+		if errors.Is(err, buntdb.ErrNotFound) {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		kvAnswer(w, record, err)
+	case r.Method == "GET":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, strings.Replace(kvBrowserHTML, "{{protocol}}", strconv.Itoa(ProtocolVersion), 1))
+	case r.Method == "PUT" && query.Has("key"):
+		b.servePut(w, r, query.Get("key"))
+	case r.Method == "DELETE" && query.Has("key"):
+		err := b.DB.Update(func(tx *buntdb.Tx) error {
+			_, err := tx.Delete(query.Get("key"))
+			return err
+		})
+		if errors.Is(err, buntdb.ErrNotFound) {
+			err = nil
+		} else if err == nil {
+			b.changed(query.Get("key"))
+		}
+		kvAnswer(w, map[string]bool{"deleted": true}, err)
+	case r.Method == "POST" && query.Has("export"):
+		b.serveExport(w, r)
+	default:
+		http.Error(w, "Unknown request", http.StatusBadRequest)
+	}
+}
+
+func (b *KVBrowser) servePrefixes(w http.ResponseWriter) {
+	prefixes := make(map[string]int)
+	err := b.DB.View(func(tx *buntdb.Tx) error {
+		return tx.AscendKeys("*", func(key, _ string) bool {
+			prefix, _, found := strings.Cut(key, ":")
+			if found {
+				prefix += ":"
+			}
+			prefixes[prefix]++
+			return true
+		})
+	})
+	kvAnswer(w, prefixes, err)
+}
+
+func (b *KVBrowser) serveList(w http.ResponseWriter, prefix, after string) {
+	records := make([]KVRecord, 0)
+	more := false
+	err := b.DB.View(func(tx *buntdb.Tx) error {
+		return tx.AscendGreaterOrEqual("", prefix, func(key, value string) bool {
+			if !strings.HasPrefix(key, prefix) {
+				return false
+			}
+			if after != "" && key <= after {
+				return true
+			}
+			if len(records) == kvPageSize {
+				more = true
+				return false
+			}
+			records = append(records, b.describe(tx, key, value))
+			return true
+		})
+	})
+	kvAnswer(w, map[string]interface{}{"records": records, "more": more}, err)
+}
+
+func (b *KVBrowser) servePut(w http.ResponseWriter, r *http.Request, key string) {
+	value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Value too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if check := b.typeOf(key); check != nil {
+		if err := check(value); err != nil {
+			http.Error(w, "Invalid record: "+err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	} else if json.Valid(bytes.TrimSpace(value)) {
+		// Keep untyped JSON compact like values written by the app
+		var compact bytes.Buffer
+		json.Compact(&compact, value)
+		value = compact.Bytes()
+	}
+	var record KVRecord
+	err = b.DB.Update(func(tx *buntdb.Tx) error {
+		var opts *buntdb.SetOptions
+		if ttl, err := tx.TTL(key); err == nil && ttl > 0 {
+			opts = &buntdb.SetOptions{Expires: true, TTL: ttl}
+		}
+		if _, _, err := tx.Set(key, string(value), opts); err != nil {
+			return err
+		}
+		record = b.describe(tx, key, string(value))
+		return nil
+	})
+	if err == nil {
+		b.changed(key)
+	}
+	kvAnswer(w, record, err)
+}
+
+func (b *KVBrowser) serveExport(w http.ResponseWriter, r *http.Request) {
+	var keys []string
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&keys); err != nil {
+		http.Error(w, "Expected a list of keys", http.StatusBadRequest)
+		return
+	}
+	export := make(map[string]json.RawMessage)
+	err := b.DB.View(func(tx *buntdb.Tx) error {
+		for _, key := range keys {
+			value, err := tx.Get(key)
+			if errors.Is(err, buntdb.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if json.Valid([]byte(value)) {
+				export[key] = json.RawMessage(value)
+			} else {
+				quoted, _ := json.Marshal(value)
+				export[key] = quoted
+			}
+		}
+		return nil
+	})
+	w.Header().Set("Content-Disposition", `attachment; filename="export.json"`)
+	kvAnswer(w, export, err)
+}
+
+func (b *KVBrowser) changed(key string) {
+	if b.OnChange != nil {
+		b.OnChange(key)
+	}
+}
+
+func (b *KVBrowser) record(key string) (KVRecord, error) {
+	var record KVRecord
+	err := b.DB.View(func(tx *buntdb.Tx) error {
+		value, err := tx.Get(key)
+		if err != nil {
+			return err
+		}
+		record = b.describe(tx, key, value)
+		return nil
+	})
+	return record, err
+}
+
+func (b *KVBrowser) describe(tx *buntdb.Tx, key, value string) KVRecord {
+	record := KVRecord{Key: key, Value: value, Type: b.typeOf(key) != nil}
+	if ttl, err := tx.TTL(key); err == nil && ttl > 0 {
+		record.TTL = int64(ttl.Round(time.Second) / time.Second)
+	}
+	return record
+}
+
+// typeOf returns the validation of the longest registered prefix of the key
+func (b *KVBrowser) typeOf(key string) func([]byte) error {
+	prefixes := make([]string, 0, len(b.types))
+	for prefix := range b.types {
+		if strings.HasPrefix(key, prefix) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	if len(prefixes) == 0 {
+		return nil
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return len(prefixes[i]) > len(prefixes[j]) })
+	return b.types[prefixes[0]]
+}
+
+func kvAnswer(w http.ResponseWriter, data interface{}, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// LibGuard watches the library files pages link to. A file deleted from the static dir after
+// startup breaks every page silently; the guard logs the miss, reports it through Err (e.g. on
+// HealthPath) and optionally downloads the file again on the first request for it.
+type LibGuard struct {
+	staticDir  string
+	files      map[string]EnsureLibsEntry // Local file => library
+	redownload bool
+
+	mu        sync.Mutex
+	missing   map[string]bool
+	restoring map[string]chan struct{} // Closed when the download of the file is done
+}
+
+// NewLibGuard guards the files of libsMap, as returned by EnsureStaticLibs for the plugins
+func NewLibGuard(staticDir string, libsMap map[string]string, plugins ...EnsureLibsEntry) *LibGuard {
+	g := &LibGuard{staticDir: staticDir, files: make(map[string]EnsureLibsEntry), missing: make(map[string]bool), restoring: make(map[string]chan struct{})}
+	for _, plugin := range plugins {
+		if file, ok := libsMap[plugin.Name]; ok {
+			g.files[file] = plugin
+		}
+	}
+	return g
+}
+
+// Redownload makes requests for a missing file download it again, from the URL in the lockfile
+func (g *LibGuard) Redownload(enabled bool) *LibGuard {
+	g.redownload = enabled
+	return g
+}
+
+// Err stats all guarded files and describes the missing ones
+func (g *LibGuard) Err() error {
+	var missing []string
+	for file := range g.files {
+		if !g.present(file) {
+			missing = append(missing, file)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	return fmt.Errorf("missing static libraries: %s", strings.Join(missing, ", "))
+}
+
+// Handler checks requests for guarded files before passing them to next, the static file server
+func (g *LibGuard) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		if plugin, ok := g.files[file]; ok && !g.present(file) && g.redownload {
+			g.restore(file, plugin)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// present checks the file and logs when it goes missing or comes back
+func (g *LibGuard) present(file string) bool {
+	_, err := os.Stat(filepath.Join(g.staticDir, file))
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	switch {
+	case err != nil && !g.missing[file]:
+		g.missing[file] = true
+		log.Printf("Static library %s is missing, pages using it are broken", file)
+	case err == nil && g.missing[file]:
+		delete(g.missing, file)
+		log.Printf("Static library %s is back", file)
+	}
+	return err == nil
+}
+
+// restore downloads the file again. Requests for a file being downloaded wait for it, the
+// download itself goes to a temporary dir without holding the lock.
+func (g *LibGuard) restore(file string, plugin EnsureLibsEntry) {
+	g.mu.Lock()
+	if done, ok := g.restoring[file]; ok {
+		g.mu.Unlock()
+		<-done
+		return
+	}
+	done := make(chan struct{})
+	g.restoring[file] = done
+	g.mu.Unlock()
+	defer func() {
+		g.mu.Lock()
+		delete(g.restoring, file)
+		g.mu.Unlock()
+		close(done)
+	}()
+
+	if _, err := os.Stat(filepath.Join(g.staticDir, file)); err == nil {
+		return
+	}
+	tmp, err := os.MkdirTemp(g.staticDir, "restore-*.tmp")
+	if err != nil {
+		log.Printf("Failed to restore static library %s: %v", file, err)
+		return
+	}
+	defer os.RemoveAll(tmp)
+	lock, err := ReadLibsLock(LockFilePath(g.staticDir))
+	if locked := lock.Libs[plugin.Name].File; err == nil && locked != file && minifiedLibFile(locked) != file {
+		err = fmt.Errorf("%s is not in %s", file, LockFileName)
+	}
+	if err == nil {
+		var locked LockedLib
+		if locked, err = resolveLib(tmp, plugin, lock); err == nil {
+			minifyLib(tmp, locked.File)
+		}
+	}
+	if err == nil {
+		err = g.swapIn(tmp)
+	}
+	if err != nil {
+		log.Printf("Failed to restore static library %s: %v", file, err)
+		return
+	}
+	g.mu.Lock()
+	delete(g.missing, file)
+	g.mu.Unlock()
+	log.Printf("Static library %s downloaded again", file)
+}
+
+// swapIn moves the downloaded files, e.g. the library with its compressed variants, into the
+// static dir
+func (g *LibGuard) swapIn(tmp string) error {
+	entries, err := os.ReadDir(tmp)
+	if err != nil {
+		return err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if err := os.Rename(filepath.Join(tmp, entry.Name()), filepath.Join(g.staticDir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+)
+
+// LibHashes returns short content hashes of the library files of libsMap in fsys, e.g.
+// os.DirFS("./static"), by library name. Files that can't be read are left out.
+func LibHashes(fsys fs.FS, libsMap map[string]string) map[string]string {
+	hashes := make(map[string]string, len(libsMap))
+	for name, file := range libsMap {
+		content, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			continue
+		}
+		sum := sha256.Sum256(content)
+		hashes[name] = hex.EncodeToString(sum[:6])
+	}
+	return hashes
+}
+
+// WithLibHashes adds "?v=hash" to library URLs injected into pages, so they can be cached
+// for good with CacheImmutable and a changed file is a new URL
+func WithLibHashes(hashes map[string]string) TemplateOption {
+	return func(t *JTemplate) {
+		t.libHashes = hashes
+	}
+}
+
+// libURL is the local URL of the library file, with its hash if known
+func libURL(name, file string, hashes map[string]string) string {
+	if hash, ok := hashes[name]; ok {
+		return "/static/" + file + "?v=" + hash
+	}
+	return "/static/" + file
+}
+
+// CacheImmutable lets browsers keep responses to URLs with the "v" query parameter for a year
+// without revalidation, see WithLibHashes
+func CacheImmutable(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("v") != "" {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// LockFileName is written by EnsureStaticLibs next to the static dir. Committing it makes
+// every machine download the same versions without committing the libraries themselves.
+const LockFileName = "libs.lock.json"
+
+// LibsLock is the content of the lockfile
+type LibsLock struct {
+	Libs map[string]LockedLib `json:"libs"` // By EnsureLibsEntry.Name
+}
+
+// LockedLib is a resolved library
+type LockedLib struct {
+	Version string `json:"version"`
+	URL     string `json:"url"`            // Download URL of the exact version
+	Path    string `json:"path,omitempty"` // File in the tarball at URL, for npm packages
+	File    string `json:"file"`           // Name in the static dir
+	SHA256  string `json:"sha256"`
+}
+
+// LockFilePath returns where the lockfile of the static dir is, e.g. "./libs.lock.json" for "./static"
+func LockFilePath(staticDir string) string {
+	return filepath.Join(filepath.Dir(filepath.Clean(staticDir)), LockFileName)
+}
+
+// ReadLibsLock reads the lockfile, a missing file is an empty lock
+func ReadLibsLock(path string) (LibsLock, error) {
+	lock := LibsLock{Libs: make(map[string]LockedLib)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return lock, nil
+	}
+	if err != nil {
+		return lock, err
+	}
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return lock, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	if lock.Libs == nil {
+		lock.Libs = make(map[string]LockedLib)
+	}
+	return lock, nil
+}
+
+// Write saves the lockfile with stable formatting, so diffs only show real changes
+func (l LibsLock) Write(path string) error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// ensureLockedLib verifies the hash of a locked library, downloading it again if the file is
+// missing, truncated or modified
+func ensureLockedLib(staticDir string, locked LockedLib, headers http.Header) error {
+	path := filepath.Join(staticDir, locked.File)
+	sum, err := fileSHA256(path)
+	if err == nil && sum == locked.SHA256 {
+		return nil
+	}
+	if err == nil {
+		log.Printf("%s does not match the hash in %s, downloading it again", path, LockFileName)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	fmt.Printf("Downloading %s (locked)...\n", locked.File)
+	if locked.Path != "" {
+		err = downloadNPMFile(npmDist{Tarball: locked.URL}, locked.Path, path, headers)
+	} else {
+		err = downloadFile(locked.URL, path, headers)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %v", locked.File, err)
+	}
+	sum, err = fileSHA256(path)
+	if err != nil {
+		return err
+	}
+	if sum != locked.SHA256 {
+		os.Remove(path)
+		return fmt.Errorf("%s from %s does not match the hash in %s", locked.File, locked.URL, LockFileName)
+	}
+	return nil
+}
+
+// lockLib describes a library found or downloaded by ensureLib for the lockfile
+func lockLib(staticDir string, plugin EnsureLibsEntry, file string) (LockedLib, error) {
+	sum, err := fileSHA256(filepath.Join(staticDir, file))
+	if err != nil {
+		return LockedLib{}, err
+	}
+	// File names are "name@version.js"
+	version := libFileVersion(plugin.Name, file)
+	if plugin.NPM != "" {
+		return LockedLib{
+			Version: version,
+			URL:     plugin.npmTarballURL(version),
+			Path:    plugin.File,
+			File:    file,
+			SHA256:  sum,
+		}, nil
+	}
+	return LockedLib{
+		Version: version,
+		URL:     plugin.WithVersion(version).URL(),
+		File:    file,
+		SHA256:  sum,
+	}, nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// sourceMappingRe finds the "//# sourceMappingURL=" or "/*# sourceMappingURL= */" comment
+var sourceMappingRe = regexp.MustCompile(`[/*]# sourceMappingURL=(\S+?)\s*(?:\*/)?\s*$`)
+
+// ensureLibSourceMap downloads the source map referenced by the library as "file.map" next to
+// it, e.g. "alpinejs@3.14.8.js.map". Libraries without a map or with an inline one are skipped.
+func ensureLibSourceMap(staticDir string, locked LockedLib, headers http.Header) error {
+	dest := filepath.Join(staticDir, locked.File+".map")
+	if _, err := os.Stat(dest); err == nil {
+		return nil
+	}
+	content, err := os.ReadFile(filepath.Join(staticDir, locked.File))
+	if err != nil {
+		return err
+	}
+	// The comment is at the end, after the last line break
+	content = bytes.TrimSpace(content)
+	match := sourceMappingRe.FindSubmatch(content[bytes.LastIndexByte(content, '\n')+1:])
+	if match == nil || bytes.HasPrefix(match[1], []byte("data:")) {
+		return nil
+	}
+	ref := string(match[1])
+
+	if locked.Path != "" {
+		// Maps of npm packages are in the same tarball
+		if strings.Contains(ref, "://") {
+			return nil
+		}
+		return downloadNPMFile(npmDist{Tarball: locked.URL}, path.Join(path.Dir(locked.Path), ref), dest, headers)
+	}
+	baseURL, err := url.Parse(locked.URL)
+	if err != nil {
+		return err
+	}
+	// Relative to the final URL, e.g. unpkg redirects to /alpinejs@3.14.8/dist/cdn.min.js
+	if location, err := headNoRedirect(locked.URL, headers); err == nil && location != "" {
+		if redirect, err := baseURL.Parse(location); err == nil {
+			baseURL = redirect
+		}
+	}
+	refURL, err := baseURL.Parse(ref)
+	if err != nil {
+		return fmt.Errorf("invalid sourceMappingURL %q in %s", ref, locked.File)
+	}
+	return downloadFile(refURL.String(), dest, headers)
+}
+
+// SourceMapHeaders points browsers to downloaded source maps of libraries in dir (see
+// DownloadConfig.SourceMaps) with the SourceMap header, which takes precedence over the
+// comment in the file. The comment refers to the original name, e.g. "cdn.min.js.map",
+// and would 404.
+func SourceMapHeaders(dir string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Base(r.URL.Path)
+		if ext := path.Ext(name); ext == ".js" || ext == ".css" {
+			if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(path.Clean("/"+r.URL.Path))+".map")); err == nil {
+				w.Header().Set("SourceMap", name+".map")
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// LibUpdatesPath reports newer versions of the static libraries, see LibUpdatesHandler
+const LibUpdatesPath = "/_jalpine/libs/updates"
+
+// LibUpdate compares the installed version of a library with the latest one on the CDN
+type LibUpdate struct {
+	Name      string `json:"name"`
+	Installed string `json:"installed"` // Empty if the library is not downloaded yet
+	Latest    string `json:"latest"`
+	Pinned    bool   `json:"pinned"` // Pinned entries only change when the code does
+	Outdated  bool   `json:"outdated"`
+	Error     string `json:"error,omitempty"` // Why Latest is unknown
+}
+
+// CheckStaticLibUpdates asks the CDN or the npm registry for the latest version of every library
+// and compares it with the installed one, from the lockfile or the static dir. Nothing is
+// downloaded, failures of single libraries are reported in their Error.
+func CheckStaticLibUpdates(staticDir string, plugins ...EnsureLibsEntry) ([]LibUpdate, error) {
+	lock, err := ReadLibsLock(LockFilePath(staticDir))
+	if err != nil {
+		return nil, err
+	}
+	report := make([]LibUpdate, len(plugins))
+	var wg sync.WaitGroup
+	for i, plugin := range plugins {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			report[i] = checkLibUpdate(staticDir, plugin, lock)
+		}()
+	}
+	wg.Wait()
+	return report, nil
+}
+
+func checkLibUpdate(staticDir string, plugin EnsureLibsEntry, lock LibsLock) LibUpdate {
+	update := LibUpdate{Name: plugin.Name, Pinned: plugin.Version != ""}
+	if plugin.LocalPath != "" {
+		// In-house files have nothing to update from
+		update.Installed, update.Latest = "local", "local"
+		return update
+	}
+	if locked, ok := lock.Libs[plugin.Name]; ok {
+		update.Installed = locked.Version
+	} else if matches, _ := filepath.Glob(filepath.Join(staticDir, plugin.Name+"@*"+plugin.ext())); len(matches) > 0 {
+		newest := slices.MaxFunc(matches, func(a, b string) int {
+			return compareVersions(libFileVersion(plugin.Name, filepath.Base(a)), libFileVersion(plugin.Name, filepath.Base(b)))
+		})
+		update.Installed = libFileVersion(plugin.Name, filepath.Base(newest))
+	}
+
+	var err error
+	update.Latest, err = latestLibVersion(plugin)
+	if err != nil {
+		update.Error = err.Error()
+		return update
+	}
+	update.Outdated = update.Installed != "" && compareVersions(update.Latest, update.Installed) > 0
+	return update
+}
+
+// latestLibVersion asks the npm registry or the CDN redirect for the latest version
+func latestLibVersion(plugin EnsureLibsEntry) (string, error) {
+	if plugin.NPM != "" {
+		version, _, err := resolveNPM(plugin, "")
+		return version, err
+	}
+	location, err := headNoRedirect(plugin.BaseURL, plugin.Headers)
+	if err != nil {
+		return "", err
+	}
+	if location == "" {
+		return "", errors.New("no redirect location for " + plugin.BaseURL)
+	}
+	return versionFromLocation(location)
+}
+
+// LibUpdatesHandler serves CheckStaticLibUpdates as JSON, intended for development use.
+// Results are cached for an hour to spare the CDN.
+func LibUpdatesHandler(staticDir string, plugins ...EnsureLibsEntry) http.HandlerFunc {
+	var (
+		mu      sync.Mutex
+		report  []LibUpdate
+		checked time.Time
+	)
+	return func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if report == nil || time.Since(checked) > time.Hour {
+			fresh, err := CheckStaticLibUpdates(staticDir, plugins...)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			report, checked = fresh, time.Now()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	}
+}
+
+// UpdateStaticLibs replaces unpinned libraries with their latest versions and pinned ones with
+// the pinned version, unlike EnsureStaticLibs which keeps whatever is already there. New files
+// are downloaded into a temporary dir first; only when all of them succeed they are renamed
+// into staticDir, the lockfile is rewritten and files of superseded versions are removed.
+// Returns the same map as EnsureStaticLibs.
+func UpdateStaticLibs(staticDir string, plugins ...EnsureLibsEntry) (map[string]string, error) {
+	if len(plugins) == 0 {
+		plugins = []EnsureLibsEntry{AlpineJS}
+	}
+	if err := os.MkdirAll(staticDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	lockPath := LockFilePath(staticDir)
+	lock, err := ReadLibsLock(lockPath)
+	if err != nil {
+		return nil, err
+	}
+	tmpDir, err := os.MkdirTemp(staticDir, ".update-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Download everything that changed, nothing in staticDir is touched yet
+	files := make([]string, len(plugins))
+	fresh := make([]bool, len(plugins)) // Downloaded into tmpDir
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		errs    []error
+		workers = make(chan struct{}, maxParallelDownloads)
+	)
+	for i, plugin := range plugins {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			workers <- struct{}{}
+			defer func() { <-workers }()
+
+			file, downloaded, err := updateLib(staticDir, tmpDir, plugin, lock)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			files[i], fresh[i] = file, downloaded
+		}()
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	libsMap := make(map[string]string)
+	newLock := LibsLock{Libs: make(map[string]LockedLib)}
+	for i, plugin := range plugins {
+		if fresh[i] {
+			if err := os.Rename(filepath.Join(tmpDir, files[i]), filepath.Join(staticDir, files[i])); err != nil {
+				return nil, err
+			}
+		}
+		libsMap[plugin.Name] = minifyLib(staticDir, files[i])
+		if plugin.LocalPath != "" {
+			continue
+		}
+		locked, ok := lock.Libs[plugin.Name]
+		if !ok || fresh[i] || locked.File != files[i] {
+			if locked, err = lockLib(staticDir, plugin, files[i]); err != nil {
+				return nil, err
+			}
+		}
+		newLock.Libs[plugin.Name] = locked
+	}
+	if err := newLock.Write(lockPath); err != nil {
+		return nil, err
+	}
+
+	// The lockfile points to the new files, older versions can go
+	for i, plugin := range plugins {
+		removeLibVersions(staticDir, plugin.Name, plugin.ext(), files[i])
+	}
+	return libsMap, nil
+}
+
+// updateLib finds the wanted version of the library, downloading it into tmpDir unless the
+// same version is already in staticDir
+func updateLib(staticDir, tmpDir string, plugin EnsureLibsEntry, lock LibsLock) (file string, downloaded bool, err error) {
+	if plugin.LocalPath != "" {
+		locked, err := copyLocalLib(staticDir, plugin)
+		return locked.File, false, err
+	}
+	version := plugin.Version
+	if version == "" {
+		if version, err = latestLibVersion(plugin); err != nil {
+			return "", false, fmt.Errorf("failed to find the latest %s: %w", plugin.Name, err)
+		}
+	}
+	file = plugin.Name + "@" + version + plugin.ext()
+	if locked, ok := lock.Libs[plugin.Name]; ok && locked.File == file {
+		// Up to date, only make sure the file is intact
+		return file, false, ensureLockedLib(staticDir, locked, plugin.Headers)
+	}
+	if _, err := os.Stat(filepath.Join(staticDir, file)); err == nil {
+		return file, false, nil
+	}
+	file, err = ensureLib(tmpDir, plugin.WithVersion(version))
+	return file, err == nil, err
+}
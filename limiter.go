@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// QueueHeader carries the queue ticket of a waiting request, see ConcurrencyLimiter
+const QueueHeader = "X-JAlpine-Queue"
+
+// QueueProbeHeader marks a bodyless retry that only asks whether it's the turn of the ticket,
+// so uploads are sent once their slot is reserved instead of on every retry
+const QueueProbeHeader = "X-JAlpine-Queue-Probe"
+
+// queueTicketTTL drops tickets of clients that stopped retrying, helpers.js retries every second
+const queueTicketTTL = 5 * time.Second
+
+// ConcurrencyLimiter caps how many expensive actions, e.g. exports and imports, run at once.
+// Requests over the limit don't block a goroutine each: they get 503 with a ticket and their
+// position, and helpers.js retries with the ticket until it's their turn.
+type ConcurrencyLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	queue   int
+	running int
+	waiting []string             // Tickets in order
+	seen    map[string]time.Time // Last retry of each ticket
+}
+
+// NewConcurrencyLimiter allows limit actions at once and queue more to wait for their turn
+func NewConcurrencyLimiter(limit, queue int) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{limit: max(limit, 1), queue: queue, seen: make(map[string]time.Time)}
+}
+
+// Limit runs next when a slot is free and it's the turn of the request, answering its
+// queue position to the error key of the component otherwise
+func (l *ConcurrencyLimiter) Limit(t *JTemplate, next http.HandlerFunc) http.HandlerFunc {
+	return wrapRoute(func(w http.ResponseWriter, r *http.Request) {
+		probe := r.Header.Get(QueueProbeHeader) != ""
+		ticket, position, ok := l.enter(r.Header.Get(QueueHeader), probe)
+		if ok && probe {
+			// The ticket stays first in line until the request with the body comes
+			w.Header().Set(QueueHeader, ticket)
+			w.Header().Set("Cache-Control", "no-store")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if ok {
+			defer l.leave()
+			next(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if ticket == "" {
+			w.Header().Set("Retry-After", "10")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			writeJSON(w, map[string]interface{}{t.errorKey(): "Server is busy, try again later"})
+			return
+		}
+		w.Header().Set(QueueHeader, ticket)
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		writeJSON(w, map[string]interface{}{
+			t.errorKey():  fmt.Sprintf("Busy, queued at position %d", position),
+			"main::queue": map[string]int{"position": position},
+		})
+	}, next, fmt.Sprintf("limit %d, queue %d", l.limit, l.queue))
+}
+
+// Running returns the number of running and waiting actions
+func (l *ConcurrencyLimiter) Running() (running, waiting int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.running, len(l.waiting)
+}
+
+// enter takes a slot if one is free and nobody is ahead of the ticket, otherwise returns the
+// ticket of the request, a new one if it had none, and its position. An empty ticket means
+// the queue is full. A probe never takes the slot, it keeps its ticket at the head of the
+// queue and reports that it's its turn.
+func (l *ConcurrencyLimiter) enter(ticket string, probe bool) (string, int, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.dropStale(now)
+
+	position := 0
+	for i, waiting := range l.waiting {
+		if waiting == ticket {
+			position = i + 1
+			break
+		}
+	}
+	if probe && position == 0 {
+		if len(l.waiting) >= l.queue {
+			return "", 0, false
+		}
+		ticket = newQueueTicket()
+		l.waiting = append(l.waiting, ticket)
+		position = len(l.waiting)
+	}
+	if l.running < l.limit && (position == 1 || (position == 0 && len(l.waiting) == 0)) {
+		if probe {
+			l.seen[ticket] = now
+			return ticket, position, true
+		}
+		if position == 1 {
+			l.waiting = l.waiting[1:]
+			delete(l.seen, ticket)
+		}
+		l.running++
+		return "", 0, true
+	}
+	if position == 0 {
+		if len(l.waiting) >= l.queue {
+			return "", 0, false
+		}
+		ticket = newQueueTicket()
+		l.waiting = append(l.waiting, ticket)
+		position = len(l.waiting)
+	}
+	l.seen[ticket] = now
+	return ticket, position, false
+}
+
+func (l *ConcurrencyLimiter) leave() {
+	l.mu.Lock()
+	l.running--
+	l.mu.Unlock()
+}
+
+// dropStale removes tickets that weren't retried for queueTicketTTL
+func (l *ConcurrencyLimiter) dropStale(now time.Time) {
+	kept := l.waiting[:0]
+	for _, ticket := range l.waiting {
+		if now.Sub(l.seen[ticket]) < queueTicketTTL {
+			kept = append(kept, ticket)
+		} else {
+			delete(l.seen, ticket)
+		}
+	}
+	l.waiting = kept
+}
+
+func newQueueTicket() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
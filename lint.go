@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// LintIssue is a problem found by JTemplate.Lint
+type LintIssue struct {
+	Kind      string // "unbound": a binding nothing populates, "orphan": a server key no template uses
+	Component string
+	Key       string
+}
+
+func (i LintIssue) String() string {
+	if i.Kind == "unbound" {
+		return fmt.Sprintf("%s::%s is bound in the template, but neither the component nor the server defines it", i.Component, i.Key)
+	}
+	return fmt.Sprintf("%s::%s is sent by the server, but the template never uses it", i.Component, i.Key)
+}
+
+var (
+	alpineDataRe    = regexp.MustCompile(`(?s)(?:Alpine\.data|jalpineExtend)\('([^']+)', \(\) => \n(.*?) \) \}\);\n`)
+	scriptDefRe     = regexp.MustCompile(`(?m)(?:^|[{,])\s*(?:get\s+|async\s+)?([A-Za-z_$][\w$]*)\s*[:(]`)
+	thisRefRe       = regexp.MustCompile(`this\.([A-Za-z_$][\w$]*)`)
+	identifierRe    = regexp.MustCompile(`(^|[^\w$.])([A-Za-z_$][\w$]*)`)
+	jsStringRe      = regexp.MustCompile(`'(?:[^'\\]|\\.)*'|"(?:[^"\\]|\\.)*"|` + "`(?:[^`\\\\]|\\\\.)*`")
+	attrRe          = regexp.MustCompile(`\s([@:]?[\w:.@-]+)="([^"]*)"`)
+	componentKeyRe  = regexp.MustCompile(`^([A-Za-z_$][\w$]*)::([A-Za-z_$][\w$]*)$`)
+	lintLoopVarRe   = regexp.MustCompile(`^\s*\(?\s*([A-Za-z_$][\w$]*)\s*(?:,\s*([A-Za-z_$][\w$]*)\s*)?\)?\s+(?:in|of)\s`)
+	lintSkippedTags = map[string]bool{"script": true, "style": true}
+)
+
+// Identifiers resolved by Alpine or the browser rather than component data
+var jsGlobals = map[string]bool{
+	"true": true, "false": true, "null": true, "undefined": true, "this": true, "new": true,
+	"typeof": true, "instanceof": true, "in": true, "of": true, "if": true, "else": true,
+	"return": true, "let": true, "const": true, "var": true, "function": true, "await": true, "async": true,
+	"Math": true, "JSON": true, "Date": true, "Object": true, "Array": true, "String": true, "Number": true,
+	"Boolean": true, "window": true, "document": true, "console": true, "alert": true, "confirm": true,
+	"setTimeout": true, "clearTimeout": true, "Alpine": true, "NaN": true, "Infinity": true,
+}
+
+// Keys set by the framework itself: the version pair, nonces, deprecations, enums and guards for main, error for any component
+var builtinKeys = map[string]bool{"error": true}
+var builtinMainKeys = map[string]bool{"currentVersion": true, "availVersion": true, "dataVersions": true, "nonces": true, "deprecations": true, "enums": true, "guards": true}
+
+// Lint cross-references bindings of the compiled template with component data keys sent by
+// handlers ("component::key"), see ServerKeysFromSource. Keys without a component prefix are ignored.
+func (t *JTemplate) Lint(serverKeys []string) []LintIssue {
+	compiled, _ := t.current()
+	sent := make(map[string]map[string]bool)
+	for _, key := range serverKeys {
+		if m := componentKeyRe.FindStringSubmatch(key); m != nil {
+			if sent[m[1]] == nil {
+				sent[m[1]] = make(map[string]bool)
+			}
+			sent[m[1]][m[2]] = true
+		}
+	}
+
+	// Properties defined by component scripts and the ones they use themselves
+	defined := make(map[string]map[string]bool)
+	used := make(map[string]map[string]bool)
+	for _, m := range alpineDataRe.FindAllStringSubmatch(compiled, -1) {
+		addAll(defined, m[1], scriptDefRe.FindAllStringSubmatch(m[2], -1))
+		addAll(used, m[1], thisRefRe.FindAllStringSubmatch(m[2], -1))
+	}
+
+	populated := func(component, key string) bool {
+		return sent[component][key] || defined[component][key] || builtinKeys[key] ||
+			(component == "main" && builtinMainKeys[key])
+	}
+
+	unbound := make(map[LintIssue]bool)
+	walkBindings(compiled, func(components []string, loopVars map[string]bool, name, key string) {
+		for _, component := range components {
+			if used[component] == nil {
+				used[component] = make(map[string]bool)
+			}
+			used[component][key] = true
+		}
+		if loopVars[key] || strings.HasPrefix(key, "$") || jsGlobals[key] || !isValueDirective(name) {
+			return
+		}
+		// Alpine resolves names through all enclosing components
+		for _, component := range components {
+			if populated(component, key) {
+				return
+			}
+		}
+		unbound[LintIssue{Kind: "unbound", Component: components[len(components)-1], Key: key}] = true
+	})
+
+	var issues []LintIssue
+	for issue := range unbound {
+		issues = append(issues, issue)
+	}
+	for component, keys := range sent {
+		for key := range keys {
+			// Framework keys are consumed by helpers.js
+			if !used[component][key] && !builtinKeys[key] && !(component == "main" && builtinMainKeys[key]) {
+				issues = append(issues, LintIssue{Kind: "orphan", Component: component, Key: key})
+			}
+		}
+	}
+	sort.Slice(issues, func(i, j int) bool {
+		return issues[i].String() < issues[j].String()
+	})
+	return issues
+}
+
+func addAll(sets map[string]map[string]bool, component string, matches [][]string) {
+	if sets[component] == nil {
+		sets[component] = make(map[string]bool)
+	}
+	for _, m := range matches {
+		sets[component][m[1]] = true
+	}
+}
+
+// isValueDirective reports whether the attribute reads data, unlike event handlers which may call anything
+func isValueDirective(name string) bool {
+	switch name {
+	case "x-model", "x-text", "x-html", "x-for", "x-show", "x-if":
+		return true
+	}
+	return strings.HasPrefix(name, ":") || strings.HasPrefix(name, "x-bind:") || strings.HasPrefix(name, "x-model.")
+}
+
+// walkBindings calls fn for every identifier used in Alpine attributes, with the stack of
+// enclosing components (innermost last) and loop variables of enclosing x-for templates
+func walkBindings(src string, fn func(components []string, loopVars map[string]bool, name, key string)) {
+	type openTag struct {
+		tag        string
+		components []string
+		loopVars   map[string]bool
+	}
+	var stack []openTag
+	pos := 0
+	for {
+		loc := ssrTagRe.FindStringSubmatchIndex(src[pos:])
+		if loc == nil {
+			return
+		}
+		for i := range loc {
+			loc[i] += pos
+		}
+		if c := strings.Index(src[pos:loc[0]], "<!--"); c != -1 {
+			commentEnd := strings.Index(src[pos+c:], "-->")
+			if commentEnd == -1 {
+				return
+			}
+			pos += c + commentEnd + len("-->")
+			continue
+		}
+		pos = loc[1]
+
+		tag := strings.ToLower(src[loc[4]:loc[5]])
+		attrs := src[loc[6]:loc[7]]
+		if loc[3] > loc[2] {
+			for i := len(stack) - 1; i >= 0; i-- {
+				if stack[i].tag == tag {
+					stack = stack[:i]
+					break
+				}
+			}
+			continue
+		}
+		if lintSkippedTags[tag] {
+			if closeStart, closeEnd := findClosingTag(src, pos, tag); closeStart != -1 {
+				pos = closeEnd
+			}
+			continue
+		}
+
+		var components []string
+		loopVars := map[string]bool{}
+		if len(stack) > 0 {
+			components, loopVars = stack[len(stack)-1].components, stack[len(stack)-1].loopVars
+		}
+		if m := ssrXDataRe.FindStringSubmatch(attrs); m != nil {
+			components = append(components[:len(components):len(components)], m[1])
+		}
+		for _, attr := range attrRe.FindAllStringSubmatch(attrs, -1) {
+			name, expression := attr[1], attr[2]
+			if name == "x-for" {
+				if m := lintLoopVarRe.FindStringSubmatch(expression); m != nil {
+					vars := make(map[string]bool, len(loopVars)+2)
+					for v := range loopVars {
+						vars[v] = true
+					}
+					vars[m[1]], vars[m[2]] = true, m[2] != ""
+					loopVars = vars
+				}
+			}
+			if len(components) == 0 || !isAlpineAttr(name) {
+				continue
+			}
+			for _, m := range identifierRe.FindAllStringSubmatch(jsStringRe.ReplaceAllString(expression, "''"), -1) {
+				fn(components, loopVars, name, m[2])
+			}
+		}
+
+		if !voidElements[tag] && !strings.HasSuffix(strings.TrimSpace(attrs), "/") {
+			stack = append(stack, openTag{tag: tag, components: components, loopVars: loopVars})
+		}
+	}
+}
+
+func isAlpineAttr(name string) bool {
+	return name != "x-data" && (strings.HasPrefix(name, "x-") || strings.HasPrefix(name, ":") || strings.HasPrefix(name, "@"))
+}
+
+// ServerKeysFromSource collects "component::key" string literals from Go files in dir,
+// it is a cheap way to know which component data handlers send
+func ServerKeysFromSource(dir string) ([]string, error) {
+	seen := make(map[string]bool)
+	fset := token.NewFileSet()
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != dir && (strings.HasPrefix(d.Name(), ".") || d.Name() == "static") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+			return nil
+		}
+		file, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			return err
+		}
+		ast.Inspect(file, func(n ast.Node) bool {
+			if lit, ok := n.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+				if value, err := strconv.Unquote(lit.Value); err == nil && componentKeyRe.MatchString(value) {
+					seen[value] = true
+				}
+			}
+			return true
+		})
+		return nil
+	})
+
+	keys := make([]string, 0, len(seen))
+	for key := range seen {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, err
+}
+
+// runLint implements "jalpine lint": checks the template against keys found in Go sources of
+// the current directory, prints issues and exits with status 1 if there are any
+func runLint(templateFile string) {
+	t, err := NewJTemplate(templateFile, map[string]string{})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to compile %s: %v\n", templateFile, err)
+		os.Exit(2)
+	}
+	keys, err := ServerKeysFromSource(".")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read Go sources: %v\n", err)
+		os.Exit(2)
+	}
+	issues := t.Lint(keys)
+	for _, issue := range issues {
+		fmt.Println(issue)
+	}
+	if len(issues) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// LiveReloadPath is where pages in dev mode wait for template changes, see LiveReloadHandler
+const LiveReloadPath = "/_jalpine/reload"
+
+// LiveReloadHandler streams a "reload" event once the page given by the "version" query parameter
+// is outdated: any template file changed or the server was restarted with a new build.
+// Intended for dev mode only, helpers.js connects to it when HelperOptions.LiveReload is set.
+func (s *TemplateSet) LiveReloadHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		version := r.URL.Query().Get("version")
+		if version == "" {
+			http.Error(w, "version is required", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		rc := http.NewResponseController(w)
+
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+		lastWrite := time.Now()
+		for {
+			if !slices.Contains(s.versions(), version) {
+				fmt.Fprint(w, "event: reload\ndata: {}\n\n")
+				rc.Flush()
+				return
+			}
+			// Comments keep proxies from closing an idle stream
+			if time.Since(lastWrite) > 15*time.Second {
+				fmt.Fprint(w, ": ping\n\n")
+				lastWrite = time.Now()
+			}
+			rc.Flush()
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}
+}
+
+// versions updates all templates of the set and their variants and returns their versions
+func (s *TemplateSet) versions() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var versions []string
+	for _, t := range s.templates {
+		t.Update()
+		versions = append(versions, t.currentVersion())
+
+		t.variants.mu.Lock()
+		for _, v := range t.variants.templates {
+			v.Update()
+			versions = append(versions, v.currentVersion())
+		}
+		t.variants.mu.Unlock()
+	}
+	return versions
+}
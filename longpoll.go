@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// PollPath is the long polling alternative to EventsPath, helpers.js switches to it when event
+// streams don't get through a proxy
+const PollPath = "/_jalpine/poll"
+
+// pollSession keeps a long polling client registered between its requests, so messages
+// published in between wait in the client buffer like they do for event streams
+type pollSession struct {
+	client   *hubClient
+	lastPoll time.Time // End of the last request, sessions idle for pollIdle are reaped
+	polling  bool
+}
+
+const (
+	pollTimeout = 25 * time.Second // Below common proxy idle timeouts
+	pollIdle    = time.Minute      // Sessions not polled for this long are dropped
+)
+
+// ServePoll answers {"session": id, "messages": [...]} once there are messages for the
+// topics or after pollTimeout. The first request, without a session, subscribes to the topics
+// and returns the new session at once. An empty session in the answer means it has expired
+// and the client starts over.
+func (h *Hub) ServePoll(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("session")
+	h.mu.Lock()
+	session := h.polls[id]
+	if session != nil && session.polling {
+		h.mu.Unlock()
+		http.Error(w, "Already polling", http.StatusConflict)
+		return
+	}
+	if session != nil {
+		session.polling = true
+	}
+	h.mu.Unlock()
+
+	if session == nil {
+		h.startPollSession(w, r)
+		return
+	}
+	client := session.client
+
+	var messages [][]byte
+	expired := false
+	timeout := time.NewTimer(pollTimeout)
+	defer timeout.Stop()
+	select {
+	case <-r.Context().Done():
+	case <-timeout.C:
+	case <-client.closed:
+		// Dropped by the slow client policy
+		expired = true
+	case message := <-client.send:
+		messages = append(messages, message)
+		// Everything buffered goes in the same answer
+		for more := true; more; {
+			select {
+			case message := <-client.send:
+				messages = append(messages, message)
+			default:
+				more = false
+			}
+		}
+	}
+
+	h.mu.Lock()
+	session.polling = false
+	session.lastPoll = time.Now()
+	if expired {
+		delete(h.polls, id)
+		id = ""
+	}
+	h.mu.Unlock()
+	writePollAnswer(w, id, messages)
+}
+
+func (h *Hub) startPollSession(w http.ResponseWriter, r *http.Request) {
+	client := h.newClient(r)
+	// The user topic counts, a connection without any would never receive anything
+	if len(client.topics) == 0 {
+		http.Error(w, "No topics", http.StatusBadRequest)
+		return
+	}
+	if err := h.register(client); err != nil {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	id := hex.EncodeToString(buf)
+
+	h.mu.Lock()
+	h.polls[id] = &pollSession{client: client, lastPoll: time.Now()}
+	h.mu.Unlock()
+	h.pollReaper.Do(func() { go h.reapPolls() })
+	writePollAnswer(w, id, nil)
+}
+
+// reapPolls unregisters clients of sessions that stopped polling, e.g. closed tabs, until
+// the hub is closed
+func (h *Hub) reapPolls() {
+	ticker := time.NewTicker(pollIdle / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.closed:
+			return
+		case now := <-ticker.C:
+			h.mu.Lock()
+			for id, session := range h.polls {
+				if !session.polling && now.Sub(session.lastPoll) >= pollIdle {
+					delete(h.polls, id)
+					h.unregister(session.client)
+				}
+			}
+			h.mu.Unlock()
+		}
+	}
+}
+
+// writePollAnswer inserts the messages as they are, they are JSON already
+func writePollAnswer(w http.ResponseWriter, session string, messages [][]byte) {
+	quoted, _ := json.Marshal(session)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte(`{"session":` + string(quoted) + `,"messages":[` + string(bytes.Join(messages, []byte(","))) + `]}`))
+}
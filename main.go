@@ -1,11 +1,20 @@
 package main
 
 import (
+	"context"
+	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -18,269 +27,854 @@ type Todo struct {
 	Text      string    `json:"text"`
 	Completed bool      `json:"completed"`
 	CreatedAt time.Time `json:"createdAt"`
+	Revision
 }
 
 // TodoIDRequest is used for operations that require only a todo ID
 type TodoIDRequest struct {
-	ID string `json:"id" validate:"required"`
+	ID  string `json:"id" validate:"required"`
+	Rev int64  `json:"rev"` // Revision the page shows, checked by toggles
+}
+
+// NewTodoRequest is the input field of a new todo
+type NewTodoRequest struct {
+	Text string `json:"newTodo" validate:"required,min=1,max=100" moderate:"true"`
 }
 
 var (
-	db       *buntdb.DB
+	db       *buntdb.DB // The "main" database, todos and audit entries
+	dbs      *Databases
 	template *JTemplate
+	hub      *Hub
+	archive  *FileArchive
+	libGuard *LibGuard
+	clock    Clock = SystemClock{}
+	devMode        = os.Getenv("JALPINE_DEV") != ""
 )
 
 const (
 	MaxTodos = 150
 )
 
+// Features limited by region of the client, e.g. {Deny: []string{"US-CA"}}, needs JALPINE_GEOIP.
+// Export is available everywhere for now.
+var regionGates = RegionGates{"export": {Unknown: true}}
+
+// Bumped on every write of todos, so open pages learn that their list is stale
+var todoVersions = NewDataVersions()
+
+// Copy files from static/ here to start without internet access, see DownloadConfig.Fallback
+//
+//go:embed fallbacklibs
+var fallbackLibs embed.FS
+
+// Words rejected in todo texts by the content filter
+var blockedWords = []string{"damn", "crap"}
+
+// Libraries downloaded into ./static and injected into pages. Alpine is pinned, so a clean deploy
+// can't pick up a new major
+var staticLibs = []EnsureLibsEntry{AlpineJS.WithVersion("3.14.8"), TailwindCSS, AlpineAutoAnimate, AlpinePersist.WithVersion("3.14.8")}
+
+//go:generate go run . vendor
+
 func main() {
-	// Initialize database
-	var err error
-	db, err = buntdb.Open("data.db")
+	// Empty todo lists reach x-for as [] rather than null
+	DefaultJSONOptions = &JSONOptions{EmptySlices: true}
+
+	// Developer commands, e.g. "go run . lint"
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "lint":
+			runLint("index.html")
+			return
+		case "package":
+			runPackage(os.Args[2:])
+			return
+		case "dev":
+			runDev(os.Args[2:])
+			return
+		case "retention":
+			runRetentionDryRun()
+			return
+		case "update-libs":
+			runUpdateLibs()
+			return
+		case "vendor":
+			runVendor("static", staticLibs...)
+			return
+		case "types":
+			// TypeScript declarations of the API, e.g. "go run . types > api.d.ts"
+			pages := NewTemplateSet(".", map[string]string{})
+			template, _ = pages.Get("index.html")
+			types, _, err := ClientAPIFromSource(".", newRouter(pages))
+			if err != nil {
+				log.Fatalf("Failed to read Go sources: %v", err)
+			}
+			fmt.Print(types)
+			return
+		case "client":
+			// Functions for $api, e.g. "go run . client > static/api.js"
+			pages := NewTemplateSet(".", map[string]string{})
+			template, _ = pages.Get("index.html")
+			script, err := ClientScriptFromSource(".", newRouter(pages))
+			if err != nil {
+				log.Fatalf("Failed to read Go sources: %v", err)
+			}
+			fmt.Print(script)
+			return
+		case "routes":
+			// Handlers are only listed, so templates are enough
+			pages := NewTemplateSet(".", map[string]string{})
+			template, _ = pages.Get("index.html")
+			router := newRouter(pages)
+			newServer(router)
+			runRoutes(router)
+			return
+		default:
+			log.Fatalf("Unknown command %q", os.Args[1])
+		}
+	}
+
+	// Listen right away, so probes report the progress while the app initializes
+	startup := NewStartup("database", "static libs", "templates")
+	addr := envOr("JALPINE_ADDR", ":8080")
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+	server := &http.Server{Handler: startup}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Serve(listener)
+	}()
+
+	// Initialize databases, closed by the last shutdown hook
+	err = startup.Run("database", func() (err error) {
+		dbs, err = OpenDatabases(appDatabases()...)
+		return err
+	})
 	if err != nil {
 		log.Fatalf("Failed to open database: %v", err)
 	}
-	defer db.Close()
+	db = dbs.Get("main")
+	dbs.Register(startup)
+	defer dbs.Schedule()()
+
+	archive, err = OpenFileArchive(envOr("JALPINE_ARCHIVE", "archive.jsonl.gz"))
+	if err != nil {
+		log.Fatalf("Failed to open archive: %v", err)
+	}
+	defer archive.Close()
+	startup.OnShutdown(func(ctx context.Context) error { return archive.Flush() })
+
+	// Replicas share realtime updates through JALPINE_BROKER, e.g. redis://localhost:6379
+	broker, err := BrokerFromURL(os.Getenv("JALPINE_BROKER"))
+	if err != nil {
+		log.Fatalf("Failed to configure broker: %v", err)
+	}
+	hub = NewHub(WithMaxConnsPerIP(20), WithBroker(broker))
+	todoImporter.Hub = hub
+	todoImporter.Begin = beginTodoImport
+	todoImporter.Clock = clock
+
+	retention, err := NewRetention(db, todoRetention, WithRetentionClock(clock), WithArchiver(archive),
+		OnRetentionRemoved(func(rule RetentionRule, keys []string) {
+			// Open pages drop the todos like deleted ones
+			ids := make([]interface{}, 0, len(keys))
+			for _, key := range keys {
+				ids = append(ids, strings.TrimPrefix(key, "todo:"))
+			}
+			broadcastTodos(PatchList[Todo]("id").Remove(ids...).Versioned(todoVersions.Bump("todoApp")))
+		}))
+	if err != nil {
+		log.Fatalf("Invalid retention rules: %v", err)
+	}
+	defer retention.Schedule(time.Hour)()
 
 	// Create static directory if it doesn't exist
 	if err = os.MkdirAll("./static", 0755); err != nil {
 		log.Fatalf("Failed to create static directory: %v", err)
 	}
 
-	// Initialize and download required libraries
-	libsMap, err := EnsureStaticLibs("./static", AlpineJS, TailwindCSS, AlpineAutoAnimate, AlpinePersist)
+	// Initialize and download required libraries, through an internal registry if configured.
+	// Copies in fallbacklibs/ are used when the CDN is unreachable.
+	LibDownloads.Fallback, _ = fs.Sub(fallbackLibs, "fallbacklibs")
+	LibDownloads.SourceMaps = devMode
+	LibDownloads.Precompress = true
+	LibDownloads.Mirrors, err = ParseMirrors(os.Getenv("JALPINE_MIRRORS"))
+	if err != nil {
+		log.Fatalf("Failed to configure mirrors: %v", err)
+	}
+	// JALPINE_ESBUILD=0.25.2 minifies libraries that are downloaded unminified
+	if version := os.Getenv("JALPINE_ESBUILD"); version != "" {
+		if LibDownloads.Minify, err = EnsureEsbuild("./bin", version); err != nil {
+			log.Fatalf("Failed to ensure esbuild: %v", err)
+		}
+	}
+	var libsMap map[string]string
+	err = startup.Run("static libs", func() (err error) {
+		// Binaries built with -tags vendored carry the libraries, see "go run . vendor"
+		if vendoredLibs != nil {
+			libsMap = vendoredLibs.Libs
+			return nil
+		}
+		libsMap, err = EnsureStaticLibs("./static", staticLibs...)
+		return err
+	})
 	if err != nil {
 		log.Fatalf("Failed to ensure static libraries: %v", err)
 	}
+	// Libraries deleted while running are downloaded again and reported on /_jalpine/health
+	if vendoredLibs == nil {
+		libGuard = NewLibGuard("./static", libsMap, staticLibs...).Redownload(true)
+		startup.Check("static libs", libGuard.Err)
+	}
+	// JALPINE_BUNDLE=1 joins the deferred libraries into one file, Alpine after its plugins
+	if os.Getenv("JALPINE_BUNDLE") != "" && vendoredLibs == nil {
+		if libsMap, err = BundleLibs("./static", libsMap, staticLibs...); err != nil {
+			log.Fatalf("Failed to bundle static libraries: %v", err)
+		}
+	}
 
-	// Load and prepare the template
-	template, err = NewJTemplate("index.html", libsMap)
+	// Load and prepare the templates
+	templateOpts := []TemplateOption{WithClock(clock), WithDevMode(devMode), WithAutoCloak(true),
+		WithBuildID(os.Getenv("JALPINE_BUILD")), WithHelperOptions(HelperOptions{PollSeconds: 60, Transport: os.Getenv("JALPINE_TRANSPORT")}),
+		WithContentFilters(WordListFilter("Please keep it polite", blockedWords...)), WithRegionGates(regionGates),
+		WithDataVersions(todoVersions), WithLibHashes(LibHashes(staticFS(), libsMap)), WithLibEntries(staticLibs...),
+		WithStrictComponents(devMode)}
+	// JALPINE_CDN=1 serves the locked libraries from the CDN, falling back to ./static in the browser
+	if os.Getenv("JALPINE_CDN") != "" {
+		lock, err := ReadLibsLock(LockFilePath("./static"))
+		if err != nil {
+			log.Fatalf("Failed to read %s: %v", LockFileName, err)
+		}
+		templateOpts = append(templateOpts, WithCDNLibs(CDNLibs(lock)))
+	}
+	// JALPINE_EXTERNAL_SCRIPTS=1 links helpers.js instead of inlining it, "data" moves the component data out as well
+	if external := os.Getenv("JALPINE_EXTERNAL_SCRIPTS"); external != "" {
+		templateOpts = append(templateOpts, WithExternalScripts(ExternalScripts{Data: external == "data"}))
+	}
+	// JALPINE_TAILWIND=4.1.4 builds the CSS with the Tailwind CLI instead of compiling it in the browser,
+	// JALPINE_TAILWIND_SHA256 pins the release asset of this platform
+	if version := os.Getenv("JALPINE_TAILWIND"); version != "" {
+		cli, err := EnsureTailwindCLI("./bin", version, os.Getenv("JALPINE_TAILWIND_SHA256"))
+		if err != nil {
+			log.Fatalf("Failed to ensure Tailwind CLI: %v", err)
+		}
+		templateOpts = append(templateOpts, WithTailwindCLI(&TailwindCLI{Path: cli, StaticDir: "./static"}))
+	}
+	pages := NewTemplateSet(".", libsMap, templateOpts...)
+	err = startup.Run("templates", func() (err error) {
+		template, err = pages.Get("index.html")
+		return err
+	})
 	if err != nil {
 		log.Fatalf("Failed to create template: %v", err)
 	}
+	// Changes of the Todo struct must invalidate opened pages as well
+	template.SetDataSchema(Todo{})
+	// Confirmations and the unsaved input warning are enforced by helpers.js
+	template.GuardAction("POST", ActionsPath+"/todos.delete", ActionGuard{Confirm: "Are you sure you want to delete this todo?"})
+	template.GuardAction("POST", ActionsPath+"/todos.clear-completed", ActionGuard{Confirm: "Delete all completed todos?"})
+	template.GuardUnsaved("todoApp", "newTodo")
+	// Open pages learn about a new version right away instead of on their next request
+	template.OnTemplateReload(func(version string) {
+		hub.Publish("todoApp", map[string]interface{}{"main::availVersion": version})
+	})
+
+	// Weekly todo summary by email, e.g. JALPINE_SMTP=smtp.example.com:25 JALPINE_REPORT_TO=me@example.com
+	if smtpAddr := os.Getenv("JALPINE_SMTP"); smtpAddr != "" {
+		mailer := SMTPMailer{Addr: smtpAddr, From: envOr("JALPINE_MAIL_FROM", "jalpine@localhost")}
+		var recipients []string
+		for _, to := range strings.Split(os.Getenv("JALPINE_REPORT_TO"), ",") {
+			if to = strings.TrimSpace(to); to != "" {
+				recipients = append(recipients, to)
+			}
+		}
+		reports, err := NewReports(db, mailer, todoReports(recipients), WithReportsClock(clock))
+		if err != nil {
+			log.Fatalf("Invalid reports: %v", err)
+		}
+		defer reports.Schedule()()
+	}
+
+	// kill -HUP reloads templates immediately
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			if err := pages.ForceReload(); err == nil {
+				log.Println("Templates reloaded")
+			}
+		}
+	}()
 
 	// Set up routes
-	router := mux.NewRouter()
-	router.HandleFunc("/", handleIndex).Methods("GET")
-	router.HandleFunc("/todos", handleGetTodos).Methods("GET")
-	router.HandleFunc("/todos", handleCreateTodo).Methods("POST")
-	router.HandleFunc("/todos/toggle", handleToggleTodo).Methods("POST")
-	router.HandleFunc("/todos/delete", handleDeleteTodo).Methods("POST")
-	router.HandleFunc("/todos/clear-completed", handleClearCompleted).Methods("POST")
-
-	// Serve static files
-	router.PathPrefix("/static/").Handler(
-		http.StripPrefix("/static/", http.FileServer(http.Dir("./static"))),
-	)
-
-	// Start the server
-	log.Println("Server starting on http://localhost:8080")
-	if err := http.ListenAndServe(":8080", router); err != nil {
+	router := newRouter(pages)
+	// Deliveries of a GitHub webhook, e.g. to show new releases. Registered here rather than in
+	// newRouter, the commands listing routes have no databases or hub.
+	if secret := os.Getenv("JALPINE_GITHUB_SECRET"); secret != "" {
+		router.Handle("/webhooks/github", NewWebhookReceiver("github", GitHubVerifier(secret), dbs.Get("ephemeral"), hub.broker)).Methods("POST")
+		OnWebhook(hub.broker, "github", func(eventType string, payload []byte) {
+			log.Printf("GitHub webhook: %s event, %d bytes", eventType, len(payload))
+		})
+	}
+
+	// Start serving the app, the first page is rendered before traffic arrives
+	startup.OnStartup("warm up", func() error {
+		r, _ := http.NewRequest("GET", "/", nil)
+		data, err := loadIndexData(r)
+		if err == nil {
+			_, err = template.ExecuteBytes(data)
+		}
+		return err
+	})
+	if err := startup.Ready(newServer(router)); err != nil {
+		log.Fatalf("Failed to start: %v", err)
+	}
+	log.Printf("Server started on %s", addr)
+	// Under systemd with WatchdogSec= the service is restarted when it stops answering
+	defer startup.SystemdWatchdog(listener.Addr().String())()
+
+	// SIGINT and SIGTERM finish running requests and the shutdown hooks before exiting
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-serverErr:
 		log.Fatalf("Server failed: %v", err)
+	case <-stop:
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown: %v", err)
+	}
+	if err := startup.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown hooks: %v", err)
+	}
+	log.Println("Server stopped")
+}
+
+// newServer wraps the router with the middlewares of every request
+func newServer(router *mux.Router) http.Handler {
+	// Webhook deliveries are not made by helpers.js, their JSON must not fail the protocol check
+	handler := http.NewServeMux()
+	handler.Handle("/webhooks/", router)
+	handler.Handle("/", template.ProtocolCheck(router))
+	AroundRouter(router, "ProtocolCheck", "/webhooks/")
+	AroundRouter(router, "Compress", "")
+	return Compress(handler)
+}
+
+// newRouter registers all routes of the app
+func newRouter(pages *TemplateSet) *mux.Router {
+	router := mux.NewRouter()
+	// Pages and answers of identified visitors are never shared through caches
+	UseMiddleware(router, "PrivateCache", PrivateCache(AuthSegment(GuestCookie)))
+	// Client locations for the page, needs a GeoLite2 database
+	if path := os.Getenv("JALPINE_GEOIP"); path != "" {
+		geoDB, err := OpenMMDB(path)
+		if err != nil {
+			log.Fatalf("Failed to open GeoIP database: %v", err)
+		}
+		UseMiddleware(router, "GeoMiddleware", GeoMiddleware(geoDB, WithClientGeo()))
+	}
+	pages.Handle(router, "/", "index.html", loadIndexData)
+	router.HandleFunc("/todos", Handle(template, getTodos)).Methods("GET")
+	router.HandleFunc("/todos", Handle(template, createTodo)).Methods("POST")
+	router.HandleFunc("/todos/archived", Handle(template, getArchivedTodos)).Methods("GET")
+	router.HandleFunc("/todos/import/preview", heavyActions.Limit(template, todoImporter.Preview(template))).Methods("POST")
+	router.HandleFunc("/todos/import/confirm", heavyActions.Limit(template, todoImporter.Confirm(template))).Methods("POST")
+	router.HandleFunc("/todos/import/status", todoImporter.Status(template)).Methods("GET")
+	router.HandleFunc("/todos/export.xlsx", regionGates.Require("export", heavyActions.Limit(template, XLSXHandler("todos.xlsx", streamTodos,
+		Column[Todo]{Header: "Task", Value: func(todo Todo) any { return todo.Text }, Width: 50},
+		Column[Todo]{Header: "Completed", Value: func(todo Todo) any { return todo.Completed }},
+		Column[Todo]{Header: "Created", Value: func(todo Todo) any { return todo.CreatedAt }, Width: 20},
+	)))).Methods("GET")
+
+	// Changes of single todos are actions called by name, $action('todos.toggle', {id})
+	actions := NewActionDispatcher(template)
+	actions.Register("todos.toggle", handleToggleTodo)
+	actions.Register("todos.delete", Handle(template, deleteTodo))
+	actions.Register("todos.clear-completed", template.RequireNonce("todos.clear-completed", handleClearCompleted))
+	router.PathPrefix(ActionsPath + "/").Handler(actions).Methods("POST")
+	// Routes of the actions before they had names, for pages opened before the update
+	router.HandleFunc("/todos/toggle", template.Deprecated("Use $action('todos.toggle')", handleToggleTodo)).Methods("POST")
+	router.HandleFunc("/todos/delete", template.Deprecated("Use $action('todos.delete')", Handle(template, deleteTodo))).Methods("POST")
+	router.HandleFunc("/todos/clear-completed", template.Deprecated("Use $action('todos.clear-completed')",
+		template.RequireNonce("todos.clear-completed", handleClearCompleted))).Methods("POST")
+
+	// Updates for x-subscribe topics
+	router.HandleFunc(EventsPath, hub.ServeSSE).Methods("GET")
+	router.HandleFunc(PollPath, hub.ServePoll).Methods("GET")
+	// Actions sent over the socket go through the same routes as regular requests
+	router.HandleFunc(WSPath, hub.ServeWS(template.ProtocolCheck(router))).Methods("GET")
+
+	// Previews of links and Markdown of user content
+	router.HandleFunc(UnfurlPath, NewUnfurler().Handler(template)).Methods("POST")
+	router.HandleFunc(MarkdownPath, MarkdownHandler(template, DefaultMarkdownPolicy)).Methods("POST")
+
+	// Database browser for admins
+	if password := os.Getenv("JALPINE_ADMIN_PASSWORD"); password != "" {
+		kv := NewKVBrowser(db, BasicAuth("admin", password))
+		KVType[Todo](kv, "todo:")
+		kv.OnChange = func(key string) {
+			if strings.HasPrefix(key, "todo:") {
+				todoVersions.Bump("todoApp")
+			}
+		}
+		router.Handle(KVBrowserPath, kv)
+	}
+
+	// Tokens of actions protected by RequireNonce, fetched before their first call
+	router.HandleFunc(NoncePath, template.NonceHandler()).Methods("GET")
+
+	// Polled by pages for new versions, see HelperOptions.PollSeconds
+	router.HandleFunc(VersionPath, template.VersionHandler()).Methods("GET")
+
+	// helpers.js and page data of WithExternalScripts
+	router.HandleFunc(HelpersPath, template.HelpersHandler()).Methods("GET")
+	router.PathPrefix(PageDataPath).HandlerFunc(template.PageDataHandler()).Methods("GET")
+
+	// Client-side errors reported by helpers.js
+	router.HandleFunc(ClientLogPath, template.ClientLogHandler()).Methods("POST")
+
+	// Template internals for development
+	if devMode {
+		router.HandleFunc("/_jalpine/profile", template.ProfileHandler()).Methods("GET")
+		router.HandleFunc(DebugPath, template.DebugHandler()).Methods("GET")
+		router.HandleFunc(LiveReloadPath, pages.LiveReloadHandler()).Methods("GET")
+		router.HandleFunc(LibUpdatesPath, LibUpdatesHandler("./static", staticLibs...)).Methods("GET")
 	}
+
+	// Functions of $api, generated from the sources in dev mode and by "go run . client > static/api.js" otherwise
+	if devMode {
+		router.HandleFunc(ClientAPIPath, ClientAPIHandler(".", router)).Methods("GET")
+	} else {
+		router.HandleFunc(ClientAPIPath, ClientAPIFile("./static/api.js", ".", router)).Methods("GET")
+	}
+
+	// Serve static files from memory, libraries precompressed, with source maps in dev mode
+	files, err := NewStaticFiles(os.DirFS("./static"))
+	if err != nil {
+		log.Fatalf("Failed to load static files: %v", err)
+	}
+	var static http.Handler = files
+	if devMode {
+		files.Watch(time.Second)
+		static = SourceMapHeaders("./static", static)
+	}
+	if libGuard != nil {
+		static = libGuard.Handler(static)
+	}
+	if vendoredLibs != nil {
+		static = vendoredLibs.Handler(static)
+	}
+	// Library URLs carry content hashes, see WithLibHashes
+	router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", CacheImmutable(static)))
+	return router
+}
+
+// staticFS has the library files, embedded ones in vendored builds
+func staticFS() fs.FS {
+	if vendoredLibs != nil {
+		return vendoredLibs.FS
+	}
+	return os.DirFS("./static")
+}
+
+// envOr returns the environment variable or the fallback if it is not set
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
 }
 
-// handleIndex serves the main page
-func handleIndex(w http.ResponseWriter, r *http.Request) {
+// loadIndexData provides data for the main page
+func loadIndexData(r *http.Request) (map[string]interface{}, error) {
 	todos, err := getAllTodos()
 	if err != nil {
-		http.Error(w, "Failed to fetch todos", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
-	data := map[string]interface{}{
+	return map[string]interface{}{
 		"todoApp::todos":   todos,
 		"todoApp::newTodo": "",
+	}, nil
+}
+
+// todoRetention archives completed todos nobody has looked at for a month
+var todoRetention = []RetentionRule{{
+	Name:      "completed todos",
+	Pattern:   "todo:*",
+	TimeField: "createdAt",
+	MaxAge:    30 * 24 * time.Hour,
+	Match:     map[string]interface{}{"completed": true},
+	Action:    RetentionArchive,
+}}
+
+// appDatabases keeps todos apart from short-lived keys like webhook delivery ids, which expire
+// all the time and are not worth a backup. JALPINE_BACKUPS enables daily snapshots of todos.
+func appDatabases() []Database {
+	return []Database{{
+		Name:      "main",
+		Path:      envOr("JALPINE_DB", "data.db"),
+		BackupDir: os.Getenv("JALPINE_BACKUPS"),
+	}, {
+		Name:        "ephemeral",
+		Path:        envOr("JALPINE_EPHEMERAL_DB", "ephemeral.db"),
+		Config:      func(config *buntdb.Config) { config.SyncPolicy = buntdb.Never },
+		ShrinkEvery: time.Hour,
+	}}
+}
+
+// todoReports mails the open todos on Monday mornings, with the data of the main page
+func todoReports(recipients []string) []Report {
+	return []Report{{
+		Name:       "weekly todos",
+		Cron:       "0 8 * * 1",
+		Recipients: recipients,
+		Subject:    "Your todos this week",
+		Load:       loadIndexData,
+		Template:   `<h2>Open todos</h2><ul>{{range index . "todoApp::todos"}}{{if not .Completed}}<li>{{.Text}}</li>{{end}}{{end}}</ul>`,
+	}}
+}
+
+// runRetentionDryRun prints what the retention rules would remove now
+func runRetentionDryRun() {
+	db, err := buntdb.Open(envOr("JALPINE_DB", "data.db"))
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	archive, err := OpenFileArchive(envOr("JALPINE_ARCHIVE", "archive.jsonl.gz"))
+	if err != nil {
+		log.Fatalf("Failed to open archive: %v", err)
+	}
+	defer archive.Close()
+	retention, err := NewRetention(db, todoRetention, WithArchiver(archive))
+	if err != nil {
+		log.Fatalf("Invalid retention rules: %v", err)
 	}
+	out, _ := json.MarshalIndent(retention.Run(true), "", "  ")
+	fmt.Println(string(out))
+}
 
-	if err := template.Execute(w, data); err != nil {
-		log.Printf("Error rendering template: %v", err)
+// runUpdateLibs upgrades staticLibs and removes old versions, "go run . update-libs"
+func runUpdateLibs() {
+	var err error
+	LibDownloads.Mirrors, err = ParseMirrors(os.Getenv("JALPINE_MIRRORS"))
+	if err != nil {
+		log.Fatalf("Failed to configure mirrors: %v", err)
+	}
+	libsMap, err := UpdateStaticLibs("./static", staticLibs...)
+	if err != nil {
+		log.Fatalf("Failed to update static libraries: %v", err)
+	}
+	for _, lib := range staticLibs {
+		fmt.Println(libsMap[lib.Name])
 	}
 }
 
-// handleGetTodos handles GET requests for todos
-func handleGetTodos(w http.ResponseWriter, r *http.Request) {
+// heavyActions limits imports and exports, so a few big files can't take the server down
+var heavyActions = NewConcurrencyLimiter(2, 20)
+
+// todoImporter imports todos from CSV files, progress is published to the todoApp topic
+var todoImporter = NewImporter("todoApp", nil,
+	ImportField{Name: "text", Label: "Task", Required: true},
+	ImportField{Name: "completed", Label: "Completed"},
+)
+
+// beginTodoImport loads the todos once per import, rows are checked against an index of
+// their titles and skipped when a todo with the same text exists
+func beginTodoImport() (func(record map[string]string) error, error) {
 	todos, err := getAllTodos()
 	if err != nil {
-		template.Error(w, "Failed to fetch todos")
-		return
+		return nil, err
 	}
-	template.JSON(w, map[string]interface{}{
-		"todoApp::todos": todos,
-	})
+	titles := make(map[string]bool, len(todos))
+	for _, todo := range todos {
+		titles[strings.ToLower(todo.Text)] = true
+	}
+	count := len(todos)
+
+	return func(record map[string]string) error {
+		type ImportedTodo struct {
+			Text string `json:"text" validate:"required,min=1,max=100" moderate:"true"`
+		}
+		imported := ImportedTodo{Text: record["text"]}
+		if err := validate.Struct(imported); err != nil {
+			return err
+		}
+		// Imported todos pass the same content filters as typed ones
+		if err := template.moderate(context.Background(), &imported); err != nil {
+			var rejection *ContentRejection
+			if errors.As(err, &rejection) {
+				return errors.New(rejection.Reason)
+			}
+			log.Printf("Content filter failed: %v", err)
+			return errors.New("can't check the content, try again later")
+		}
+		title := strings.ToLower(record["text"])
+		if titles[title] {
+			return fmt.Errorf("%q already exists", record["text"])
+		}
+		if count >= MaxTodos {
+			return fmt.Errorf("maximum number of todos (%d) reached", MaxTodos)
+		}
+
+		completed, _ := strconv.ParseBool(record["completed"])
+		now := clock.Now()
+		todo := Todo{ID: now.String(), Text: record["text"], Completed: completed, CreatedAt: now}
+		change, err := saveTodo(todo)
+		if err != nil {
+			return err
+		}
+		titles[title] = true
+		count++
+		broadcastTodos(PatchList[Todo]("id").Append(todo).Versioned(change))
+		return nil
+	}, nil
+}
+
+// todoExportBatch is how many todos an export reads per transaction
+const todoExportBatch = 500
+
+// streamTodos passes all todos to yield for exports, reading them in batches so a slow
+// download doesn't hold the database
+func streamTodos(r *http.Request, yield func(todo Todo) bool) error {
+	pivot := "todo:"
+	for {
+		var batch []Todo
+		read := 0
+		err := db.View(func(tx *buntdb.Tx) error {
+			return tx.AscendGreaterOrEqual("", pivot, func(key, value string) bool {
+				if !strings.HasPrefix(key, "todo:") || read == todoExportBatch {
+					return false
+				}
+				read++
+				pivot = key + "\x00"
+				var todo Todo
+				if err := json.Unmarshal([]byte(value), &todo); err == nil {
+					batch = append(batch, todo)
+				}
+				return true
+			})
+		})
+		if err != nil {
+			return err
+		}
+		for _, todo := range batch {
+			if !yield(todo) {
+				return nil
+			}
+		}
+		if read < todoExportBatch {
+			return nil
+		}
+	}
+}
+
+// Filters of the todo list, the UI renders its buttons from "main::enums"
+var TodoFilter = NewEnum("TodoFilter", "all", "active", "completed")
+
+// TodoListQuery are optional query parameters of GET /todos
+type TodoListQuery struct {
+	Filter string `query:"filter" validate:"omitempty,enum=TodoFilter"`
+	Limit  int    `query:"limit" validate:"min=0,max=150"`
 }
 
-// handleCreateTodo handles POST requests to create a new todo
-func handleCreateTodo(w http.ResponseWriter, r *http.Request) {
-	type NewTodoRequest struct {
-		Text string `json:"newTodo" validate:"required,min=1,max=100"`
+// getTodos answers GET requests for todos, see Handle
+func getTodos(ctx context.Context, query TodoListQuery) (map[string]any, error) {
+	todos, err := getAllTodos()
+	if err != nil {
+		log.Printf("Failed to fetch todos: %v", err)
+		return nil, errors.New("Couldn't load the todos, try again")
 	}
 
-	req, ok := DecodeAndValidate[NewTodoRequest](template, w, r)
-	if !ok {
-		return
+	// Same filters as in the UI
+	if query.Filter == "active" || query.Filter == "completed" {
+		filtered := make([]Todo, 0, len(todos))
+		for _, todo := range todos {
+			if todo.Completed == (query.Filter == "completed") {
+				filtered = append(filtered, todo)
+			}
+		}
+		todos = filtered
+	}
+	if query.Limit > 0 && len(todos) > query.Limit {
+		todos = todos[:query.Limit]
+	}
+	return map[string]any{
+		"todoApp::todos": todos,
+	}, nil
+}
+
+// getArchivedTodos returns todos moved to the archive by the retention rules, see Handle
+func getArchivedTodos(ctx context.Context, _ struct{}) (map[string]any, error) {
+	todos := make([]Todo, 0)
+	err := archive.Scan("todo:", func(record ArchivedRecord) bool {
+		var todo Todo
+		if err := json.Unmarshal([]byte(record.Value), &todo); err == nil {
+			todos = append(todos, todo)
+		}
+		return true
+	})
+	if err != nil {
+		log.Printf("Failed to read the archive: %v", err)
+		return nil, errors.New("Couldn't read the archive, try again")
 	}
+	return map[string]any{
+		"todoApp::archivedTodos": todos,
+	}, nil
+}
 
+// createTodo handles POST requests to create a new todo, see Handle
+func createTodo(ctx context.Context, req NewTodoRequest) (map[string]any, error) {
 	// Check if we've reached the maximum number of todos
 	todos, err := getAllTodos()
 	if err != nil {
-		template.Error(w, "Failed to check todos count")
-		return
+		log.Printf("Failed to check todos count: %v", err)
+		return nil, errors.New("Couldn't save the todo, try again")
 	}
 
 	if len(todos) >= MaxTodos {
-		template.Error(w, fmt.Sprintf("Maximum number of todos (%d) reached. Please delete some todos first.", MaxTodos))
-		return
+		return nil, fmt.Errorf("Maximum number of todos (%d) reached. Please delete some todos first.", MaxTodos)
 	}
 
 	// Create and save new todo
+	now := clock.Now()
 	todo := Todo{
-		ID:        time.Now().String(),
+		ID:        now.String(),
 		Text:      req.Text,
 		Completed: false,
-		CreatedAt: time.Now(),
+		CreatedAt: now,
 	}
 
-	if err := saveTodo(todo); err != nil {
-		template.Error(w, "Failed to save todo")
-		return
-	}
-
-	// Return updated list
-	todos, err = getAllTodos()
+	change, err := saveTodo(todo)
 	if err != nil {
-		template.Error(w, "Failed to fetch updated todos")
-		return
+		log.Printf("Failed to save todo: %v", err)
+		return nil, errors.New("Couldn't save the todo, try again")
 	}
 
-	template.JSON(w, map[string]interface{}{
-		"todoApp::todos":   todos,
+	// Only the new todo is sent, the pages have the rest
+	patch := PatchList[Todo]("id").Append(todo).Versioned(change)
+	broadcastTodos(patch)
+	return map[string]any{
+		"todoApp::todos":   patch,
 		"todoApp::newTodo": "", // Clear the input field
-		"main::error":      "", // Clear error
-	})
+		"todoApp::error":   "", // Clear error
+	}, nil
 }
 
-// handleToggleTodo toggles the completed status of a todo
+// handleToggleTodo toggles the completed status of a todo. It isn't written for Handle,
+// since a stale revision is answered with Conflict, a 409 with the stored todo.
 func handleToggleTodo(w http.ResponseWriter, r *http.Request) {
 	req, ok := DecodeAndValidate[TodoIDRequest](template, w, r)
 	if !ok {
 		return
 	}
 
-	// Find and toggle the todo
-	err := db.Update(func(tx *buntdb.Tx) error {
-		val, err := tx.Get("todo:" + req.ID)
-		if err != nil {
-			return err
-		}
-
-		var todo Todo
-		if err := json.Unmarshal([]byte(val), &todo); err != nil {
-			return err
-		}
-
-		// Toggle the completed status
-		todo.Completed = !todo.Completed
-
-		// Save the updated todo
-		todoJSON, err := json.Marshal(todo)
-		if err != nil {
-			return err
-		}
-		_, _, err = tx.Set("todo:"+todo.ID, string(todoJSON), nil)
+	// Toggle the todo unless another tab changed it since the page got it
+	var todo *Todo
+	change, err := todoVersions.UpdateChange(db, "todoApp", func(tx *buntdb.Tx) (err error) {
+		todo, err = UpdateEntity[Todo](tx, clock, "todo:"+req.ID, req.Rev, func(todo *Todo) error {
+			todo.Completed = !todo.Completed
+			return nil
+		})
 		return err
 	})
 
-	if err != nil {
-		template.Error(w, "Failed to toggle todo: "+err.Error())
+	// Show the todo as it is now instead
+	var conflict *ConflictError
+	if errors.As(err, &conflict) {
+		template.Conflict(w, "todoApp", conflict, map[string]interface{}{
+			"todoApp::todos": PatchList[Todo]("id").Update(*conflict.Current.(*Todo)),
+		})
 		return
 	}
-
-	// Return updated list
-	todos, err := getAllTodos()
 	if err != nil {
-		template.Error(w, "Failed to fetch updated todos: "+err.Error())
+		log.Printf("Failed to toggle todo %s: %v", req.ID, err)
+		template.ErrorFor(w, "todoApp", "Couldn't update the todo, try again")
 		return
 	}
 
+	patch := PatchList[Todo]("id").Update(*todo).Versioned(change)
+	broadcastTodos(patch)
 	template.JSON(w, map[string]interface{}{
-		"todoApp::todos": todos,
+		"todoApp::todos": patch,
 	})
 }
 
-// handleDeleteTodo deletes a todo
-func handleDeleteTodo(w http.ResponseWriter, r *http.Request) {
-	req, ok := DecodeAndValidate[TodoIDRequest](template, w, r)
-	if !ok {
-		return
-	}
-
-	// Delete the todo
-	err := db.Update(func(tx *buntdb.Tx) error {
+// deleteTodo deletes a todo, see Handle
+func deleteTodo(ctx context.Context, req TodoIDRequest) (map[string]any, error) {
+	change, err := todoVersions.UpdateChange(db, "todoApp", func(tx *buntdb.Tx) error {
 		_, err := tx.Delete("todo:" + req.ID)
 		return err
 	})
 
 	if err != nil && err != buntdb.ErrNotFound {
-		template.Error(w, "Failed to delete todo: "+err.Error())
-		return
-	}
-
-	// Return updated list
-	todos, err := getAllTodos()
-	if err != nil {
-		template.Error(w, "Failed to fetch updated todos: "+err.Error())
-		return
+		log.Printf("Failed to delete todo %s: %v", req.ID, err)
+		return nil, errors.New("Couldn't delete the todo, try again")
 	}
 
-	template.JSON(w, map[string]interface{}{
-		"todoApp::todos": todos,
-	})
+	patch := PatchList[Todo]("id").Remove(req.ID).Versioned(change)
+	broadcastTodos(patch)
+	return map[string]any{
+		"todoApp::todos": patch,
+	}, nil
 }
 
-// handleClearCompleted removes all completed todos
+// handleClearCompleted removes all completed todos. It isn't written for Handle, which
+// decodes a JSON body, while $api.todosClearCompleted() sends none.
 func handleClearCompleted(w http.ResponseWriter, r *http.Request) {
 	// Get all todos
 	todos, err := getAllTodos()
 	if err != nil {
-		template.Error(w, "Failed to fetch todos: "+err.Error())
+		log.Printf("Failed to fetch todos: %v", err)
+		template.ErrorFor(w, "todoApp", "Couldn't clear the todos, try again")
 		return
 	}
 
 	// Delete all completed todos
-	err = db.Update(func(tx *buntdb.Tx) error {
+	var removed []interface{}
+	change, err := todoVersions.UpdateChange(db, "todoApp", func(tx *buntdb.Tx) error {
 		for _, todo := range todos {
 			if todo.Completed {
 				_, err := tx.Delete("todo:" + todo.ID)
 				if err != nil && err != buntdb.ErrNotFound {
 					return err
 				}
+				removed = append(removed, todo.ID)
 			}
 		}
 		return nil
 	})
 
 	if err != nil {
-		template.Error(w, "Failed to clear completed todos: "+err.Error())
-		return
-	}
-
-	// Return updated list
-	todos, err = getAllTodos()
-	if err != nil {
-		template.Error(w, "Failed to fetch updated todos: "+err.Error())
+		log.Printf("Failed to clear completed todos: %v", err)
+		template.ErrorFor(w, "todoApp", "Couldn't clear the todos, try again")
 		return
 	}
 
+	patch := PatchList[Todo]("id").Remove(removed...).Versioned(change)
+	broadcastTodos(patch)
 	template.JSON(w, map[string]interface{}{
-		"todoApp::todos": todos,
+		"todoApp::todos": patch,
 	})
 }
 
+// broadcastTodos sends the change of the list to other pages subscribed to todoApp
+func broadcastTodos(patch *ListPatch[Todo]) {
+	if err := hub.Publish("todoApp", map[string]interface{}{"todoApp::todos": patch}); err != nil {
+		log.Printf("Failed to broadcast todos: %v", err)
+	}
+}
+
 // saveTodo stores a todo in the database
-func saveTodo(todo Todo) error {
-	return db.Update(func(tx *buntdb.Tx) error {
+func saveTodo(todo Todo) (DataChange, error) {
+	return todoVersions.UpdateChange(db, "todoApp", func(tx *buntdb.Tx) error {
 		todoJSON, err := json.Marshal(todo)
 		if err != nil {
 			return err
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// MarkdownPath is where components convert user Markdown to HTML, see MarkdownHandler
+const MarkdownPath = "/_jalpine/markdown"
+
+// MarkdownPolicy controls what RenderMarkdown may produce. Raw HTML in the source is always
+// escaped, so the output only contains tags generated by the renderer.
+type MarkdownPolicy struct {
+	AllowImages    bool
+	AllowedSchemes []string // Of link and image URLs, relative URLs are always allowed. Default http, https, mailto
+	LinkRel        string   // rel of links, "nofollow noopener noreferrer" by default
+	// Highlight renders fenced code blocks, the result is inserted as is and must be safe HTML.
+	// Without it blocks are escaped into <pre><code class="language-...">.
+	Highlight func(code, lang string) string
+}
+
+// DefaultMarkdownPolicy suits comments and notes of untrusted users
+var DefaultMarkdownPolicy = MarkdownPolicy{
+	AllowedSchemes: []string{"http", "https", "mailto"},
+	LinkRel:        "nofollow noopener noreferrer",
+}
+
+var (
+	mdHeadingRe  = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	mdRuleRe     = regexp.MustCompile(`^ {0,3}(?:(?:-\s*){3,}|(?:\*\s*){3,}|(?:_\s*){3,})$`)
+	mdBulletRe   = regexp.MustCompile(`^ {0,3}[-*+]\s+(.*)$`)
+	mdOrderedRe  = regexp.MustCompile(`^ {0,3}(\d{1,9})[.)]\s+(.*)$`)
+	mdFenceRe    = regexp.MustCompile("^ {0,3}(```|~~~)\\s*([\\w+-]*)")
+	mdQuoteRe    = regexp.MustCompile(`^ {0,3}>\s?(.*)$`)
+	mdLangRe     = regexp.MustCompile(`^[\w+-]+$`)
+	mdLinkTailRe = regexp.MustCompile(`^\(\s*<?([^\s()<>]*)>?(?:\s+"([^"]*)")?\s*\)`)
+)
+
+// RenderMarkdown converts Markdown to HTML: headings, paragraphs, emphasis, strikethrough,
+// code spans and fenced blocks, block quotes, lists, rules, links and images
+func RenderMarkdown(source string, policy MarkdownPolicy) string {
+	if policy.AllowedSchemes == nil {
+		policy.AllowedSchemes = DefaultMarkdownPolicy.AllowedSchemes
+	}
+	if policy.LinkRel == "" {
+		policy.LinkRel = DefaultMarkdownPolicy.LinkRel
+	}
+	source = strings.ReplaceAll(strings.ReplaceAll(source, "\r\n", "\n"), "\x00", "�")
+	var b strings.Builder
+	policy.blocks(&b, strings.Split(source, "\n"))
+	return b.String()
+}
+
+func (p *MarkdownPolicy) blocks(b *strings.Builder, lines []string) {
+	var paragraph []string
+	flush := func() {
+		if len(paragraph) > 0 {
+			b.WriteString("<p>" + p.inline(strings.Join(paragraph, "\n")) + "</p>\n")
+			paragraph = nil
+		}
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case strings.TrimSpace(line) == "":
+			flush()
+
+		case mdFenceRe.MatchString(line):
+			flush()
+			m := mdFenceRe.FindStringSubmatch(line)
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), m[1]); i++ {
+				code = append(code, lines[i])
+			}
+			p.codeBlock(b, strings.Join(code, "\n"), m[2])
+
+		case mdHeadingRe.MatchString(line):
+			flush()
+			m := mdHeadingRe.FindStringSubmatch(line)
+			level := string(rune('0' + len(m[1])))
+			b.WriteString("<h" + level + ">" + p.inline(m[2]) + "</h" + level + ">\n")
+
+		case mdRuleRe.MatchString(line):
+			flush()
+			b.WriteString("<hr>\n")
+
+		case mdQuoteRe.MatchString(line):
+			flush()
+			var quoted []string
+			for ; i < len(lines) && mdQuoteRe.MatchString(lines[i]); i++ {
+				quoted = append(quoted, mdQuoteRe.FindStringSubmatch(lines[i])[1])
+			}
+			i--
+			b.WriteString("<blockquote>\n")
+			p.blocks(b, quoted)
+			b.WriteString("</blockquote>\n")
+
+		case mdBulletRe.MatchString(line) || mdOrderedRe.MatchString(line):
+			flush()
+			i = p.list(b, lines, i) - 1
+
+		default:
+			paragraph = append(paragraph, strings.TrimSpace(line))
+		}
+	}
+	flush()
+}
+
+// list renders consecutive items of one kind and returns the index of the first line after them
+func (p *MarkdownPolicy) list(b *strings.Builder, lines []string, i int) int {
+	ordered := mdOrderedRe.MatchString(lines[i])
+	itemRe, tag := mdBulletRe, "ul"
+	if ordered {
+		itemRe, tag = mdOrderedRe, "ol"
+	}
+	b.WriteString("<" + tag + ">\n")
+	for i < len(lines) {
+		m := itemRe.FindStringSubmatch(lines[i])
+		if m == nil {
+			break
+		}
+		item := []string{m[len(m)-1]}
+		// Indented lines continue the item
+		for i++; i < len(lines) && strings.HasPrefix(lines[i], "  ") && strings.TrimSpace(lines[i]) != ""; i++ {
+			item = append(item, strings.TrimSpace(lines[i]))
+		}
+		b.WriteString("<li>" + p.inline(strings.Join(item, "\n")) + "</li>\n")
+	}
+	b.WriteString("</" + tag + ">\n")
+	return i
+}
+
+func (p *MarkdownPolicy) codeBlock(b *strings.Builder, code, lang string) {
+	if p.Highlight != nil {
+		b.WriteString(p.Highlight(code, lang))
+		b.WriteString("\n")
+		return
+	}
+	class := ""
+	if mdLangRe.MatchString(lang) {
+		class = ` class="language-` + lang + `"`
+	}
+	b.WriteString("<pre><code" + class + ">" + html.EscapeString(code) + "</code></pre>\n")
+}
+
+// inline renders spans of a block, everything that is not markup is escaped
+func (p *MarkdownPolicy) inline(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		rest := s[i:]
+		switch {
+		case rest[0] == '\\' && len(rest) > 1 && strings.ContainsRune("\\`*_{}[]()#+-.!~>", rune(rest[1])):
+			b.WriteString(html.EscapeString(rest[1:2]))
+			i += 2
+			continue
+
+		case rest[0] == '`':
+			if end := strings.IndexByte(rest[1:], '`'); end != -1 {
+				b.WriteString("<code>" + html.EscapeString(rest[1:1+end]) + "</code>")
+				i += end + 2
+				continue
+			}
+
+		case strings.HasPrefix(rest, "!["):
+			if text, target, title, n := mdLink(rest[1:]); n > 0 {
+				if p.AllowImages && p.urlAllowed(target) {
+					b.WriteString(`<img src="` + html.EscapeString(target) + `" alt="` + html.EscapeString(text) + `"` + mdTitle(title) + `>`)
+				} else {
+					b.WriteString(html.EscapeString(text))
+				}
+				i += n + 1
+				continue
+			}
+
+		case rest[0] == '[':
+			if text, target, title, n := mdLink(rest); n > 0 {
+				if p.urlAllowed(target) {
+					b.WriteString(`<a href="` + html.EscapeString(target) + `" rel="` + html.EscapeString(p.LinkRel) + `"` + mdTitle(title) + `>` + p.inline(text) + `</a>`)
+				} else {
+					b.WriteString(p.inline(text))
+				}
+				i += n
+				continue
+			}
+
+		case strings.HasPrefix(rest, "**") || strings.HasPrefix(rest, "__"):
+			if end := strings.Index(rest[2:], rest[:2]); end > 0 {
+				b.WriteString("<strong>" + p.inline(rest[2:2+end]) + "</strong>")
+				i += end + 4
+				continue
+			}
+
+		case strings.HasPrefix(rest, "~~"):
+			if end := strings.Index(rest[2:], "~~"); end > 0 {
+				b.WriteString("<del>" + p.inline(rest[2:2+end]) + "</del>")
+				i += end + 4
+				continue
+			}
+
+		case (rest[0] == '*' || rest[0] == '_') && len(rest) > 1 && rest[1] != ' ':
+			if end := strings.IndexByte(rest[1:], rest[0]); end > 0 && rest[end] != ' ' {
+				b.WriteString("<em>" + p.inline(rest[1:1+end]) + "</em>")
+				i += end + 2
+				continue
+			}
+
+		case rest[0] == '\n':
+			b.WriteString("\n")
+			i++
+			continue
+		}
+		b.WriteString(html.EscapeString(rest[:1]))
+		i++
+	}
+	return b.String()
+}
+
+// mdMaxLinkText bounds the search for the end of a link text, otherwise every "[" of a text
+// without links would scan the rest of it
+const mdMaxLinkText = 1000
+
+// mdLink parses "[text](url "title")" at the start of s, n is 0 if it is not a link
+func mdLink(s string) (text, target, title string, n int) {
+	depth := 0
+	for i := 0; i < len(s) && i <= mdMaxLinkText; i++ {
+		switch s[i] {
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				m := mdLinkTailRe.FindStringSubmatch(s[i+1:])
+				if m == nil {
+					return "", "", "", 0
+				}
+				return s[1:i], m[1], m[2], i + 1 + len(m[0])
+			}
+		case '\n':
+			return "", "", "", 0
+		}
+	}
+	return "", "", "", 0
+}
+
+func mdTitle(title string) string {
+	if title == "" {
+		return ""
+	}
+	return ` title="` + html.EscapeString(title) + `"`
+}
+
+// urlAllowed rejects javascript:, data: and other schemes missing from the policy
+func (p *MarkdownPolicy) urlAllowed(target string) bool {
+	if strings.ContainsFunc(target, func(r rune) bool { return r < ' ' || r == 0x7f }) {
+		return false
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+	return u.Scheme == "" && !strings.HasPrefix(target, "//") || slices.Contains(p.AllowedSchemes, strings.ToLower(u.Scheme))
+}
+
+// MarkdownHandler is an action taking {"markdown": "..."} and answering with "markdownHTML"
+// for the calling component, e.g. $post('/_jalpine/markdown', { markdown: note })
+func MarkdownHandler(t *JTemplate, policy MarkdownPolicy) http.HandlerFunc {
+	type markdownRequest struct {
+		Markdown string `json:"markdown" validate:"max=100000"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, ok := DecodeAndValidate[markdownRequest](t, w, r)
+		if !ok {
+			return
+		}
+		t.JSON(w, map[string]interface{}{"markdownHTML": RenderMarkdown(req.Markdown, policy)})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// EnsureEsbuild downloads the esbuild binary of the version from npm into dir unless it's
+// already there, and returns its path for DownloadConfig.Minify
+func EnsureEsbuild(dir, version string) (string, error) {
+	osName, arch := runtime.GOOS, runtime.GOARCH
+	if osName == "windows" {
+		osName = "win32"
+	}
+	file, binary := "bin/esbuild", filepath.Join(dir, "esbuild@"+version)
+	if osName == "win32" {
+		file, binary = "esbuild.exe", binary+".exe"
+	}
+	if _, err := os.Stat(binary); err == nil {
+		return binary, nil
+	}
+
+	pkg := NPMPackage("esbuild", "@esbuild/"+osName+"-"+arch, file)
+	_, dist, err := resolveNPM(pkg, version)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve esbuild: %v", err)
+	}
+	fmt.Printf("Downloading esbuild @ %s...\n", version)
+	tmp := binary + ".tmp"
+	if err := downloadNPMFile(dist, file, tmp, nil); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("failed to download esbuild: %v", err)
+	}
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return "", err
+	}
+	return binary, os.Rename(tmp, binary)
+}
+
+// minifiedLibFile is where the minified copy of a library goes, "alpinejs@3.14.8.min.js"
+func minifiedLibFile(file string) string {
+	ext := filepath.Ext(file)
+	return strings.TrimSuffix(file, ext) + ".min" + ext
+}
+
+// isMinified guesses from the line length, minified files have few very long lines
+func isMinified(file string, content []byte) bool {
+	if strings.Contains(file, ".min.") {
+		return true
+	}
+	lines := bytes.Count(content, []byte("\n")) + 1
+	return len(content)/lines > 200
+}
+
+// minifyLib returns the file of the library to serve: a minified copy written next to the
+// original if LibDownloads.Minify is set and the library is not minified yet, the file itself
+// otherwise. The original stays for debugging and for the lockfile hash. Failures are logged.
+func minifyLib(staticDir, file string) string {
+	ext := strings.ToLower(filepath.Ext(file))
+	if LibDownloads.Minify == "" || (ext != ".js" && ext != ".css") {
+		return file
+	}
+	path := filepath.Join(staticDir, file)
+	minified := minifiedLibFile(file)
+	out := filepath.Join(staticDir, minified)
+	if info, err := os.Stat(out); err == nil {
+		if orig, err := os.Stat(path); err == nil && !info.ModTime().Before(orig.ModTime()) {
+			return minified
+		}
+	}
+	content, err := os.ReadFile(path)
+	if err != nil || isMinified(file, content) {
+		return file
+	}
+
+	tmp := out + ".tmp"
+	cmd := exec.Command(LibDownloads.Minify, path, "--minify", "--log-level=warning", "--loader="+ext[1:], "--outfile="+tmp)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(tmp)
+		log.Printf("Failed to minify %s: %v: %s", file, err, output)
+		return file
+	}
+	if err := os.Rename(tmp, out); err != nil {
+		log.Printf("Failed to minify %s: %v", file, err)
+		return file
+	}
+	if LibDownloads.Precompress {
+		if err := precompressFile(out); err != nil {
+			log.Printf("Failed to precompress %s: %v", minified, err)
+		}
+	}
+	return minified
+}
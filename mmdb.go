@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+// MMDB is a MaxMind DB file such as GeoLite2-Country.mmdb or GeoLite2-City.mmdb, loaded into
+// memory. It implements GeoResolver.
+type MMDB struct {
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	dataStart  uint // Offset of the data section
+	ipv4Start  uint // Node of ::/96 in IPv6 trees
+}
+
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// OpenMMDB reads the whole file and validates its metadata
+func OpenMMDB(path string) (*MMDB, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseMMDB(data)
+}
+
+// ParseMMDB uses the contents of a MaxMind DB file, e.g. embedded into the binary
+func ParseMMDB(data []byte) (*MMDB, error) {
+	markerAt := bytes.LastIndex(data, mmdbMetadataMarker)
+	if markerAt == -1 {
+		return nil, errors.New("mmdb: metadata not found")
+	}
+	metaStart := uint(markerAt + len(mmdbMetadataMarker))
+	meta, _, err := (&mmdbDecoder{data: data[metaStart:]}).decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("mmdb: metadata: %w", err)
+	}
+	fields, ok := meta.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("mmdb: metadata is not a map")
+	}
+	db := &MMDB{
+		data:       data,
+		nodeCount:  mmdbUint(fields["node_count"]),
+		recordSize: mmdbUint(fields["record_size"]),
+		ipVersion:  mmdbUint(fields["ip_version"]),
+	}
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("mmdb: unsupported record size %d", db.recordSize)
+	}
+	treeSize := db.nodeCount * db.recordSize / 4
+	db.dataStart = treeSize + 16
+	if db.dataStart > metaStart {
+		return nil, errors.New("mmdb: search tree is larger than the file")
+	}
+	if db.ipVersion == 6 {
+		for i := 0; i < 96 && db.ipv4Start < db.nodeCount; i++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+func mmdbUint(v interface{}) uint {
+	n, _ := v.(uint64)
+	return uint(n)
+}
+
+// LookupIP returns the record of the network containing ip, nil if there is none
+func (db *MMDB) LookupIP(ip net.IP) (interface{}, error) {
+	node, bits := uint(0), 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+		if db.ipVersion == 6 {
+			node = db.ipv4Start
+		}
+	} else if db.ipVersion == 4 {
+		return nil, nil
+	}
+	for i := 0; i < bits && node < db.nodeCount; i++ {
+		bit := uint(ip[i>>3]>>(7-uint(i&7))) & 1
+		node = db.record(node, bit)
+	}
+	if node == db.nodeCount {
+		return nil, nil
+	}
+	if node < db.nodeCount {
+		return nil, errors.New("mmdb: invalid search tree")
+	}
+	offset := node - db.nodeCount - 16
+	if db.dataStart+offset >= uint(len(db.data)) {
+		return nil, errors.New("mmdb: invalid data pointer")
+	}
+	value, _, err := (&mmdbDecoder{data: db.data[db.dataStart:]}).decode(offset)
+	return value, err
+}
+
+// record reads the left (bit 0) or right (bit 1) record of the node
+func (db *MMDB) record(node, bit uint) uint {
+	b := db.data
+	switch db.recordSize {
+	case 24:
+		o := node*6 + bit*3
+		return uint(b[o])<<16 | uint(b[o+1])<<8 | uint(b[o+2])
+	case 28:
+		o := node * 7
+		if bit == 0 {
+			return uint(b[o+3]&0xF0)<<20 | uint(b[o])<<16 | uint(b[o+1])<<8 | uint(b[o+2])
+		}
+		return uint(b[o+3]&0x0F)<<24 | uint(b[o+4])<<16 | uint(b[o+5])<<8 | uint(b[o+6])
+	default:
+		o := node*8 + bit*4
+		return uint(binary.BigEndian.Uint32(b[o:]))
+	}
+}
+
+// mmdbDecoder reads values of the data section, pointers are relative to the start of data
+type mmdbDecoder struct {
+	data  []byte
+	depth int
+}
+
+var errMMDBTruncated = errors.New("mmdb: truncated data")
+
+// decode returns the value at offset and the offset after it
+func (d *mmdbDecoder) decode(offset uint) (interface{}, uint, error) {
+	if d.depth > 32 {
+		return nil, 0, errors.New("mmdb: data nested too deep")
+	}
+	if offset >= uint(len(d.data)) {
+		return nil, 0, errMMDBTruncated
+	}
+	ctrl := d.data[offset]
+	offset++
+	typ := uint(ctrl >> 5)
+	if typ == 1 {
+		return d.pointer(ctrl, offset)
+	}
+	if typ == 0 {
+		if offset >= uint(len(d.data)) {
+			return nil, 0, errMMDBTruncated
+		}
+		typ = 7 + uint(d.data[offset])
+		offset++
+	}
+	size, offset, err := d.size(ctrl, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if typ != 7 && typ != 11 && typ != 14 && offset+size > uint(len(d.data)) {
+		return nil, 0, errMMDBTruncated
+	}
+	raw := d.data[offset:min(offset+size, uint(len(d.data)))]
+
+	switch typ {
+	case 2: // UTF-8 string
+		return string(raw), offset + size, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, errors.New("mmdb: invalid double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(raw)), offset + size, nil
+	case 4: // bytes
+		return bytes.Clone(raw), offset + size, nil
+	case 5, 6, 9, 10: // uint16, uint32, uint64, uint128 (large values are truncated to 64 bits)
+		var n uint64
+		for _, b := range raw {
+			n = n<<8 | uint64(b)
+		}
+		return n, offset + size, nil
+	case 8: // int32
+		var n uint32
+		for _, b := range raw {
+			n = n<<8 | uint32(b)
+		}
+		return int64(int32(n << (32 - 8*min(size, 4)) >> (32 - 8*min(size, 4)))), offset + size, nil
+	case 7: // map
+		d.depth++
+		defer func() { d.depth-- }()
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var key, value interface{}
+			key, offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("mmdb: map key is not a string")
+			}
+			m[k] = value
+		}
+		return m, offset, nil
+	case 11: // array
+		d.depth++
+		defer func() { d.depth-- }()
+		a := make([]interface{}, 0, min(size, 1024))
+		for i := uint(0); i < size; i++ {
+			var value interface{}
+			value, offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+		}
+		return a, offset, nil
+	case 14: // boolean, the value is the size
+		return size != 0, offset, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, errors.New("mmdb: invalid float")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(raw))), offset + size, nil
+	}
+	return nil, 0, fmt.Errorf("mmdb: unsupported data type %d", typ)
+}
+
+func (d *mmdbDecoder) size(ctrl byte, offset uint) (uint, uint, error) {
+	size := uint(ctrl & 0x1F)
+	if size < 29 {
+		return size, offset, nil
+	}
+	extra := size - 28 // Bytes holding the size
+	if offset+extra > uint(len(d.data)) {
+		return 0, 0, errMMDBTruncated
+	}
+	var n uint
+	for _, b := range d.data[offset : offset+extra] {
+		n = n<<8 | uint(b)
+	}
+	switch size {
+	case 29:
+		n += 29
+	case 30:
+		n += 285
+	case 31:
+		n += 65821
+	}
+	return n, offset + extra, nil
+}
+
+// pointer decodes the value a pointer refers to, returning the offset after the pointer itself
+func (d *mmdbDecoder) pointer(ctrl byte, offset uint) (interface{}, uint, error) {
+	length := uint(ctrl>>3&0x3) + 1
+	if offset+length > uint(len(d.data)) {
+		return nil, 0, errMMDBTruncated
+	}
+	var target uint
+	if length < 4 {
+		target = uint(ctrl & 0x7)
+	}
+	for _, b := range d.data[offset : offset+length] {
+		target = target<<8 | uint(b)
+	}
+	target += [...]uint{0, 2048, 526336, 0}[length-1]
+
+	d.depth++
+	defer func() { d.depth-- }()
+	value, _, err := d.decode(target)
+	return value, offset + length, err
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ContentFilter checks user text before it is stored. Returning a *ContentRejection rejects the
+// text with a message for the user, other errors mean the filter itself failed.
+type ContentFilter interface {
+	Check(ctx context.Context, field, text string) error
+}
+
+// ContentFilterFunc adapts a function to ContentFilter
+type ContentFilterFunc func(ctx context.Context, field, text string) error
+
+func (f ContentFilterFunc) Check(ctx context.Context, field, text string) error {
+	return f(ctx, field, text)
+}
+
+// ContentRejection is sent to the calling component as "fieldErrors": {field: reason} along
+// with the usual error key, so forms can show the reason next to the input
+type ContentRejection struct {
+	Field  string
+	Reason string
+}
+
+func (r *ContentRejection) Error() string {
+	return r.Field + ": " + r.Reason
+}
+
+// WithContentFilters makes DecodeAndValidate run the filters, in order, on string fields
+// tagged `moderate:"true"`
+func WithContentFilters(filters ...ContentFilter) TemplateOption {
+	return func(t *JTemplate) {
+		t.contentFilters = append(t.contentFilters, filters...)
+	}
+}
+
+// WordListFilter rejects text containing any of the words, ignoring case. Words only match
+// whole, so "ass" doesn't reject "class".
+func WordListFilter(reason string, words ...string) ContentFilter {
+	if len(words) == 0 {
+		return ContentFilterFunc(func(context.Context, string, string) error { return nil })
+	}
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		quoted[i] = regexp.QuoteMeta(strings.TrimSpace(word))
+	}
+	re := regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`)
+	return ContentFilterFunc(func(_ context.Context, field, text string) error {
+		if re.MatchString(text) {
+			return &ContentRejection{Field: field, Reason: reason}
+		}
+		return nil
+	})
+}
+
+// ModerationAPIFilter posts {"field": ..., "text": ...} to an external moderation service which
+// answers {"flagged": bool, "reason": "..."}. Requests are limited by the timeout.
+func ModerationAPIFilter(url string, headers http.Header, timeout time.Duration) ContentFilter {
+	client := &http.Client{Timeout: timeout}
+	return ContentFilterFunc(func(ctx context.Context, field, text string) error {
+		body, err := json.Marshal(map[string]string{"field": field, "text": text})
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		for key, values := range headers {
+			req.Header[key] = values
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("moderation service: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("moderation service: %s", resp.Status)
+		}
+		var verdict struct {
+			Flagged bool   `json:"flagged"`
+			Reason  string `json:"reason"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&verdict); err != nil {
+			return fmt.Errorf("moderation service: %w", err)
+		}
+		if verdict.Flagged {
+			if verdict.Reason == "" {
+				verdict.Reason = "Content is not allowed"
+			}
+			return &ContentRejection{Field: field, Reason: verdict.Reason}
+		}
+		return nil
+	})
+}
+
+// moderate runs the content filters on tagged fields of the decoded request. Fields are named
+// by their json tag, which is the component key the form binds to.
+func (t *JTemplate) moderate(ctx context.Context, data interface{}) error {
+	if len(t.contentFilters) == 0 {
+		return nil
+	}
+	v := reflect.Indirect(reflect.ValueOf(data))
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.Tag.Get("moderate") != "true" || field.Type.Kind() != reflect.String {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" {
+			name = field.Name
+		}
+		for _, filter := range t.contentFilters {
+			if err := filter.Check(ctx, name, v.Field(i).String()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// moderationError answers the rejection to the form, or a generic error if a filter failed
+func (t *JTemplate) moderationError(w http.ResponseWriter, err error) {
+	var rejection *ContentRejection
+	if !errors.As(err, &rejection) {
+		log.Printf("Content filter failed: %v", err)
+		t.Error(w, "Can't check the content, try again later")
+		return
+	}
+	t.JSON(w, map[string]interface{}{
+		"fieldErrors": map[string]string{rejection.Field: rejection.Reason},
+		t.errorKey():  rejection.Reason,
+	})
+}
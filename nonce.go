@@ -0,0 +1,192 @@
+package main
+
+import (
+	"container/heap"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NoncePath hands out nonces to pages, see JTemplate.NonceHandler
+const NoncePath = "/_jalpine/nonce"
+
+// actionNonces checks one-time tokens for sensitive actions. Tokens carry their expiry and are
+// signed, so issuing them stores nothing and NonceHandler can be called by anyone as often as
+// they like. Only consumed tokens are kept, until they expire.
+type actionNonces struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	key      []byte          // Signs tokens, random for each run of the server
+	used     map[string]bool // Consumed tokens that are not expired yet
+	expiring usedNonces      // The same tokens, soonest to expire first
+	actions  map[string]bool // Protected by RequireNonce
+}
+
+// usedNonces is a heap of consumed tokens by expiry
+type usedNonces []usedNonce
+
+type usedNonce struct {
+	token   string
+	expires time.Time
+}
+
+func (h usedNonces) Len() int           { return len(h) }
+func (h usedNonces) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+func (h usedNonces) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *usedNonces) Push(x any)        { *h = append(*h, x.(usedNonce)) }
+func (h *usedNonces) Pop() any {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// WithNonceTTL sets how long action nonces stay valid, one hour by default
+func WithNonceTTL(ttl time.Duration) TemplateOption {
+	return func(t *JTemplate) {
+		t.nonces.ttl = ttl
+	}
+}
+
+// IssueNonce creates a one-time token for the action, e.g. "todos.clear-completed"
+func (t *JTemplate) IssueNonce(action string) string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	expires := strconv.FormatInt(t.clock.Now().Add(t.nonces.ttl).UnixMilli(), 16)
+	payload := expires + "." + hex.EncodeToString(buf)
+	return payload + "." + t.nonces.sign(action, payload)
+}
+
+// sign returns the signature of the token payload for the action
+func (n *actionNonces) sign(action, payload string) string {
+	n.mu.Lock()
+	if n.key == nil {
+		n.key = make([]byte, 32)
+		rand.Read(n.key)
+	}
+	key := n.key
+	n.mu.Unlock()
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(action + "\n" + payload))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Nonces issues tokens for several actions to be sent as "main::nonces". Pages get the names of
+// the actions of RequireNonce without tokens and fetch them from NonceHandler when needed, so
+// data with tokens suits uncached answers only: it changes the ETag on every render.
+func (t *JTemplate) Nonces(actions ...string) map[string]string {
+	nonces := make(map[string]string, len(actions))
+	for _, action := range actions {
+		nonces[action] = t.IssueNonce(action)
+	}
+	return nonces
+}
+
+// ConsumeNonce checks that the token was issued for the action and is not expired.
+// A token can be consumed only once.
+func (t *JTemplate) ConsumeNonce(action, token string) bool {
+	expires, payload, ok := parseNonce(token)
+	if !ok || !hmac.Equal([]byte(token[len(payload)+1:]), []byte(t.nonces.sign(action, payload))) {
+		return false
+	}
+	now := t.clock.Now()
+	if now.After(expires) {
+		return false
+	}
+
+	n := &t.nonces
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for n.expiring.Len() > 0 && now.After(n.expiring[0].expires) {
+		delete(n.used, heap.Pop(&n.expiring).(usedNonce).token)
+	}
+	if n.used[token] {
+		return false
+	}
+	if n.used == nil {
+		n.used = make(map[string]bool)
+	}
+	n.used[token] = true
+	heap.Push(&n.expiring, usedNonce{token: token, expires: expires})
+	return true
+}
+
+// parseNonce splits a token of IssueNonce into its expiry and the signed part
+func parseNonce(token string) (expires time.Time, payload string, ok bool) {
+	idx := strings.LastIndexByte(token, '.')
+	if idx == -1 {
+		return time.Time{}, "", false
+	}
+	payload = token[:idx]
+	millis, _, found := strings.Cut(payload, ".")
+	if !found {
+		return time.Time{}, "", false
+	}
+	ms, err := strconv.ParseInt(millis, 16, 64)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	return time.UnixMilli(ms), payload, true
+}
+
+// RequireNonce protects a destructive action from accidental or replayed requests: the handler
+// is only called with a valid X-JAlpine-Nonce header. helpers.js sends it when the request is made
+// with the {action: "..."} option, fetching a token from NonceHandler if it has none. A fresh
+// nonce for the next call is returned in the response header of an accepted request.
+func (t *JTemplate) RequireNonce(action string, next http.HandlerFunc) http.HandlerFunc {
+	n := &t.nonces
+	n.mu.Lock()
+	if n.actions == nil {
+		n.actions = make(map[string]bool)
+	}
+	n.actions[action] = true
+	n.mu.Unlock()
+	return wrapRoute(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("X-JAlpine-Nonce")
+		if !t.ConsumeNonce(action, strings.TrimSpace(token)) {
+			t.Error(w, "This action has expired or was already performed, please try again")
+			return
+		}
+		w.Header().Set("X-JAlpine-Nonce", action+"="+t.IssueNonce(action))
+		next(w, r)
+	}, next, "nonce "+action)
+}
+
+// nonceActions returns the actions of RequireNonce with empty tokens, sent as "main::nonces"
+func (t *JTemplate) nonceActions() map[string]string {
+	n := &t.nonces
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.actions) == 0 {
+		return nil
+	}
+	actions := make(map[string]string, len(n.actions))
+	for action := range n.actions {
+		actions[action] = ""
+	}
+	return actions
+}
+
+// NonceHandler issues a nonce for ?action= in the X-JAlpine-Nonce header, only for actions
+// protected by RequireNonce. Pages ask for one before the first call of the action.
+func (t *JTemplate) NonceHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		action := r.URL.Query().Get("action")
+		t.nonces.mu.Lock()
+		known := t.nonces.actions[action]
+		t.nonces.mu.Unlock()
+		if !known {
+			http.Error(w, "Unknown action", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-JAlpine-Nonce", action+"="+t.IssueNonce(action))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// NPMRegistry is where NPMPackage entries are resolved, LibDownloads.Mirrors apply to it as well
+var NPMRegistry = "https://registry.npmjs.org/"
+
+// maxTarballSize protects from unexpectedly large packages
+const maxTarballSize = 64 << 20
+
+// NPMPackage describes a library taken from a file of an npm package, for packages without a
+// single-file CDN URL, e.g. NPMPackage("alpinejs-ui", "@alpinejs/ui", "dist/cdn.min.js").
+// The package is resolved through the registry metadata and its tarball is downloaded.
+func NPMPackage(name, pkg, file string) EnsureLibsEntry {
+	return EnsureLibsEntry{Name: name, NPM: pkg, File: file}
+}
+
+// npmTarballURL follows the registry convention "registry/pkg/-/basename-version.tgz"
+func (e EnsureLibsEntry) npmTarballURL(version string) string {
+	return strings.TrimSuffix(NPMRegistry, "/") + "/" + e.NPM + "/-/" + path.Base(e.NPM) + "-" + version + ".tgz"
+}
+
+type npmDist struct {
+	Tarball   string `json:"tarball"`
+	Shasum    string `json:"shasum"`
+	Integrity string `json:"integrity"`
+}
+
+// resolveNPM finds the tarball of the version, the latest one if version is empty
+func resolveNPM(plugin EnsureLibsEntry, version string) (string, npmDist, error) {
+	metadataURL := strings.TrimSuffix(NPMRegistry, "/") + "/" + strings.Replace(url.PathEscape(plugin.NPM), "%40", "@", 1)
+	var metadata struct {
+		DistTags map[string]string `json:"dist-tags"`
+		Versions map[string]struct {
+			Dist npmDist `json:"dist"`
+		} `json:"versions"`
+	}
+	err := LibDownloads.retry("Metadata of "+plugin.NPM, func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, "GET", LibDownloads.mirror(metadataURL), nil)
+		if err != nil {
+			return permanentError{err}
+		}
+		setHeaders(req, plugin.Headers)
+		// The abbreviated document is much smaller and has everything needed here
+		req.Header.Set("Accept", "application/vnd.npm.install-v1+json")
+		resp, err := LibDownloads.client().Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if err := checkStatus(resp, http.StatusOK); err != nil {
+			return err
+		}
+		return json.NewDecoder(resp.Body).Decode(&metadata)
+	})
+	if err != nil {
+		return "", npmDist{}, err
+	}
+	if version == "" {
+		version = metadata.DistTags["latest"]
+	}
+	found, ok := metadata.Versions[version]
+	if !ok || found.Dist.Tarball == "" {
+		return "", npmDist{}, fmt.Errorf("%s has no version %q", plugin.NPM, version)
+	}
+	return version, found.Dist, nil
+}
+
+// downloadNPMFile downloads the tarball, checks its integrity if known and extracts the file,
+// replacing dest only once everything succeeded
+func downloadNPMFile(dist npmDist, file, dest string, headers http.Header) error {
+	var tarball []byte
+	err := LibDownloads.retry("Download of "+dist.Tarball, func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, "GET", LibDownloads.mirror(dist.Tarball), nil)
+		if err != nil {
+			return permanentError{err}
+		}
+		setHeaders(req, headers)
+		resp, err := LibDownloads.client().Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if err := checkStatus(resp, http.StatusOK); err != nil {
+			return err
+		}
+		tarball, err = io.ReadAll(io.LimitReader(resp.Body, maxTarballSize+1))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(tarball) > maxTarballSize {
+		return fmt.Errorf("%s is larger than %d MB", dist.Tarball, maxTarballSize>>20)
+	}
+	if err := checkNPMIntegrity(dist, tarball); err != nil {
+		return err
+	}
+	content, err := extractTarballFile(tarball, file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", dist.Tarball, err)
+	}
+	size := int64(len(content))
+	if err := checkDownload(dest, "", content[:min(len(content), 512)], size, size); err != nil {
+		return fmt.Errorf("%s: %s: %w", dist.Tarball, file, err)
+	}
+	tmp := dest + ".tmp"
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
+
+// checkNPMIntegrity verifies the sha512 "integrity" of the registry or the older sha1 "shasum"
+func checkNPMIntegrity(dist npmDist, tarball []byte) error {
+	if digest, ok := strings.CutPrefix(dist.Integrity, "sha512-"); ok {
+		sum := sha512.Sum512(tarball)
+		if base64.StdEncoding.EncodeToString(sum[:]) != digest {
+			return fmt.Errorf("%s does not match its integrity", dist.Tarball)
+		}
+		return nil
+	}
+	if dist.Shasum != "" {
+		sum := sha1.Sum(tarball)
+		if hex.EncodeToString(sum[:]) != dist.Shasum {
+			return fmt.Errorf("%s does not match its shasum", dist.Tarball)
+		}
+	}
+	return nil
+}
+
+// extractTarballFile returns the file from a package tarball. Files are under a single top
+// directory, usually "package/", which is ignored.
+func extractTarballFile(tarball []byte, file string) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(tarball))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("no %s in the package", file)
+		}
+		if err != nil {
+			return nil, err
+		}
+		_, name, _ := strings.Cut(header.Name, "/")
+		if header.Typeflag == tar.TypeReg && path.Clean(name) == path.Clean(file) {
+			return io.ReadAll(io.LimitReader(tr, maxTarballSize))
+		}
+	}
+}
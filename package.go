@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Multi-stage build: a static binary in a distroless image together with templates and
+// already downloaded static libs, so the container needs no network access on start
+const dockerfileTemplate = `# Generated by "go run . package"
+FROM golang:{{GO_VERSION}} AS build
+WORKDIR /src
+COPY go.mod go.sum ./
+RUN go mod download
+COPY . .
+RUN CGO_ENABLED=0 go build -trimpath -ldflags="-s -w" -o /out/server . \
+    && cp *.html /out/ \
+    && cp -r static /out/ \
+    && if [ -d components ]; then cp -r components /out/; fi \
+    && mkdir /data
+
+FROM gcr.io/distroless/static-debian12:nonroot
+WORKDIR /app
+COPY --from=build /out /app
+COPY --from=build --chown=nonroot:nonroot /data /data
+ENV JALPINE_ADDR=:8080 \
+    JALPINE_DB=/data/data.db \
+    JALPINE_EPHEMERAL_DB=/data/ephemeral.db \
+    JALPINE_ARCHIVE=/data/archive.jsonl.gz
+VOLUME /data
+EXPOSE 8080
+ENTRYPOINT ["/app/server"]
+`
+
+const dockerignoreContent = `.git
+*.db
+*.jsonl.gz
+Dockerfile
+.dockerignore
+`
+
+// runPackage implements "jalpine package": fetches static libs, writes Dockerfile and .dockerignore
+// and optionally builds the image with docker
+func runPackage(args []string) {
+	flags := flag.NewFlagSet("package", flag.ExitOnError)
+	force := flags.Bool("force", false, "overwrite existing Dockerfile and .dockerignore")
+	tag := flags.String("build", "", "build the image with this tag using docker")
+	flags.Parse(args)
+
+	// The image gets the same libs as a running instance would download
+	if _, err := EnsureStaticLibs("./static", staticLibs...); err != nil {
+		log.Fatalf("Failed to ensure static libraries: %v", err)
+	}
+
+	dockerfile := strings.ReplaceAll(dockerfileTemplate, "{{GO_VERSION}}", goMinorVersion("go.mod"))
+	files := []struct{ name, content string }{
+		{"Dockerfile", dockerfile},
+		{".dockerignore", dockerignoreContent},
+	}
+	for _, file := range files {
+		name, content := file.name, file.content
+		if _, err := os.Stat(name); err == nil && !*force {
+			fmt.Printf("%s exists, keeping it (use -force to overwrite)\n", name)
+			continue
+		}
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			log.Fatalf("Failed to write %s: %v", name, err)
+		}
+		fmt.Printf("Wrote %s\n", name)
+	}
+
+	if *tag != "" {
+		cmd := exec.Command("docker", "build", "-t", *tag, ".")
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			log.Fatalf("docker build failed: %v", err)
+		}
+	}
+}
+
+// goMinorVersion returns "1.23" for "go 1.23.6" in go.mod, the golang image is tagged by it
+func goMinorVersion(goMod string) string {
+	file, err := os.Open(goMod)
+	if err != nil {
+		return "1"
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if version, ok := strings.CutPrefix(strings.TrimSpace(scanner.Text()), "go "); ok {
+			parts := strings.SplitN(version, ".", 3)
+			return strings.Join(parts[:min(len(parts), 2)], ".")
+		}
+	}
+	return "1"
+}
@@ -0,0 +1,67 @@
+package main
+
+import "encoding/json"
+
+// ListPatch changes a list of a component in place instead of sending it whole, e.g.
+// "todoApp::todos": PatchList[Todo]("id").Update(todo). helpers.js applies the operations in
+// order to the list the page has and keeps the other items as they are, so Alpine only
+// re-renders the changed ones. Patches are meant for answers of JSON and for Hub.Publish,
+// pages rendered by Execute need the full list.
+//
+// Published patches can get lost, e.g. to a slow connection or between polls, and a page that
+// misses one would never show that change. Versioned patches carry the data version they
+// apply to, a page that has another version runs the x-loader of the component instead.
+type ListPatch[T any] struct {
+	key    string
+	ops    []listOp[T]
+	change DataChange
+}
+
+type listOp[T any] struct {
+	Append []T           `json:"append,omitempty"`
+	Remove []interface{} `json:"remove,omitempty"`
+	Update []T           `json:"update,omitempty"`
+}
+
+// PatchList starts a patch of a list whose items are identified by the key field, the name it
+// has in JSON like "id"
+func PatchList[T any](key string) *ListPatch[T] {
+	return &ListPatch[T]{key: key}
+}
+
+// Append adds items to the end of the list, items the page already has are skipped
+func (p *ListPatch[T]) Append(items ...T) *ListPatch[T] {
+	p.ops = append(p.ops, listOp[T]{Append: items})
+	return p
+}
+
+// Remove deletes the items with the ids
+func (p *ListPatch[T]) Remove(ids ...interface{}) *ListPatch[T] {
+	p.ops = append(p.ops, listOp[T]{Remove: ids})
+	return p
+}
+
+// Update replaces the items with the same ids, items the page doesn't have yet are appended
+func (p *ListPatch[T]) Update(items ...T) *ListPatch[T] {
+	p.ops = append(p.ops, listOp[T]{Update: items})
+	return p
+}
+
+// Versioned ties the patch to the write of DataVersions.UpdateChange that made it, the prefix
+// of the versions has to be the component of the list
+func (p *ListPatch[T]) Versioned(change DataChange) *ListPatch[T] {
+	p.change = change
+	return p
+}
+
+// MarshalJSON encodes the patch as {"$patch": "list", "key": "id", "ops": [...]} with "base"
+// and "version" of versioned patches, helpers.js tells it apart from plain values by the marker
+func (p *ListPatch[T]) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Marker  string      `json:"$patch"`
+		Key     string      `json:"key"`
+		Ops     []listOp[T] `json:"ops"`
+		Base    string      `json:"base,omitempty"`
+		Version string      `json:"version,omitempty"`
+	}{"list", p.key, p.ops, p.change.Base, p.change.Version})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+)
+
+// encodingExt returns the file extension of precompressed variants, e.g. ".gz" for gzip
+func encodingExt(encoding string) string {
+	switch encoding {
+	case "gzip":
+		return ".gz"
+	case "zstd":
+		return ".zst"
+	default:
+		return "." + encoding
+	}
+}
+
+// precompressFile writes a variant of the file for every registered compressor, e.g.
+// "alpinejs@3.14.8.js.gz". Up to date variants are kept. Only gzip is built in, ".br" needs a
+// brotli encoder registered with RegisterCompressor.
+func precompressFile(file string) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	for encoding, compressor := range compressors {
+		variant := file + encodingExt(encoding)
+		if vi, err := os.Stat(variant); err == nil && !vi.ModTime().Before(info.ModTime()) {
+			continue
+		}
+		if encoding == "gzip" {
+			// Compressed once, so spend more time than on responses
+			compressor = func(w io.Writer) io.WriteCloser {
+				gw, _ := gzip.NewWriterLevel(w, gzip.BestCompression)
+				return gw
+			}
+		}
+		if err := writeCompressed(file, variant, compressor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeCompressed(file, variant string, compressor Compressor) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := variant + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	cw := compressor(out)
+	_, err = io.Copy(cw, in)
+	if closeErr := cw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, variant)
+}
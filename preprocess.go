@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	texttemplate "text/template"
+)
+
+// PreprocessOptions configures an optional pass of Go templates over the compiled template.
+// It runs once per compilation, after includes are resolved and before the Alpine integration
+// is added, so static server-known values (app name, build hash, canonical URLs) can be baked
+// into the page without client JS.
+type PreprocessOptions struct {
+	Data  interface{}            // Passed as the dot to the template
+	Funcs map[string]interface{} // Additional template functions
+	// Use contextually escaping html/template instead of text/template. Note that html/template
+	// strips all comments, including include markers and sourceURL hints even in dev mode.
+	HTML bool
+	// Delimiters, "{{" and "}}" by default
+	LeftDelim  string
+	RightDelim string
+}
+
+// WithPreprocess enables the Go template pass, see PreprocessOptions
+func WithPreprocess(opts PreprocessOptions) TemplateOption {
+	return func(t *JTemplate) {
+		t.preprocess = &opts
+	}
+}
+
+// execute runs content through text/template or html/template
+func (p *PreprocessOptions) execute(content string) (string, error) {
+	var buf bytes.Buffer
+	if p.HTML {
+		tmpl, err := htmltemplate.New("preprocess").
+			Delims(p.LeftDelim, p.RightDelim).
+			Funcs(htmltemplate.FuncMap(p.Funcs)).
+			Parse(content)
+		if err != nil {
+			return "", err
+		}
+		if err := tmpl.Execute(&buf, p.Data); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	}
+
+	tmpl, err := texttemplate.New("preprocess").
+		Delims(p.LeftDelim, p.RightDelim).
+		Funcs(texttemplate.FuncMap(p.Funcs)).
+		Parse(content)
+	if err != nil {
+		return "", err
+	}
+	if err := tmpl.Execute(&buf, p.Data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
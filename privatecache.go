@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// PrivateCache keeps responses of signed in users apart in every cache. segment identifies the
+// user of the request, e.g. by a session cookie, and returns "" for anonymous requests, see
+// AuthSegment. All responses vary on Authorization and Cookie, so shared caches never serve
+// an anonymous page to a user or the other way round. Responses of users are marked private,
+// their ETags and render cache entries are per user, and JSON answers are not stored at all.
+func PrivateCache(segment func(r *http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			addVary(w.Header(), "Authorization", "Cookie")
+			user := segment(r)
+			if user == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			// Only a hash goes into keys and ETags, segments may be tokens
+			sum := sha256.Sum256([]byte(user))
+			next.ServeHTTP(&segmentWriter{ResponseWriter: w, segment: hex.EncodeToString(sum[:8])}, r)
+		})
+	}
+}
+
+// AuthSegment identifies users by the Authorization header and the named cookies,
+// e.g. AuthSegment("session")
+func AuthSegment(cookies ...string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		var parts []string
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			parts = append(parts, "auth="+auth)
+		}
+		for _, name := range cookies {
+			if c, err := r.Cookie(name); err == nil && c.Value != "" {
+				parts = append(parts, name+"="+c.Value)
+			}
+		}
+		return strings.Join(parts, ";")
+	}
+}
+
+// segmentWriter carries the cache segment of the user to ExecuteHTTP and JSON
+type segmentWriter struct {
+	http.ResponseWriter
+	segment string
+}
+
+func (w *segmentWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// cacheSegment returns the segment found by PrivateCache among the wrappers of w,
+// "" for anonymous requests
+func cacheSegment(w io.Writer) string {
+	for {
+		switch cur := w.(type) {
+		case *segmentWriter:
+			return cur.segment
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = cur.Unwrap()
+		default:
+			return ""
+		}
+	}
+}
+
+// addVary adds the header names to Vary unless they are already listed
+func addVary(h http.Header, names ...string) {
+	listed := strings.ToLower(strings.Join(h.Values("Vary"), ","))
+	for _, name := range names {
+		if !strings.Contains(listed, strings.ToLower(name)) {
+			h.Add("Vary", name)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// IncludeProfile describes how a single file contributed to the compiled template
+type IncludeProfile struct {
+	File         string
+	Depth        int           // Nesting level, 0 for the main file
+	Duration     time.Duration // Compile time including nested includes
+	Size         int           // Output size in bytes including nested includes
+	XDataScripts int           // Number of <script x-data> blocks transformed in this file
+}
+
+// countXDataScripts returns the number of <script x-data> blocks that processScripts would transform
+func countXDataScripts(content string) int {
+	count := 0
+	for _, m := range scriptBlockRe.FindAllStringSubmatch(content, -1) {
+		if xDataScriptRe.MatchString(m[1]) {
+			count++
+		}
+	}
+	return count
+}
+
+// Profile returns per-file statistics collected during the last compilation, in include order
+func (t *JTemplate) Profile() []IncludeProfile {
+	t.Update()
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return append([]IncludeProfile(nil), t.profile...)
+}
+
+// WriteProfile writes a human readable report of the last compilation: compile time,
+// total and own output size, and the number of x-data transforms for each included file.
+// Own size excludes nested includes, which helps to find partials that bloat the page.
+func (t *JTemplate) WriteProfile(w io.Writer) error {
+	profile := t.Profile()
+	total := 0
+	if len(profile) > 0 {
+		total = profile[0].Size
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "FILE\tTIME\tSIZE\tOWN SIZE\tSHARE\tX-DATA\t\n")
+	for i, p := range profile {
+		// Direct children follow the entry with a depth exactly one level deeper
+		own := p.Size
+		for _, child := range profile[i+1:] {
+			if child.Depth <= p.Depth {
+				break
+			}
+			if child.Depth == p.Depth+1 {
+				own -= child.Size
+			}
+		}
+		share := 0.0
+		if total > 0 {
+			share = float64(own) * 100 / float64(total)
+		}
+		name := strings.Repeat("  ", p.Depth) + p.File
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%.1f%%\t%d\t\n",
+			name, p.Duration.Round(time.Microsecond), p.Size, own, share, p.XDataScripts)
+	}
+	return tw.Flush()
+}
+
+// ProfileHandler serves the compilation report as plain text, intended for development use
+func (t *JTemplate) ProfileHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		t.WriteProfile(w)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ProtocolVersion is the version of the client-server protocol spoken by the embedded helpers.js.
+// It is taken from helpers.js itself, so the two can't drift apart.
+var ProtocolVersion = parseHelperProtocol(helperJS)
+
+func parseHelperProtocol(js string) int {
+	match := regexp.MustCompile(`const jalpineProtocol = (\d+);`).FindStringSubmatch(js)
+	if match == nil {
+		panic("helpers.js does not define jalpineProtocol")
+	}
+	version, _ := strconv.Atoi(match[1])
+	return version
+}
+
+// ProtocolCheck is a middleware that detects requests made by helpers.js of a different protocol
+// version, e.g. from a page cached before a framework upgrade. Such requests are rejected with
+// 409 Conflict and the X-JAlpine-Reload header, which makes the client reload the page.
+// Clients older than the protocol negotiation don't send a version at all and are recognized
+// by the JSON content type, they get an error and the current availVersion instead.
+func (t *JTemplate) ProtocolCheck(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("X-JAlpine-Protocol")
+		if header == "" && !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			// Regular navigation or a request not made by helpers.js
+			next.ServeHTTP(w, r)
+			return
+		}
+		if version, err := strconv.Atoi(header); err == nil && version == ProtocolVersion {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("X-JAlpine-Reload", "1")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		t.Error(w, "This page is outdated, please reload it")
+	})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// DecodeQueryAndValidate binds query parameters of the request into an instance of T and validates it,
+// like DecodeAndValidate does for JSON bodies. Fields are matched by the `query` tag, then by the
+// `json` tag name, then by the lowercased field name. Slices collect repeated parameters.
+//
+//	type ListQuery struct {
+//		Page  int    `query:"page" validate:"min=0"`
+//		Limit int    `query:"limit" validate:"omitempty,max=100"`
+//		Sort  string `query:"sort" validate:"omitempty,oneof=text createdAt"`
+//	}
+func DecodeQueryAndValidate[T any](t *JTemplate, w http.ResponseWriter, r *http.Request) (*T, bool) {
+	data, err := DecodeQuery[T](r)
+	if err != nil {
+		t.Error(w, err.Error())
+		return nil, false
+	}
+	return data, true
+}
+
+// DecodeQuery binds and validates query parameters without writing a response, for page loaders
+func DecodeQuery[T any](r *http.Request) (*T, error) {
+	var data T
+	if err := bindQuery(reflect.ValueOf(&data).Elem(), r.URL.Query()); err != nil {
+		return nil, fmt.Errorf("Invalid request %v", err)
+	}
+	if err := validate.Struct(data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+func bindQuery(v reflect.Value, query url.Values) error {
+	if v.Kind() != reflect.Struct {
+		return fmt.Errorf("query can only be bound to a struct, not %s", v.Type())
+	}
+	typ := v.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := queryParamName(field)
+		if name == "-" {
+			continue
+		}
+		values, ok := query[name]
+		if !ok || len(values) == 0 {
+			continue
+		}
+		if err := setQueryValue(v.Field(i), values); err != nil {
+			return fmt.Errorf("parameter %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func queryParamName(field reflect.StructField) string {
+	if name, _, _ := strings.Cut(field.Tag.Get("query"), ","); name != "" {
+		return name
+	}
+	if name, _, _ := strings.Cut(field.Tag.Get("json"), ","); name != "" {
+		return name
+	}
+	return strings.ToLower(field.Name)
+}
+
+// setQueryValue parses values into a field of a basic type, a pointer to it or a slice of them
+func setQueryValue(v reflect.Value, values []string) error {
+	switch v.Kind() {
+	case reflect.Slice:
+		slice := reflect.MakeSlice(v.Type(), len(values), len(values))
+		for i, value := range values {
+			if err := setQueryValue(slice.Index(i), []string{value}); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+		return nil
+	case reflect.Pointer:
+		ptr := reflect.New(v.Type().Elem())
+		if err := setQueryValue(ptr.Elem(), values); err != nil {
+			return err
+		}
+		v.Set(ptr)
+		return nil
+	}
+
+	value := values[len(values)-1]
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		// A bare flag like "?done" means true
+		if value == "" {
+			value = "true"
+		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
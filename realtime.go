@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventsPath is where helpers.js connects to receive updates for x-subscribe topics
+const EventsPath = "/_jalpine/events"
+
+// Hub fans out component data updates to connected browsers. Each connection subscribes to
+// named topics (per component like "todoApp", per record like "todo:42", per tenant, ...),
+// so a broadcast only wakes up pages that are interested in it.
+type Hub struct {
+	mu         sync.Mutex
+	clients    map[*hubClient]struct{}
+	polls      map[string]*pollSession // Long polling clients by session, see ServePoll
+	pollReaper sync.Once
+	closed     chan struct{}
+	perIP      map[string]int
+	perSession map[string]int
+
+	maxConns      int
+	maxPerIP      int
+	maxPerSession int
+	sessionCookie string
+	heartbeat     time.Duration
+	writeTimeout  time.Duration
+	bufferSize    int
+	slowPolicy    SlowClientPolicy
+
+	broker      Broker
+	unsubscribe func()
+	jsonOptions *JSONOptions
+	identify    func(r *http.Request) string // User of a connection, see WithUsers
+}
+
+type hubClient struct {
+	topics  map[string]bool
+	send    chan []byte
+	ip      string
+	session string
+	tab     string        // Skipped by broadcasts of its own changes, see BroadcastJSON
+	closed  chan struct{} // Closed by the hub to disconnect a slow client
+}
+
+// SlowClientPolicy decides what happens when a client's buffer is full
+type SlowClientPolicy int
+
+const (
+	DropNewest SlowClientPolicy = iota // Skip the new message, the client gets the next one
+	DropOldest                         // Discard the oldest buffered message to make room
+	Disconnect                         // Close the connection, the browser reconnects and resyncs
+)
+
+// HubOption configures limits of the Hub
+type HubOption func(*Hub)
+
+// WithMaxConns limits the total number of connections, 0 means no limit
+func WithMaxConns(n int) HubOption {
+	return func(h *Hub) { h.maxConns = n }
+}
+
+// WithMaxConnsPerIP limits connections from a single remote address, 0 means no limit.
+// Behind a reverse proxy all clients share its address, so use a session limit instead.
+func WithMaxConnsPerIP(n int) HubOption {
+	return func(h *Hub) { h.maxPerIP = n }
+}
+
+// WithMaxConnsPerSession limits connections per value of the session cookie, 0 means no limit
+func WithMaxConnsPerSession(cookie string, n int) HubOption {
+	return func(h *Hub) {
+		h.sessionCookie = cookie
+		h.maxPerSession = n
+	}
+}
+
+// WithHeartbeat sets the interval of keepalive comments, which also detect dead connections.
+// A write blocked for longer than the interval drops the connection.
+func WithHeartbeat(interval time.Duration) HubOption {
+	return func(h *Hub) {
+		h.heartbeat = interval
+		h.writeTimeout = interval
+	}
+}
+
+// WithClientBuffer sets how many messages may wait for a slow client and what to do when it is full
+func WithClientBuffer(size int, policy SlowClientPolicy) HubOption {
+	return func(h *Hub) {
+		h.bufferSize = size
+		h.slowPolicy = policy
+	}
+}
+
+// WithBroker distributes published messages through the broker, needed when the app runs
+// as several replicas. By default messages stay within the process.
+func WithBroker(broker Broker) HubOption {
+	return func(h *Hub) { h.broker = broker }
+}
+
+func NewHub(opts ...HubOption) *Hub {
+	h := &Hub{
+		clients:      make(map[*hubClient]struct{}),
+		polls:        make(map[string]*pollSession),
+		closed:       make(chan struct{}),
+		perIP:        make(map[string]int),
+		perSession:   make(map[string]int),
+		heartbeat:    30 * time.Second,
+		writeTimeout: 30 * time.Second,
+		bufferSize:   16,
+		slowPolicy:   DropNewest,
+		jsonOptions:  DefaultJSONOptions,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	if h.broker == nil {
+		h.broker = NewMemoryBroker()
+	}
+	h.unsubscribe = h.broker.Subscribe(h.dispatch)
+	return h
+}
+
+// Close stops receiving messages from the broker, connected clients are not affected
+func (h *Hub) Close() {
+	h.unsubscribe()
+	close(h.closed)
+}
+
+// Connections returns the number of currently connected clients
+func (h *Hub) Connections() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients)
+}
+
+// Publish sends data in "component::key" form to all connections subscribed to the topic,
+// on this instance and on others sharing the broker
+func (h *Hub) Publish(topic string, data map[string]interface{}) error {
+	message, err := h.jsonOptions.encode(data, 1)
+	if err != nil {
+		return err
+	}
+	return h.broker.Publish(topic, message)
+}
+
+// dispatch delivers a message received from the broker to local connections
+func (h *Hub) dispatch(topic string, message []byte) {
+	topic, skipTab := splitUserTopic(topic)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		if c.topics[topic] && (skipTab == "" || c.tab != skipTab) {
+			h.deliver(c, message)
+		}
+	}
+}
+
+// deliver puts the message into the client's buffer applying the slow client policy.
+// Must be called with h.mu held.
+func (h *Hub) deliver(c *hubClient, message []byte) {
+	select {
+	case c.send <- message:
+		return
+	default:
+	}
+
+	switch h.slowPolicy {
+	case DropOldest:
+		select {
+		case <-c.send:
+		default:
+		}
+		select {
+		case c.send <- message:
+		default:
+		}
+	case Disconnect:
+		h.unregister(c)
+	}
+}
+
+var errTooManyConnections = errors.New("too many connections")
+
+// register adds the client if limits allow it
+func (h *Hub) register(c *hubClient) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.maxConns > 0 && len(h.clients) >= h.maxConns {
+		return errTooManyConnections
+	}
+	if h.maxPerIP > 0 && h.perIP[c.ip] >= h.maxPerIP {
+		return errTooManyConnections
+	}
+	if h.maxPerSession > 0 && c.session != "" && h.perSession[c.session] >= h.maxPerSession {
+		return errTooManyConnections
+	}
+	h.clients[c] = struct{}{}
+	h.perIP[c.ip]++
+	if c.session != "" {
+		h.perSession[c.session]++
+	}
+	return nil
+}
+
+// unregister removes the client, it is safe to call it several times.
+// Must be called with h.mu held.
+func (h *Hub) unregister(c *hubClient) {
+	if _, ok := h.clients[c]; !ok {
+		return
+	}
+	delete(h.clients, c)
+	close(c.closed)
+	if h.perIP[c.ip]--; h.perIP[c.ip] <= 0 {
+		delete(h.perIP, c.ip)
+	}
+	if c.session != "" {
+		if h.perSession[c.session]--; h.perSession[c.session] <= 0 {
+			delete(h.perSession, c.session)
+		}
+	}
+}
+
+// newClient creates a client for the request with topics from the comma separated "topics" parameter
+func (h *Hub) newClient(r *http.Request) *hubClient {
+	client := &hubClient{
+		topics: make(map[string]bool),
+		send:   make(chan []byte, h.bufferSize),
+		closed: make(chan struct{}),
+	}
+	for _, topic := range strings.Split(r.URL.Query().Get("topics"), ",") {
+		// Topics starting with "_" are internal to the server, e.g. webhook events
+		if topic = strings.TrimSpace(topic); topic != "" && !strings.HasPrefix(topic, "_") {
+			client.topics[topic] = true
+		}
+	}
+	if h.identify != nil {
+		if user := h.identify(r); user != "" {
+			client.topics[userTopic(user)] = true
+		}
+	}
+	client.tab = r.URL.Query().Get("tab")
+	client.ip, _, _ = net.SplitHostPort(r.RemoteAddr)
+	if h.sessionCookie != "" {
+		if cookie, err := r.Cookie(h.sessionCookie); err == nil {
+			client.session = cookie.Value
+		}
+	}
+	return client
+}
+
+// ServeSSE streams updates as Server-Sent Events. Topics are passed by helpers.js
+// as a comma separated "topics" query parameter.
+func (h *Hub) ServeSSE(w http.ResponseWriter, r *http.Request) {
+	client := h.newClient(r)
+	// The user topic counts, a connection without any would never receive anything
+	if len(client.topics) == 0 {
+		http.Error(w, "No topics", http.StatusBadRequest)
+		return
+	}
+	if err := h.register(client); err != nil {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	defer func() {
+		h.mu.Lock()
+		h.unregister(client)
+		h.mu.Unlock()
+	}()
+
+	rc := http.NewResponseController(w)
+	// write sends a chunk and flushes it, a client not accepting data within the timeout is dropped
+	write := func(chunk string) error {
+		rc.SetWriteDeadline(time.Now().Add(h.writeTimeout))
+		if _, err := fmt.Fprint(w, chunk); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	// A named event rather than a comment, so helpers.js sees the stream got through
+	if err := write("event: connected\ndata: {}\n\n"); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(h.heartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-client.closed:
+			return
+		case <-heartbeat.C:
+			if err := write(": ping\n\n"); err != nil {
+				return
+			}
+		case message := <-client.send:
+			if err := write("data: " + string(message) + "\n\n"); err != nil {
+				return
+			}
+		}
+	}
+}
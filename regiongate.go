@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// RegionRule decides where a feature is available. Locations are country codes ("DE") or
+// country and subdivision ("US-CA"), as found by GeoMiddleware.
+type RegionRule struct {
+	Allow   []string // The feature is only on here, empty is everywhere not denied
+	Deny    []string // Checked before Allow
+	Unknown bool     // Result for clients without a known location
+}
+
+// RegionGates maps feature names to their rules. Pass them to WithRegionGates to send the
+// results as "main::features" and use Require on the routes of the features, so the page never
+// shows what the server refuses.
+type RegionGates map[string]RegionRule
+
+// WithRegionGates adds "main::features": {feature: enabled} to Execute and JSON responses,
+// evaluated for the location of GeoMiddleware
+func WithRegionGates(gates RegionGates) TemplateOption {
+	return func(t *JTemplate) {
+		t.regionGates = gates
+	}
+}
+
+// Enabled evaluates the rule of the feature, features without a rule are enabled
+func (g RegionGates) Enabled(feature string, geo GeoInfo, known bool) bool {
+	rule, ok := g[feature]
+	if !ok {
+		return true
+	}
+	if !known || geo.Country == "" {
+		return rule.Unknown
+	}
+	if rule.matches(rule.Deny, geo) {
+		return false
+	}
+	return len(rule.Allow) == 0 || rule.matches(rule.Allow, geo)
+}
+
+func (RegionRule) matches(locations []string, geo GeoInfo) bool {
+	return slices.ContainsFunc(locations, func(location string) bool {
+		country, region, hasRegion := strings.Cut(location, "-")
+		return strings.EqualFold(country, geo.Country) && (!hasRegion || strings.EqualFold(region, geo.Region))
+	})
+}
+
+// Evaluate returns the results of all features
+func (g RegionGates) Evaluate(geo GeoInfo, known bool) map[string]bool {
+	features := make(map[string]bool, len(g))
+	for feature := range g {
+		features[feature] = g.Enabled(feature, geo, known)
+	}
+	return features
+}
+
+// Require answers 451 Unavailable For Legal Reasons where the feature is disabled
+func (g RegionGates) Require(feature string, next http.HandlerFunc) http.HandlerFunc {
+	return wrapRoute(func(w http.ResponseWriter, r *http.Request) {
+		geo, known := GeoFromContext(r.Context())
+		if !g.Enabled(feature, geo, known) {
+			http.Error(w, "Not available in your region", http.StatusUnavailableForLegalReasons)
+			return
+		}
+		next(w, r)
+	}, next, "region "+feature)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+)
+
+// renderCache keeps rendered (and possibly compressed) pages keyed by the hash of component data.
+// All entries belong to one template version and are dropped when it changes.
+type renderCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	version    string
+	entries    map[string][]byte
+	order      []string // Insertion order for eviction of the oldest entries
+}
+
+// WithRenderCache enables caching of rendered pages for templates whose data rarely changes.
+// Pages are reused while both the template version and the hash of component data match.
+// maxEntries limits the number of cached pages, counting each content encoding separately.
+func WithRenderCache(maxEntries int) TemplateOption {
+	return func(t *JTemplate) {
+		t.renderCache = &renderCache{maxEntries: maxEntries, entries: make(map[string][]byte)}
+	}
+}
+
+// cachedRender returns the page for the serialized component data and the given encoding,
+// rendering it only on a cache miss. Pages of users are only reused for the same segment,
+// see PrivateCache.
+func (t *JTemplate) cachedRender(compDataJSON []byte, encoding, segment string) ([]byte, error) {
+	compDataJSON = t.externalData(compDataJSON)
+	c := t.renderCache
+	if c == nil {
+		return t.renderEncoded(compDataJSON, encoding)
+	}
+
+	sum := sha256.Sum256(compDataJSON)
+	key := hex.EncodeToString(sum[:]) + "/" + encoding + "/" + segment
+	version := t.currentVersion()
+
+	c.mu.Lock()
+	if c.version != version {
+		// Template was recompiled
+		c.version = version
+		c.entries = make(map[string][]byte)
+		c.order = nil
+	}
+	page, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok {
+		return page, nil
+	}
+
+	page, err := t.renderEncoded(compDataJSON, encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.version == version {
+		if _, exists := c.entries[key]; !exists {
+			c.entries[key] = page
+			c.order = append(c.order, key)
+		}
+		for len(c.order) > c.maxEntries {
+			delete(c.entries, c.order[0])
+			c.order = c.order[1:]
+		}
+	}
+	return page, nil
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+// Mailer sends HTML emails
+type Mailer interface {
+	Send(to []string, subject, htmlBody string) error
+}
+
+// SMTPMailer sends emails through an SMTP server, e.g. {Addr: "smtp.example.com:587", From: "app@example.com"}
+type SMTPMailer struct {
+	Addr string
+	From string
+	Auth smtp.Auth // Optional, e.g. smtp.PlainAuth
+}
+
+func (m SMTPMailer) Send(to []string, subject, htmlBody string) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: %s\r\n", m.From, strings.Join(to, ", "), mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/html; charset=utf-8\r\n\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString(htmlBody)
+	return smtp.SendMail(m.Addr, m.Auth, m.From, to, msg.Bytes())
+}
+
+// Report is an email rendered from a page loader and sent on a schedule
+type Report struct {
+	Name       string
+	Cron       string // "minute hour day-of-month month day-of-week", e.g. "0 8 * * 1" for Mondays at 8:00
+	Recipients []string
+	Subject    string
+	Path       string       // Path of the request passed to Load, "/" by default
+	Load       PageDataFunc // Data of the email, the same loaders pages use
+	Template   string       // html/template source executed with the loaded data, e.g. {{len (index . "todoApp::todos")}}
+}
+
+// ReportDelivery is one attempt to send a report, stored under ReportHistoryPrefix
+type ReportDelivery struct {
+	Report     string    `json:"report"`
+	At         time.Time `json:"at"`
+	Recipients []string  `json:"recipients"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// ReportHistoryPrefix is the key prefix of deliveries, browsable in the KVBrowser
+const ReportHistoryPrefix = "audit:report:"
+
+// ReportScheduleKey stores the last minute Schedule went through, so a restart in the same
+// minute doesn't send its reports again
+const ReportScheduleKey = "report:schedule:last"
+
+// maxReportCatchUp is how far back Schedule sends reports of minutes missed while the server
+// was down, older ones are skipped rather than mailed all at once
+const maxReportCatchUp = time.Hour
+
+// Reports sends reports through a Mailer, see Run and Schedule
+type Reports struct {
+	db      *buntdb.DB
+	mailer  Mailer
+	clock   Clock
+	reports []Report
+	crons   []cronSchedule
+	bodies  []*htmltemplate.Template
+}
+
+// ReportsOption configures optional behavior of Reports
+type ReportsOption func(*Reports)
+
+// WithReportsClock replaces the clock schedules are checked by, e.g. in tests
+func WithReportsClock(clock Clock) ReportsOption {
+	return func(r *Reports) {
+		r.clock = clock
+	}
+}
+
+// NewReports validates the reports and their schedules
+func NewReports(db *buntdb.DB, mailer Mailer, reports []Report, opts ...ReportsOption) (*Reports, error) {
+	r := &Reports{db: db, mailer: mailer, clock: SystemClock{}}
+	for _, opt := range opts {
+		opt(r)
+	}
+	names := make(map[string]bool)
+	for _, report := range reports {
+		if report.Name == "" || report.Load == nil || report.Template == "" || len(report.Recipients) == 0 {
+			return nil, fmt.Errorf("report %q: name, loader, template and recipients are required", report.Name)
+		}
+		if names[report.Name] {
+			return nil, fmt.Errorf("report %q is defined twice", report.Name)
+		}
+		names[report.Name] = true
+		cron, err := parseCron(report.Cron)
+		if err != nil {
+			return nil, fmt.Errorf("report %q: %w", report.Name, err)
+		}
+		body, err := htmltemplate.New(report.Name).Parse(report.Template)
+		if err != nil {
+			return nil, fmt.Errorf("report %q: %w", report.Name, err)
+		}
+		r.reports = append(r.reports, report)
+		r.crons = append(r.crons, cron)
+		r.bodies = append(r.bodies, body)
+	}
+	return r, nil
+}
+
+// Run renders and sends the report now, regardless of its schedule
+func (r *Reports) Run(name string) (ReportDelivery, error) {
+	for i, report := range r.reports {
+		if report.Name == name {
+			return r.send(i), nil
+		}
+	}
+	return ReportDelivery{}, fmt.Errorf("unknown report %q", name)
+}
+
+// Schedule sends the reports whose schedule matches the current minute until stop is called.
+// Every minute since the last one gone through is checked, so minutes passed during a slow
+// send or a short downtime are not skipped.
+func (r *Reports) Schedule() (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(15 * time.Second)
+		defer ticker.Stop()
+		last := r.lastMinute()
+		for {
+			now := r.clock.Now().Truncate(time.Minute)
+			if now.Sub(last) > maxReportCatchUp {
+				log.Printf("Reports of %s to %s are skipped", last.Add(time.Minute).Format(time.DateTime), now.Add(-maxReportCatchUp).Format(time.DateTime))
+				last = now.Add(-maxReportCatchUp)
+			}
+			for minute := last.Add(time.Minute); !minute.After(now); minute = minute.Add(time.Minute) {
+				// Saved before sending: a crash while sending loses the reports rather than repeats them
+				last = minute
+				r.saveLastMinute(minute)
+				for i := range r.reports {
+					if r.crons[i].matches(minute) {
+						r.send(i)
+					}
+				}
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// lastMinute returns the last minute Schedule went through, the previous minute on the first run
+func (r *Reports) lastMinute() time.Time {
+	now := r.clock.Now()
+	var value string
+	err := r.db.View(func(tx *buntdb.Tx) error {
+		var err error
+		value, err = tx.Get(ReportScheduleKey)
+		return err
+	})
+	if err == nil {
+		if last, err := time.Parse(time.RFC3339, value); err == nil && !last.After(now) {
+			return last.In(now.Location())
+		}
+	}
+	return now.Truncate(time.Minute).Add(-time.Minute)
+}
+
+func (r *Reports) saveLastMinute(minute time.Time) {
+	err := r.db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(ReportScheduleKey, minute.Format(time.RFC3339), nil)
+		return err
+	})
+	if err != nil {
+		log.Printf("Failed to save the report schedule: %v", err)
+	}
+}
+
+// History returns up to limit latest deliveries of the report, newest first
+func (r *Reports) History(name string, limit int) ([]ReportDelivery, error) {
+	var deliveries []ReportDelivery
+	err := r.db.View(func(tx *buntdb.Tx) error {
+		return tx.DescendKeys(ReportHistoryPrefix+"*", func(key, value string) bool {
+			var delivery ReportDelivery
+			if json.Unmarshal([]byte(value), &delivery) == nil && delivery.Report == name {
+				deliveries = append(deliveries, delivery)
+			}
+			return len(deliveries) < limit
+		})
+	})
+	return deliveries, err
+}
+
+func (r *Reports) send(i int) ReportDelivery {
+	report := r.reports[i]
+	delivery := ReportDelivery{Report: report.Name, At: r.clock.Now(), Recipients: report.Recipients}
+	body, err := r.render(report, r.bodies[i])
+	if err == nil {
+		err = r.mailer.Send(report.Recipients, report.Subject, body)
+	}
+	if err != nil {
+		delivery.Error = err.Error()
+		log.Printf("Report %s failed: %v", report.Name, err)
+	}
+	r.record(delivery)
+	return delivery
+}
+
+func (r *Reports) render(report Report, tmpl *htmltemplate.Template) (string, error) {
+	path := report.Path
+	if path == "" {
+		path = "/"
+	}
+	req, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		return "", err
+	}
+	data, err := report.Load(req)
+	if err != nil {
+		return "", fmt.Errorf("load: %w", err)
+	}
+	var body strings.Builder
+	if err := tmpl.Execute(&body, data); err != nil {
+		return "", fmt.Errorf("render: %w", err)
+	}
+	return body.String(), nil
+}
+
+// record stores the delivery under ReportHistoryPrefix
+func (r *Reports) record(delivery ReportDelivery) {
+	entry, err := json.Marshal(delivery)
+	if err == nil {
+		err = r.db.Update(func(tx *buntdb.Tx) error {
+			key := ReportHistoryPrefix + delivery.At.UTC().Format(time.RFC3339Nano) + ":" + delivery.Report
+			_, _, err := tx.Set(key, string(entry), nil)
+			return err
+		})
+	}
+	if err != nil {
+		log.Printf("Failed to record report delivery: %v", err)
+	}
+}
+
+// cronSchedule holds the allowed values of the five cron fields
+type cronSchedule struct {
+	fields [5]map[int]bool
+	star   [5]bool // The field starts with "*", such day fields don't restrict the other one
+}
+
+// Day of week 7 is Sunday as well as 0
+var cronRanges = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+// parseCron supports "*", numbers, lists, ranges and steps like "*/15" or "1-5"
+func parseCron(spec string) (cronSchedule, error) {
+	var cron cronSchedule
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return cron, fmt.Errorf("cron %q must have 5 fields", spec)
+	}
+	for i, field := range fields {
+		cron.fields[i] = make(map[int]bool)
+		cron.star[i] = strings.HasPrefix(field, "*")
+		for _, part := range strings.Split(field, ",") {
+			lo, hi := cronRanges[i][0], cronRanges[i][1]
+			values, step, hasStep := strings.Cut(part, "/")
+			stepN := 1
+			if hasStep {
+				n, err := strconv.Atoi(step)
+				if err != nil || n <= 0 {
+					return cron, fmt.Errorf("cron %q: bad step %q", spec, part)
+				}
+				stepN = n
+			}
+			if values != "*" {
+				from, to, isRange := strings.Cut(values, "-")
+				a, err := strconv.Atoi(from)
+				b := a
+				if err == nil && isRange {
+					b, err = strconv.Atoi(to)
+				} else if err == nil && hasStep {
+					b = hi
+				}
+				if err != nil || a < lo || b > hi || a > b {
+					return cron, fmt.Errorf("cron %q: bad value %q", spec, part)
+				}
+				lo, hi = a, b
+			}
+			for v := lo; v <= hi; v += stepN {
+				cron.fields[i][v] = true
+			}
+			if i == 4 && cron.fields[i][7] {
+				delete(cron.fields[i], 7)
+				cron.fields[i][0] = true
+			}
+		}
+	}
+	return cron, nil
+}
+
+// matches follows cron: when neither day of month nor day of week starts with "*", either
+// matching is enough, so "0 8 1-31 * 1" runs every day
+func (c cronSchedule) matches(t time.Time) bool {
+	if !c.fields[0][t.Minute()] || !c.fields[1][t.Hour()] || !c.fields[3][int(t.Month())] {
+		return false
+	}
+	day, weekday := c.fields[2][t.Day()], c.fields[4][int(t.Weekday())]
+	if !c.star[2] && !c.star[4] {
+		return day || weekday
+	}
+	return day && weekday
+}
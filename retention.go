@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"slices"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+// RetentionAction is what happens to records older than the rule allows
+type RetentionAction string
+
+const (
+	RetentionDelete  RetentionAction = "delete"
+	RetentionArchive RetentionAction = "archive" // Passed to the Archiver, then deleted
+)
+
+// RetentionRule declares how long records of a type are kept
+type RetentionRule struct {
+	Name      string
+	Pattern   string                 // buntdb key pattern of the type, e.g. "todo:*" or "tenant:acme:todo:*"
+	TimeField string                 // JSON field with the record time, an RFC 3339 string or unix milliseconds
+	MaxAge    time.Duration          // Records older than this are removed
+	Match     map[string]interface{} // Optional JSON field values the record must have, e.g. {"completed": true}
+	Action    RetentionAction        // RetentionDelete by default
+}
+
+// Archiver receives records of RetentionArchive rules before they are deleted
+type Archiver interface {
+	Archive(key, value string) error
+}
+
+// RetentionReport describes one run of a rule, stored as an audit entry unless it was a dry run
+type RetentionReport struct {
+	Rule    string          `json:"rule"`
+	Action  RetentionAction `json:"action"`
+	DryRun  bool            `json:"dryRun"`
+	At      time.Time       `json:"at"`
+	Cutoff  time.Time       `json:"cutoff"`
+	Matched int             `json:"matched"`
+	Keys    []string        `json:"keys,omitempty"` // The first matched keys
+	Error   string          `json:"error,omitempty"`
+}
+
+// RetentionAuditPrefix is the key prefix of audit entries written by Retention.Run
+const RetentionAuditPrefix = "audit:retention:"
+
+const maxReportedKeys = 20
+
+// Retention applies retention rules to a buntdb database, see Run and Schedule
+type Retention struct {
+	db       *buntdb.DB
+	rules    []RetentionRule
+	clock    Clock
+	archiver Archiver
+	removed  func(rule RetentionRule, keys []string)
+}
+
+// RetentionOption configures optional behavior of Retention
+type RetentionOption func(*Retention)
+
+// WithRetentionClock replaces the clock records are aged by, e.g. in tests
+func WithRetentionClock(clock Clock) RetentionOption {
+	return func(r *Retention) {
+		r.clock = clock
+	}
+}
+
+// WithArchiver sets where records of RetentionArchive rules go
+func WithArchiver(archiver Archiver) RetentionOption {
+	return func(r *Retention) {
+		r.archiver = archiver
+	}
+}
+
+// OnRetentionRemoved calls fn after a run of a rule deleted or archived records, with their
+// keys, e.g. to bump DataVersions and broadcast the removal to open pages
+func OnRetentionRemoved(fn func(rule RetentionRule, keys []string)) RetentionOption {
+	return func(r *Retention) {
+		r.removed = fn
+	}
+}
+
+// NewRetention validates the rules and creates a Retention for the database
+func NewRetention(db *buntdb.DB, rules []RetentionRule, opts ...RetentionOption) (*Retention, error) {
+	r := &Retention{db: db, rules: slices.Clone(rules), clock: SystemClock{}}
+	for _, opt := range opts {
+		opt(r)
+	}
+	for i, rule := range r.rules {
+		if rule.Name == "" || rule.Pattern == "" || rule.TimeField == "" || rule.MaxAge <= 0 {
+			return nil, fmt.Errorf("retention rule %d: name, pattern, time field and max age are required", i)
+		}
+		switch rule.Action {
+		case "":
+			r.rules[i].Action = RetentionDelete
+		case RetentionDelete:
+		case RetentionArchive:
+			if r.archiver == nil {
+				return nil, fmt.Errorf("retention rule %s: archiving requires WithArchiver", rule.Name)
+			}
+		default:
+			return nil, fmt.Errorf("retention rule %s: unknown action %q", rule.Name, rule.Action)
+		}
+	}
+	return r, nil
+}
+
+// Run applies all rules once. A dry run only reports what would be removed.
+func (r *Retention) Run(dryRun bool) []RetentionReport {
+	reports := make([]RetentionReport, 0, len(r.rules))
+	for _, rule := range r.rules {
+		report := r.apply(rule, dryRun)
+		if report.Error != "" {
+			log.Printf("Retention %s failed: %s", rule.Name, report.Error)
+		} else if report.Matched > 0 || dryRun {
+			log.Printf("Retention %s: %s %d records (dry run: %v)", rule.Name, rule.Action, report.Matched, dryRun)
+		}
+		if !dryRun && (report.Matched > 0 || report.Error != "") {
+			r.audit(report)
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+// Schedule runs the rules every interval until stop is called
+func (r *Retention) Schedule(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			r.Run(false)
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// apply removes the expired records of a rule in a single transaction. Archived records are
+// durable in the archive before they are deleted.
+func (r *Retention) apply(rule RetentionRule, dryRun bool) RetentionReport {
+	now := r.clock.Now()
+	report := RetentionReport{Rule: rule.Name, Action: rule.Action, DryRun: dryRun, At: now, Cutoff: now.Add(-rule.MaxAge)}
+
+	var expired []string
+	values := make(map[string]string)
+	err := r.db.View(func(tx *buntdb.Tx) error {
+		return tx.AscendKeys(rule.Pattern, func(key, value string) bool {
+			if recordExpired(rule, value, report.Cutoff) {
+				expired = append(expired, key)
+				values[key] = value
+			}
+			return true
+		})
+	})
+	if err == nil {
+		report.Matched = len(expired)
+		report.Keys = expired[:min(len(expired), maxReportedKeys)]
+		var removed []string
+		switch {
+		case dryRun || len(expired) == 0:
+		case rule.Action == RetentionArchive:
+			removed, err = archiveAndDelete(r.db, r.archiver, values)
+		default:
+			removed, err = deleteUnchanged(r.db, values)
+		}
+		if len(removed) > 0 && r.removed != nil {
+			r.removed(rule, removed)
+		}
+	}
+	if err != nil {
+		report.Error = err.Error()
+	}
+	return report
+}
+
+// recordExpired checks the time and the Match fields of a JSON record, unparsable records are kept
+func recordExpired(rule RetentionRule, value string, cutoff time.Time) bool {
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &fields); err != nil {
+		return false
+	}
+	for name, want := range rule.Match {
+		if !jsonValueEqual(fields[name], want) {
+			return false
+		}
+	}
+
+	var recordTime time.Time
+	switch v := fields[rule.TimeField].(type) {
+	case string:
+		parsed, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return false
+		}
+		recordTime = parsed
+	case float64:
+		recordTime = time.UnixMilli(int64(v))
+	default:
+		return false
+	}
+	return recordTime.Before(cutoff)
+}
+
+// jsonValueEqual compares a decoded JSON value with a Go value by their JSON form
+func jsonValueEqual(decoded, want interface{}) bool {
+	encoded, err := json.Marshal(want)
+	if err != nil {
+		return false
+	}
+	var normalized interface{}
+	json.Unmarshal(encoded, &normalized)
+	return reflect.DeepEqual(decoded, normalized)
+}
+
+// audit stores the report under RetentionAuditPrefix
+func (r *Retention) audit(report RetentionReport) {
+	entry, err := json.Marshal(report)
+	if err == nil {
+		err = r.db.Update(func(tx *buntdb.Tx) error {
+			key := RetentionAuditPrefix + report.At.UTC().Format(time.RFC3339Nano) + ":" + report.Rule
+			_, _, err := tx.Set(key, string(entry), nil)
+			return err
+		})
+	}
+	if err != nil {
+		log.Printf("Failed to write retention audit entry: %v", err)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"unsafe"
+
+	"github.com/gorilla/mux"
+)
+
+// RouteInfo describes a registered route, see RouteTable
+type RouteInfo struct {
+	Path        string   // Path template, prefixes end with "*"
+	Methods     []string // Empty means any method
+	Handler     string   // Function name, behind wrappers like RequireNonce or Handle
+	Source      string   // file:line of the handler function
+	Requires    []string // Checks of the wrappers, e.g. "nonce todos.clear-completed" or "region export"
+	Middlewares []string // Wrapping every request of the route, outermost first
+}
+
+// routeWrappers remembers what wrappers like RequireNonce wrap, keyed by the closure they
+// return, so RouteTable shows the handler and its requirements instead of the closure
+var routeWrappers sync.Map // closure => routeWrapper
+
+type routeWrapper struct {
+	inner       any    // http.HandlerFunc, or the function given to Handle
+	requirement string // Empty for wrappers that check nothing
+}
+
+// wrapRoute records that wrapper calls inner after checking the requirement
+func wrapRoute(wrapper http.HandlerFunc, inner any, requirement string) http.HandlerFunc {
+	routeWrappers.Store(closureKey(wrapper), routeWrapper{inner: inner, requirement: requirement})
+	return wrapper
+}
+
+// closureKey identifies a func value. Closures of the same code share their code pointer, so
+// the pointer to the closure itself is used.
+func closureKey(fn http.HandlerFunc) unsafe.Pointer {
+	return *(*unsafe.Pointer)(unsafe.Pointer(&fn))
+}
+
+// routeMiddleware is a middleware applied to the routes of a router
+type routeMiddleware struct {
+	name   string
+	except string // Path prefix the middleware is skipped for
+}
+
+var (
+	middlewaresMu     sync.Mutex
+	routerMiddlewares = make(map[*mux.Router][]routeMiddleware) // Outermost first
+)
+
+// UseMiddleware is router.Use recording the name of the middleware for RouteTable
+func UseMiddleware(router *mux.Router, name string, mw mux.MiddlewareFunc) {
+	router.Use(mw)
+	middlewaresMu.Lock()
+	defer middlewaresMu.Unlock()
+	routerMiddlewares[router] = append(routerMiddlewares[router], routeMiddleware{name: name})
+}
+
+// AroundRouter records a middleware wrapping the router from the outside, e.g. Compress, for
+// RouteTable. Paths starting with except don't go through it. Call it from the inside out.
+func AroundRouter(router *mux.Router, name, except string) {
+	middlewaresMu.Lock()
+	defer middlewaresMu.Unlock()
+	routerMiddlewares[router] = append([]routeMiddleware{{name: name, except: except}}, routerMiddlewares[router]...)
+}
+
+// middlewaresFor returns the names of the middlewares a request of the path goes through
+func middlewaresFor(router *mux.Router, path string) []string {
+	middlewaresMu.Lock()
+	defer middlewaresMu.Unlock()
+	var names []string
+	for _, mw := range routerMiddlewares[router] {
+		if mw.except == "" || !strings.HasPrefix(path, mw.except) {
+			names = append(names, mw.name)
+		}
+	}
+	return names
+}
+
+// RouteTable lists routes of the router in registration order and reports routes registered
+// more than once for the same path and method, the later of which would never be reached
+func RouteTable(router *mux.Router) ([]RouteInfo, []error) {
+	var routes []RouteInfo
+	var conflicts []error
+	seen := make(map[string]map[string]RouteInfo) // path => method => route
+
+	router.Walk(func(route *mux.Route, r *mux.Router, ancestors []*mux.Route) error {
+		// Actions of a dispatcher show up as routes of their own
+		if actions, ok := route.GetHandler().(*ActionDispatcher); ok {
+			for _, name := range actions.Names() {
+				info := RouteInfo{Path: ActionsPath + "/" + name, Methods: []string{"POST"}}
+				info.Handler, info.Source, info.Requires = describeHandler(actions.handler(name))
+				info.Middlewares = middlewaresFor(router, info.Path)
+				routes = append(routes, info)
+			}
+			return nil
+		}
+		info := RouteInfo{}
+		if path, err := route.GetPathTemplate(); err == nil {
+			info.Path = path
+		} else if prefix, err := route.GetPathRegexp(); err == nil {
+			info.Path = prefix
+		}
+		if isPrefixRoute(route) {
+			info.Path += "*"
+		}
+		info.Methods, _ = route.GetMethods()
+		info.Handler, info.Source, info.Requires = describeHandler(route.GetHandler())
+		info.Middlewares = middlewaresFor(router, info.Path)
+		routes = append(routes, info)
+
+		methods := info.Methods
+		if len(methods) == 0 {
+			methods = []string{"*"}
+		}
+		if seen[info.Path] == nil {
+			seen[info.Path] = make(map[string]RouteInfo)
+		}
+		for _, method := range methods {
+			for previousMethod, previous := range seen[info.Path] {
+				if method == previousMethod || method == "*" || previousMethod == "*" {
+					conflicts = append(conflicts, fmt.Errorf("%s %s is registered twice: %s (%s) and %s (%s)",
+						method, info.Path, previous.Handler, previous.Source, info.Handler, info.Source))
+				}
+			}
+			seen[info.Path][method] = info
+		}
+		return nil
+	})
+	return routes, conflicts
+}
+
+// isPrefixRoute tells PathPrefix routes from exact ones, mux only exposes it through the regexp
+func isPrefixRoute(route *mux.Route) bool {
+	re, err := route.GetPathRegexp()
+	return err == nil && !strings.HasSuffix(re, "$")
+}
+
+// describeHandler returns the name and source location of the function behind the handler,
+// unwrapping wrappers recorded by wrapRoute, and the requirements of those wrappers
+func describeHandler(handler http.Handler) (name, source string, requires []string) {
+	var inner any = handler
+	for {
+		fn, ok := inner.(http.HandlerFunc)
+		if !ok {
+			break
+		}
+		wrapper, ok := routeWrappers.Load(closureKey(fn))
+		if !ok {
+			break
+		}
+		if requirement := wrapper.(routeWrapper).requirement; requirement != "" {
+			requires = append(requires, requirement)
+		}
+		inner = wrapper.(routeWrapper).inner
+	}
+	name, source = describeFunc(inner)
+	return name, source, requires
+}
+
+// describeFunc returns the name and source location of a function or the type of a handler
+func describeFunc(handler any) (name, source string) {
+	if handler == nil {
+		return "-", "-"
+	}
+	v := reflect.ValueOf(handler)
+	if v.Kind() != reflect.Func {
+		return strings.TrimPrefix(v.Type().String(), "*"), "-"
+	}
+	fn := runtime.FuncForPC(v.Pointer())
+	if fn == nil {
+		return "?", "-"
+	}
+	name = strings.TrimSuffix(strings.TrimPrefix(fn.Name(), "main."), "-fm")
+	file, line := fn.FileLine(fn.Entry())
+	// Method values are wrapped by the compiler and have no real location
+	if strings.HasPrefix(file, "<") {
+		return name, "-"
+	}
+	return name, fmt.Sprintf("%s:%d", filepath.Base(file), line)
+}
+
+// runRoutes implements "jalpine routes": prints the route table and exits with status 1 on conflicts
+func runRoutes(router *mux.Router) {
+	routes, conflicts := RouteTable(router)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "METHODS\tPATH\tHANDLER\tSOURCE\tREQUIRES\tMIDDLEWARES\t\n")
+	for _, route := range routes {
+		methods := strings.Join(route.Methods, ",")
+		if methods == "" {
+			methods = "*"
+		}
+		requires := strings.Join(route.Requires, ", ")
+		if requires == "" {
+			requires = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t\n", methods, route.Path, route.Handler, route.Source,
+			requires, strings.Join(route.Middlewares, ", "))
+	}
+	tw.Flush()
+
+	for _, err := range conflicts {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(conflicts) > 0 {
+		os.Exit(1)
+	}
+}
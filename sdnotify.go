@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// SDNotify sends a state like "READY=1" to systemd for services with Type=notify. Without
+// NOTIFY_SOCKET, i.e. when not started by systemd, it does nothing.
+func SDNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// Names starting with @ are abstract sockets, Go translates them
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// WatchdogInterval returns how often systemd expects keepalives (WatchdogSec=), 0 if the
+// watchdog is off or meant for another process
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// SystemdWatchdog sends keepalives at half the watchdog interval as long as the server at addr,
+// the address it listens on, answers LivenessPath. A hung server misses them and systemd
+// restarts it. Does nothing when the watchdog is off.
+func (s *Startup) SystemdWatchdog(addr string) (stop func()) {
+	interval := WatchdogInterval()
+	if interval == 0 {
+		return func() {}
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		log.Printf("Systemd watchdog disabled: %v", err)
+		return func() {}
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	url := "http://" + net.JoinHostPort(host, port) + LivenessPath
+	client := &http.Client{Timeout: interval / 2}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for {
+			if err := selfCheck(client, url); err != nil {
+				log.Printf("Self-check failed, skipping watchdog keepalive: %v", err)
+			} else if err := SDNotify("WATCHDOG=1"); err != nil {
+				log.Printf("Failed to notify systemd: %v", err)
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func selfCheck(client *http.Client, url string) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	return nil
+}
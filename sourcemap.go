@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+)
+
+// inlineSourceMap returns a sourceMappingURL comment mapping lines of a transformed script to
+// the template file. The script body starts after headerLines generated lines and corresponds
+// to the file starting at line:column (0-based), each of its bodyLines lines maps one to one.
+// The file content is embedded, the browser has no URL to fetch it from.
+func inlineSourceMap(filename, source string, headerLines, line, column, bodyLines int) string {
+	var mappings strings.Builder
+	mappings.WriteString(strings.Repeat(";", headerLines))
+	for i := 0; i < bodyLines; i++ {
+		if i > 0 {
+			mappings.WriteByte(';')
+		}
+		// Segment fields are deltas: generated column, source index, source line, source column
+		switch i {
+		case 0:
+			mappings.WriteString(encodeVLQ(0, 0, line, column))
+		case 1:
+			mappings.WriteString(encodeVLQ(0, 0, 1, -column))
+		default:
+			mappings.WriteString(encodeVLQ(0, 0, 1, 0))
+		}
+	}
+
+	sourceMap, _ := json.Marshal(map[string]interface{}{
+		"version":        3,
+		"sources":        []string{"templates/" + filename},
+		"sourcesContent": []string{source},
+		"names":          []string{},
+		"mappings":       mappings.String(),
+	})
+	return "\n//# sourceMappingURL=data:application/json;charset=utf-8;base64," +
+		base64.StdEncoding.EncodeToString(sourceMap) + "\n"
+}
+
+const vlqChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+// encodeVLQ encodes values as a source map segment in base64 VLQ
+func encodeVLQ(values ...int) string {
+	var b strings.Builder
+	for _, value := range values {
+		// The sign goes into the lowest bit
+		v := value << 1
+		if value < 0 {
+			v = (-value << 1) | 1
+		}
+		for {
+			digit := v & 31
+			v >>= 5
+			if v > 0 {
+				digit |= 32
+			}
+			b.WriteByte(vlqChars[digit])
+			if v == 0 {
+				break
+			}
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// WithSSR enables server-side rendering of simple bindings, so lists and texts are visible
+// before Alpine boots. Only plain data paths are supported: x-for="item in key" (or
+// "(item, index) in key"), x-text="key" / x-text="item.field", boolean attributes like
+// :checked="item.done" and x-show="key". Expressions, getters and methods are left to Alpine.
+// Rendered list items are marked with data-jalpine-ssr and replaced by Alpine on init.
+func WithSSR(enabled bool) TemplateOption {
+	return func(t *JTemplate) {
+		t.ssr = enabled
+	}
+}
+
+var (
+	ssrTagRe      = regexp.MustCompile(`<(/?)([a-zA-Z][\w-]*)((?:[^>"']|"[^"]*"|'[^']*')*)>`)
+	ssrXDataRe    = regexp.MustCompile(`\sx-data="([^"]*)"`)
+	ssrXForRe     = regexp.MustCompile(`\sx-for="\s*\(?\s*([A-Za-z_$][\w$]*)\s*(?:,\s*([A-Za-z_$][\w$]*)\s*)?\)?\s+(?:in|of)\s+([A-Za-z_$][\w$.]*)\s*"`)
+	ssrXTextRe    = regexp.MustCompile(`\sx-text="\s*([A-Za-z_$][\w$.]*)\s*"`)
+	ssrXShowRe    = regexp.MustCompile(`\sx-show="\s*([A-Za-z_$][\w$.]*)\s*"`)
+	ssrBoolAttrRe = regexp.MustCompile(`\s(?:x-bind)?:(checked|disabled|selected|hidden)="\s*([A-Za-z_$][\w$.]*)\s*"`)
+)
+
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true,
+	"input": true, "link": true, "meta": true, "source": true, "track": true, "wbr": true,
+}
+
+// ssrExpand renders bindings of the compiled template with the serialized component data
+func ssrExpand(compiled string, compDataJSON []byte) string {
+	var data map[string]map[string]interface{}
+	if err := json.Unmarshal(compDataJSON, &data); err != nil {
+		return compiled
+	}
+	r := ssrRenderer{data: data}
+	return r.walk(compiled, "", nil, false)
+}
+
+type ssrRenderer struct {
+	data map[string]map[string]interface{}
+}
+
+type ssrOpenTag struct {
+	tag       string
+	component string
+}
+
+// walk rewrites html tag by tag, tracking the nearest x-data component of every element.
+// vars holds loop variables in scope, markFirst adds data-jalpine-ssr to the first element.
+func (r *ssrRenderer) walk(src, component string, vars map[string]interface{}, markFirst bool) string {
+	var out strings.Builder
+	var stack []ssrOpenTag
+	pos := 0
+	for pos < len(src) {
+		loc := ssrTagRe.FindStringSubmatchIndex(src[pos:])
+		if loc == nil {
+			break
+		}
+		for i := range loc {
+			loc[i] += pos
+		}
+		start, end := loc[0], loc[1]
+
+		// Copy comments as is, they may contain anything looking like tags
+		if c := strings.Index(src[pos:start], "<!--"); c != -1 {
+			commentEnd := strings.Index(src[pos+c:], "-->")
+			if commentEnd == -1 {
+				break
+			}
+			commentEnd += pos + c + len("-->")
+			out.WriteString(src[pos:commentEnd])
+			pos = commentEnd
+			continue
+		}
+
+		closing := loc[3] > loc[2]
+		tag := strings.ToLower(src[loc[4]:loc[5]])
+		attrs := src[loc[6]:loc[7]]
+		if closing {
+			for i := len(stack) - 1; i >= 0; i-- {
+				if stack[i].tag == tag {
+					stack = stack[:i]
+					break
+				}
+			}
+			out.WriteString(src[pos:end])
+			pos = end
+			continue
+		}
+
+		current := component
+		if len(stack) > 0 {
+			current = stack[len(stack)-1].component
+		}
+		if m := ssrXDataRe.FindStringSubmatch(attrs); m != nil {
+			current = m[1]
+		}
+		resolve := func(path string) (interface{}, bool) {
+			return r.resolve(path, current, vars)
+		}
+
+		// Raw text elements and templates are copied untouched
+		if tag == "script" || tag == "style" || tag == "template" {
+			closeStart, closeEnd := findClosingTag(src, end, tag)
+			if closeStart == -1 {
+				break
+			}
+			out.WriteString(src[pos:closeEnd])
+			pos = closeEnd
+			if tag == "template" {
+				r.expandFor(&out, attrs, src[end:closeStart], current, vars)
+			}
+			continue
+		}
+
+		newAttrs := attrs
+		if markFirst {
+			newAttrs = " data-jalpine-ssr" + newAttrs
+			markFirst = false
+		}
+		for _, m := range ssrBoolAttrRe.FindAllStringSubmatch(attrs, -1) {
+			if value, ok := resolve(m[2]); ok && truthy(value) {
+				newAttrs += " " + m[1]
+			}
+		}
+		if m := ssrXShowRe.FindStringSubmatch(attrs); m != nil && !strings.Contains(attrs, "style=") {
+			if value, ok := resolve(m[1]); ok && !truthy(value) {
+				newAttrs += ` style="display: none;"`
+			}
+		}
+		out.WriteString(src[pos:loc[6]])
+		out.WriteString(newAttrs)
+		out.WriteString(src[loc[7]:end])
+		pos = end
+
+		// Fill x-text only for elements containing nothing but text
+		if m := ssrXTextRe.FindStringSubmatch(attrs); m != nil {
+			if value, ok := resolve(m[1]); ok {
+				if text, ok := ssrText(value); ok {
+					lt := strings.IndexByte(src[end:], '<')
+					if lt != -1 && strings.HasPrefix(strings.ToLower(src[end+lt:]), "</"+tag) {
+						out.WriteString(text)
+						pos = end + lt
+					}
+				}
+			}
+		}
+
+		if !voidElements[tag] && !strings.HasSuffix(strings.TrimSpace(attrs), "/") {
+			stack = append(stack, ssrOpenTag{tag: tag, component: current})
+		}
+	}
+	out.WriteString(src[pos:])
+	return out.String()
+}
+
+// expandFor renders items of x-for after its <template> if the list is known
+func (r *ssrRenderer) expandFor(out *strings.Builder, attrs, inner, component string, vars map[string]interface{}) {
+	m := ssrXForRe.FindStringSubmatch(attrs)
+	if m == nil {
+		return
+	}
+	value, ok := r.resolve(m[3], component, vars)
+	if !ok {
+		return
+	}
+	items, ok := value.([]interface{})
+	if !ok {
+		return
+	}
+
+	for i, item := range items {
+		itemVars := make(map[string]interface{}, len(vars)+2)
+		for k, v := range vars {
+			itemVars[k] = v
+		}
+		itemVars[m[1]] = item
+		if m[2] != "" {
+			itemVars[m[2]] = float64(i)
+		}
+		out.WriteString(r.walk(strings.TrimSpace(inner), component, itemVars, true))
+	}
+}
+
+// resolve looks up a dotted path in loop variables first, then in the component data
+func (r *ssrRenderer) resolve(path, component string, vars map[string]interface{}) (interface{}, bool) {
+	segments := strings.Split(path, ".")
+	current, ok := vars[segments[0]]
+	if !ok {
+		current, ok = r.data[component][segments[0]]
+		if !ok {
+			return nil, false
+		}
+	}
+	for _, segment := range segments[1:] {
+		object, isObject := current.(map[string]interface{})
+		if !isObject {
+			return nil, false
+		}
+		if current, ok = object[segment]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// findClosingTag returns the bounds of the closing tag matching an element opened before from
+func findClosingTag(src string, from int, tag string) (closeStart, closeEnd int) {
+	lower := strings.ToLower(src[from:])
+	depth := 1
+	pos := 0
+	for {
+		closeIdx := strings.Index(lower[pos:], "</"+tag)
+		if closeIdx == -1 {
+			return -1, -1
+		}
+		// Templates may be nested, other raw text elements can't
+		if tag == "template" {
+			if openIdx := strings.Index(lower[pos:], "<"+tag); openIdx != -1 && openIdx < closeIdx {
+				depth++
+				pos += openIdx + len(tag) + 1
+				continue
+			}
+		}
+		closeIdx += pos
+		gt := strings.IndexByte(lower[closeIdx:], '>')
+		if gt == -1 {
+			return -1, -1
+		}
+		if depth--; depth == 0 {
+			return from + closeIdx, from + closeIdx + gt + 1
+		}
+		pos = closeIdx + gt + 1
+	}
+}
+
+// ssrText formats a value like Alpine's x-text does, only for scalars
+func ssrText(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return html.EscapeString(v), true
+	case float64:
+		encoded, _ := json.Marshal(v)
+		return string(encoded), true
+	case bool:
+		return strconv.FormatBool(v), true
+	case nil:
+		return "", true
+	}
+	return "", false
+}
+
+// truthy follows JavaScript rules for JSON values
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	}
+	return true
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StaticFiles serves a directory from memory instead of reading files on every request, with
+// strong ETags, precompressed variants (see DownloadConfig.Precompress) and no directory
+// listings. Files created after loading, e.g. by the Tailwind CLI, are loaded on first request.
+type StaticFiles struct {
+	fsys fs.FS
+
+	mu    sync.RWMutex
+	files map[string]*staticFile
+}
+
+type staticFile struct {
+	content []byte
+	modTime time.Time
+	etag    string
+}
+
+// NewStaticFiles loads all files of fsys, e.g. os.DirFS("./static"). A directory that doesn't
+// exist yet is empty, e.g. for commands that only list the routes of a fresh checkout.
+func NewStaticFiles(fsys fs.FS) (*StaticFiles, error) {
+	s := &StaticFiles{fsys: fsys}
+	return s, s.Reload()
+}
+
+// Reload loads all files again, dropping deleted ones
+func (s *StaticFiles) Reload() error {
+	files := make(map[string]*staticFile)
+	err := fs.WalkDir(s.fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if name == "." && errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err == nil && d.IsDir() && strings.HasSuffix(name, ".tmp") {
+			return fs.SkipDir // Downloads in progress, see LibGuard.restore
+		}
+		if err != nil || d.IsDir() || strings.HasSuffix(name, ".tmp") {
+			return err
+		}
+		file, err := loadStaticFile(s.fsys, name)
+		if err != nil {
+			return err
+		}
+		files[name] = file
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files = files
+	return nil
+}
+
+func loadStaticFile(fsys fs.FS, name string) (*staticFile, error) {
+	info, err := fs.Stat(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", name)
+	}
+	content, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	modTime := info.ModTime()
+	if modTime.IsZero() {
+		// Embedded files have no modification times
+		modTime = vendorBuildTime
+	}
+	sum := sha256.Sum256(content)
+	return &staticFile{content: content, modTime: modTime, etag: `"` + hex.EncodeToString(sum[:8]) + `"`}, nil
+}
+
+// Watch reloads the files when any of them changes, checking every interval, for development
+func (s *StaticFiles) Watch(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	last := s.state()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if state := s.state(); !slices.Equal(state, last) {
+				last = state
+				if err := s.Reload(); err != nil {
+					log.Printf("Failed to reload static files: %v", err)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// state lists names, sizes and modification times of the files on disk
+func (s *StaticFiles) state() []string {
+	var state []string
+	fs.WalkDir(s.fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			state = append(state, fmt.Sprintf("%s %d %d", name, info.Size(), info.ModTime().UnixNano()))
+		}
+		return nil
+	})
+	return state
+}
+
+// file returns the loaded file, loading files that appeared since with their variants
+func (s *StaticFiles) file(name string) *staticFile {
+	s.mu.RLock()
+	file := s.files[name]
+	s.mu.RUnlock()
+	if file != nil {
+		return file
+	}
+	file, err := loadStaticFile(s.fsys, name)
+	if err != nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[name] = file
+	for encoding := range compressors {
+		variant := name + encodingExt(encoding)
+		if loaded, err := loadStaticFile(s.fsys, variant); err == nil {
+			s.files[variant] = loaded
+		}
+	}
+	return file
+}
+
+// ServeHTTP serves the file of the request path, the precompressed variant if the client
+// accepts it. Responses are revalidated by ETag unless Cache-Control was set before, e.g. by
+// CacheImmutable for versioned URLs.
+func (s *StaticFiles) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if strings.Contains(r.URL.Path, "\\") || slices.Contains(strings.Split(r.URL.Path, "/"), "..") {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	var file *staticFile
+	if fs.ValidPath(name) && name != "." {
+		file = s.file(name)
+	}
+	if file == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	h := w.Header()
+	addVary(h, "Accept-Encoding")
+	if h.Get("Cache-Control") == "" {
+		h.Set("Cache-Control", "public, no-cache")
+	}
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		h.Set("Content-Type", contentType)
+	}
+	content, etag := file.content, file.etag
+	if encoding := negotiateEncoding(r); encoding != "" {
+		s.mu.RLock()
+		variant := s.files[name+encodingExt(encoding)]
+		s.mu.RUnlock()
+		// Variants older than the file are stale
+		if variant != nil && !variant.modTime.Before(file.modTime) {
+			content, etag = variant.content, variant.etag
+			h.Set("Content-Encoding", encoding)
+		}
+	}
+	h.Set("ETag", etag)
+	http.ServeContent(w, r, name, file.modTime, bytes.NewReader(content))
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// For useful autocomplete EnsureStaticLibs in IDE
+type EnsureLibsEntry struct {
+	Name    string
+	BaseURL string
+	Version string      // Exact version to download, e.g. "3.14.8". Empty takes whatever BaseURL redirects to
+	Headers http.Header // Sent with requests for this library, e.g. Authorization of a private registry
+	NPM     string      // Package taken from the npm registry instead of BaseURL, see NPMPackage
+	File    string      // Path of the file in the NPM package, e.g. "dist/cdn.min.js"
+	// In-house file copied into the static dir instead of a download, e.g. "assets/my-widgets.js".
+	// Its version is the content hash unless Version is set; it is not recorded in the lockfile.
+	LocalPath string
+
+	// How the tag is injected into pages, used with WithLibEntries
+	Order       int    // Tags with lower orders come first, equal ones are sorted by name length
+	Load        string // LoadDefer (the default for scripts), LoadAsync, LoadModule, LoadNoModule or LoadBlocking
+	CrossOrigin string // The crossorigin attribute, e.g. "anonymous"
+}
+
+// Values of EnsureLibsEntry.Load
+const (
+	LoadDefer    = "defer"
+	LoadAsync    = "async"
+	LoadModule   = "module"
+	LoadNoModule = "nomodule"
+	LoadBlocking = "blocking" // A plain <script>, runs before the page is parsed further
+)
+
+// loadAttrs returns the attributes of the script tag, crossorigin excluded
+func (e EnsureLibsEntry) loadAttrs() string {
+	switch e.Load {
+	case LoadAsync:
+		return " async"
+	case LoadModule:
+		return ` type="module"`
+	case LoadNoModule:
+		return " nomodule defer"
+	case LoadBlocking:
+		return ""
+	}
+	return " defer"
+}
+
+// ext is the extension of the local file: ".css" for stylesheets like daisyUI or animate.css,
+// recognized by the extension of the npm file, the local path or the URL path, ".js" otherwise
+func (e EnsureLibsEntry) ext() string {
+	name := e.File
+	if e.LocalPath != "" {
+		name = e.LocalPath
+	} else if e.NPM == "" {
+		name = e.BaseURL
+		if u, err := url.Parse(e.BaseURL); err == nil {
+			name = u.Path
+		}
+	}
+	if strings.EqualFold(path.Ext(name), ".css") {
+		return ".css"
+	}
+	return ".js"
+}
+
+// WithVersion returns a copy of the entry pinned to the exact version
+func (e EnsureLibsEntry) WithVersion(version string) EnsureLibsEntry {
+	e.Version = version
+	return e
+}
+
+// WithHeaders returns a copy of the entry sending the headers, in addition to ones set before
+func (e EnsureLibsEntry) WithHeaders(headers http.Header) EnsureLibsEntry {
+	merged := e.Headers.Clone()
+	if merged == nil {
+		merged = make(http.Header)
+	}
+	for key, values := range headers {
+		merged[http.CanonicalHeaderKey(key)] = values
+	}
+	e.Headers = merged
+	return e
+}
+
+// URL returns the download URL, with the version put into the package part of unpkg and jsdelivr URLs
+func (e EnsureLibsEntry) URL() string {
+	if e.Version == "" {
+		return e.BaseURL
+	}
+	u, err := url.Parse(e.BaseURL)
+	if err != nil {
+		return e.BaseURL
+	}
+	segments := strings.Split(strings.TrimPrefix(u.Path, "/"), "/")
+	// jsdelivr: /npm/package@version/file
+	pkg := 0
+	if segments[0] == "npm" && len(segments) > 1 {
+		pkg = 1
+	}
+	// Scoped packages: /@scope/package
+	if strings.HasPrefix(segments[pkg], "@") && len(segments) > pkg+1 {
+		pkg++
+	}
+	name, _, _ := strings.Cut(segments[pkg], "@")
+	segments[pkg] = name + "@" + e.Version
+	u.Path = "/" + strings.Join(segments, "/")
+	return u.String()
+}
+
+var (
+	// Alpine starts as soon as it runs, so it comes after plugins registering on alpine:init
+	AlpineJS = EnsureLibsEntry{
+		Name:    "alpinejs",
+		BaseURL: "https://unpkg.com/alpinejs",
+		Order:   10,
+	}
+
+	AlpinePersist = EnsureLibsEntry{
+		Name:    "alpinejs-persist",
+		BaseURL: "https://unpkg.com/@alpinejs/persist",
+	}
+
+	AlpineCollapse = EnsureLibsEntry{
+		Name:    "alpinejs-collapse",
+		BaseURL: "https://unpkg.com/@alpinejs/collapse",
+	}
+
+	AlpineFocus = EnsureLibsEntry{
+		Name:    "alpinejs-focus",
+		BaseURL: "https://unpkg.com/@alpinejs/focus",
+	}
+
+	AlpineAnchor = EnsureLibsEntry{
+		Name:    "alpinejs-anchor",
+		BaseURL: "https://unpkg.com/@alpinejs/anchor",
+	}
+
+	AlpineSort = EnsureLibsEntry{
+		Name:    "alpinejs-sort",
+		BaseURL: "https://unpkg.com/@alpinejs/sort",
+	}
+
+	AlpineIntersect = EnsureLibsEntry{
+		Name:    "alpinejs-intersect",
+		BaseURL: "https://unpkg.com/@alpinejs/intersect",
+	}
+
+	AlpineMask = EnsureLibsEntry{
+		Name:    "alpinejs-mask",
+		BaseURL: "https://unpkg.com/@alpinejs/mask",
+	}
+
+	AlpineMorph = EnsureLibsEntry{
+		Name:    "alpinejs-morph",
+		BaseURL: "https://unpkg.com/@alpinejs/morph",
+	}
+
+	AlpineResize = EnsureLibsEntry{
+		Name:    "alpinejs-resize",
+		BaseURL: "https://unpkg.com/@alpinejs/resize",
+	}
+
+	AlpineAutoAnimate = EnsureLibsEntry{
+		Name:    "alpinejs-autoanimate",
+		BaseURL: "https://cdn.jsdelivr.net/npm/@marcreichel/alpine-auto-animate@latest/dist/alpine-auto-animate.min.js",
+	}
+
+	// Headless UI components, resolved through the npm registry
+	AlpineUI = NPMPackage("alpinejs-ui", "@alpinejs/ui", "dist/cdn.min.js")
+
+	// The browser build must style the page before it is shown
+	TailwindCSS = EnsureLibsEntry{
+		Name:    "tailwindcss",
+		BaseURL: "https://unpkg.com/@tailwindcss/browser@4",
+		Load:    LoadBlocking,
+	}
+
+	// Libraries often used next to Alpine. unpkg redirects the bare package to its browser build,
+	// so WithVersion pins them like Alpine plugins.
+	HTMX = EnsureLibsEntry{
+		Name:    "htmx",
+		BaseURL: "https://unpkg.com/htmx.org",
+	}
+
+	ChartJS = EnsureLibsEntry{
+		Name:    "chartjs",
+		BaseURL: "https://unpkg.com/chart.js",
+	}
+
+	DayJS = EnsureLibsEntry{
+		Name:    "dayjs",
+		BaseURL: "https://unpkg.com/dayjs",
+	}
+
+	// Icons as inline SVG: <i data-lucide="check"></i> and lucide.createIcons() after Alpine renders
+	LucideIcons = EnsureLibsEntry{
+		Name:    "lucide",
+		BaseURL: "https://unpkg.com/lucide",
+	}
+
+	// <iconify-icon icon="mdi:home"> of any Iconify set, icons are fetched from the Iconify API
+	IconifyIcon = EnsureLibsEntry{
+		Name:    "iconify-icon",
+		BaseURL: "https://unpkg.com/iconify-icon",
+	}
+)
+
+// EnsureStaticLibs checks for the presence of each required file in the static folder by pattern,
+// where the file name contains a version (for example, "alpinejs@*.min.js"). If the file is not found,
+// a request is made to unpkg to determine the current version and download the necessary file.
+//
+// The function returns a map where the key is the library identifier (for example, "alpinejs"),
+// and the value is the local file name (with version number). Libraries whose URL ends with ".css"
+// are kept as "name@version.css" and linked as stylesheets.
+func EnsureStaticLibs(staticDir string, plugins ...EnsureLibsEntry) (map[string]string, error) {
+	err := os.MkdirAll(staticDir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	// Если плагины не указаны, используем только Alpine.js
+	if len(plugins) == 0 {
+		plugins = []EnsureLibsEntry{AlpineJS}
+	}
+
+	lockPath := LockFilePath(staticDir)
+	lock, err := ReadLibsLock(lockPath)
+	if err != nil {
+		return nil, err
+	}
+	newLock := LibsLock{Libs: make(map[string]LockedLib)}
+
+	// Libraries are resolved concurrently, errors of all of them are reported together
+	libsMap := make(map[string]string)
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		errs    []error
+		workers = make(chan struct{}, maxParallelDownloads)
+	)
+	for _, plugin := range plugins {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			workers <- struct{}{}
+			defer func() { <-workers }()
+
+			locked, err := resolveLib(staticDir, plugin, lock)
+			served := locked.File
+			if err == nil {
+				served = minifyLib(staticDir, locked.File)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			libsMap[plugin.Name] = served
+			if plugin.LocalPath == "" {
+				newLock.Libs[plugin.Name] = locked
+			}
+		}()
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	if !reflect.DeepEqual(lock.Libs, newLock.Libs) {
+		if err := newLock.Write(lockPath); err != nil {
+			return nil, err
+		}
+	}
+	return libsMap, nil
+}
+
+// maxParallelDownloads limits concurrent requests to the CDN
+const maxParallelDownloads = 4
+
+// resolveLib makes sure the library is in staticDir and describes it for the lockfile
+func resolveLib(staticDir string, plugin EnsureLibsEntry, lock LibsLock) (LockedLib, error) {
+	if plugin.LocalPath != "" {
+		locked, err := copyLocalLib(staticDir, plugin)
+		if err == nil && LibDownloads.Precompress {
+			if err := precompressFile(filepath.Join(staticDir, locked.File)); err != nil {
+				log.Printf("Failed to precompress %s: %v", locked.File, err)
+			}
+		}
+		return locked, err
+	}
+	locked, err := downloadLib(staticDir, plugin, lock)
+	if err != nil {
+		if locked, err = fallbackLib(staticDir, plugin, lock, err); err != nil {
+			return LockedLib{}, err
+		}
+	} else if LibDownloads.SourceMaps {
+		if err := ensureLibSourceMap(staticDir, locked, plugin.Headers); err != nil {
+			log.Printf("No source map for %s: %v", locked.File, err)
+		}
+	}
+	if LibDownloads.Precompress {
+		if err := precompressFile(filepath.Join(staticDir, locked.File)); err != nil {
+			log.Printf("Failed to precompress %s: %v", locked.File, err)
+		}
+	}
+	return locked, nil
+}
+
+// copyLocalLib copies the LocalPath file into staticDir as "name@version.ext" and removes copies
+// of its previous versions
+func copyLocalLib(staticDir string, plugin EnsureLibsEntry) (LockedLib, error) {
+	content, err := os.ReadFile(plugin.LocalPath)
+	if err != nil {
+		return LockedLib{}, fmt.Errorf("failed to read %s: %v", plugin.Name, err)
+	}
+	sum := sha256.Sum256(content)
+	version := plugin.Version
+	if version == "" {
+		version = hex.EncodeToString(sum[:4])
+	}
+	file := plugin.Name + "@" + version + plugin.ext()
+	path := filepath.Join(staticDir, file)
+	if existing, err := os.ReadFile(path); err != nil || !bytes.Equal(existing, content) {
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			return LockedLib{}, err
+		}
+	}
+	removeLibVersions(staticDir, plugin.Name, plugin.ext(), file)
+	return LockedLib{Version: version, File: file, SHA256: hex.EncodeToString(sum[:])}, nil
+}
+
+// removeLibVersions removes "name@*ext" files in staticDir except keep and its minified copy,
+// with their source maps
+// and compressed variants
+func removeLibVersions(staticDir, name, ext, keep string) {
+	matches, _ := filepath.Glob(filepath.Join(staticDir, name+"@*"+ext))
+	for _, match := range matches {
+		if base := filepath.Base(match); base == keep || base == minifiedLibFile(keep) {
+			continue
+		}
+		log.Printf("Removing superseded %s", filepath.Base(match))
+		os.Remove(match)
+		os.Remove(match + ".map")
+		for encoding := range compressors {
+			os.Remove(match + encodingExt(encoding))
+		}
+	}
+}
+
+func downloadLib(staticDir string, plugin EnsureLibsEntry, lock LibsLock) (LockedLib, error) {
+	// Locked libraries are taken from the exact URL recorded before, unless the pin changed
+	if locked, ok := lock.Libs[plugin.Name]; ok && (plugin.Version == "" || plugin.Version == locked.Version) {
+		return locked, ensureLockedLib(staticDir, locked, plugin.Headers)
+	}
+	localFileName, err := ensureLib(staticDir, plugin)
+	if err != nil {
+		return LockedLib{}, err
+	}
+	return lockLib(staticDir, plugin, localFileName)
+}
+
+// libFileVersion returns the version part of a "name@version.js" or "name@version.min.js" file name
+func libFileVersion(name, file string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(file, name+"@"), filepath.Ext(file)), ".min")
+}
+
+// compareVersions compares dotted versions like "3.14.8" numerically, parts that are not
+// numbers (pre-releases) are compared as strings
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y string
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		xn, xerr := strconv.Atoi(x)
+		yn, yerr := strconv.Atoi(y)
+		switch {
+		case xerr == nil && yerr == nil && xn != yn:
+			return cmp.Compare(xn, yn)
+		case (xerr != nil || yerr != nil) && x != y:
+			return strings.Compare(x, y)
+		}
+	}
+	return 0
+}
+
+// versionFromLocation extracts the version from a CDN redirect like "/alpinejs@3.14.8/dist/cdn.min.js"
+func versionFromLocation(location string) (string, error) {
+	// Use the last index of the '@' character to extract the version
+	idx := strings.LastIndex(location, "@")
+	if idx == -1 || idx == len(location)-1 {
+		return "", errors.New("no version in " + location)
+	}
+	versionPart := location[idx+1:]
+
+	// If "/" is present, keep only the part before "/"
+	if slashIdx := strings.Index(versionPart, "/"); slashIdx != -1 {
+		versionPart = versionPart[:slashIdx]
+	}
+	return versionPart, nil
+}
+
+// ensureLib finds the library in staticDir or downloads it, returning the local file name
+func ensureLib(staticDir string, plugin EnsureLibsEntry) (string, error) {
+	// Pinned libraries only accept the exact version
+	pattern := filepath.Join(staticDir, plugin.Name+"@*"+plugin.ext())
+	if plugin.Version != "" {
+		pattern = filepath.Join(staticDir, plugin.Name+"@"+plugin.Version+plugin.ext())
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return "", err
+	}
+
+	if len(matches) > 0 {
+		// File exists — use its base name.
+		return filepath.Base(matches[0]), nil
+	}
+
+	if plugin.NPM != "" {
+		version, dist, err := resolveNPM(plugin, plugin.Version)
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve %s: %v", plugin.NPM, err)
+		}
+		localFileName := plugin.Name + "@" + version + plugin.ext()
+		fmt.Printf("Downloading %s @ %s from npm...\n", plugin.Name, version)
+		if err := downloadNPMFile(dist, plugin.File, filepath.Join(staticDir, localFileName), plugin.Headers); err != nil {
+			return "", fmt.Errorf("failed to download %s: %v", plugin.Name, err)
+		}
+		return localFileName, nil
+	}
+
+	if plugin.Version != "" {
+		localFileName := plugin.Name + "@" + plugin.Version + plugin.ext()
+		fmt.Printf("Downloading %s @ %s...\n", plugin.Name, plugin.Version)
+		if err := downloadFile(plugin.URL(), filepath.Join(staticDir, localFileName), plugin.Headers); err != nil {
+			return "", fmt.Errorf("failed to download %s: %v", plugin.Name, err)
+		}
+		return localFileName, nil
+	}
+
+	// File not found — determine version via unpkg.
+	// Use HEAD request with redirection disabled.
+	location, err := headNoRedirect(plugin.BaseURL, plugin.Headers)
+	if err != nil {
+		return "", fmt.Errorf("failed HEAD for %s: %v", plugin.BaseURL, err)
+	}
+
+	if location == "" {
+		log.Printf("Can't determine version. No redirect location for %s", plugin.BaseURL)
+		location = "@latest"
+	}
+	versionPart, err := versionFromLocation(location)
+	if err != nil {
+		return "", fmt.Errorf("unexpected redirect format for %s: %s", plugin.BaseURL, location)
+	}
+
+	// Form a local file name including the version, for example "alpinejs@3.14.8.js"
+	localFileName := plugin.Name + "@" + versionPart + plugin.ext()
+	localPath := filepath.Join(staticDir, localFileName)
+
+	fmt.Printf("Downloading %s @ %s...\n", plugin.Name, versionPart)
+	if err := downloadFile(plugin.BaseURL, localPath, plugin.Headers); err != nil {
+		return "", fmt.Errorf("failed to download %s: %v", plugin.Name, err)
+	}
+	return localFileName, nil
+}
+
+// libOrder returns the library names in the order they are injected: by EnsureLibsEntry.Order,
+// then by descending length, so plugins like "alpinejs-persist" come before "alpinejs" even
+// without entries, then alphabetically
+func libOrder(libsMap map[string]string, entries map[string]EnsureLibsEntry) []string {
+	keys := make([]string, 0, len(libsMap))
+	for k := range libsMap {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if oi, oj := entries[keys[i]].Order, entries[keys[j]].Order; oi != oj {
+			return oi < oj
+		}
+		if len(keys[i]) == len(keys[j]) {
+			return keys[i] < keys[j]
+		}
+		return len(keys[i]) > len(keys[j])
+	})
+	return keys
+}
+
+// WithLibEntries tells the template how to inject the libraries, usually the same entries
+// passed to EnsureStaticLibs: order, load mode and crossorigin. Without an entry scripts are
+// deferred, except for "tailwindcss".
+func WithLibEntries(entries ...EnsureLibsEntry) TemplateOption {
+	return func(t *JTemplate) {
+		t.libEntries = make(map[string]EnsureLibsEntry, len(entries))
+		for _, entry := range entries {
+			t.libEntries[entry.Name] = entry
+		}
+	}
+}
+
+// injectExternalLibs inserts references to external libraries (Tailwind CSS, AlpineJS, AlpineJS Persist)
+// into the provided HTML, in the order of libOrder and with the load mode of their entries.
+// JavaScript libraries without an entry get the "defer" attribute, except for "tailwindcss".
+// Libraries in cdnLibs are loaded from the CDN with the local file as fallback, see WithCDNLibs.
+// Local URLs carry the content hash from hashes, see WithLibHashes.
+func injectExternalLibs(html string, libsMap map[string]string, entries map[string]EnsureLibsEntry, cdnLibs map[string]CDNLib, hashes map[string]string) string {
+	var tags []string
+	if len(cdnLibs) > 0 {
+		tags = append(tags, assetFallbackScript)
+	}
+
+	// Iterate over the sorted keys and create corresponding tags
+	for _, name := range libOrder(libsMap, entries) {
+		filename := libsMap[name]
+		ext := strings.ToLower(filepath.Ext(filename))
+
+		entry, ok := entries[name]
+		if !ok && strings.ToLower(name) == "tailwindcss" {
+			entry.Load = LoadBlocking
+		}
+		cdn, fromCDN := cdnLibs[name]
+		local := libURL(name, filename, hashes)
+		switch ext {
+		case ".css":
+			// For CSS files, add a link tag
+			if fromCDN {
+				tags = append(tags, cdnTag(cdn, local, false, "", entry.CrossOrigin))
+				continue
+			}
+			tags = append(tags, fmt.Sprintf(`<link rel="stylesheet" href="%s"%s>`, local, crossOriginAttr(entry.CrossOrigin)))
+		case ".js":
+			attrs := entry.loadAttrs()
+			if fromCDN {
+				tags = append(tags, cdnTag(cdn, local, true, attrs, entry.CrossOrigin))
+				continue
+			}
+			tags = append(tags, fmt.Sprintf(`<script src="%s"%s%s></script>`, local, attrs, crossOriginAttr(entry.CrossOrigin)))
+		}
+	}
+
+	// Join all tags with newline separator
+	injection := strings.Join(tags, "\n")
+
+	// Insert the injection before </head> if present, otherwise before </body>, else append at the end
+	if strings.Contains(html, "</head>") {
+		return strings.Replace(html, "</head>", injection+"\n</head>", 1)
+	}
+	if strings.Contains(html, "</body>") {
+		return strings.Replace(html, "</body>", injection+"\n</body>", 1)
+	}
+	return html + injection
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// streamHeartbeat keeps proxies from closing idle streams
+const streamHeartbeat = 30 * time.Second
+
+// Stream pushes component data to a single page over Server-Sent Events, for updates that
+// don't follow a request: timers, background jobs, progress. Unlike Hub topics it belongs to
+// one request, the page opens it with x-stream="/url" or $stream('/url').
+type Stream struct {
+	t   *JTemplate
+	w   http.ResponseWriter
+	rc  *http.ResponseController
+	ctx context.Context
+
+	mu     sync.Mutex
+	closed bool
+	stop   chan struct{}
+}
+
+// Stream answers the request with an event stream. Send data to it until Done is closed or the
+// work is finished. The stream must be closed before the handler returns, usually deferred.
+func (t *JTemplate) Stream(w http.ResponseWriter, r *http.Request) (*Stream, error) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// nginx buffers responses by default, which holds events back
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	s := &Stream{t: t, w: w, rc: http.NewResponseController(w), ctx: r.Context(), stop: make(chan struct{})}
+	if err := s.write("event: connected\ndata: {}\n\n"); err != nil {
+		return nil, err
+	}
+	go s.heartbeat()
+	return s, nil
+}
+
+// Send pushes data in "component::key" form, applied by helpers.js like answers of JSON
+func (s *Stream) Send(data map[string]interface{}) error {
+	s.t.Update()
+	if err := s.t.checkComponents(data); err != nil {
+		return err
+	}
+	data = maps.Clone(data)
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	data["main::availVersion"] = s.t.currentVersion()
+	if s.t.dataVersions != nil {
+		data["main::dataVersions"] = s.t.dataVersions.snapshot()
+	}
+	body, err := s.t.jsonOptions.encode(data, 1)
+	if err != nil {
+		return err
+	}
+	return s.write("data: " + string(body) + "\n\n")
+}
+
+// Done is closed when the page went away
+func (s *Stream) Done() <-chan struct{} {
+	return s.ctx.Done()
+}
+
+// Close stops the heartbeat and tells helpers.js the stream is finished, so the page doesn't
+// reconnect
+func (s *Stream) Close() error {
+	err := s.write("event: done\ndata: {}\n\n")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.stop)
+	}
+	return err
+}
+
+func (s *Stream) heartbeat() {
+	ticker := time.NewTicker(streamHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if s.write(": ping\n\n") != nil {
+				return
+			}
+		}
+	}
+}
+
+// write sends a chunk and flushes it, sends of several goroutines don't interleave
+func (s *Stream) write(chunk string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return fmt.Errorf("stream is closed")
+	}
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	s.rc.SetWriteDeadline(time.Now().Add(streamHeartbeat))
+	if _, err := fmt.Fprint(s.w, chunk); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
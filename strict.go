@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// componentRegistrationRe finds components registered by the compiled template, merged or not
+var componentRegistrationRe = regexp.MustCompile(`(?:Alpine\.data|jalpineExtend)\('([^']+)'`)
+
+// WithStrictComponents makes Execute and JSON fail on data keys of components the template
+// doesn't register, e.g. "todoAp::todos", instead of the data silently vanishing in the
+// browser. Meant for development. Components registered outside the template, e.g. in a
+// library, are passed as known.
+func WithStrictComponents(strict bool, known ...string) TemplateOption {
+	return func(t *JTemplate) {
+		t.strictComponents = nil
+		if strict {
+			t.strictComponents = append([]string{"main"}, known...)
+		}
+	}
+}
+
+// registeredComponents collects the component names of the compiled page and its components
+func registeredComponents(content string, components map[string]string) map[string]bool {
+	names := make(map[string]bool)
+	for _, source := range append([]string{content}, slices.Collect(maps.Values(components))...) {
+		for _, m := range componentRegistrationRe.FindAllStringSubmatch(source, -1) {
+			names[m[1]] = true
+		}
+	}
+	return names
+}
+
+// checkComponents returns an error naming the keys of data that belong to unknown components
+func (t *JTemplate) checkComponents(data map[string]interface{}) error {
+	if t.strictComponents == nil {
+		return nil
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var unknown []string
+	for key := range data {
+		comp, _, ok := strings.Cut(key, "::")
+		if ok && !t.componentNames[comp] && !slices.Contains(t.strictComponents, comp) {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	known := slices.Sorted(maps.Keys(t.componentNames))
+	return fmt.Errorf("unknown components in %s, `%s` registers %s", strings.Join(unknown, ", "), t.mainFile, strings.Join(known, ", "))
+}
+
+// strictError answers the failed check to the page, so it doesn't go unnoticed
+func (t *JTemplate) strictError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInternalServerError)
+	t.writeJSON(w, map[string]string{
+		"main::error":        err.Error(),
+		"main::availVersion": t.currentVersion(),
+	})
+}
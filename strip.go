@@ -0,0 +1,80 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+var fragmentBeginRe = regexp.MustCompile(`\n<!-- BEGIN (.+?) -->\n`)
+
+// extractFragments returns the content of every included file by its BEGIN/END markers,
+// the first inclusion wins if a file is included several times
+func extractFragments(compiled string) map[string]string {
+	fragments := make(map[string]string)
+	for _, m := range fragmentBeginRe.FindAllStringSubmatchIndex(compiled, -1) {
+		name := compiled[m[2]:m[3]]
+		if _, ok := fragments[name]; ok {
+			continue
+		}
+		length := strings.Index(compiled[m[1]:], "\n<!-- END "+name+" -->")
+		if length == -1 {
+			continue
+		}
+		fragments[name] = compiled[m[1] : m[1]+length]
+	}
+	return fragments
+}
+
+// stripComments removes HTML comments, including include markers, leaving the contents
+// of <script>, <style> and <textarea> untouched
+func stripComments(html string) string {
+	var b strings.Builder
+	lower := strings.ToLower(html)
+	pos := 0
+	for {
+		comment := strings.Index(lower[pos:], "<!--")
+		if comment == -1 {
+			break
+		}
+		comment += pos
+
+		// Copy raw text elements preceding the comment as is
+		if raw, tag := nextRawTextElement(lower, pos); raw != -1 && raw < comment {
+			end := strings.Index(lower[raw:], "</"+tag)
+			if end == -1 {
+				break
+			}
+			end += raw
+			b.WriteString(html[pos:end])
+			pos = end
+			continue
+		}
+
+		commentEnd := strings.Index(html[comment:], "-->")
+		if commentEnd == -1 {
+			break
+		}
+		commentEnd += comment + len("-->")
+		// Markers take a line of their own, drop it entirely
+		start := comment
+		if start > pos && html[start-1] == '\n' && strings.HasPrefix(html[commentEnd:], "\n") {
+			start--
+		}
+		b.WriteString(html[pos:start])
+		pos = commentEnd
+	}
+	b.WriteString(html[pos:])
+	return b.String()
+}
+
+// nextRawTextElement returns the position and name of the first raw text element after pos
+func nextRawTextElement(lower string, pos int) (int, string) {
+	first, name := -1, ""
+	for _, tag := range []string{"script", "style", "textarea"} {
+		idx := strings.Index(lower[pos:], "<"+tag)
+		if idx != -1 && (first == -1 || pos+idx < first) {
+			first, name = pos+idx, tag
+		}
+	}
+	return first, name
+}
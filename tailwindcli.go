@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// TailwindCLIURL is the release asset of the standalone Tailwind CLI, formatted with the
+// version, the OS and the architecture
+const TailwindCLIURL = "https://github.com/tailwindlabs/tailwindcss/releases/download/v%s/tailwindcss-%s-%s"
+
+// tailwindBuildLib replaces "tailwindcss" in the injected libraries when the CSS is built
+const tailwindBuildLib = "tailwindcss-build"
+
+// TailwindCLI generates a stylesheet with only the classes the page uses, instead of the
+// browser build compiling CSS on every page load, see WithTailwindCLI
+type TailwindCLI struct {
+	Path      string // The standalone binary, see EnsureTailwindCLI
+	StaticDir string // Where generated stylesheets are written, served under /static
+	CSS       string // Appended to the input after the import of Tailwind, e.g. a @theme block
+
+	mu    sync.Mutex
+	built map[string]string // Hash of the input => generated file name
+}
+
+// EnsureTailwindCLI downloads the standalone CLI of the version into dir unless it's already
+// there, and returns its path. The binary is kept out of the static dir, it's not for browsers.
+// checksum pins the hex sha256 of the release asset for this platform, the binary is checked
+// against it before every use and refused on a mismatch.
+func EnsureTailwindCLI(dir, version, checksum string) (string, error) {
+	osName, arch := runtime.GOOS, runtime.GOARCH
+	if osName == "darwin" {
+		osName = "macos"
+	}
+	if arch == "amd64" {
+		arch = "x64"
+	}
+	asset := fmt.Sprintf(TailwindCLIURL, version, osName, arch)
+	binary := filepath.Join(dir, "tailwindcss@"+version)
+	if osName == "windows" {
+		asset += ".exe"
+		binary += ".exe"
+	}
+	if checksum == "" {
+		return "", fmt.Errorf("no sha256 pinned for %s", asset)
+	}
+	if _, err := os.Stat(binary); err == nil {
+		return binary, checkFileSHA256(binary, checksum)
+	}
+
+	fmt.Printf("Downloading Tailwind CLI @ %s...\n", version)
+	tmp := binary + ".tmp"
+	if err := downloadFile(asset, tmp, nil); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("failed to download Tailwind CLI: %v", err)
+	}
+	if err := checkFileSHA256(tmp, checksum); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return "", err
+	}
+	return binary, os.Rename(tmp, binary)
+}
+
+// checkFileSHA256 compares the sha256 of the file with the hex checksum
+func checkFileSHA256(path, checksum string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, checksum) {
+		return fmt.Errorf("%s has sha256 %s, expected %s", path, sum, checksum)
+	}
+	return nil
+}
+
+// WithTailwindCLI builds the stylesheet of the page with the CLI on every compilation and links
+// it instead of the Tailwind browser build. If the CLI fails the browser build stays.
+func WithTailwindCLI(cli *TailwindCLI) TemplateOption {
+	return func(t *JTemplate) {
+		t.tailwind = cli
+	}
+}
+
+// apply builds the stylesheet of the compiled page and its components and returns libsMap
+// linking it instead of the browser build
+func (c *TailwindCLI) apply(page string, components map[string]string, libsMap map[string]string) (map[string]string, error) {
+	names := make([]string, 0, len(components))
+	for name := range components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	io.WriteString(h, c.CSS)
+	io.WriteString(h, page)
+	io.WriteString(h, helperJS)
+	for _, name := range names {
+		io.WriteString(h, components[name])
+	}
+	hash := hex.EncodeToString(h.Sum(nil))[:12]
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	file, ok := c.built[hash]
+	if !ok {
+		file = "tailwind@" + hash + ".css"
+		if _, err := os.Stat(filepath.Join(c.StaticDir, file)); err != nil {
+			if err := c.build(filepath.Join(c.StaticDir, file), page, components); err != nil {
+				return libsMap, err
+			}
+		}
+		if c.built == nil {
+			c.built = make(map[string]string)
+		}
+		c.built[hash] = file
+	}
+
+	libs := maps.Clone(libsMap)
+	delete(libs, "tailwindcss")
+	libs[tailwindBuildLib] = file
+	return libs, nil
+}
+
+// build runs the CLI over the page, components and helpers.js written into a temporary directory
+func (c *TailwindCLI) build(out, page string, components map[string]string) error {
+	dir, err := os.MkdirTemp("", "jalpine-tailwind-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	sources := filepath.Join(dir, "sources")
+	if err := os.Mkdir(sources, 0755); err != nil {
+		return err
+	}
+	files := map[string]string{"page.html": page, "helpers.js": helperJS}
+	i := 0
+	for _, component := range components {
+		files[fmt.Sprintf("component%d.html", i)] = component
+		i++
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(sources, name), []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	input := filepath.Join(dir, "input.css")
+	css := "@import \"tailwindcss\" source(none);\n@source \"./sources\";\n" + c.CSS
+	if err := os.WriteFile(input, []byte(css), 0644); err != nil {
+		return err
+	}
+
+	tmp := out + ".tmp"
+	cmd := exec.Command(c.Path, "--input", input, "--output", tmp, "--minify")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("%v: %s", err, output)
+	}
+	if err := os.Rename(tmp, out); err != nil {
+		return err
+	}
+	if LibDownloads.Precompress {
+		if err := precompressFile(out); err != nil {
+			log.Printf("Failed to precompress %s: %v", out, err)
+		}
+	}
+	return nil
+}
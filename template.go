@@ -2,111 +2,367 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	_ "embed"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"net/http"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-playground/validator"
 )
 
 type JTemplate struct {
+	// Guards the state replaced by compile, as ForceReload may run while pages are served
+	mu sync.RWMutex
+
 	compiled string              // Fully "compiled" template after recursive processing of include directives and other actions
-	version  string              // Last modification time among all used files
+	version  string              // Hash of the compiled template, helpers and data schema
 	deps     map[string]struct{} // All files that participated in forming the result
+	stamp    string              // Modification times and sizes of deps at the moment of compilation
+	schema   string              // Hash of the Go types sent as component data, see SetDataSchema
+	buildID  string              // Identifies the server binary, see WithBuildID
 
 	mainFile      string
+	componentsDir string
+	components    map[string]string // Compiled fragments from componentsDir by relative file name
+	fragments     map[string]string // Included files by name, see ExecuteFragment
 	libsMap       map[string]string
 	lastCheck     time.Time
-	checkInterval time.Duration
+	checkInterval time.Duration // 0 checks files on every call, see WithCheckInterval
+	noRecheck     bool          // Files are only read on creation and ForceReload
+	clock         Clock
+
+	profile      []IncludeProfile // Per-file statistics of the last compilation
+	profileDepth int
+
+	preprocess *PreprocessOptions
+
+	dev            bool              // Development mode, see WithDevMode
+	deprecatedKeys map[string]string // Data key => deprecation message
+
+	gzipCache   gzipPage
+	renderCache *renderCache // Optional, see WithRenderCache
+
+	errorReporter ErrorReporter // Receives client-side errors, see ClientLogHandler
+	nonces        actionNonces
+	ssr           bool // Render simple bindings on the server, see WithSSR
+	autoCloak     bool // Stamp x-cloak onto component roots, see WithAutoCloak
+	guards        navigationGuards
+	jsonOptions   *JSONOptions     // Optional, see WithJSONOptions
+	helperOptions HelperOptions    // See WithHelperOptions
+	helperJSON    string           // Serialized helperOptions
+	opts          []TemplateOption // Applied to variants as well, see ExecuteVariant
+	variants      pageVariants
+
+	contentFilters []ContentFilter // Run on request fields tagged `moderate:"true"`, see WithContentFilters
+	regionGates    RegionGates     // Sent as "main::features", see WithRegionGates
+
+	cdnLibs      map[string]CDNLib // Loaded from the CDN instead of /static, see WithCDNLibs
+	dataVersions *DataVersions     // Sent as "main::dataVersions", see WithDataVersions
+	libHashes    map[string]string // Appended to library URLs, see WithLibHashes
+	tailwind     *TailwindCLI      // Builds the CSS of the page, see WithTailwindCLI
+	external     *ExternalScripts  // Helpers and data outside the page, see WithExternalScripts
+	pageData     *pageDataStore    // Data scripts of ExternalScripts.Data
+	reloadHooks  []func(version string)
+	libEntries   map[string]EnsureLibsEntry // Order and attributes of injected libraries, see WithLibEntries
+
+	strictComponents []string        // Components known besides registered ones, nil if not strict, see WithStrictComponents
+	componentNames   map[string]bool // Components registered by the compiled template
+	broadcastHub     *Hub            // Sends BroadcastJSON data to other tabs, see WithBroadcastHub
 }
 
+// TemplateOption configures optional behavior of JTemplate, see NewJTemplate
+type TemplateOption func(*JTemplate)
+
 //go:embed helpers.js
 var helperJS string
 
 // NewJTemplate creates a new JTemplate by loading and compiling a template from a file
 // mainFile - path to the main template file
-func NewJTemplate(mainFile string, libsMap map[string]string) (*JTemplate, error) {
+func NewJTemplate(mainFile string, libsMap map[string]string, opts ...TemplateOption) (*JTemplate, error) {
 	t := JTemplate{
 		checkInterval: 2 * time.Second,
 		mainFile:      mainFile,
+		componentsDir: filepath.Join(filepath.Dir(mainFile), "components"),
 		libsMap:       libsMap,
 		deps:          make(map[string]struct{}),
+		clock:         SystemClock{},
+		nonces:        actionNonces{ttl: time.Hour},
+		jsonOptions:   DefaultJSONOptions,
+		opts:          opts,
+	}
+	for _, opt := range opts {
+		opt(&t)
 	}
+	// Pages keep a connection open for BroadcastJSON even without x-subscribe topics
+	t.helperOptions.UserUpdates = t.helperOptions.UserUpdates || t.broadcastHub != nil
+	t.helperJSON = t.helperOptions.encode(t.dev)
 
 	err := t.Update()
-	t.updateVersion()
 	return &t, err
 }
 
-// Recompile template
+// WithCheckInterval sets how often Update looks at the files, 0 checks them on every call.
+// The default is 2 seconds.
+func WithCheckInterval(interval time.Duration) TemplateOption {
+	return func(t *JTemplate) {
+		t.checkInterval = interval
+	}
+}
+
+// WithoutRecheck compiles the template once, later changes are only picked up by ForceReload.
+// Suits production deploys where files never change under a running server.
+func WithoutRecheck() TemplateOption {
+	return func(t *JTemplate) {
+		t.noRecheck = true
+	}
+}
+
+// Recompile template if any of the files changed
 func (t *JTemplate) Update() error {
+	t.mu.RLock()
+	compiled := t.noRecheck && t.stamp != ""
+	t.mu.RUnlock()
+	if compiled {
+		return nil
+	}
+
+	t.mu.Lock()
 	// Avoid checking the file system on every call
-	if time.Since(t.lastCheck) < t.checkInterval {
+	now := t.clock.Now()
+	if t.checkInterval > 0 && now.Sub(t.lastCheck) < t.checkInterval {
+		t.mu.Unlock()
 		return nil
 	}
-	t.lastCheck = time.Now()
+	t.lastCheck = now
 
-	// Returns true if version was updated
-	if !t.updateVersion() {
+	// Nothing to do if none of the files were touched since the last compilation
+	if t.stamp != "" && t.stamp == t.depsStamp() {
+		t.mu.Unlock()
 		return nil
 	}
+	previous := t.version
+	err := t.compile()
+	version := t.version
+	t.mu.Unlock()
+	t.reloaded(previous, version)
+	return err
+}
+
+// ForceReload recompiles the template regardless of the check policy and modification times,
+// e.g. on SIGHUP
+func (t *JTemplate) ForceReload() error {
+	t.mu.Lock()
+	t.lastCheck = t.clock.Now()
+	previous := t.version
+	err := t.compile()
+	version := t.version
+	t.mu.Unlock()
+	t.reloaded(previous, version)
+	return err
+}
+
+// reloaded runs the hooks of OnTemplateReload when a recompilation changed the version. They
+// run without the lock, so they may render the page.
+func (t *JTemplate) reloaded(previous, version string) {
+	if previous != "" && previous != version {
+		for _, hook := range t.reloadHooks {
+			hook(version)
+		}
+	}
+}
+
+// current returns the compiled template with its version
+func (t *JTemplate) current() (compiled, version string) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.compiled, t.version
+}
 
+// currentVersion returns the version of the compiled template
+func (t *JTemplate) currentVersion() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.version
+}
+
+// OnTemplateReload registers fn to run after a recompilation changed the version, e.g. to warm
+// caches or notify open pages. Hooks run in the call that noticed the change, slow ones should
+// start a goroutine.
+func (t *JTemplate) OnTemplateReload(fn func(version string)) {
+	t.reloadHooks = append(t.reloadHooks, fn)
+}
+
+// compile reads all files and replaces the compiled template, t.mu must be locked
+func (t *JTemplate) compile() error {
 	t.deps = make(map[string]struct{})
+	t.profile = nil
 	content, err := t.loadTemplate(t.mainFile)
+	var components map[string]string
+	if err == nil {
+		components, err = t.loadComponents()
+	}
+	// Remember the state of the new set of deps even on failure, so a fix triggers recompilation
+	t.stamp = t.depsStamp()
+	if err == nil && t.preprocess != nil {
+		content, err = t.preprocess.execute(content)
+	}
 	if err != nil {
 		log.Printf("Error during update template `%s`: %s", t.mainFile, err)
 		return err
 	}
-	content = injectExternalLibs(content, t.libsMap)
+	content = mergeSplitComponents(content)
+	// Include markers and comments are only useful for development
+	fragments := extractFragments(content)
+	if !t.dev {
+		content = stripComments(content)
+		for name, fragment := range fragments {
+			fragments[name] = stripComments(fragment)
+		}
+		for name, component := range components {
+			components[name] = stripComments(component)
+		}
+	}
+	if t.autoCloak {
+		content = stampCloak(content)
+	}
+	content = injectCloakStyle(content)
+	libsMap := t.libsMap
+	if t.tailwind != nil {
+		if libsMap, err = t.tailwind.apply(content, components, libsMap); err != nil {
+			log.Printf("Tailwind CLI failed for `%s`, using the browser build: %s", t.mainFile, err)
+		}
+	}
+	content = injectExternalLibs(content, libsMap, t.libEntries, t.cdnLibs, t.libHashes)
 	t.compiled = content
+	t.components = components
+	t.componentNames = registeredComponents(content, components)
+	t.fragments = fragments
+	t.updateVersion()
 	return nil
 }
 
-// Version = latest modification time among the main file and any includes
-func (t *JTemplate) updateVersion() bool {
-	var lastModTime time.Time
-	for filepath := range t.deps {
-		info, _ := os.Stat(filepath)
-		modTime := info.ModTime()
-		if modTime.After(lastModTime) {
-			lastModTime = modTime
+// depsStamp returns a fingerprint of modification times and sizes of all dependencies.
+// It is only used to detect that recompilation is needed, the version itself is a content hash.
+func (t *JTemplate) depsStamp() string {
+	files := make([]string, 0, len(t.deps))
+	for file := range t.deps {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	var b strings.Builder
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			fmt.Fprintf(&b, "%s:missing;", file)
+			continue
 		}
+		fmt.Fprintf(&b, "%s:%d:%d;", file, info.ModTime().UnixNano(), info.Size())
 	}
+	return b.String()
+}
 
-	newVersion := lastModTime.Format(time.DateTime)
-	needUpdate := t.version != newVersion
-	t.version = newVersion
-	return needUpdate
+// Version = hash of the compiled template, embedded helpers, data schema and build id.
+// It stays the same across deploys that don't change the content.
+func (t *JTemplate) updateVersion() {
+	h := sha256.New()
+	io.WriteString(h, t.compiled)
+	io.WriteString(h, helperJS)
+	io.WriteString(h, t.schema)
+	io.WriteString(h, t.buildID)
+	t.version = hex.EncodeToString(h.Sum(nil))[:16]
 }
 
-// loadTemplate loads a file by filePath, adds sourceURL to <script> blocks
+// WithBuildID includes an identifier of the server build into the version, so pages opened
+// before a deploy of changed Go code are asked to reload even if templates stay the same
+func WithBuildID(id string) TemplateOption {
+	return func(t *JTemplate) {
+		t.buildID = id
+	}
+}
+
+// SetDataSchema declares the Go types that are sent to the client as component data.
+// Their structure is hashed into the version, so changing a struct invalidates
+// already opened pages even if the template files stay the same.
+func (t *JTemplate) SetDataSchema(samples ...interface{}) {
+	h := sha256.New()
+	for _, sample := range samples {
+		writeTypeSchema(h, reflect.TypeOf(sample), make(map[reflect.Type]bool))
+	}
+	t.schema = hex.EncodeToString(h.Sum(nil))
+	t.updateVersion()
+}
+
+// writeTypeSchema writes a description of the type including struct fields and their tags
+func writeTypeSchema(w io.Writer, typ reflect.Type, seen map[reflect.Type]bool) {
+	if typ == nil {
+		return
+	}
+	fmt.Fprintf(w, "%s(%s);", typ.String(), typ.Kind())
+	if seen[typ] {
+		return
+	}
+	seen[typ] = true
+
+	switch typ.Kind() {
+	case reflect.Pointer, reflect.Slice, reflect.Array:
+		writeTypeSchema(w, typ.Elem(), seen)
+	case reflect.Map:
+		writeTypeSchema(w, typ.Key(), seen)
+		writeTypeSchema(w, typ.Elem(), seen)
+	case reflect.Struct:
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			fmt.Fprintf(w, "%s `%s`:", field.Name, field.Tag)
+			writeTypeSchema(w, field.Type, seen)
+		}
+	}
+}
+
+// loadTemplate loads a file by filePath, transforms its <script> blocks
 // and processes include directives (<% ... %>) recursively
 func (t *JTemplate) loadTemplate(filePath string) (string, error) {
 	t.deps[filePath] = struct{}{}
 
+	// Reserve the profile entry first so that the report keeps include order
+	start := t.clock.Now()
+	profileIdx := len(t.profile)
+	t.profile = append(t.profile, IncludeProfile{File: filePath, Depth: t.profileDepth})
+	t.profileDepth++
+	defer func() { t.profileDepth-- }()
+
 	bytesContent, err := os.ReadFile(filePath)
 	if err != nil {
 		return "", err
 	}
 	content := string(bytesContent)
+	// Transform own <script> blocks before includes, so positions match the file.
+	// Debugging hints (sourceURL, source maps) are limited to dev mode.
+	xDataCount := countXDataScripts(content)
+	content = processScripts(content, filepath.Base(filePath), t.dev)
 	// Process include directives recursively
 	processed, err := t.processIncludes(content, filepath.Dir(filePath))
 	if err != nil {
 		return "", err
 	}
-	// Process <script x-data="..."> tags transformation
-	processed = processXDataScripts(processed)
-	// Insert sourceURL comments in <script> blocks using the file's base name
-	processed = addSourceURL(processed, filepath.Base(filePath))
+
+	p := &t.profile[profileIdx]
+	p.Duration = t.clock.Now().Sub(start)
+	p.Size = len(processed)
+	p.XDataScripts = xDataCount
 	return processed, nil
 }
 
@@ -134,7 +390,7 @@ func (t *JTemplate) processIncludes(content string, currentDir string) (string,
 		// Write before `include`
 		builder.WriteString(content[prevEnd:start])
 
-		includePath := filepath.Join(currentDir, fileName)
+		includePath := t.resolveInclude(currentDir, fileName)
 		includedContent, err := t.loadTemplate(includePath)
 		if err != nil {
 			return "", fmt.Errorf("error including %s: %v", fileName, err)
@@ -150,28 +406,10 @@ func (t *JTemplate) processIncludes(content string, currentDir string) (string,
 	return builder.String(), nil
 }
 
-// addSourceURL finds all <script> tags in content and inserts a sourceURL comment with the file name
-func addSourceURL(content, filename string) string {
-	const scriptTag = "<script>"
-	result := content
-	startIdx := 0
-	for {
-		idx := strings.Index(result[startIdx:], scriptTag)
-		if idx == -1 {
-			break
-		}
-		idx += startIdx
-		// Helper for in browser debugger
-		urlComment := fmt.Sprintf("\n//# sourceURL=%s\n", filename)
-		// Insert after <script>.
-		result = result[:idx+len(scriptTag)] + urlComment + result[idx+len(scriptTag):]
-		startIdx = idx + len(scriptTag) + len(urlComment)
-	}
-	return result
-}
-
-// processXDataScripts finds <script> tags with the x-data attribute and replaces them with
-// a tag without x-data, inside which is a wrapper for Alpine.data
+// processScripts prepares inline <script> blocks of a single file for the browser. Scripts with
+// the x-data attribute are wrapped into Alpine.data, scripts with other attributes (src, type, ...)
+// are kept as is. With debug all inline scripts get a sourceURL comment with the file name and
+// an inline source map pointing every line back to the template file, since the wrapper shifts lines.
 // This function transforms:
 //
 //	<script x-data="componentName"> ({ script content }) </script>
@@ -179,27 +417,108 @@ func addSourceURL(content, filename string) string {
 // into:
 //
 //	<script>
-//	  document.addEventListener('alpine:init', () => {
-//	      Alpine.data('componentName', () => {
-//	          ...script content...
-//	      });
-//	  });
+//	//# sourceURL=file.html
+//	 document.addEventListener('alpine:init', () => { Alpine.data('componentName', () =>
+//	 ({ script content }) ) });
 //	</script>
-func processXDataScripts(content string) string {
-	// (?s) enables the dot to match newlines.
-	re := regexp.MustCompile(`(?s)<script([^>]*)x-data="([^"]+)"([^>]*)>(.*?)</script>`)
-	// Replace all occurrences with the desired format.
-	replacement := `<script> document.addEventListener('alpine:init', () => { Alpine.data('$2', () => 
-$4 ) });
-</script>`
-	return re.ReplaceAllString(content, replacement)
-}
-
-// Execute runs the template, integrating component data and js helpers.
-// The method looks for the closing </body> tag and inserts integration code before it.
+func processScripts(content, filename string, debug bool) string {
+	var b strings.Builder
+	prevEnd := 0
+	for _, m := range scriptBlockRe.FindAllStringSubmatchIndex(content, -1) {
+		attrs, body := content[m[2]:m[3]], content[m[4]:m[5]]
+		header := "\n"
+		if debug {
+			header = fmt.Sprintf("\n//# sourceURL=%s\n", filename)
+		}
+		if x := xDataScriptRe.FindStringSubmatch(attrs); x != nil {
+			header += fmt.Sprintf(" document.addEventListener('alpine:init', () => { Alpine.data('%s', () => \n", x[1])
+			body += " ) });\n"
+		} else if attrs != "" || !debug {
+			continue
+		}
+
+		b.WriteString(content[prevEnd:m[0]])
+		b.WriteString("<script>")
+		b.WriteString(header)
+		b.WriteString(body)
+		if debug {
+			line := strings.Count(content[:m[4]], "\n")
+			column := m[4] - (strings.LastIndex(content[:m[4]], "\n") + 1)
+			b.WriteString(inlineSourceMap(filename, content, strings.Count(header, "\n"), line, column, strings.Count(body, "\n")+1))
+		}
+		b.WriteString("</script>")
+		prevEnd = m[1]
+	}
+	b.WriteString(content[prevEnd:])
+	return b.String()
+}
+
+// (?s) enables the dot to match newlines.
+var (
+	scriptBlockRe = regexp.MustCompile(`(?s)<script([^>]*)>(.*?)</script>`)
+	xDataScriptRe = regexp.MustCompile(`x-data="([^"]+)"`)
+)
+
+// mergeSplitComponents handles components defined by several <script x-data> blocks, e.g. markup
+// with state in one include and extra methods in another. Their registrations are replaced with
+// jalpineExtend from helpers.js, which merges all parts into a single Alpine.data on init.
+func mergeSplitComponents(content string) string {
+	counts := make(map[string]int)
+	for _, m := range alpineRegistrationRe.FindAllStringSubmatch(content, -1) {
+		counts[m[1]]++
+	}
+	return alpineRegistrationRe.ReplaceAllStringFunc(content, func(registration string) string {
+		name := alpineRegistrationRe.FindStringSubmatch(registration)[1]
+		if counts[name] < 2 {
+			return registration
+		}
+		return fmt.Sprintf("jalpineExtend('%s', () => ", name)
+	})
+}
+
+var alpineRegistrationRe = regexp.MustCompile(`Alpine\.data\('([^']+)', \(\) => `)
+
+// Execute runs the template, integrating component data and js helpers, and writes the page to w.
 func (t *JTemplate) Execute(w io.Writer, data map[string]interface{}) error {
+	if t.hasClientGeo(w) {
+		data = maps.Clone(data)
+		if data == nil {
+			data = make(map[string]interface{})
+		}
+		t.addClientGeo(w, data)
+	}
+	output, err := t.ExecuteBytes(data)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(output)
+	return err
+}
+
+// ExecuteToString renders the whole page as a string, see ExecuteBytes
+func (t *JTemplate) ExecuteToString(data map[string]interface{}) (string, error) {
+	output, err := t.ExecuteBytes(data)
+	return string(output), err
+}
+
+// ExecuteBytes renders the whole page without any HTTP context, which is useful for emails,
+// caching layers or static export. The method looks for the closing </body> tag and inserts
+// integration code with component data and js helpers before it.
+func (t *JTemplate) ExecuteBytes(data map[string]interface{}) ([]byte, error) {
 	t.Update()
 
+	compDataJSON, err := t.componentDataJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	return t.cachedRender(compDataJSON, "", "")
+}
+
+// componentDataJSON splits data by components and serializes it together with the version
+func (t *JTemplate) componentDataJSON(data map[string]interface{}) ([]byte, error) {
+	if err := t.checkComponents(data); err != nil {
+		return nil, err
+	}
 	// Split data by components.
 	componentData := make(map[string]map[string]interface{})
 	componentData["main"] = make(map[string]interface{})
@@ -216,257 +535,161 @@ func (t *JTemplate) Execute(w io.Writer, data map[string]interface{}) error {
 		}
 	}
 
-	componentData["main"]["currentVersion"] = t.version
-	componentData["main"]["availVersion"] = t.version
-
-	compDataJSON, err := json.Marshal(componentData)
-	if err != nil {
-		return err
-	}
-
-	// Form an integration block with data and js helpers
-	integrationScript := fmt.Sprintf(`
-<script>
-	//# sourceURL=helpers.js
-	// Set component data for Alpine
-	window._componentData = %s;
-%s
-</script>
-</body>`, compDataJSON, helperJS)
-
-	// Insert the integration script before the closing </body> tag.
-	// TODO can be optimized and instead of replace just write the first and second parts
-	var output string
-	if strings.Contains(t.compiled, "</body>") {
-		output = strings.Replace(t.compiled, "</body>", integrationScript, 1)
-	} else {
-		output = t.compiled + integrationScript
-	}
-
-	_, err = w.Write([]byte(output))
-	return err
-}
-
-///////////////////////////////////////////////////////////////////////////////
-
-// For useful autocomplete EnsureStaticLibs in IDE
-type EnsureLibsEntry struct {
-	Name    string
-	BaseURL string
-}
-
-var (
-	AlpineJS = EnsureLibsEntry{
-		Name:    "alpinejs",
-		BaseURL: "https://unpkg.com/alpinejs",
-	}
-
-	AlpinePersist = EnsureLibsEntry{
-		Name:    "alpinejs-persist",
-		BaseURL: "https://unpkg.com/@alpinejs/persist",
+	version := t.currentVersion()
+	componentData["main"]["currentVersion"] = version
+	componentData["main"]["availVersion"] = version
+	if t.dataVersions != nil {
+		componentData["main"]["dataVersions"] = t.dataVersions.snapshot()
 	}
-
-	AlpineCollapse = EnsureLibsEntry{
-		Name:    "alpinejs-collapse",
-		BaseURL: "https://unpkg.com/@alpinejs/collapse",
-	}
-
-	AlpineFocus = EnsureLibsEntry{
-		Name:    "alpinejs-focus",
-		BaseURL: "https://unpkg.com/@alpinejs/focus",
+	if deprecations := t.deprecations(data); len(deprecations) > 0 {
+		componentData["main"]["deprecations"] = deprecations
 	}
-
-	AlpineAnchor = EnsureLibsEntry{
-		Name:    "alpinejs-anchor",
-		BaseURL: "https://unpkg.com/@alpinejs/anchor",
+	if enums := registeredEnums(); enums != nil {
+		componentData["main"]["enums"] = enums
 	}
-
-	AlpineSort = EnsureLibsEntry{
-		Name:    "alpinejs-sort",
-		BaseURL: "https://unpkg.com/@alpinejs/sort",
+	if guards := t.guardsData(); guards != nil {
+		componentData["main"]["guards"] = guards
 	}
-
-	AlpineAutoAnimate = EnsureLibsEntry{
-		Name:    "alpinejs-autoanimate",
-		BaseURL: "https://cdn.jsdelivr.net/npm/@marcreichel/alpine-auto-animate@latest/dist/alpine-auto-animate.min.js",
+	if _, ok := componentData["main"]["nonces"]; !ok {
+		if nonces := t.nonceActions(); nonces != nil {
+			componentData["main"]["nonces"] = nonces
+		}
 	}
 
-	TailwindCSS = EnsureLibsEntry{
-		Name:    "tailwindcss",
-		BaseURL: "https://unpkg.com/@tailwindcss/browser@4",
-	}
-)
+	// Keys of components and of their data are always sent
+	return t.jsonOptions.encode(componentData, 2)
+}
 
-// EnsureStaticLibs checks for the presence of each required file in the static folder by pattern,
-// where the file name contains a version (for example, "alpinejs@*.min.js"). If the file is not found,
-// a request is made to unpkg to determine the current version and download the necessary file.
-//
-// The function returns a map where the key is the library identifier (for example, "alpinejs"),
-// and the value is the local file name (with version number).
-func EnsureStaticLibs(staticDir string, plugins ...EnsureLibsEntry) (map[string]string, error) {
-	err := os.MkdirAll(staticDir, os.ModePerm)
-	if err != nil {
-		return nil, err
-	}
+// render inserts the integration block with serialized component data and js helpers
+func (t *JTemplate) render(compDataJSON []byte) []byte {
+	compiled, _ := t.current()
+	if t.ssr {
+		compiled = ssrExpand(compiled, compDataJSON)
+	}
+	prefix, suffix := t.pageParts(compiled)
+	output := make([]byte, 0, len(prefix)+len(compDataJSON)+len(suffix))
+	output = append(output, prefix...)
+	output = append(output, compDataJSON...)
+	output = append(output, suffix...)
+	return output
+}
 
-	// Если плагины не указаны, используем только Alpine.js
-	if len(plugins) == 0 {
-		plugins = []EnsureLibsEntry{AlpineJS}
+// pageParts splits the page around the component data, which is the only part that depends
+// on the request (unless SSR is enabled). The integration block with data and js helpers goes
+// before the closing </body> tag, or at the end if there is none.
+func pageParts(compiled, helperOptions string) (prefix, suffix string) {
+	before, after := compiled, ""
+	if idx := strings.Index(compiled, "</body>"); idx != -1 {
+		before, after = compiled[:idx], compiled[idx+len("</body>"):]
 	}
 
-	libsMap := make(map[string]string)
-	for _, plugin := range plugins {
-		pattern := filepath.Join(staticDir, plugin.Name+"@*.js")
-		matches, err := filepath.Glob(pattern)
-		if err != nil {
-			return nil, err
-		}
-
-		if len(matches) > 0 {
-			// File exists — use its base name.
-			baseName := filepath.Base(matches[0])
-			libsMap[plugin.Name] = baseName
-			continue
-		}
-
-		// File not found — determine version via unpkg.
-		// Use HEAD request with redirection disabled.
-		client := &http.Client{
-			CheckRedirect: func(req *http.Request, via []*http.Request) error {
-				return http.ErrUseLastResponse
-			},
-		}
-		resp, err := client.Head(plugin.BaseURL)
-		if err != nil {
-			return nil, fmt.Errorf("failed HEAD for %s: %v", plugin.BaseURL, err)
-		}
-
-		location := resp.Header.Get("Location")
-		if location == "" {
-			log.Printf("Can't determine version. No redirect location for %s", plugin.BaseURL)
-			location = "@latest"
-		}
+	prefix = before + `
+<script>
+	//# sourceURL=helpers.js
+`
+	if helperOptions != "" {
+		prefix += "\twindow._jalpineOptions = " + helperOptions + ";\n"
+	}
+	prefix += `	// Set component data for Alpine
+	window._componentData = `
+	suffix = ";\n" + helperJS + "\n</script>\n</body>" + after
+	return prefix, suffix
+}
 
-		// Use the last index of the '@' character to extract the version
-		idx := strings.LastIndex(location, "@")
-		if idx == -1 || idx == len(location)-1 {
-			return nil, fmt.Errorf("unexpected redirect format for %s: %s", plugin.BaseURL, location)
-		}
-		versionPart := location[idx+1:]
+///////////////////////////////////////////////////////////////////////////////
 
-		// If "/" is present, keep only the part before "/"
-		if slashIdx := strings.Index(versionPart, "/"); slashIdx != -1 {
-			versionPart = versionPart[:slashIdx]
-		}
+var validate = validator.New()
 
-		// Form a local file name including the version, for example "alpinejs@3.14.8.min.js"
-		localFileName := fmt.Sprintf("%s@%s%s", plugin.Name, versionPart, ".js")
-		localPath := filepath.Join(staticDir, localFileName)
+func (t *JTemplate) Error(w http.ResponseWriter, errMsg string) {
+	t.Update()
+	t.writeJSON(w, map[string]string{
+		"main::error":        errMsg,
+		"main::availVersion": t.currentVersion(),
+	})
+}
 
-		fmt.Printf("Downloading %s @ %s...\n", plugin.Name, versionPart)
-		if err := downloadFile(plugin.BaseURL, localPath); err != nil {
-			return nil, fmt.Errorf("failed to download %s: %v", plugin.Name, err)
-		}
-		libsMap[plugin.Name] = localFileName
+// ErrorFor sends the error to the error key of the component (HelperOptions.ErrorKey), so a
+// failed action of one component doesn't overwrite errors shown by others. An empty component
+// means the component that made the request.
+func (t *JTemplate) ErrorFor(w http.ResponseWriter, component, errMsg string) {
+	t.Update()
+	key := t.errorKey()
+	if component != "" {
+		key = component + "::" + key
 	}
-	return libsMap, nil
+	t.writeJSON(w, map[string]string{
+		key:                  errMsg,
+		"main::availVersion": t.currentVersion(),
+	})
 }
 
-// injectExternalLibs inserts references to external libraries (Tailwind CSS, AlpineJS, AlpineJS Persist)
-// into the provided HTML. It sorts the libraries so that the ones with the longest names appear first,
-// and for JavaScript libraries (except for "tailwindcss") it adds the "defer" attribute.
-func injectExternalLibs(html string, libsMap map[string]string) string {
-	var tags []string
-
-	// Create a slice of keys (library names)
-	keys := make([]string, 0, len(libsMap))
-	for k := range libsMap {
-		keys = append(keys, k)
+// errorKey is the component key receiving error messages
+func (t *JTemplate) errorKey() string {
+	if t.helperOptions.ErrorKey == "" {
+		return "error"
 	}
+	return t.helperOptions.ErrorKey
+}
 
-	// Sort keys by descending order of length; if equal, sort alphabetically
-	sort.Slice(keys, func(i, j int) bool {
-		if len(keys[i]) == len(keys[j]) {
-			return keys[i] < keys[j]
-		}
-		return len(keys[i]) > len(keys[j])
-	})
+func (t *JTemplate) JSON(w http.ResponseWriter, data map[string]interface{}) error {
+	return t.jsonStatus(w, 0, data)
+}
 
-	// Iterate over the sorted keys and create corresponding tags
-	for _, name := range keys {
-		filename := libsMap[name]
-		ext := strings.ToLower(filepath.Ext(filename))
-
-		switch ext {
-		case ".css":
-			// For CSS files, add a link tag
-			tags = append(tags, fmt.Sprintf(`<link rel="stylesheet" href="/static/%s">`, filename))
-		case ".js":
-			// For JS files, add the "defer" attribute if the library is not "tailwindcss"
-			deferAttr := ""
-			if strings.ToLower(name) != "tailwindcss" {
-				deferAttr = " defer"
-			}
-			tags = append(tags, fmt.Sprintf(`<script src="/static/%s"%s></script>`, filename, deferAttr))
-		}
+// jsonStatus is JSON answering with status, 0 leaves it to the writer. The status is written
+// only after the data is checked and the headers are set.
+func (t *JTemplate) jsonStatus(w http.ResponseWriter, status int, data map[string]interface{}) error {
+	t.Update()
+	if err := t.checkComponents(data); err != nil {
+		log.Printf("JSON: %v", err)
+		t.strictError(w, err)
+		return err
 	}
+	data["main::availVersion"] = t.currentVersion()
+	if t.dataVersions != nil {
+		data["main::dataVersions"] = t.dataVersions.snapshot()
+	}
+	t.addClientGeo(w, data)
 
-	// Join all tags with newline separator
-	injection := strings.Join(tags, "\n")
-
-	// Insert the injection before </head> if present, otherwise before </body>, else append at the end
-	if strings.Contains(html, "</head>") {
-		return strings.Replace(html, "</head>", injection+"\n</head>", 1)
+	deprecations := t.deprecations(data)
+	if dw, ok := w.(*deprecationWriter); ok {
+		deprecations = append(dw.messages, deprecations...)
 	}
-	if strings.Contains(html, "</body>") {
-		return strings.Replace(html, "</body>", injection+"\n</body>", 1)
+	if len(deprecations) > 0 {
+		data["main::deprecations"] = deprecations
 	}
-	return html + injection
+	return t.writeJSONStatus(w, status, data)
 }
 
-// downloadFile downloads the content from the specified URL and saves it to dest.
-func downloadFile(url, dest string) error {
-	// Ensure the destination directory exists.
-	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
-		return err
-	}
-	// Perform HTTP GET request.
-	resp, err := http.Get(url)
+// writeJSON sends component data in "component::key" form applying the template's JSON options
+func (t *JTemplate) writeJSON(w http.ResponseWriter, data interface{}) error {
+	return t.writeJSONStatus(w, 0, data)
+}
+
+func (t *JTemplate) writeJSONStatus(w http.ResponseWriter, status int, data interface{}) error {
+	body, err := t.jsonOptions.encode(data, 1)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to download file: %s (status: %s)", url, resp.Status)
+	w.Header().Set("Content-Type", "application/json")
+	if cacheSegment(w) != "" && w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", "private, no-store")
 	}
-	// Create destination file.
-	out, err := os.Create(dest)
-	if err != nil {
-		return err
+	if status != 0 {
+		w.WriteHeader(status)
 	}
-	defer out.Close()
-	_, err = io.Copy(out, resp.Body)
+	_, err = w.Write(append(body, '\n'))
 	return err
 }
 
-///////////////////////////////////////////////////////////////////////////////
-
-var validate = validator.New()
-
-func (t *JTemplate) Error(w http.ResponseWriter, errMsg string) {
-	t.Update()
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"main::error":        errMsg,
-		"main::availVersion": t.version,
-	})
-}
-
-func (t *JTemplate) JSON(w http.ResponseWriter, data map[string]interface{}) error {
-	t.Update()
+// writeJSON sends data in canonical form with DefaultJSONOptions, see CanonicalJSON
+func writeJSON(w http.ResponseWriter, data interface{}) error {
+	body, err := DefaultJSONOptions.encode(data, 1)
+	if err != nil {
+		return err
+	}
 	w.Header().Set("Content-Type", "application/json")
-	data["main::availVersion"] = t.version
-	return json.NewEncoder(w).Encode(data)
+	_, err = w.Write(append(body, '\n'))
+	return err
 }
 
 // decodeAndValidate decodes the JSON body into an instance of T and validates it using go-playground/validator.
@@ -481,5 +704,9 @@ func DecodeAndValidate[T any](t *JTemplate, w http.ResponseWriter, r *http.Reque
 		t.Error(w, err.Error())
 		return nil, false
 	}
+	if err := t.moderate(r.Context(), &data); err != nil {
+		t.moderationError(w, err)
+		return nil, false
+	}
 	return &data, true
 }
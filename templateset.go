@@ -0,0 +1,95 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"path/filepath"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// TemplateSet holds JTemplates of several pages sharing the same libraries and options
+type TemplateSet struct {
+	dir     string
+	libsMap map[string]string
+	opts    []TemplateOption
+
+	mu        sync.Mutex
+	templates map[string]*JTemplate
+}
+
+// NewTemplateSet creates a set of pages located in dir, templates are compiled on first use
+func NewTemplateSet(dir string, libsMap map[string]string, opts ...TemplateOption) *TemplateSet {
+	return &TemplateSet{
+		dir:       dir,
+		libsMap:   libsMap,
+		opts:      opts,
+		templates: make(map[string]*JTemplate),
+	}
+}
+
+// Get returns the template for the file name relative to the set directory.
+// On compilation error the template is still returned and will recompile once files change.
+func (s *TemplateSet) Get(name string) (*JTemplate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.templates[name]; ok {
+		return t, nil
+	}
+	t, err := NewJTemplate(filepath.Join(s.dir, name), s.libsMap, s.opts...)
+	s.templates[name] = t
+	return t, err
+}
+
+// ForceReload recompiles all templates of the set, returning the first error
+func (s *TemplateSet) ForceReload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var firstErr error
+	for _, t := range s.templates {
+		if err := t.ForceReload(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// PageDataFunc loads component data for a page, see TemplateSet.Handle
+type PageDataFunc func(r *http.Request) (map[string]interface{}, error)
+
+// Handle registers a GET route rendering the page with data from dataFunc (may be nil).
+// Errors of dataFunc are logged and answered with 500, so pages don't need a handwritten handler.
+// "?variant=print" renders the variant of the page with the same data, see ExecuteVariant.
+func (s *TemplateSet) Handle(router *mux.Router, path, name string, dataFunc PageDataFunc) *mux.Route {
+	t, err := s.Get(name)
+	if err != nil {
+		log.Printf("Failed to compile template for %s: %v", path, err)
+	}
+
+	return router.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		data := map[string]interface{}{}
+		if dataFunc != nil {
+			var err error
+			if data, err = dataFunc(r); err != nil {
+				log.Printf("Failed to load data for %s: %v", r.URL.Path, err)
+				http.Error(w, "Failed to load page", http.StatusInternalServerError)
+				return
+			}
+		}
+		if variant := r.URL.Query().Get(VariantParam); variant != "" {
+			page, err := t.Variant(variant)
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			if err := page.ExecuteHTTP(w, r, data); err != nil {
+				log.Printf("Error rendering variant %s of %s: %v", variant, name, err)
+			}
+			return
+		}
+		if err := t.ExecuteHTTP(w, r, data); err != nil {
+			log.Printf("Error rendering template %s: %v", name, err)
+		}
+	}).Methods("GET")
+}
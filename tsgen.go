@@ -0,0 +1,551 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"maps"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// ClientAction is an endpoint of the Go API as seen by TypeScript, see ClientAPIFromSource
+type ClientAction struct {
+	Method  string
+	Path    string
+	Request string   // Name of the request interface, "" if the handler decodes nothing
+	Query   bool     // Request is decoded from the query string
+	Keys    []string // "component::key" literals and bare keys of response maps the handler sends
+	Handler string   // Function serving the action, e.g. "createTodo" or "(*Importer).Preview"
+	Upload  bool     // The handler reads a multipart upload instead of JSON
+	Old     bool     // The handler is wrapped in JTemplate.Deprecated
+}
+
+// funcSuffixRe matches names of closures, e.g. "(*JTemplate).MarkdownHandler.func1"
+var funcSuffixRe = regexp.MustCompile(`(\.func\d+)+$`)
+
+// tsGenerator turns Go structs found in the sources into TypeScript interfaces
+type tsGenerator struct {
+	types      map[string]ast.Expr            // Package level type declarations by name
+	localTypes map[string]map[string]ast.Expr // Types declared inside functions, by function
+	names      map[ast.Expr]string            // Interface name of each emitted struct
+	taken      map[string]bool
+	out        strings.Builder
+}
+
+// sourceHandler is what a handler function decodes and sends
+type sourceHandler struct {
+	request string // Type argument of DecodeAndValidate or DecodeQueryAndValidate
+	query   bool
+	keys    []string
+	upload  bool // Calls FormFile, ParseMultipartForm or MultipartReader
+}
+
+// ClientAPIFromSource finds request types of the routed handlers in Go files of dir, the same
+// way ServerKeysFromSource finds the keys they send, and renders them as a TypeScript
+// declaration file: an interface per request struct with validation constraints as JSDoc and
+// a JAlpineActions map from "METHOD /path" to its request and response.
+func ClientAPIFromSource(dir string, router *mux.Router) (string, []ClientAction, error) {
+	g := &tsGenerator{
+		types:      make(map[string]ast.Expr),
+		localTypes: make(map[string]map[string]ast.Expr),
+		names:      make(map[ast.Expr]string),
+		taken:      make(map[string]bool),
+	}
+	handlers := make(map[string]sourceHandler)
+	typedRoutes := make(map[string]string)  // "METHOD /path" => function passed to Handle
+	routeCalls := make(map[string][]string) // "METHOD /path" => functions called to make the handler
+	fset := token.NewFileSet()
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != dir && (strings.HasPrefix(d.Name(), ".") || d.Name() == "static") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+			return nil
+		}
+		file, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			return err
+		}
+		for _, decl := range file.Decls {
+			switch decl := decl.(type) {
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					if ts, ok := spec.(*ast.TypeSpec); ok {
+						g.types[ts.Name.Name] = ts.Type
+					}
+				}
+			case *ast.FuncDecl:
+				if decl.Body != nil {
+					name := funcDeclName(decl)
+					g.localTypes[name] = localTypes(decl.Body)
+					handlers[name] = inspectHandler(decl.Body)
+					if request := typedRequest(decl); request != "" {
+						handler := handlers[name]
+						handler.request = request
+						handlers[name] = handler
+					}
+					findTypedRoutes(decl.Body, typedRoutes, routeCalls)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	routes, _ := RouteTable(router)
+	var actions []ClientAction
+	for _, route := range routes {
+		fn := funcSuffixRe.ReplaceAllString(route.Handler, "")
+		handler, ok := handlers[fn]
+		// Handlers made by Handle are the same closure, the registration tells the function
+		isTyped := false
+		for _, method := range route.Methods {
+			if typed, found := typedRoutes[method+" "+route.Path]; found {
+				fn, isTyped = typed, true
+				handler, ok = handlers[fn]
+				handler.query = method == "GET"
+			}
+		}
+		// Wrappers like a limiter hide the handler, the registration tells what makes it
+		upload, deprecated := handler.upload, false
+		var wrapperKeys []string
+		for _, method := range route.Methods {
+			for _, call := range routeCalls[method+" "+route.Path] {
+				deprecated = deprecated || call == "Deprecated"
+				name, wrapped, found := findHandler(handlers, call)
+				if !found {
+					continue
+				}
+				upload = upload || wrapped.upload
+				if name != fn {
+					// Keys of wrappers like the queue position of a limiter
+					wrapperKeys = append(wrapperKeys, wrapped.keys...)
+				}
+				// Functions for Handle may take struct{}, nothing to look for then
+				if !isTyped && handler.request == "" && wrapped.request != "" {
+					fn, handler, ok = name, wrapped, true
+				}
+			}
+		}
+		// Named actions are for helpers.js even when the source doesn't tell what they take, and
+		// uploads take a form
+		isAction := strings.HasPrefix(route.Path, ActionsPath+"/")
+		if !isAction && (!ok || strings.HasSuffix(route.Path, "*") || (handler.request == "" && len(handler.keys) == 0 && !upload)) {
+			continue
+		}
+		keys := slices.Clone(handler.keys)
+		for _, key := range wrapperKeys {
+			if !slices.Contains(keys, key) {
+				keys = append(keys, key)
+			}
+		}
+		action := ClientAction{Path: route.Path, Query: handler.query, Keys: keys, Handler: fn, Upload: upload, Old: deprecated}
+		if handler.request != "" {
+			action.Request = g.interfaceFor(fn, handler.request)
+		}
+		for _, method := range route.Methods {
+			action.Method = method
+			actions = append(actions, action)
+		}
+	}
+	return g.render(actions), actions, nil
+}
+
+// typedRequest returns the request type of a function for Handle, one taking a context and a
+// request struct and returning data and an error
+func typedRequest(decl *ast.FuncDecl) string {
+	params, results := decl.Type.Params.List, decl.Type.Results
+	if decl.Recv != nil || len(params) != 2 || len(params[0].Names) > 1 || results == nil || len(results.List) != 2 {
+		return ""
+	}
+	if sel, ok := params[0].Type.(*ast.SelectorExpr); !ok || sel.Sel.Name != "Context" {
+		return ""
+	}
+	if ident, ok := params[1].Type.(*ast.Ident); ok {
+		return ident.Name
+	}
+	return ""
+}
+
+// findTypedRoutes collects registrations like router.HandleFunc("/todos", Handle(t, getTodos))
+// with their Methods, and actions.Register("todos.delete", Handle(t, deleteTodo)). calls gets
+// the names of all functions called in the handler expression of registrations.
+func findTypedRoutes(body *ast.BlockStmt, routes map[string]string, calls map[string][]string) {
+	ast.Inspect(body, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		switch sel.Sel.Name {
+		case "Methods":
+			registration, ok := sel.X.(*ast.CallExpr)
+			if !ok || len(registration.Args) < 2 {
+				return true
+			}
+			path, fn := stringLiteral(registration.Args[0]), handleTarget(registration.Args[1])
+			if path == "" {
+				return true
+			}
+			for _, arg := range call.Args {
+				if method := stringLiteral(arg); method != "" {
+					if fn != "" {
+						routes[method+" "+path] = fn
+					}
+					calls[method+" "+path] = calledNames(registration.Args[1])
+				}
+			}
+		case "Register":
+			if len(call.Args) == 2 {
+				if name, fn := stringLiteral(call.Args[0]), handleTarget(call.Args[1]); name != "" {
+					if fn != "" {
+						routes["POST "+ActionsPath+"/"+name] = fn
+					}
+					calls["POST "+ActionsPath+"/"+name] = calledNames(call.Args[1])
+				}
+			}
+		}
+		return true
+	})
+}
+
+// handleTarget returns the function passed to Handle within the expression, also when the
+// handler is wrapped, e.g. RequireNonce("...", Handle(t, fn))
+func handleTarget(expr ast.Expr) string {
+	var target string
+	ast.Inspect(expr, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || target != "" {
+			return target == ""
+		}
+		fn := call.Fun
+		if index, ok := fn.(*ast.IndexExpr); ok {
+			fn = index.X
+		}
+		if ident, ok := fn.(*ast.Ident); ok && ident.Name == "Handle" && len(call.Args) == 2 {
+			if arg, ok := call.Args[1].(*ast.Ident); ok {
+				target = arg.Name
+			}
+		}
+		return target == ""
+	})
+	return target
+}
+
+// calledNames returns the names of functions and methods called in the expression
+func calledNames(expr ast.Expr) []string {
+	var names []string
+	ast.Inspect(expr, func(n ast.Node) bool {
+		if call, ok := n.(*ast.CallExpr); ok {
+			switch fn := call.Fun.(type) {
+			case *ast.Ident:
+				names = append(names, fn.Name)
+			case *ast.SelectorExpr:
+				names = append(names, fn.Sel.Name)
+			}
+		}
+		return true
+	})
+	return names
+}
+
+// findHandler finds a function or method by name, "Preview" finds "(*Importer).Preview"
+func findHandler(handlers map[string]sourceHandler, name string) (string, sourceHandler, bool) {
+	if handler, ok := handlers[name]; ok {
+		return name, handler, true
+	}
+	for _, fn := range slices.Sorted(maps.Keys(handlers)) {
+		if strings.HasSuffix(fn, "."+name) {
+			return fn, handlers[fn], true
+		}
+	}
+	return "", sourceHandler{}, false
+}
+
+func stringLiteral(expr ast.Expr) string {
+	lit, ok := expr.(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return ""
+	}
+	value, _ := strconv.Unquote(lit.Value)
+	return value
+}
+
+// funcDeclName names functions like describeHandler does, e.g. "(*Importer).Confirm"
+func funcDeclName(decl *ast.FuncDecl) string {
+	if decl.Recv == nil || len(decl.Recv.List) == 0 {
+		return decl.Name.Name
+	}
+	recv := decl.Recv.List[0].Type
+	if index, ok := recv.(*ast.IndexExpr); ok {
+		recv = index.X
+	}
+	if star, ok := recv.(*ast.StarExpr); ok {
+		if ident, ok := star.X.(*ast.Ident); ok {
+			return "(*" + ident.Name + ")." + decl.Name.Name
+		}
+	}
+	if ident, ok := recv.(*ast.Ident); ok {
+		return ident.Name + "." + decl.Name.Name
+	}
+	return decl.Name.Name
+}
+
+func localTypes(body *ast.BlockStmt) map[string]ast.Expr {
+	types := make(map[string]ast.Expr)
+	ast.Inspect(body, func(n ast.Node) bool {
+		if ts, ok := n.(*ast.TypeSpec); ok {
+			types[ts.Name.Name] = ts.Type
+		}
+		return true
+	})
+	return types
+}
+
+func inspectHandler(body *ast.BlockStmt) sourceHandler {
+	var handler sourceHandler
+	seen := make(map[string]bool)
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.SelectorExpr:
+			switch n.Sel.Name {
+			case "FormFile", "ParseMultipartForm", "MultipartReader":
+				handler.upload = true
+			}
+		case *ast.IndexExpr:
+			fn, ok := n.X.(*ast.Ident)
+			arg, argOK := n.Index.(*ast.Ident)
+			if ok && argOK && (fn.Name == "DecodeAndValidate" || fn.Name == "DecodeQueryAndValidate") {
+				handler.request = arg.Name
+				handler.query = fn.Name == "DecodeQueryAndValidate"
+			}
+		case *ast.CompositeLit:
+			// Bare keys like "linkPreview" go to the calling component, they are found as keys
+			// of map[string]interface{} literals
+			if !isResponseMap(n.Type) {
+				break
+			}
+			for _, elt := range n.Elts {
+				kv, ok := elt.(*ast.KeyValueExpr)
+				lit, litOK := kv.Key.(*ast.BasicLit)
+				if !ok || !litOK || lit.Kind != token.STRING {
+					continue
+				}
+				if value, err := strconv.Unquote(lit.Value); err == nil && value != "" && !strings.Contains(value, "::") && !seen[value] {
+					seen[value] = true
+					handler.keys = append(handler.keys, value)
+				}
+			}
+		case *ast.BasicLit:
+			if n.Kind != token.STRING {
+				break
+			}
+			if value, err := strconv.Unquote(n.Value); err == nil && componentKeyRe.MatchString(value) && !seen[value] {
+				seen[value] = true
+				handler.keys = append(handler.keys, value)
+			}
+		}
+		return true
+	})
+	sort.Strings(handler.keys)
+	return handler
+}
+
+// isResponseMap reports whether expr is map[string]interface{} or map[string]any
+func isResponseMap(expr ast.Expr) bool {
+	m, ok := expr.(*ast.MapType)
+	if !ok {
+		return false
+	}
+	if key, ok := m.Key.(*ast.Ident); !ok || key.Name != "string" {
+		return false
+	}
+	switch value := m.Value.(type) {
+	case *ast.InterfaceType:
+		return len(value.Methods.List) == 0
+	case *ast.Ident:
+		return value.Name == "any"
+	}
+	return false
+}
+
+// lookup finds a type declared in the function or at package level
+func (g *tsGenerator) lookup(fn, name string) ast.Expr {
+	if expr, ok := g.localTypes[fn][name]; ok {
+		return expr
+	}
+	return g.types[name]
+}
+
+// interfaceFor emits the interface of a named struct once and returns its name. Local types
+// of different handlers may share a name, later ones get the handler name as a prefix.
+func (g *tsGenerator) interfaceFor(fn, name string) string {
+	expr := g.lookup(fn, name)
+	st, ok := expr.(*ast.StructType)
+	if !ok {
+		return g.tsType(fn, expr)
+	}
+	if emitted, ok := g.names[st]; ok {
+		return emitted
+	}
+	tsName := strings.ToUpper(name[:1]) + name[1:]
+	if g.taken[tsName] {
+		prefix := strings.NewReplacer("(", "", "*", "", ")", "", ".", "").Replace(fn)
+		tsName = strings.ToUpper(prefix[:1]) + prefix[1:] + tsName
+	}
+	g.names[st] = tsName
+	g.taken[tsName] = true
+
+	// Nested interfaces are written first
+	body := g.structBody(fn, st, "")
+	fmt.Fprintf(&g.out, "export interface %s %s\n\n", tsName, body)
+	return tsName
+}
+
+// structBody renders the fields of the struct as a TypeScript object type
+func (g *tsGenerator) structBody(fn string, st *ast.StructType, indent string) string {
+	var b strings.Builder
+	b.WriteString("{\n")
+	for _, field := range st.Fields.List {
+		var tag reflect.StructTag
+		if field.Tag != nil {
+			unquoted, _ := strconv.Unquote(field.Tag.Value)
+			tag = reflect.StructTag(unquoted)
+		}
+		for _, ident := range field.Names {
+			if !ident.IsExported() {
+				continue
+			}
+			name, optional := ident.Name, false
+			_, isPointer := field.Type.(*ast.StarExpr)
+			for _, key := range []string{"json", "query"} {
+				value, ok := tag.Lookup(key)
+				if !ok {
+					continue
+				}
+				tagName, opts, _ := strings.Cut(value, ",")
+				if tagName == "-" {
+					name = ""
+					break
+				}
+				if tagName != "" {
+					name = tagName
+				}
+				optional = optional || strings.Contains(opts, "omitempty") || key == "query"
+				break
+			}
+			if name == "" {
+				continue
+			}
+			if rules := tag.Get("validate"); rules != "" {
+				fmt.Fprintf(&b, "%s  /** @validate %s */\n", indent, rules)
+				optional = optional && !strings.Contains(rules, "required")
+			}
+			mark := ""
+			if optional || isPointer {
+				mark = "?"
+			}
+			fmt.Fprintf(&b, "%s  %s%s: %s;\n", indent, strconv.Quote(name), mark, g.tsType(fn, field.Type))
+		}
+	}
+	b.WriteString(indent + "}")
+	return b.String()
+}
+
+// tsType maps a Go type expression to TypeScript, unknown where it can't tell
+func (g *tsGenerator) tsType(fn string, expr ast.Expr) string {
+	switch expr := expr.(type) {
+	case *ast.Ident:
+		switch expr.Name {
+		case "string":
+			return "string"
+		case "bool":
+			return "boolean"
+		case "int", "int8", "int16", "int32", "int64", "uint", "uint8", "uint16", "uint32", "uint64",
+			"float32", "float64", "byte", "rune":
+			return "number"
+		}
+		switch decl := g.lookup(fn, expr.Name).(type) {
+		case *ast.StructType:
+			return g.interfaceFor(fn, expr.Name)
+		case nil:
+			return "unknown"
+		default:
+			// Named types like enums take their underlying type
+			return g.tsType(fn, decl)
+		}
+	case *ast.StarExpr:
+		return g.tsType(fn, expr.X)
+	case *ast.ArrayType:
+		if ident, ok := expr.Elt.(*ast.Ident); ok && ident.Name == "byte" {
+			return "string" // Base64 in JSON
+		}
+		return g.tsType(fn, expr.Elt) + "[]"
+	case *ast.MapType:
+		return "Record<string, " + g.tsType(fn, expr.Value) + ">"
+	case *ast.SelectorExpr:
+		if pkg, ok := expr.X.(*ast.Ident); ok && pkg.Name == "time" && expr.Sel.Name == "Time" {
+			return "string"
+		}
+	case *ast.StructType:
+		return g.structBody(fn, expr, "  ")
+	}
+	return "unknown"
+}
+
+func (g *tsGenerator) render(actions []ClientAction) string {
+	var b strings.Builder
+	b.WriteString("// Generated from the Go sources by \"go run . types\", do not edit\n\n")
+	b.WriteString(g.out.String())
+	b.WriteString("export interface JAlpineActions {\n")
+	for _, action := range actions {
+		request := "undefined"
+		if action.Request != "" {
+			request = action.Request
+		}
+		if action.Old {
+			b.WriteString("  /** @deprecated */\n")
+		}
+		fmt.Fprintf(&b, "  %s: {\n", strconv.Quote(action.Method+" "+action.Path))
+		if action.Query {
+			fmt.Fprintf(&b, "    query: %s;\n", request)
+		} else if action.Upload {
+			b.WriteString("    request: FormData;\n")
+		} else {
+			fmt.Fprintf(&b, "    request: %s;\n", request)
+		}
+		b.WriteString("    response: {\n")
+		for _, key := range action.Keys {
+			if key == "main::availVersion" || key == "main::error" {
+				continue
+			}
+			fmt.Fprintf(&b, "      %s?: unknown;\n", strconv.Quote(key))
+		}
+		b.WriteString("      \"main::availVersion\": string;\n")
+		b.WriteString("      \"main::error\"?: string;\n")
+		b.WriteString("    };\n  };\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// Handle turns a function of a decoded request into a handler: the request is decoded and
+// validated into TReq (from the query string for GET, from the JSON body otherwise), fn gets
+// it with the context of the request, and its data is sent with JSON. An error of fn goes to
+// the error key of the component that made the request, like ErrorFor(w, "", err.Error()),
+// so messages should be fit for users.
+//
+//	actions.Register("todos.delete", Handle(template, deleteTodo))
+//	func deleteTodo(ctx context.Context, req TodoIDRequest) (map[string]any, error)
+func Handle[TReq any](t *JTemplate, fn func(ctx context.Context, req TReq) (map[string]any, error)) http.HandlerFunc {
+	return wrapRoute(func(w http.ResponseWriter, r *http.Request) {
+		var req *TReq
+		var ok bool
+		if r.Method == "GET" || r.Method == "HEAD" {
+			req, ok = DecodeQueryAndValidate[TReq](t, w, r)
+		} else {
+			req, ok = DecodeAndValidate[TReq](t, w, r)
+		}
+		if !ok {
+			return
+		}
+		data, err := fn(r.Context(), *req)
+		if err != nil {
+			t.ErrorFor(w, "", err.Error())
+			return
+		}
+		if data == nil {
+			data = make(map[string]any)
+		}
+		t.JSON(w, data)
+	}, fn, "")
+}
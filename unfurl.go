@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// UnfurlPath is where components request previews of links, see Unfurler.Handler
+const UnfurlPath = "/_jalpine/unfurl"
+
+// LinkPreview is what a page shows for a pasted link
+type LinkPreview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Image       string `json:"image,omitempty"`
+	SiteName    string `json:"siteName,omitempty"`
+}
+
+// Unfurler fetches titles, descriptions and images of links on the server, avoiding CORS
+// problems of the browser. Only public addresses are contacted, whatever the DNS says.
+type Unfurler struct {
+	client   *http.Client
+	ttl      time.Duration
+	maxBytes int64
+
+	rate    int // Requests a client may make per ratePer
+	ratePer time.Duration
+
+	mu      sync.Mutex
+	cache   map[string]unfurlEntry
+	clients map[string]*unfurlWindow
+}
+
+// unfurlWindow counts the requests of a client in the current window
+type unfurlWindow struct {
+	count int
+	start time.Time
+}
+
+type unfurlEntry struct {
+	preview LinkPreview
+	err     error
+	expires time.Time
+}
+
+const maxUnfurlCache = 1000
+
+// NewUnfurler creates an unfurler with a 5 second timeout, results cached for an hour and 30
+// requests per minute for each client
+func NewUnfurler() *Unfurler {
+	dialer := &net.Dialer{Timeout: 5 * time.Second, Control: denyPrivateAddresses}
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 5 * time.Second,
+		MaxIdleConns:          10,
+	}
+	return &Unfurler{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   10 * time.Second,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= 5 {
+					return errors.New("too many redirects")
+				}
+				return checkUnfurlURL(req.URL)
+			},
+		},
+		ttl:      time.Hour,
+		maxBytes: 512 << 10,
+		rate:     30,
+		ratePer:  time.Minute,
+		cache:    make(map[string]unfurlEntry),
+		clients:  make(map[string]*unfurlWindow),
+	}
+}
+
+// RateLimit lets every client address make n requests per period of Handler, 0 turns it off
+func (u *Unfurler) RateLimit(n int, per time.Duration) *Unfurler {
+	u.rate, u.ratePer = n, per
+	return u
+}
+
+// allow counts a request of the client and reports whether it's within the rate limit
+func (u *Unfurler) allow(client string, now time.Time) bool {
+	if u.rate <= 0 {
+		return true
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	window, ok := u.clients[client]
+	if !ok || now.Sub(window.start) >= u.ratePer {
+		if len(u.clients) >= maxUnfurlCache {
+			for key, window := range u.clients {
+				if now.Sub(window.start) >= u.ratePer {
+					delete(u.clients, key)
+				}
+			}
+		}
+		window = &unfurlWindow{start: now}
+		u.clients[client] = window
+	}
+	window.count++
+	return window.count <= u.rate
+}
+
+// deniedNetworks are special purpose ranges the net.IP methods don't cover: "this network",
+// carrier-grade NAT, IETF protocol assignments, benchmarking, reserved and NAT64, which can
+// reach internal IPv4 hosts
+var deniedNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{"0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15", "240.0.0.0/4", "64:ff9b::/96", "64:ff9b:1::/48"} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+// denyPrivateAddresses runs after DNS resolution, so rebinding to internal hosts doesn't work
+func denyPrivateAddresses(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return fmt.Errorf("address %s is not public", host)
+	}
+	for _, network := range deniedNetworks {
+		if network.Contains(ip) {
+			return fmt.Errorf("address %s is not public", host)
+		}
+	}
+	return nil
+}
+
+func checkUnfurlURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		return fmt.Errorf("unsupported port %s", port)
+	}
+	if u.User != nil {
+		return errors.New("credentials in links are not allowed")
+	}
+	return nil
+}
+
+// Unfurl returns the preview of the link, from the cache if it was fetched recently
+func (u *Unfurler) Unfurl(ctx context.Context, link string) (LinkPreview, error) {
+	now := time.Now()
+	u.mu.Lock()
+	if entry, ok := u.cache[link]; ok && now.Before(entry.expires) {
+		u.mu.Unlock()
+		return entry.preview, entry.err
+	}
+	u.mu.Unlock()
+
+	preview, err := u.fetch(ctx, link)
+	if ctx.Err() != nil {
+		// The caller gave up, nothing is known about the link
+		return preview, err
+	}
+	// Failures are remembered for a short time only, the site may be down temporarily
+	ttl := u.ttl
+	if err != nil {
+		ttl = time.Minute
+	}
+	u.mu.Lock()
+	if len(u.cache) >= maxUnfurlCache {
+		for key, entry := range u.cache {
+			if now.After(entry.expires) || len(u.cache) >= maxUnfurlCache {
+				delete(u.cache, key)
+			}
+		}
+	}
+	u.cache[link] = unfurlEntry{preview: preview, err: err, expires: now.Add(ttl)}
+	u.mu.Unlock()
+	return preview, err
+}
+
+func (u *Unfurler) fetch(ctx context.Context, link string) (LinkPreview, error) {
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return LinkPreview{}, err
+	}
+	if err := checkUnfurlURL(parsed); err != nil {
+		return LinkPreview{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", parsed.String(), nil)
+	if err != nil {
+		return LinkPreview{}, err
+	}
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("User-Agent", "JAlpine link preview")
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return LinkPreview{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return LinkPreview{}, fmt.Errorf("status %s", resp.Status)
+	}
+	preview := LinkPreview{URL: resp.Request.URL.String()}
+	if !strings.Contains(resp.Header.Get("Content-Type"), "html") {
+		return preview, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, u.maxBytes))
+	if err != nil {
+		return LinkPreview{}, err
+	}
+	parsePreview(&preview, string(body), resp.Request.URL)
+	return preview, nil
+}
+
+var (
+	metaTagRe   = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	metaAttrRe  = regexp.MustCompile(`(?is)([a-z:-]+)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+	titleTagRe  = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	previewSpRe = regexp.MustCompile(`\s+`)
+)
+
+// parsePreview fills the preview from Open Graph tags, falling back to <title> and description
+func parsePreview(preview *LinkPreview, page string, base *url.URL) {
+	if end := strings.Index(strings.ToLower(page), "</head>"); end != -1 {
+		page = page[:end]
+	}
+	meta := make(map[string]string)
+	for _, tag := range metaTagRe.FindAllString(page, -1) {
+		attrs := make(map[string]string)
+		for _, m := range metaAttrRe.FindAllStringSubmatch(tag, -1) {
+			attrs[strings.ToLower(m[1])] = m[2] + m[3]
+		}
+		name := strings.ToLower(attrs["property"] + attrs["name"])
+		if _, seen := meta[name]; name != "" && !seen {
+			meta[name] = cleanPreviewText(attrs["content"])
+		}
+	}
+
+	preview.Title = firstNonEmpty(meta["og:title"], meta["twitter:title"])
+	if preview.Title == "" {
+		if m := titleTagRe.FindStringSubmatch(page); m != nil {
+			preview.Title = cleanPreviewText(m[1])
+		}
+	}
+	preview.Description = firstNonEmpty(meta["og:description"], meta["twitter:description"], meta["description"])
+	preview.SiteName = meta["og:site_name"]
+	if image := firstNonEmpty(meta["og:image"], meta["twitter:image"]); image != "" {
+		if ref, err := base.Parse(image); err == nil && (ref.Scheme == "http" || ref.Scheme == "https") {
+			preview.Image = ref.String()
+		}
+	}
+}
+
+func cleanPreviewText(s string) string {
+	return strings.TrimSpace(previewSpRe.ReplaceAllString(html.UnescapeString(s), " "))
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// Handler is an action taking {"url": "..."} and answering with "linkPreview" for the calling
+// component, e.g. $post('/_jalpine/unfurl', { url }). Clients over the rate limit get 429,
+// failures a generic message, the cause is only logged.
+func (u *Unfurler) Handler(t *JTemplate) http.HandlerFunc {
+	type unfurlRequest struct {
+		URL string `json:"url" validate:"required,url,max=2048"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, ok := DecodeAndValidate[unfurlRequest](t, w, r)
+		if !ok {
+			return
+		}
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		if !u.allow(client, time.Now()) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", fmt.Sprint(int(u.ratePer.Seconds())))
+			w.WriteHeader(http.StatusTooManyRequests)
+			t.Error(w, "Too many link previews, try again later")
+			return
+		}
+		preview, err := u.Unfurl(r.Context(), req.URL)
+		if err != nil {
+			log.Printf("Link preview of %s failed: %v", req.URL, err)
+			t.Error(w, "Can't preview the link")
+			return
+		}
+		t.JSON(w, map[string]interface{}{"linkPreview": preview})
+	}
+}
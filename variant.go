@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// VariantParam selects a variant of a page handled by TemplateSet.Handle, e.g. "?variant=print"
+const VariantParam = "variant"
+
+var variantNameRe = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// pageVariants holds lazily compiled secondary templates of a page
+type pageVariants struct {
+	mu        sync.Mutex
+	templates map[string]*JTemplate
+}
+
+// ExecuteVariant renders a secondary template of the page with the same data, e.g. a print view
+// of a list or an invoice. The variant "print" of "index.html" is "index.print.html" next to it,
+// compiled with the same libraries and options.
+func (t *JTemplate) ExecuteVariant(w io.Writer, variant string, data map[string]interface{}) error {
+	v, err := t.Variant(variant)
+	if err != nil {
+		return err
+	}
+	return v.Execute(w, data)
+}
+
+// Variant returns the compiled template of the variant, see ExecuteVariant
+func (t *JTemplate) Variant(variant string) (*JTemplate, error) {
+	if !variantNameRe.MatchString(variant) {
+		return nil, fmt.Errorf("invalid variant name %q", variant)
+	}
+	t.variants.mu.Lock()
+	defer t.variants.mu.Unlock()
+	if v, ok := t.variants.templates[variant]; ok {
+		return v, nil
+	}
+
+	ext := filepath.Ext(t.mainFile)
+	file := strings.TrimSuffix(t.mainFile, ext) + "." + variant + ext
+	if _, err := os.Stat(file); err != nil {
+		return nil, fmt.Errorf("variant %s of %s: %w", variant, t.mainFile, err)
+	}
+	v, err := NewJTemplate(file, t.libsMap, t.opts...)
+	if err != nil {
+		return nil, err
+	}
+	if t.variants.templates == nil {
+		t.variants.templates = make(map[string]*JTemplate)
+	}
+	t.variants.templates[variant] = v
+	return v, nil
+}
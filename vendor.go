@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VendoredLibsFile is written by "go run . vendor" and compiled with -tags vendored
+const VendoredLibsFile = "vendored_libs.go"
+
+// VendoredLibs are static libraries embedded into the binary, see WriteVendoredLibs
+type VendoredLibs struct {
+	FS   fs.FS             // Files by their name in the static dir
+	Libs map[string]string // The map EnsureStaticLibs would return
+}
+
+// vendoredLibs is set by the generated file when built with -tags vendored
+var vendoredLibs *VendoredLibs
+
+// vendorBuildTime is the Last-Modified of embedded files, they have no modification times
+var vendorBuildTime = time.Now()
+
+// WriteVendoredLibs writes a Go file embedding the libraries of libsMap from staticDir, which
+// must be inside the package directory. The file is only compiled with -tags vendored, so the
+// package builds without it and the generator can run again after the libraries change.
+func WriteVendoredLibs(goFile, staticDir string, libsMap map[string]string) error {
+	names := make([]string, 0, len(libsMap))
+	for name := range libsMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	dir := filepath.ToSlash(filepath.Clean(staticDir))
+
+	var b bytes.Buffer
+	b.WriteString("// Code generated by \"go run . vendor\"; DO NOT EDIT.\n\n//go:build vendored\n\npackage main\n\n")
+	b.WriteString("import (\n\"embed\"\n\"io/fs\"\n)\n\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "//go:embed %s\n", strconv.Quote(path.Join(dir, libsMap[name])))
+	}
+	b.WriteString("var vendoredLibsFS embed.FS\n\nfunc init() {\n")
+	fmt.Fprintf(&b, "libs, _ := fs.Sub(vendoredLibsFS, %s)\n", strconv.Quote(dir))
+	b.WriteString("vendoredLibs = &VendoredLibs{FS: libs, Libs: map[string]string{\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s: %s,\n", strconv.Quote(name), strconv.Quote(libsMap[name]))
+	}
+	b.WriteString("}}\n}\n")
+
+	source, err := format.Source(b.Bytes())
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(goFile, source, 0644)
+}
+
+// Handler serves the embedded libraries from memory and passes other requests to next,
+// usually the file server of the static dir. Names contain versions, so they are cached for good.
+func (v *VendoredLibs) Handler(next http.Handler) http.Handler {
+	files := make(map[string]bool, len(v.Libs))
+	for _, file := range v.Libs {
+		files[file] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		if !files[name] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		content, err := fs.ReadFile(v.FS, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		http.ServeContent(w, r, name, vendorBuildTime, bytes.NewReader(content))
+	})
+}
+
+// runVendor implements "jalpine vendor": downloads the libraries like a normal start and
+// writes VendoredLibsFile, e.g. from "//go:generate go run . vendor"
+func runVendor(staticDir string, plugins ...EnsureLibsEntry) {
+	libsMap, err := EnsureStaticLibs(staticDir, plugins...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to ensure static libraries: %v\n", err)
+		os.Exit(1)
+	}
+	if err := WriteVendoredLibs(VendoredLibsFile, staticDir, libsMap); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write %s: %v\n", VendoredLibsFile, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Wrote %s, build with -tags vendored\n", VendoredLibsFile)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+// WebhookTopicPrefix starts broker topics of inbound webhooks. Browsers can't subscribe to
+// topics starting with "_", so payloads stay on the server.
+const WebhookTopicPrefix = "_webhook:"
+
+// WebhookMeta is what a verifier learned about a delivery
+type WebhookMeta struct {
+	ID        string    // Unique delivery id, used for replay protection
+	Type      string    // Event type, e.g. "push" or "invoice.paid"
+	Timestamp time.Time // Signed time of the delivery, zero if the provider doesn't sign one
+}
+
+// WebhookVerifier checks the signature of a delivery
+type WebhookVerifier interface {
+	Verify(r *http.Request, body []byte) (WebhookMeta, error)
+}
+
+var errWebhookSignature = errors.New("invalid signature")
+
+// StripeVerifier checks the Stripe-Signature header: "t=timestamp,v1=hex(HMAC-SHA256(t.body))"
+func StripeVerifier(secret string) WebhookVerifier {
+	return webhookVerifierFunc(func(r *http.Request, body []byte) (WebhookMeta, error) {
+		var timestamp string
+		var signatures []string
+		for _, part := range strings.Split(r.Header.Get("Stripe-Signature"), ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			switch key {
+			case "t":
+				timestamp = value
+			case "v1":
+				signatures = append(signatures, value)
+			}
+		}
+		seconds, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil || !anyHMACMatches(secret, timestamp+"."+string(body), signatures) {
+			return WebhookMeta{}, errWebhookSignature
+		}
+		meta := webhookJSONMeta(body)
+		meta.Timestamp = time.Unix(seconds, 0)
+		return meta, nil
+	})
+}
+
+// GitHubVerifier checks the X-Hub-Signature-256 header: "sha256=hex(HMAC-SHA256(body))"
+func GitHubVerifier(secret string) WebhookVerifier {
+	return webhookVerifierFunc(func(r *http.Request, body []byte) (WebhookMeta, error) {
+		signature, ok := strings.CutPrefix(r.Header.Get("X-Hub-Signature-256"), "sha256=")
+		if !ok || !anyHMACMatches(secret, string(body), []string{signature}) {
+			return WebhookMeta{}, errWebhookSignature
+		}
+		return WebhookMeta{ID: r.Header.Get("X-GitHub-Delivery"), Type: r.Header.Get("X-GitHub-Event")}, nil
+	})
+}
+
+// HMACVerifier checks hex HMAC-SHA256 signatures of other providers and internal services
+type HMACVerifier struct {
+	Secret          string
+	Header          string // Holding the signature, e.g. "X-Signature"
+	Prefix          string // Before the hex digest in the header, e.g. "sha256="
+	TimestampHeader string // Unix seconds, signed as "timestamp.body" when set
+	IDHeader        string // Delivery id, otherwise "id" of the JSON body
+	TypeHeader      string // Event type, otherwise "type" of the JSON body
+}
+
+func (v HMACVerifier) Verify(r *http.Request, body []byte) (WebhookMeta, error) {
+	signature, ok := strings.CutPrefix(r.Header.Get(v.Header), v.Prefix)
+	signed := string(body)
+	var timestamp time.Time
+	if v.TimestampHeader != "" {
+		value := r.Header.Get(v.TimestampHeader)
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return WebhookMeta{}, errWebhookSignature
+		}
+		signed = value + "." + signed
+		timestamp = time.Unix(seconds, 0)
+	}
+	if !ok || !anyHMACMatches(v.Secret, signed, []string{signature}) {
+		return WebhookMeta{}, errWebhookSignature
+	}
+	meta := webhookJSONMeta(body)
+	meta.Timestamp = timestamp
+	if v.IDHeader != "" {
+		meta.ID = r.Header.Get(v.IDHeader)
+	}
+	if v.TypeHeader != "" {
+		meta.Type = r.Header.Get(v.TypeHeader)
+	}
+	return meta, nil
+}
+
+type webhookVerifierFunc func(r *http.Request, body []byte) (WebhookMeta, error)
+
+func (f webhookVerifierFunc) Verify(r *http.Request, body []byte) (WebhookMeta, error) {
+	return f(r, body)
+}
+
+func anyHMACMatches(secret, signed string, signatures []string) bool {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	expected := mac.Sum(nil)
+	for _, signature := range signatures {
+		if got, err := hex.DecodeString(signature); err == nil && hmac.Equal(got, expected) {
+			return true
+		}
+	}
+	return false
+}
+
+func webhookJSONMeta(body []byte) WebhookMeta {
+	var fields struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+	}
+	json.Unmarshal(body, &fields)
+	return WebhookMeta{ID: fields.ID, Type: fields.Type}
+}
+
+// WebhookReceiver is an endpoint for deliveries of one provider. Verified events are published
+// on the broker as WebhookTopic(name, type) with the raw body, see OnWebhook.
+type WebhookReceiver struct {
+	Name      string
+	Verifier  WebhookVerifier
+	DB        *buntdb.DB    // Remembers delivery ids to drop replays, nil disables it
+	Broker    Broker        // Every replica subscribed to the broker gets the events
+	Tolerance time.Duration // Maximum age of signed timestamps, 5 minutes by default
+	MaxBody   int64         // 1 MB by default
+	Clock     Clock
+
+	schemas map[string]func(body []byte) error
+}
+
+// NewWebhookReceiver creates a receiver with default limits
+func NewWebhookReceiver(name string, verifier WebhookVerifier, db *buntdb.DB, broker Broker) *WebhookReceiver {
+	return &WebhookReceiver{
+		Name:      name,
+		Verifier:  verifier,
+		DB:        db,
+		Broker:    broker,
+		Tolerance: 5 * time.Minute,
+		MaxBody:   1 << 20,
+		Clock:     SystemClock{},
+		schemas:   make(map[string]func([]byte) error),
+	}
+}
+
+// WebhookSchema makes events of the type decode into T and pass its validate tags before they
+// are published, invalid ones are answered with 400
+func WebhookSchema[T any](wr *WebhookReceiver, eventType string) {
+	wr.schemas[eventType] = func(body []byte) error {
+		var payload T
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return err
+		}
+		return validate.Struct(payload)
+	}
+}
+
+// WebhookTopic is the broker topic of events of the provider
+func WebhookTopic(name, eventType string) string {
+	return WebhookTopicPrefix + name + ":" + eventType
+}
+
+// OnWebhook calls handler for events of the provider. With a shared broker it runs on every
+// replica, handlers that must run once should be idempotent or coordinate through the database.
+func OnWebhook(broker Broker, name string, handler func(eventType string, payload []byte)) (unsubscribe func()) {
+	prefix := WebhookTopic(name, "")
+	return broker.Subscribe(func(topic string, message []byte) {
+		if eventType, ok := strings.CutPrefix(topic, prefix); ok {
+			handler(eventType, message)
+		}
+	})
+}
+
+func (wr *WebhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, wr.MaxBody))
+	if err != nil {
+		http.Error(w, "Body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	meta, err := wr.Verifier.Verify(r, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	now := wr.Clock.Now()
+	if !meta.Timestamp.IsZero() && (meta.Timestamp.Before(now.Add(-wr.Tolerance)) || meta.Timestamp.After(now.Add(wr.Tolerance))) {
+		http.Error(w, "Timestamp outside of the tolerance", http.StatusUnauthorized)
+		return
+	}
+	if check, ok := wr.schemas[meta.Type]; ok {
+		if err := check(body); err != nil {
+			http.Error(w, "Invalid payload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	seenKey := "webhook:" + wr.Name + ":" + meta.ID
+	if wr.DB != nil && meta.ID != "" {
+		fresh, err := wr.remember(seenKey)
+		if err != nil {
+			http.Error(w, "Failed to record the delivery", http.StatusInternalServerError)
+			return
+		}
+		if !fresh {
+			// Already processed, the provider retries until it gets a 2xx
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
+	if err := wr.Broker.Publish(WebhookTopic(wr.Name, meta.Type), body); err != nil {
+		log.Printf("Webhook %s: failed to publish %s: %v", wr.Name, meta.Type, err)
+		if wr.DB != nil && meta.ID != "" {
+			// Let the retry of the provider through
+			wr.DB.Update(func(tx *buntdb.Tx) error {
+				_, err := tx.Delete(seenKey)
+				return err
+			})
+		}
+		http.Error(w, "Failed to dispatch", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// remember stores the delivery id, returning false if it was already seen. Ids are kept for a
+// day, providers stop retrying long before.
+func (wr *WebhookReceiver) remember(key string) (fresh bool, err error) {
+	err = wr.DB.Update(func(tx *buntdb.Tx) error {
+		_, replaced, err := tx.Set(key, fmt.Sprint(wr.Clock.Now().Unix()), &buntdb.SetOptions{Expires: true, TTL: 24 * time.Hour})
+		fresh = !replaced
+		return err
+	})
+	return fresh, err
+}
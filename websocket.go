@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WSPath is where helpers.js connects when HelperOptions.Transport is "ws"
+const WSPath = "/_jalpine/ws"
+
+// wsGUID is appended to the client key of the handshake, see RFC 6455
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsMaxMessage limits messages of the browser, actions carry JSON bodies, not uploads
+const wsMaxMessage = 1 << 20
+
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xa
+)
+
+var errWSTooLarge = errors.New("websocket message too large")
+
+// wsConn is the server side of a WebSocket, enough of RFC 6455 for helpers.js:
+// text messages, fragmentation, ping/pong and close
+type wsConn struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	timeout time.Duration
+
+	mu sync.Mutex // Serializes writes of the reader and writer loops
+}
+
+// upgradeWS does the handshake and takes over the connection. Connections from other origins
+// are refused, browsers send cookies along with them.
+func upgradeWS(w http.ResponseWriter, r *http.Request, timeout time.Duration) (*wsConn, error) {
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "Expected a WebSocket handshake", http.StatusBadRequest)
+		return nil, errors.New("not a websocket handshake")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusBadRequest)
+		return nil, errors.New("unsupported websocket version")
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || !strings.EqualFold(u.Host, r.Host) {
+			http.Error(w, "Cross-origin WebSocket", http.StatusForbidden)
+			return nil, errors.New("cross-origin websocket from " + origin)
+		}
+	}
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return nil, err
+	}
+	// Deadlines of the server apply to hijacked connections too
+	conn.SetDeadline(time.Time{})
+	sum := sha1.Sum([]byte(key + wsGUID))
+	c := &wsConn{conn: conn, br: brw.Reader, timeout: timeout}
+	c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	_, err = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: "+base64.StdEncoding.EncodeToString(sum[:])+"\r\n\r\n")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// headerHasToken checks comma separated header values like "keep-alive, Upgrade"
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// read returns the next data message, answering pings on the way. A peer silent for longer
+// than idle, not even answering pings, is considered gone.
+func (c *wsConn) read(idle time.Duration) ([]byte, error) {
+	var message []byte
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(idle))
+		var head [2]byte
+		if _, err := io.ReadFull(c.br, head[:]); err != nil {
+			return nil, err
+		}
+		fin, opcode := head[0]&0x80 != 0, head[0]&0x0f
+		length := uint64(head[1] & 0x7f)
+		// Browsers always mask, unmasked frames come from something else
+		if head[1]&0x80 == 0 {
+			return nil, errors.New("unmasked websocket frame")
+		}
+		switch length {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+				return nil, err
+			}
+			length = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+				return nil, err
+			}
+			length = binary.BigEndian.Uint64(ext[:])
+		}
+		if length > wsMaxMessage-uint64(len(message)) {
+			return nil, errWSTooLarge
+		}
+		var mask [4]byte
+		if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+			return nil, err
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return nil, err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch opcode {
+		case wsPing:
+			if err := c.write(wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			c.write(wsClose, nil)
+			return nil, io.EOF
+		}
+		message = append(message, payload...)
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+// write sends a single unfragmented frame
+func (c *wsConn) write(opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xffff:
+		frame = binary.BigEndian.AppendUint16(append(frame, 126), uint16(n))
+	default:
+		frame = binary.BigEndian.AppendUint64(append(frame, 127), uint64(n))
+	}
+	frame = append(frame, payload...)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// wsMessage is a message of helpers.js: a change of subscriptions or an action
+type wsMessage struct {
+	Type    string            `json:"type"` // "subscribe", "unsubscribe" or "action"
+	Topics  []string          `json:"topics,omitempty"`
+	ID      int               `json:"id,omitempty"`
+	Method  string            `json:"method,omitempty"`
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+}
+
+// wsResponse captures the answer of an action handler
+type wsResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *wsResponse) Header() http.Header { return w.header }
+
+func (w *wsResponse) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+func (w *wsResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// ServeWS is a bidirectional alternative to ServeSSE: updates of subscribed topics are pushed
+// as on the event stream, and the page sends its actions ($post, $get, ...) over the same
+// socket, where they are served by actions like regular requests with the cookies and headers
+// of the handshake. Actions of a connection run one after another in the order sent.
+// Cookies set by actions don't reach the browser, sign in and out over regular requests.
+func (h *Hub) ServeWS(actions http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Topics are subscribed over the socket, the page may only send actions
+		client := h.newClient(r)
+		if err := h.register(client); err != nil {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		defer func() {
+			h.mu.Lock()
+			h.unregister(client)
+			h.mu.Unlock()
+		}()
+
+		conn, err := upgradeWS(w, r, h.writeTimeout)
+		if err != nil {
+			return
+		}
+		defer conn.conn.Close()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				message, err := conn.read(2 * h.heartbeat)
+				if err != nil {
+					return
+				}
+				if err := h.handleWS(conn, client, r, actions, message); err != nil {
+					return
+				}
+			}
+		}()
+
+		heartbeat := time.NewTicker(h.heartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-client.closed:
+				return
+			case <-heartbeat.C:
+				if err := conn.write(wsPing, nil); err != nil {
+					return
+				}
+			case message := <-client.send:
+				if err := conn.write(wsText, wsEnvelope("data", message)); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// wsEnvelope wraps an encoded message as {"type": ..., "data": ...}
+func wsEnvelope(kind string, data []byte) []byte {
+	return []byte(`{"type":"` + kind + `","data":` + string(data) + `}`)
+}
+
+// handleWS processes a message of the page, errors end the connection
+func (h *Hub) handleWS(conn *wsConn, client *hubClient, r *http.Request, actions http.Handler, data []byte) error {
+	var message wsMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return err
+	}
+	switch message.Type {
+	case "subscribe", "unsubscribe":
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for _, topic := range message.Topics {
+			// Topics starting with "_" are internal to the server, e.g. webhook events
+			if topic = strings.TrimSpace(topic); topic == "" || strings.HasPrefix(topic, "_") {
+				continue
+			}
+			if message.Type == "subscribe" {
+				client.topics[topic] = true
+			} else {
+				delete(client.topics, topic)
+			}
+		}
+		return nil
+	case "action":
+		result, err := json.Marshal(serveWSAction(r, actions, message))
+		if err != nil {
+			return err
+		}
+		return conn.write(wsText, result)
+	}
+	return errors.New("unknown websocket message " + message.Type)
+}
+
+// wsResult is the answer to an action, helpers.js turns it into a fetch Response
+type wsResult struct {
+	Type    string            `json:"type"`
+	ID      int               `json:"id"`
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+// serveWSAction runs an action as a request derived from the handshake
+func serveWSAction(r *http.Request, actions http.Handler, message wsMessage) wsResult {
+	result := wsResult{Type: "result", ID: message.ID, Headers: make(map[string]string)}
+	// Only paths of this server, "//host/..." would be another one
+	if !strings.HasPrefix(message.URL, "/") || strings.HasPrefix(message.URL, "//") {
+		result.Status = http.StatusBadRequest
+		result.Body = "Invalid action URL"
+		return result
+	}
+	req, err := http.NewRequestWithContext(r.Context(), message.Method, message.URL, strings.NewReader(message.Body))
+	if err != nil {
+		result.Status = http.StatusBadRequest
+		result.Body = err.Error()
+		return result
+	}
+	req.Header = r.Header.Clone()
+	for _, name := range []string{"Connection", "Upgrade", "Sec-Websocket-Key", "Sec-Websocket-Version", "Sec-Websocket-Extensions", "Sec-Websocket-Protocol"} {
+		req.Header.Del(name)
+	}
+	for name, value := range message.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Host, req.RemoteAddr, req.TLS = r.Host, r.RemoteAddr, r.TLS
+
+	resp := &wsResponse{header: make(http.Header)}
+	actions.ServeHTTP(resp, req)
+	result.Status = resp.status
+	if result.Status == 0 {
+		result.Status = http.StatusOK
+	}
+	for name, values := range resp.header {
+		result.Headers[name] = strings.Join(values, ", ")
+	}
+	result.Body = resp.body.String()
+	return result
+}
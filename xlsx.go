@@ -0,0 +1,295 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"log"
+	"math"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Column describes one column of an exported list
+type Column[T any] struct {
+	Header string
+	Value  func(item T) any // Numbers, bools and time.Time keep their type, the rest becomes text
+	Format string           // Excel number format, e.g. "0.00" or "yyyy-mm-dd", times default to DefaultTimeFormat
+	Width  float64          // In characters, 0 leaves it to the spreadsheet
+}
+
+// DefaultTimeFormat is the Excel number format of time.Time cells without Column.Format
+const DefaultTimeFormat = "yyyy-mm-dd hh:mm:ss"
+
+// XLSXContentType is the MIME type of .xlsx files
+const XLSXContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// XLSXHandler serves the items load passes to yield as an .xlsx download. Rows are written
+// as they come, load should read the data in batches instead of holding a transaction for
+// the whole download. A load error before the first 64 KB of the file answers 500, a later
+// one cuts the download short.
+func XLSXHandler[T any](filename string, load func(r *http.Request, yield func(item T) bool) error, columns ...Column[T]) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		out := &xlsxResponse{w: w, filename: filename}
+		var loadErr error
+		err := WriteXLSX(out, "Sheet1", columns, func(yield func(T) bool) {
+			loadErr = load(r, yield)
+		})
+		if err == nil && loadErr == nil {
+			err = out.start()
+		}
+		if err := errors.Join(loadErr, err); err != nil {
+			log.Printf("Error exporting %s: %v", filename, err)
+			if !out.started {
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+		}
+	}
+}
+
+// xlsxResponse holds back the first 64 KB of the file, so early errors can still answer 500,
+// and sets the download headers when it starts sending
+type xlsxResponse struct {
+	w        http.ResponseWriter
+	filename string
+	buf      bytes.Buffer
+	started  bool
+}
+
+func (x *xlsxResponse) Write(p []byte) (int, error) {
+	if !x.started && x.buf.Len()+len(p) <= 64<<10 {
+		return x.buf.Write(p)
+	}
+	if err := x.start(); err != nil {
+		return 0, err
+	}
+	return x.w.Write(p)
+}
+
+func (x *xlsxResponse) start() error {
+	if x.started {
+		return nil
+	}
+	x.started = true
+	x.w.Header().Set("Content-Type", XLSXContentType)
+	x.w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", x.filename))
+	_, err := x.buf.WriteTo(x.w)
+	return err
+}
+
+// checkSheetName applies the rules of spreadsheet apps to sheet names
+func checkSheetName(name string) error {
+	switch {
+	case name == "":
+		return errors.New("sheet name is empty")
+	case utf8.RuneCountInString(name) > 31:
+		return fmt.Errorf("sheet name %q is longer than 31 characters", name)
+	case strings.ContainsAny(name, `[]:*?/\`):
+		return fmt.Errorf("sheet name %q contains one of []:*?/\\", name)
+	case strings.HasPrefix(name, "'") || strings.HasSuffix(name, "'"):
+		return fmt.Errorf("sheet name %q starts or ends with an apostrophe", name)
+	}
+	return nil
+}
+
+// WriteXLSX writes a workbook with a single sheet: a bold header row and a row per item.
+// Rows are streamed, so the whole sheet is never held in memory. The sheet name must be
+// valid in spreadsheet apps: up to 31 characters, none of []:*?/\
+func WriteXLSX[T any](w io.Writer, sheet string, columns []Column[T], items iter.Seq[T]) error {
+	if err := checkSheetName(sheet); err != nil {
+		return err
+	}
+	// Styles: 0 default, 1 bold header, 2 times without a format, then one per column format
+	styles := make([]int, len(columns))
+	formats := []string{DefaultTimeFormat}
+	for i, col := range columns {
+		if col.Format == "" {
+			continue
+		}
+		idx := slices.Index(formats, col.Format)
+		if idx == -1 {
+			idx = len(formats)
+			formats = append(formats, col.Format)
+		}
+		styles[i] = 2 + idx
+	}
+
+	zw := zip.NewWriter(w)
+	static := []struct{ name, content string }{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRootRels},
+		{"xl/workbook.xml", fmt.Sprintf(xlsxWorkbook, xmlEscape(sheet))},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+		{"xl/styles.xml", xlsxStyles(formats)},
+	}
+	for _, file := range static {
+		fw, err := zw.Create(file.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(fw, file.content); err != nil {
+			return err
+		}
+	}
+
+	fw, err := zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(fw)
+	bw.WriteString(xml.Header + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`)
+	if slices.ContainsFunc(columns, func(col Column[T]) bool { return col.Width > 0 }) {
+		bw.WriteString("<cols>")
+		for i, col := range columns {
+			if col.Width > 0 {
+				fmt.Fprintf(bw, `<col min="%d" max="%d" width="%g" customWidth="1"/>`, i+1, i+1, col.Width)
+			}
+		}
+		bw.WriteString("</cols>")
+	}
+	bw.WriteString("<sheetData>")
+
+	bw.WriteString(`<row r="1">`)
+	for i, col := range columns {
+		writeXLSXCell(bw, xlsxCellRef(i, 1), 1, col.Header)
+	}
+	bw.WriteString("</row>")
+
+	row := 1
+	for item := range items {
+		row++
+		fmt.Fprintf(bw, `<row r="%d">`, row)
+		for i, col := range columns {
+			if col.Value != nil {
+				writeXLSXCell(bw, xlsxCellRef(i, row), styles[i], col.Value(item))
+			}
+		}
+		bw.WriteString("</row>")
+	}
+	bw.WriteString("</sheetData></worksheet>")
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// writeXLSXCell writes a typed cell, nil and zero times are left empty
+func writeXLSXCell(w *bufio.Writer, ref string, style int, value any) {
+	styleAttr := ""
+	if style != 0 {
+		styleAttr = fmt.Sprintf(` s="%d"`, style)
+	}
+	switch v := value.(type) {
+	case nil:
+		return
+	case time.Time:
+		if v.IsZero() {
+			return
+		}
+		if style == 0 {
+			styleAttr = ` s="2"`
+		}
+		fmt.Fprintf(w, `<c r="%s"%s><v>%s</v></c>`, ref, styleAttr, formatXLSXNumber(excelSerial(v)))
+		return
+	case bool:
+		b := "0"
+		if v {
+			b = "1"
+		}
+		fmt.Fprintf(w, `<c r="%s"%s t="b"><v>%s</v></c>`, ref, styleAttr, b)
+		return
+	}
+
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		fmt.Fprintf(w, `<c r="%s"%s><v>%d</v></c>`, ref, styleAttr, rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		fmt.Fprintf(w, `<c r="%s"%s><v>%d</v></c>`, ref, styleAttr, rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		f := rv.Float()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return
+		}
+		fmt.Fprintf(w, `<c r="%s"%s><v>%s</v></c>`, ref, styleAttr, formatXLSXNumber(f))
+	default:
+		fmt.Fprintf(w, `<c r="%s"%s t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`,
+			ref, styleAttr, xmlEscape(fmt.Sprint(value)))
+	}
+}
+
+// excelSerial converts the wall clock time to days since 1899-12-30, as spreadsheets store dates
+func excelSerial(t time.Time) float64 {
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+	epoch := time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+	return wall.Sub(epoch).Hours() / 24
+}
+
+func formatXLSXNumber(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// xlsxCellRef returns the A1-style reference of a zero-based column and one-based row
+func xlsxCellRef(col, row int) string {
+	name := ""
+	for col++; col > 0; col = (col - 1) / 26 {
+		name = string(rune('A'+(col-1)%26)) + name
+	}
+	return name + strconv.Itoa(row)
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func xlsxStyles(formats []string) string {
+	numFmts := ""
+	xfs := `<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>` +
+		`<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/>`
+	for i, format := range formats {
+		// Custom formats start at 164, lower ids are built in
+		numFmts += fmt.Sprintf(`<numFmt numFmtId="%d" formatCode="%s"/>`, 164+i, xmlEscape(format))
+		xfs += fmt.Sprintf(`<xf numFmtId="%d" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>`, 164+i)
+	}
+	return xml.Header + `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+		fmt.Sprintf(`<numFmts count="%d">%s</numFmts>`, len(formats), numFmts) +
+		`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+		`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+		`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+		`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+		fmt.Sprintf(`<cellXfs count="%d">%s</cellXfs>`, 2+len(formats), xfs) +
+		`</styleSheet>`
+}
+
+const xlsxContentTypes = xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+	`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+	`<Default Extension="xml" ContentType="application/xml"/>` +
+	`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+	`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+	`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+	`</Types>`
+
+const xlsxRootRels = xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+	`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+	`</Relationships>`
+
+const xlsxWorkbook = xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+	`<sheets><sheet name="%s" sheetId="1" r:id="rId1"/></sheets>` +
+	`</workbook>`
+
+const xlsxWorkbookRels = xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+	`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+	`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>` +
+	`</Relationships>`